@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+// --a11y (or ENCUTITL_A11Y=1) is for screen readers: no tables or column
+// padding, one plain sentence per status line, and key fingerprints read
+// out as eight words in pairs instead of base64, which is unreadable
+// letter by letter. Fingerprint flags such as --from accept either form.
+
+var a11yFlag = flag.Bool("a11y", os.Getenv("ENCUTITL_A11Y") != "", "Screen reader friendly output: plain status lines, fingerprints as words")
+
+func addA11yFlag(fs *flag.FlagSet) {
+	fs.BoolVar(a11yFlag, "a11y", *a11yFlag, "Screen reader friendly output: plain status lines, fingerprints as words")
+}
+
+// fingerprintWords maps the first 88 bits of the key hash to eight words
+// of the BIP39 list, 11 bits each.
+func fingerprintWords(key []byte) string {
+	sum := sha256.Sum256(key)
+	list := bip39.GetWordList()
+	var words []string
+	var acc, bits uint
+	for _, b := range sum {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 11 && len(words) < 8 {
+			bits -= 11
+			words = append(words, list[acc>>bits&0x7ff])
+		}
+	}
+	return strings.Join(words[:2], " ") + ", " + strings.Join(words[2:4], " ") + ", " +
+		strings.Join(words[4:6], " ") + ", " + strings.Join(words[6:], " ")
+}
+
+// displayFingerprint is keyFingerprint for humans.
+func displayFingerprint(key []byte) string {
+	if *a11yFlag {
+		return fingerprintWords(key)
+	}
+	return keyFingerprint(key)
+}
+
+func matchFingerprint(s string, key []byte) bool {
+	return s == keyFingerprint(key) || strings.EqualFold(strings.Join(strings.Fields(strings.ReplaceAll(s, ",", " ")), " "),
+		strings.ReplaceAll(fingerprintWords(key), ",", ""))
+}
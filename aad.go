@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+)
+
+// --aad binds context, a record ID or the path a file belongs at, into
+// the payload authentication without storing it, so a ciphertext swapped
+// in from another context fails to decrypt. @file reads it from a file.
+
+var aadFlag = flag.String("aad", "", "Associated data that has to match at decryption but is not stored: a string, or @file")
+
+// aadData is --aad resolved, nil when unset.
+var aadData []byte
+
+func loadAAD() error {
+	switch {
+	case *aadFlag == "":
+		return nil
+	case *formatFlag != "encutitl" && *encrypt:
+		return errors.New("--aad needs the encutitl format")
+	case strings.HasPrefix(*aadFlag, "@"):
+		data, err := os.ReadFile(strings.TrimPrefix(*aadFlag, "@"))
+		if err != nil {
+			return err
+		}
+		aadData = data
+	default:
+		aadData = []byte(*aadFlag)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// --format age writes files the age tool can open, and age files are
+// recognized on decryption whatever the flag says. age has no notion of a
+// shared symmetric key, so age output always needs --recipient.
+
+const ageMagic = "age-encryption.org/v1\n"
+
+func isAge(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageMagic))
+}
+
+func isAgeArmor(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), armor.Header)
+}
+
+func isAgeIdentityFile(data []byte) bool {
+	return bytes.Contains(data, []byte("AGE-SECRET-KEY-"))
+}
+
+func ageEncrypt(plain []byte, specs []string) ([]byte, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("--format age needs at least one --recipient")
+	}
+	var recipients []age.Recipient
+	err := parseRecipientSpecs(specs, func(line string) error {
+		r, err := parseAgeRecipient(line)
+		if err == nil {
+			recipients = append(recipients, r)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseAgeRecipient parses an age1 key or an SSH public key line.
+func parseAgeRecipient(line string) (age.Recipient, error) {
+	switch {
+	case strings.HasPrefix(line, "age1pq1"):
+		return age.ParseHybridRecipient(line)
+	case strings.HasPrefix(line, "age1"):
+		return age.ParseX25519Recipient(line)
+	}
+	return agessh.ParseRecipient(line)
+}
+
+func ageDecrypt(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := ageDecryptTo(&buf, data, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ageDecryptTo(w io.Writer, data []byte, maxSize int64) (int64, error) {
+	identities, err := ageIdentities()
+	if err != nil {
+		return 0, err
+	}
+	if len(identities) == 0 {
+		return 0, errors.New("no identities, pass an age identity file or SSH key with -i")
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		return 0, err
+	}
+	return encutil.CopyLimited(w, r, maxSize)
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	paths, err := identityFiles()
+	if err != nil {
+		return nil, err
+	}
+	var out []age.Identity
+	for _, path := range paths {
+		data, err := readPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if encutil.IsHybridIdentity(data) {
+			continue // encutitl only
+		}
+		if isAge(data) || isAgeArmor(string(data)) {
+			// An identity file encrypted with a passphrase.
+			if data, err = decryptAgeIdentityFile(path, data); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		if isAgeIdentityFile(data) {
+			ids, err := age.ParseIdentities(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			out = append(out, ids...)
+			continue
+		}
+		id, err := agessh.ParseIdentity(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && missing.PublicKey != nil {
+			id, err = agessh.NewEncryptedSSHIdentity(missing.PublicKey, data, passphrasePrompt(path))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+func armorAge(data []byte) (string, error) {
+	var buf bytes.Buffer
+	w := armor.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func dearmorAge(s string) ([]byte, error) {
+	return io.ReadAll(armor.NewReader(strings.NewReader(strings.TrimSpace(s) + "\n")))
+}
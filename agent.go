@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// encutitl agent keeps identities in memory and serves them on a unix
+// socket, so other encutitl runs (and ssh, through SSH_AUTH_SOCK) can use
+// them without reading key files or asking for their passphrases again.
+//
+// It speaks the ssh-agent protocol, constrained to what a key holder
+// needs to do: list keys, sign, and the unwrap@encutitl extension, which
+// takes a JSON stanza and answers SSH_AGENT_SUCCESS followed by the file
+// key, or by nothing when no identity matches. Private keys never leave
+// it and it refuses to add, remove or export any. With --confirm every
+// signature and unwrap is approved in a desktop dialog first.
+//
+// Clients find it through ENCUTITL_AGENT_SOCK; with it set and no -i,
+// decryption and signing go through the agent instead of key files.
+
+const (
+	agentSockEnv     = "ENCUTITL_AGENT_SOCK"
+	agentUnwrapExt   = "unwrap@encutitl"
+	agentSignComment = "encutitl signing key"
+	agentSuccess     = 6 // SSH_AGENT_SUCCESS
+)
+
+var errAgentConstrained = errors.New("this agent only lists, signs and unwraps")
+
+type agentKey struct {
+	comment string
+	signer  ssh.Signer
+}
+
+type keyAgent struct {
+	keys       []agentKey
+	identities []encutil.Identity
+	confirm    bool
+}
+
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	sock := fs.String("a", "", "Socket path (default agent.sock in a new private directory)")
+	confirm := fs.Bool("confirm", false, "Ask in a dialog before every signature and unwrap")
+	fs.Var(&identityFlags, "i", "Identity file to serve (repeatable, default as for -d)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fail(exitUsage, "Usage: agent [-a SOCKET] [--confirm] [-i KEY...]")
+		return
+	}
+	if os.Getenv(agentSockEnv) != "" {
+		// Otherwise the identities below would come from the agent.
+		os.Unsetenv(agentSockEnv)
+	}
+	a, err := loadAgentKeys(*confirm)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+
+	path := *sock
+	if path == "" {
+		dir, err := os.MkdirTemp("", "encutitl-agent-")
+		if err != nil {
+			fail(exitIO, tr("Error:"), err)
+			return
+		}
+		defer os.Remove(dir)
+		path = filepath.Join(dir, "agent.sock")
+	}
+	spec := &listenSpec{network: "unix", addr: path, mode: 0600}
+	ln, err := spec.listen()
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+	defer os.Remove(path)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		ln.Close()
+	}()
+
+	fmt.Printf("%s=%s; export %s;\n", agentSockEnv, path, agentSockEnv)
+	fmt.Fprintf(os.Stderr, tr("Serving %d keys and %d identities")+"\n", len(a.keys), len(a.identities))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // closed by a signal
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(a, conn)
+		}()
+	}
+}
+
+// loadAgentKeys reads the identities now, so passphrases are asked for
+// once, at startup.
+func loadAgentKeys(confirm bool) (*keyAgent, error) {
+	a := &keyAgent{confirm: confirm}
+	ids, err := sshIdentities()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if sshID, ok := id.(*encutil.SSHIdentity); ok {
+			signer, err := sshID.Signer()
+			if err != nil {
+				return nil, err
+			}
+			a.keys = append(a.keys, agentKey{comment: "encutitl identity", signer: signer})
+		}
+		a.identities = append(a.identities, id)
+	}
+	if _, err := os.Stat(signKeyPath()); err == nil {
+		priv, err := loadOrGenerateSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = append(a.keys, agentKey{comment: agentSignComment, signer: signer})
+	}
+	if len(a.keys) == 0 && len(a.identities) == 0 {
+		return nil, errors.New("no identities or signing key to serve")
+	}
+	return a, nil
+}
+
+func (a *keyAgent) approve(question string) error {
+	if !a.confirm {
+		return nil
+	}
+	ok, err := askApproval(question)
+	if err == nil && !ok {
+		err = errors.New("declined")
+	}
+	return err
+}
+
+func (a *keyAgent) List() ([]*agent.Key, error) {
+	var out []*agent.Key
+	for _, k := range a.keys {
+		pub := k.signer.PublicKey()
+		out = append(out, &agent.Key{Format: pub.Type(), Blob: pub.Marshal(), Comment: k.comment})
+	}
+	return out, nil
+}
+
+func (a *keyAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *keyAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	for _, k := range a.keys {
+		if !bytes.Equal(k.signer.PublicKey().Marshal(), key.Marshal()) {
+			continue
+		}
+		if err := a.approve(fmt.Sprintf("Allow a program to sign with %s (%s)?", k.comment, ssh.FingerprintSHA256(key))); err != nil {
+			return nil, err
+		}
+		algo := ""
+		switch {
+		case flags&agent.SignatureFlagRsaSha256 != 0:
+			algo = ssh.KeyAlgoRSASHA256
+		case flags&agent.SignatureFlagRsaSha512 != 0:
+			algo = ssh.KeyAlgoRSASHA512
+		}
+		if s, ok := k.signer.(ssh.AlgorithmSigner); ok && algo != "" {
+			return s.SignWithAlgorithm(nil, data, algo)
+		}
+		return k.signer.Sign(nil, data)
+	}
+	return nil, errors.New("no such key")
+}
+
+// Extension implements unwrap@encutitl.
+func (a *keyAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != agentUnwrapExt {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	var s encutil.Stanza
+	if err := json.Unmarshal(contents, &s); err != nil {
+		return nil, err
+	}
+	for _, id := range a.identities {
+		key, err := id.Unwrap(&s)
+		if errors.Is(err, encutil.ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := a.approve(fmt.Sprintf("Allow a program to decrypt with your %s key?", s.Type)); err != nil {
+			return nil, err
+		}
+		return append([]byte{agentSuccess}, key...), nil
+	}
+	return []byte{agentSuccess}, nil
+}
+
+func (a *keyAgent) Add(agent.AddedKey) error       { return errAgentConstrained }
+func (a *keyAgent) Remove(ssh.PublicKey) error     { return errAgentConstrained }
+func (a *keyAgent) RemoveAll() error               { return errAgentConstrained }
+func (a *keyAgent) Lock([]byte) error              { return errAgentConstrained }
+func (a *keyAgent) Unlock([]byte) error            { return errAgentConstrained }
+func (a *keyAgent) Signers() ([]ssh.Signer, error) { return nil, errAgentConstrained }
+
+// agentIdentity unwraps through a running agent.
+type agentIdentity struct {
+	client agent.ExtendedAgent
+}
+
+func (i *agentIdentity) Unwrap(s *encutil.Stanza) ([]byte, error) {
+	req, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := i.client.Extension(agentUnwrapExt, req)
+	if err != nil {
+		return nil, fmt.Errorf("agent: %w", err)
+	}
+	if len(resp) <= 1 {
+		return nil, encutil.ErrIncorrectIdentity
+	}
+	return resp[1:], nil
+}
+
+func dialAgent() (agent.ExtendedAgent, error) {
+	conn, err := net.Dial("unix", os.Getenv(agentSockEnv))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", agentSockEnv, err)
+	}
+	return agent.NewClient(conn), nil
+}
+
+// agentSign signs data with the agent's encutitl signing key.
+func agentSign(data []byte) ([]byte, error) {
+	client, err := dialAgent()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := client.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.Comment == agentSignComment && k.Format == ssh.KeyAlgoED25519 {
+			sig, err := client.Sign(k, data)
+			if err != nil {
+				return nil, fmt.Errorf("agent: %w", err)
+			}
+			if len(sig.Blob) != ed25519.SignatureSize {
+				return nil, errors.New("agent: bad signature")
+			}
+			return sig.Blob, nil
+		}
+	}
+	return nil, errors.New("the agent has no signing key")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// Errors from encutitl's HTTP APIs are JSON with a stable code that
+// clients branch on, the message being for people only:
+//
+//	{"error": {"code": "PAYLOAD_TOO_LARGE", "message": "...", "request_id": "3f9c..."}}
+//
+// The request ID is also sent as X-Request-Id and written to the server
+// log with the underlying error, so a report from a client can be matched
+// to what the server saw. A client sending its own X-Request-Id gets
+// that one back.
+
+// API error codes. Retrying only makes sense for UNAVAILABLE and
+// INTERNAL; the rest need a different request.
+const (
+	codeAuthFailed        = "AUTH_FAILED"        // wrong key or tampered data
+	codeKeyNotFound       = "KEY_NOT_FOUND"      // no key or identity for it
+	codePayloadTooLarge   = "PAYLOAD_TOO_LARGE"  // over a size or ratio limit
+	codeFormatUnsupported = "FORMAT_UNSUPPORTED" // malformed or unknown format
+	codeReplayed          = "REPLAYED"           // decrypted before, see --replay-window
+	codeNotFound          = "NOT_FOUND"
+	codeMethodNotAllowed  = "METHOD_NOT_ALLOWED"
+	codeBadRequest        = "BAD_REQUEST"
+	codeUnavailable       = "UNAVAILABLE"
+	codeInternal          = "INTERNAL"
+)
+
+var codeStatus = map[string]int{
+	codeAuthFailed:        http.StatusForbidden,
+	codeKeyNotFound:       http.StatusNotFound,
+	codePayloadTooLarge:   http.StatusRequestEntityTooLarge,
+	codeFormatUnsupported: http.StatusUnsupportedMediaType,
+	codeReplayed:          http.StatusConflict,
+	codeNotFound:          http.StatusNotFound,
+	codeMethodNotAllowed:  http.StatusMethodNotAllowed,
+	codeBadRequest:        http.StatusBadRequest,
+	codeUnavailable:       http.StatusServiceUnavailable,
+	codeInternal:          http.StatusInternalServerError,
+}
+
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s (request %s)", e.Code, e.Message, e.RequestID)
+}
+
+// errorCode classifies an error from decrypting or reading a request.
+func errorCode(err error) string {
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.Is(err, encutil.ErrOutputTooLarge), errors.As(err, &tooBig):
+		return codePayloadTooLarge
+	case errors.Is(err, encutil.ErrNoIdentityMatched), errors.Is(err, os.ErrNotExist):
+		return codeKeyNotFound
+	case errors.Is(err, encutil.ErrMalformed):
+		return codeFormatUnsupported
+	case errors.Is(err, errReplayed):
+		return codeReplayed
+	case errors.Is(err, encutil.ErrIncorrectIdentity), errors.Is(err, encutil.ErrAADRequired),
+		err != nil && err.Error() == "cipher: message authentication failed":
+		return codeAuthFailed
+	}
+	return codeInternal
+}
+
+// requestID returns the client's X-Request-Id, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 64 {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeAPIError sends code with msg to the client and logs err, which may
+// say more than the client should see, under the same request ID.
+func writeAPIError(w http.ResponseWriter, r *http.Request, code, msg string, err error) {
+	id := requestID(r)
+	logLine := fmt.Sprintf("%s request_id=%s code=%s %s %s", time.Now().UTC().Format(time.RFC3339), id, code, r.Method, r.URL.Path)
+	if err != nil {
+		logLine += ": " + err.Error()
+	}
+	fmt.Fprintln(os.Stderr, logLine)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Request-Id", id)
+	w.WriteHeader(codeStatus[code])
+	json.NewEncoder(w).Encode(map[string]*apiError{"error": {Code: code, Message: msg, RequestID: id}})
+}
+
+// readAPIError turns an error response into an *apiError, falling back to
+// the status line for servers that predate error codes.
+func readAPIError(resp *http.Response) error {
+	var body struct {
+		Error *apiError `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) != nil || body.Error == nil {
+		return errors.New(resp.Status)
+	}
+	return body.Error
+}
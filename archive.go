@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// Deflating bytes that are already compressed (archives, images, video)
+// burns CPU for nothing. --compression auto, the default, stores such
+// inputs uncompressed inside the encrypted file. --recompress goes
+// further for archives: zip members (ZIP64 included) are rewritten stored
+// so the outer compressor sees the raw data, and .tar.gz/.tar.zst are
+// unpacked to plain .tar, which is what decryption then gives back.
+
+var (
+	compressionFlag = flag.String("compression", "auto", "Payload compression for the encutitl format: auto (skip for compressed inputs), deflate or none")
+	recompressFlag  = flag.Bool("recompress", false, "Unpack compressed archive inputs (zip, tar.gz, tar.zst) so they compress as a whole")
+)
+
+var compressedMagic = [][]byte{
+	[]byte("PK\x03\x04"),             // zip, docx, jar, apk
+	{0x1f, 0x8b},                     // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},         // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00}, // xz
+	[]byte("BZh"),                    // bzip2
+	[]byte("7z\xbc\xaf\x27\x1c"),     // 7z
+	[]byte("Rar!\x1a\x07"),           // rar
+	[]byte("\x89PNG"),                // png
+	{0xff, 0xd8, 0xff},               // jpeg
+	[]byte("OggS"),                   // ogg
+	{0x1a, 0x45, 0xdf, 0xa3},         // mkv, webm
+}
+
+// isCompressed sniffs data for formats that do not deflate further.
+func isCompressed(data []byte) bool {
+	for _, m := range compressedMagic {
+		if bytes.HasPrefix(data, m) {
+			return true
+		}
+	}
+	// ISO base media (mp4, mov, heic): a box size, then "ftyp".
+	return len(data) >= 8 && string(data[4:8]) == "ftyp"
+}
+
+// payloadCompression picks the compression for data under --compression.
+func payloadCompression(data []byte) (string, error) {
+	switch *compressionFlag {
+	case "auto":
+		// A --recompress zip has stored members by now.
+		stored := *recompressFlag && bytes.HasPrefix(data, []byte("PK\x03\x04"))
+		if isCompressed(data) && !stored {
+			return encutil.CompressionNone, nil
+		}
+		return encutil.CompressionDeflate, nil
+	case encutil.CompressionDeflate, encutil.CompressionNone:
+		return *compressionFlag, nil
+	}
+	return "", fmt.Errorf("unknown --compression %q", *compressionFlag)
+}
+
+// recompress unpacks a compressed archive input, returning the new data
+// and name (see recompressedName). Other inputs come back unchanged.
+func recompress(data []byte, name string) ([]byte, string, error) {
+	var zr io.Reader
+	var err error
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+	case strings.HasSuffix(lower, ".tar.zst") || strings.HasSuffix(lower, ".tzst"):
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(bytes.NewReader(data)); err == nil {
+			defer d.Close()
+			zr = d
+		}
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		out, err := storeZip(data)
+		return out, name, limitError(err, len(data))
+	default:
+		return data, name, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", name, err)
+	}
+	var out bytes.Buffer
+	if _, err := encutil.CopyLimited(&out, zr, decompressLimit(len(data))); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", name, limitError(err, len(data)))
+	}
+	return out.Bytes(), recompressedName(name), nil
+}
+
+// recompressedName is the name of a --recompress input after unpacking:
+// compressed tarballs become .tar, everything else keeps its name.
+func recompressedName(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar.zst", ".tzst"} {
+		if strings.HasSuffix(lower, ext) {
+			return name[:len(name)-len(ext)] + ".tar"
+		}
+	}
+	return name
+}
+
+// storeZip rewrites a zip with every member stored, keeping names, times
+// and comments. The result is a valid zip of the same files.
+func storeZip(data []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	// The members together, not each, stay under the limit.
+	limit := decompressLimit(len(data))
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.SetComment(zr.Comment)
+	for _, f := range zr.File {
+		hdr := f.FileHeader
+		hdr.Method = zip.Store
+		hdr.Extra = nil // may hold stale ZIP64 sizes; the writer adds its own
+		w, err := zw.CreateHeader(&hdr)
+		if err != nil {
+			return nil, err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if limit > 0 && int64(buf.Len()) >= limit {
+			r.Close()
+			return nil, encutil.ErrOutputTooLarge
+		}
+		_, err = encutil.CopyLimited(w, r, limit-int64(buf.Len()))
+		r.Close()
+		if errors.Is(err, encutil.ErrOutputTooLarge) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
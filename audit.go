@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The audit log records access to files marked --sensitive. It goes to
+// audit.log in the config directory, one JSON object per line, unless
+// config.toml lists sinks, which are all written to for every event:
+//
+//	[[audit.sink]]
+//	type = "file"            # appended to, one event per line
+//	path = "/var/log/encutitl/audit.log"
+//
+//	[[audit.sink]]
+//	type = "syslog"          # address empty for the local syslog
+//	address = "tcp://siem.internal:514"
+//	format = "cef"
+//
+//	[[audit.sink]]
+//	type = "webhook"         # POSTed, one event per request
+//	url = "https://siem.internal/ingest"
+//
+//	[[audit.sink]]
+//	type = "s3"              # one object per event under the prefix
+//	url = "s3://audit-bucket/encutitl/"
+//
+// format is json (the default) or cef, the ArcSight Common Event Format
+// most SIEMs take. An event that cannot be written to every sink fails
+// the operation it records.
+
+const (
+	auditFile    = "audit.log"
+	auditTimeout = 10 * time.Second
+)
+
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Host   string    `json:"host"`
+	Op     string    `json:"op"`
+	File   string    `json:"file"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type auditSink struct {
+	Type    string `toml:"type"`
+	Format  string `toml:"format"`
+	Path    string `toml:"path"`
+	Address string `toml:"address"`
+	URL     string `toml:"url"`
+}
+
+// loadAuditSinks reads [[audit.sink]] from config.toml, defaulting to
+// audit.log in dir.
+func loadAuditSinks(dir string) ([]auditSink, error) {
+	var file struct {
+		Audit struct {
+			Sinks []auditSink `toml:"sink"`
+		} `toml:"audit"`
+	}
+	if _, err := toml.DecodeFile(filepath.Join(dir, configFile), &file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	sinks := file.Audit.Sinks
+	if len(sinks) == 0 {
+		return []auditSink{{Type: "file", Path: filepath.Join(dir, auditFile)}}, nil
+	}
+	for i, s := range sinks {
+		var missing string
+		switch s.Type {
+		case "file":
+			if s.Path == "" {
+				missing = "path"
+			}
+		case "syslog":
+		case "webhook", "s3":
+			if s.URL == "" {
+				missing = "url"
+			}
+		default:
+			return nil, fmt.Errorf("audit sink %d: unknown type %q, want file, syslog, webhook or s3", i+1, s.Type)
+		}
+		if missing != "" {
+			return nil, fmt.Errorf("audit sink %d: %s sinks need %s", i+1, s.Type, missing)
+		}
+		if s.Format != "" && s.Format != "json" && s.Format != "cef" {
+			return nil, fmt.Errorf("audit sink %d: unknown format %q, want json or cef", i+1, s.Format)
+		}
+	}
+	return sinks, nil
+}
+
+// writeAudit sends ev to every sink, filling in when, who and where.
+func writeAudit(ev auditEvent) error {
+	ev.Time = time.Now().UTC()
+	ev.User = "unknown"
+	if u, err := user.Current(); err == nil {
+		ev.User = u.Username
+	}
+	ev.Host, _ = os.Hostname()
+	if ev.Op == "" {
+		ev.Op = auditOp()
+	}
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	sinks, err := loadAuditSinks(dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range sinks {
+		if err := s.write(ev); err != nil {
+			errs = append(errs, fmt.Errorf("%s sink: %w", s.Type, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s auditSink) write(ev auditEvent) error {
+	var line []byte
+	if s.Format == "cef" {
+		line = []byte(ev.cef())
+	} else {
+		var err error
+		if line, err = json.Marshal(ev); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	switch s.Type {
+	case "file":
+		f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case "syslog":
+		w, err := dialSyslog(s.Address)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(line); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	case "webhook":
+		client, err := httpClient()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(line))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if s.Format == "cef" {
+			req.Header.Set("Content-Type", "text/plain")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s: %s", redactURL(s.URL), resp.Status)
+		}
+		return nil
+	case "s3":
+		suffix := make([]byte, 4)
+		rand.Read(suffix)
+		ext := ".json"
+		if s.Format == "cef" {
+			ext = ".cef"
+		}
+		prefix := s.URL
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		name := ev.Time.Format("2006/01/02/150405.000000000") + "-" + hex.EncodeToString(suffix) + ext
+		return uploadS3(ctx, prefix+name, bytes.NewReader(append(line, '\n')))
+	}
+	return fmt.Errorf("unknown type %q", s.Type)
+}
+
+// cef is ev in the Common Event Format.
+func (ev auditEvent) cef() string {
+	header := strings.NewReplacer(`\`, `\\`, "|", `\|`)
+	ext := strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`, "\r", `\r`)
+	fields := []string{
+		"rt=" + fmt.Sprint(ev.Time.UnixMilli()),
+		"suser=" + ext.Replace(ev.User),
+		"shost=" + ext.Replace(ev.Host),
+		"act=" + ext.Replace(ev.Op),
+		"fname=" + ext.Replace(ev.File),
+	}
+	if ev.Reason != "" {
+		fields = append(fields, "cs1Label=reason", "cs1="+ext.Replace(ev.Reason))
+	}
+	return fmt.Sprintf("CEF:0|encutitl|encutitl|1|%s|%s|5|%s",
+		header.Replace("sensitive-"+ev.Op), header.Replace("Sensitive file "+ev.Op), strings.Join(fields, " "))
+}
+
+// auditOp names what is being done: the subcommand, or decrypt for -d.
+func auditOp() string {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		return os.Args[1]
+	}
+	return "decrypt"
+}
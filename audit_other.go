@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func dialSyslog(address string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog sinks are not supported on this platform")
+}
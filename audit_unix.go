@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// dialSyslog connects to the syslog at address, udp://host:port or
+// tcp://host:port, or the local one when it is empty.
+func dialSyslog(address string) (io.WriteCloser, error) {
+	var network, raddr string
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	return syslog.Dial(network, raddr, syslog.LOG_NOTICE|syslog.LOG_AUTH, "encutitl")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// --batch (or --yes, or ENCUTITL_BATCH=1) is for scripts and CI: nothing
+// is asked on the terminal. Existing outputs are overwritten unless
+// --on-conflict says otherwise, and where a passphrase or PIN would be
+// asked for, the command fails saying what to set instead.
+
+var batchFlag = flag.Bool("batch", os.Getenv("ENCUTITL_BATCH") != "", "Never prompt; fail where input would be needed (also --yes, ENCUTITL_BATCH)")
+
+func init() {
+	flag.BoolVar(batchFlag, "yes", *batchFlag, "Same as --batch")
+}
+
+// addBatchFlag offers --batch and --yes on a subcommand.
+func addBatchFlag(fs *flag.FlagSet) {
+	fs.BoolVar(batchFlag, "batch", *batchFlag, "Never prompt; fail where input would be needed (also --yes, ENCUTITL_BATCH)")
+	fs.BoolVar(batchFlag, "yes", *batchFlag, "Same as --batch")
+}
+
+// errNeedsInput is returned instead of prompting in batch mode.
+var errNeedsInput = errors.New("input needed but running with --batch")
+
+// batchPrompt fails in batch mode for a prompt, naming what to give
+// instead.
+func batchPrompt(what, instead string) error {
+	if !*batchFlag {
+		return nil
+	}
+	return fmt.Errorf("%w: %s (%s)", errNeedsInput, what, instead)
+}
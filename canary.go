@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// --canary plants a decoy: a plausible looking file, encrypted to the
+// same recipients, next to the encrypted output, or with --archive as an
+// entry of the tar. The decoy's header seals a canary marker with its
+// token and webhook, readable only by whoever can decrypt it, so
+// decrypting the decoy through any encutitl install (-d, cat, the daemon,
+// the servers or a mount) raises an alert once it has authenticated,
+// and someone working through a stolen-but-decryptable set of files shows
+// up. Restoring an archive only extracts the decoy, still encrypted, so
+// the owner's restores stay quiet. The decoy's plaintext carries the
+// token as well, for matching leaked contents.
+
+var (
+	canaryFlag    = flag.Bool("canary", false, "Also plant an encrypted decoy that raises an alert when decrypted, as an archive entry with --archive")
+	canaryName    = flag.String("canary-name", "credentials.txt", "File name of the --canary decoy")
+	canaryWebhook = flag.String("canary-webhook", "", "URL to POST an alert to when a --canary decoy is decrypted; when decrypting, overrides the decoy's own")
+)
+
+// sealDecoy returns a new decoy encrypted to recipients.
+func sealDecoy(recipients []encutil.Recipient) ([]byte, error) {
+	tok := make([]byte, 16)
+	if _, err := rand.Read(tok); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(tok)
+	decoy := fmt.Sprintf("# service accounts - do not share\nadmin\t%s\nbackup\t%s\n", token[:16], token[16:])
+	c := &encutil.Canary{Token: token, Webhook: *canaryWebhook}
+	return encutil.EncryptWith([]byte(decoy), encutil.EncryptOptions{Canary: c}, recipients...)
+}
+
+// writeCanary writes a decoy encrypted to recipients next to out.
+func writeCanary(out string, recipients []encutil.Recipient) (string, error) {
+	sealed, err := sealDecoy(recipients)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(filepath.Dir(out), *canaryName+".bin")
+	if isRemoteURL(out) {
+		path = out[:strings.LastIndex(out, "/")+1] + *canaryName + ".bin"
+	}
+	return path, writeOutput(path, sealed, 0600)
+}
+
+// addCanaryEntry adds a decoy encrypted to recipients to a tar made by
+// tarDir, next to its top-level entries, and returns the new tar and the
+// decoy's entry name.
+func addCanaryEntry(data []byte, recipients []encutil.Recipient) ([]byte, string, error) {
+	sealed, err := sealDecoy(recipients)
+	if err != nil {
+		return nil, "", err
+	}
+	entry := path.Join(commonRoot(data), *canaryName+".bin")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	rd := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := rd.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if path.Clean(hdr.Name) == entry {
+			return nil, "", fmt.Errorf("%s is already in the archive, pick another --canary-name", entry)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, "", err
+		}
+		if _, err := io.Copy(tw, rd); err != nil {
+			return nil, "", err
+		}
+	}
+	hdr := &tar.Header{Name: entry, Mode: 0600, Size: int64(len(sealed)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, "", err
+	}
+	if _, err := tw.Write(sealed); err != nil {
+		return nil, "", err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), entry, nil
+}
+
+// raiseCanary is the DecryptOptions.OnCanary of every decryption: a line
+// in canary.log in the config directory, and a POST to --canary-webhook
+// or else the decoy's own webhook. Decryption carries on either way, so
+// the reader gets no hint.
+func raiseCanary(c *encutil.Canary) {
+	who := "unknown"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+	host, _ := os.Hostname()
+	alert := map[string]string{
+		"canary": c.Token,
+		"user":   who,
+		"host":   host,
+		"time":   time.Now().UTC().Format(time.RFC3339),
+	}
+	body, _ := json.Marshal(alert)
+	if dir, err := configDir(); err == nil {
+		if f, err := os.OpenFile(filepath.Join(dir, "canary.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err == nil {
+			f.Write(append(body, '\n'))
+			f.Close()
+		}
+	}
+	webhook := *canaryWebhook
+	if webhook == "" {
+		webhook = c.Webhook
+	}
+	if webhook == "" {
+		return
+	}
+	client, err := httpClient()
+	if err != nil {
+		return
+	}
+	if resp, err := client.Post(webhook, "application/json", bytes.NewReader(body)); err == nil {
+		resp.Body.Close()
+	}
+}
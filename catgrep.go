@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// cat and grep read encrypted files without leaving plaintext behind:
+// cat streams each file's plaintext to stdout in turn, grep decrypts
+// into memory and prints the matching lines, prefixed with the file name
+// when there are several files, like grep(1). Both take every format -d
+// does. grep exits with status 1 when nothing matched, and takes
+// identities with --identity since -i is grep's ignore case.
+
+func runCat(args []string) {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	fs.Var(&identityFlags, "i", "Identity file used for decryption (repeatable)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.StringVar(reasonFlag, "reason", *reasonFlag, "Why a sensitive file is decrypted, for the audit log")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fail(exitUsage, "Usage: cat [-i KEY...] [--reason TEXT] FILE...")
+		return
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, path := range fs.Args() {
+		data, err := readFileRetry(path)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			continue
+		}
+		if err := openTo(out, path, data); err != nil {
+			out.Flush()
+			fail(exitAuth, tr("Decryption error:"), fmt.Errorf("%s: %w", path, err))
+		}
+	}
+}
+
+func runGrep(args []string) {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	ignoreCase := fs.Bool("i", false, "Ignore case")
+	invert := fs.Bool("v", false, "Print the lines that do not match")
+	lineNumbers := fs.Bool("n", false, "Print line numbers")
+	count := fs.Bool("c", false, "Only print the number of matching lines per file")
+	names := fs.Bool("l", false, "Only print the names of files with a match")
+	fs.Var(&identityFlags, "identity", "Identity file used for decryption (repeatable)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.StringVar(reasonFlag, "reason", *reasonFlag, "Why a sensitive file is decrypted, for the audit log")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fail(exitUsage, "Usage: grep [-i] [-v] [-n] [-c] [-l] [--identity KEY...] [--reason TEXT] PATTERN FILE...")
+		return
+	}
+	pattern := fs.Arg(0)
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	files := fs.Args()[1:]
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	matched := false
+	for _, path := range files {
+		data, err := readFileRetry(path)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			continue
+		}
+		plain, err := openData(path, data)
+		if err != nil {
+			out.Flush()
+			fail(exitAuth, tr("Decryption error:"), fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		prefix := ""
+		if len(files) > 1 {
+			prefix = path + ":"
+		}
+		binary := bytes.IndexByte(plain, 0) >= 0
+		n := 0
+		for i, line := range bytes.SplitAfter(plain, []byte("\n")) {
+			if len(line) == 0 || re.Match(bytes.TrimSuffix(line, []byte("\n"))) == *invert {
+				continue
+			}
+			n++
+			if *count || *names || binary {
+				continue
+			}
+			fmt.Fprint(out, prefix)
+			if *lineNumbers {
+				fmt.Fprintf(out, "%d:", i+1)
+			}
+			out.Write(bytes.TrimSuffix(line, []byte("\n")))
+			out.WriteByte('\n')
+		}
+		matched = matched || n > 0
+		switch {
+		case *count:
+			fmt.Fprintf(out, "%s%d\n", prefix, n)
+		case *names && n > 0:
+			fmt.Fprintln(out, path)
+		case binary && n > 0:
+			fmt.Fprintf(out, tr("Binary file %s matches")+"\n", path)
+		}
+		clear(plain)
+	}
+	if !matched && exitCode == 0 {
+		exitCode = exitError // silently, as grep does
+	}
+}
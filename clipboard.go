@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/atotto/clipboard"
+)
+
+// --copy puts the result on the system clipboard instead of a file: the
+// encoded ciphertext when encrypting, the plaintext when decrypting.
+// --paste reads the input from it, the way -s would. On Linux this goes
+// through wl-copy/wl-paste, xclip or xsel, so neither can run sandboxed.
+//
+// A decrypted secret should not sit on the clipboard forever, so a
+// detached copy of the binary waits --clear-after and then empties the
+// clipboard, unless something else has been copied since. It only holds
+// a hash of the secret to compare against.
+
+const clearArg = "__clipboard-clear"
+
+var (
+	copyFlag   = flag.Bool("copy", false, "Put the encoded ciphertext or decrypted secret on the clipboard instead of writing a file")
+	pasteFlag  = flag.Bool("paste", false, "Read the input from the clipboard")
+	clearAfter = flag.Duration("clear-after", 45*time.Second, "Clear a decrypted secret from the clipboard after this long, 0 to leave it")
+)
+
+func checkClipboard() error {
+	switch {
+	case *pasteFlag && (*fileFlag != "" || *stringFlag != ""):
+		return errors.New("--paste cannot be combined with -f or -s")
+	case !*copyFlag:
+		return nil
+	case *toStdout || *outputFlag != "" || *inPlaceFlag || *qrFlag != "":
+		return errors.New("--copy cannot be combined with -o, --to-stdout, --in-place or --qr")
+	case *archiveFlag || *recurseFlag != "":
+		return errors.New("--copy cannot be combined with --archive or -R")
+	case *signOutput || *metadataFlag || *canaryFlag:
+		return errors.New("--copy cannot be combined with --sign, --metadata or --canary, which need file output")
+	case *clearAfter < 0:
+		return errors.New("--clear-after must not be negative")
+	}
+	return nil
+}
+
+func readClipboard() ([]byte, error) {
+	text, err := clipboard.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		return nil, errors.New("clipboard is empty")
+	}
+	return []byte(text), nil
+}
+
+// copyOutput puts data on the clipboard and, for a secret, schedules it
+// to be cleared.
+func copyOutput(data []byte, secret bool) error {
+	if err := clipboard.WriteAll(string(data)); err != nil {
+		return err
+	}
+	if !secret || *clearAfter == 0 {
+		fmt.Println(tr("Copied to the clipboard."))
+		return nil
+	}
+	if err := scheduleClear(data); err != nil {
+		clipboard.WriteAll("")
+		return fmt.Errorf("scheduling the clipboard clear: %w", err)
+	}
+	fmt.Printf(tr("Copied to the clipboard, clearing in %s.")+"\n", *clearAfter)
+	return nil
+}
+
+func scheduleClear(data []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	cmd := exec.Command(exe, clearArg, clearAfter.String(), hex.EncodeToString(sum[:]))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// runClipboardClear is the detached side: wait, then clear the clipboard
+// if it still holds the secret with the given hash.
+func runClipboardClear(args []string) {
+	if len(args) != 2 {
+		os.Exit(exitUsage)
+	}
+	wait, err := time.ParseDuration(args[0])
+	want, herr := hex.DecodeString(args[1])
+	if err != nil || herr != nil {
+		os.Exit(exitUsage)
+	}
+	// Outlive the terminal the secret was copied from.
+	signal.Ignore(syscall.SIGHUP)
+	time.Sleep(wait)
+	text, err := clipboard.ReadAll()
+	if err != nil {
+		os.Exit(exitIO)
+	}
+	sum := sha256.Sum256([]byte(text))
+	if subtle.ConstantTimeCompare(sum[:], want) == 1 {
+		clipboard.WriteAll("")
+	}
+}
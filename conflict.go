@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// When decrypting onto a file that already exists, --on-conflict decides
+// what happens: ask (the default on a terminal), overwrite (the default
+// otherwise, as before), skip, rename to a free name like report-1.pdf, or
+// fail. Asking also offers a diff against the existing file.
+
+var onConflict = flag.String("on-conflict", "", "When the decrypted output exists: ask, overwrite, skip, rename or fail (default ask on a terminal, else overwrite)")
+
+// resolveConflict returns the path to write data to, or "" to skip.
+func resolveConflict(path string, data []byte) (string, error) {
+	return resolveConflictDiff(path, func() { showDiff(path, data) })
+}
+
+// resolveConflictDiff is resolveConflict for output that is not in
+// memory; diff shows it against the existing file when asked.
+func resolveConflictDiff(path string, diff func()) (string, error) {
+	if isRemoteURL(path) {
+		return path, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, nil
+	}
+	policy := *onConflict
+	if policy == "" {
+		policy = "overwrite"
+		if term.IsTerminal(int(os.Stdin.Fd())) && !*batchFlag {
+			policy = "ask"
+		}
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		switch policy {
+		case "overwrite":
+			return path, nil
+		case "skip":
+			fmt.Println(tr("Skipped existing file:"), path)
+			return "", nil
+		case "rename":
+			return freeName(path), nil
+		case "fail":
+			return "", fmt.Errorf("%s already exists", path)
+		case "ask":
+			if err := batchPrompt(path+" already exists", "use --on-conflict overwrite, skip, rename or fail"); err != nil {
+				return "", err
+			}
+			fmt.Printf(tr("%s exists: [o]verwrite, [s]kip, [r]ename, [d]iff? "), path)
+			answer, err := in.ReadString('\n')
+			if err != nil {
+				return "", fmt.Errorf("%s already exists", path)
+			}
+			switch strings.TrimSpace(strings.ToLower(answer)) {
+			case "o":
+				policy = "overwrite"
+			case "s":
+				policy = "skip"
+			case "r":
+				policy = "rename"
+			case "d":
+				diff()
+			}
+		default:
+			return "", fmt.Errorf("unknown --on-conflict %q", policy)
+		}
+	}
+}
+
+// freeName returns path with the first free -N suffix before the
+// extension.
+func freeName(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		p := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return p
+		}
+	}
+}
+
+// showDiff runs diff -u against the existing file if diff is installed,
+// otherwise reports sizes and the first differing line.
+func showDiff(path string, data []byte) {
+	old, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("Read error:"), err)
+		return
+	}
+	if bytes.Equal(old, data) {
+		fmt.Println(tr("The existing file is identical."))
+		return
+	}
+	if diff, err := exec.LookPath("diff"); err == nil {
+		if tmp, err := os.CreateTemp("", "encutitl-diff-*"); err == nil {
+			defer os.Remove(tmp.Name())
+			tmp.Chmod(0600)
+			tmp.Write(data)
+			tmp.Close()
+			cmd := exec.Command(diff, "-u", "--label", path, "--label", "decrypted", path, tmp.Name())
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			// diff exits 1 for differences; only a failure to start
+			// (say, inside the sandbox) falls back to the summary.
+			if err := cmd.Run(); err == nil || cmd.ProcessState != nil {
+				return
+			}
+		}
+	}
+	fmt.Printf(tr("%s: %d bytes, decrypted: %d bytes")+"\n", path, len(old), len(data))
+	oldLines, newLines := strings.Split(string(old), "\n"), strings.Split(string(data), "\n")
+	for i := range max(len(oldLines), len(newLines)) {
+		var o, n string
+		if i < len(oldLines) {
+			o = oldLines[i]
+		}
+		if i < len(newLines) {
+			n = newLines[i]
+		}
+		if o != n {
+			fmt.Printf(tr("first difference at line %d:")+"\n- %s\n+ %s\n", i+1, o, n)
+			return
+		}
+	}
+}
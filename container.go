@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// A vault file holds many named entries, each encrypted on its own, in
+// an append-only log:
+//
+//	"encutitl-vault\n"
+//	record: u32 len, meta, u64 len, data
+//
+// meta and data are separate encutitl files: meta holds the entry name,
+// size and times, data the content. list only decrypts metas; add and
+// remove append a record (a removal is a meta with no data), so updates
+// never rewrite the file. The latest record for a name wins. Content of
+// removed or replaced entries stays in the file, still encrypted, as the
+// entry's history: each put is a numbered version that vault restore can
+// bring back, until vault compact rewrites the file keeping the last
+// --keep versions.
+//
+// Every record has an ID and names the record of the same name it
+// replaced as its parent, so two copies of a vault can be merged by
+// vault sync (see vaultsync.go).
+
+var vaultMagic = []byte("encutitl-vault\n")
+
+const (
+	vaultPut    = "put"
+	vaultRemove = "remove"
+)
+
+type vaultMeta struct {
+	Op      string      `json:"op"`
+	Name    string      `json:"name"`
+	Size    int64       `json:"size,omitempty"`
+	Mode    fs.FileMode `json:"mode,omitempty"`
+	ModTime time.Time   `json:"mtime,omitempty"`
+	Added   time.Time   `json:"added"`
+	// Version counts the puts of a name from 1. Records written before
+	// versions existed have none and are numbered by position.
+	Version int `json:"version,omitempty"`
+	// RestoredFrom is the version a vault restore copied.
+	RestoredFrom int `json:"restored_from,omitempty"`
+	// ID is random for new records. Older records get one derived from
+	// their encrypted meta, and the previous record of their name in the
+	// file as parent.
+	ID      string   `json:"id,omitempty"`
+	Parents []string `json:"parents,omitempty"`
+	// Conflict marks content vault sync merged with conflict markers.
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+// vaultRecord is one parsed record; data is still encrypted.
+type vaultRecord struct {
+	meta       vaultMeta
+	sealedMeta []byte
+	data       []byte
+}
+
+type vaultFile struct {
+	path    string
+	records []vaultRecord
+
+	identities []encutil.Identity
+	legacyKey  []byte
+}
+
+func runVault(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "Usage: vault add|extract|list|remove|history|restore|compact|sync|du [flags] VAULT [NAME...]")
+		return
+	}
+	switch args[0] {
+	case "add":
+		runVaultAdd(args[1:])
+	case "extract":
+		runVaultExtract(args[1:])
+	case "list":
+		runVaultList(args[1:])
+	case "remove":
+		runVaultRemove(args[1:])
+	case "history":
+		runVaultHistory(args[1:])
+	case "restore":
+		runVaultRestore(args[1:])
+	case "compact":
+		runVaultCompact(args[1:])
+	case "sync":
+		runVaultSync(args[1:])
+	case "du":
+		runVaultDu(args[1:])
+	default:
+		fail(exitUsage, tr("Error: unknown vault command"), args[0])
+	}
+}
+
+// openVault reads and decrypts the metadata of every record.
+func openVault(path string) (*vaultFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	v := &vaultFile{path: path}
+	return v, v.parse(data)
+}
+
+// parse reads the records of a vault's contents.
+func (v *vaultFile) parse(data []byte) error {
+	path := v.path
+	if !bytes.HasPrefix(data, vaultMagic) {
+		return fmt.Errorf("%s is not a vault", path)
+	}
+	r := bytes.NewReader(data[len(vaultMagic):])
+	for r.Len() > 0 {
+		var metaLen uint32
+		if err := binary.Read(r, binary.BigEndian, &metaLen); err != nil || int64(metaLen) > int64(r.Len()) {
+			return fmt.Errorf("%s: truncated record", path)
+		}
+		sealed := make([]byte, metaLen)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return fmt.Errorf("%s: truncated record", path)
+		}
+		var dataLen uint64
+		if err := binary.Read(r, binary.BigEndian, &dataLen); err != nil || dataLen > uint64(r.Len()) {
+			return fmt.Errorf("%s: truncated record", path)
+		}
+		rec := vaultRecord{sealedMeta: sealed, data: make([]byte, dataLen)}
+		io.ReadFull(r, rec.data)
+
+		plain, err := v.open(sealed)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(plain, &rec.meta); err != nil {
+			return fmt.Errorf("%s: bad record: %w", path, err)
+		}
+		// Anyone with the public key can append records, so names are
+		// checked before they get near a path.
+		if name, err := entryName(rec.meta.Name); err != nil || name != rec.meta.Name {
+			return fmt.Errorf("%s: bad record: invalid entry name %q", path, rec.meta.Name)
+		}
+		if rec.meta.ID == "" {
+			sum := sha256.Sum256(sealed)
+			rec.meta.ID = hex.EncodeToString(sum[:16])
+			if head := v.head(rec.meta.Name); head != "" {
+				rec.meta.Parents = []string{head}
+			}
+		}
+		v.records = append(v.records, rec)
+	}
+	return nil
+}
+
+// open decrypts one blob, resolving identities once from the first.
+func (v *vaultFile) open(sealed []byte) ([]byte, error) {
+	plain, _, err := v.openStanza(sealed)
+	return plain, err
+}
+
+// openStanza is open that also returns the stanza that matched.
+func (v *vaultFile) openStanza(sealed []byte) ([]byte, *encutil.Stanza, error) {
+	if v.identities == nil && v.legacyKey == nil {
+		ids, key, err := decryptIdentities(sealed)
+		if err != nil {
+			return nil, nil, err
+		}
+		v.identities, v.legacyKey = ids, key
+	}
+	var buf bytes.Buffer
+	_, stanza, err := decryptTo(&buf, sealed, v.legacyKey, v.identities)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), stanza, nil
+}
+
+func failVault(err error) {
+	if errors.Is(err, encutil.ErrNoIdentityMatched) {
+		fail(exitAuth, tr("Vault error:"), err)
+		return
+	}
+	fail(exitIO, tr("Vault error:"), err)
+}
+
+// current returns the live entries, latest record per name.
+func (v *vaultFile) current() map[string]vaultRecord {
+	entries := map[string]vaultRecord{}
+	for _, rec := range v.records {
+		if rec.meta.Op == vaultRemove {
+			delete(entries, rec.meta.Name)
+		} else {
+			entries[rec.meta.Name] = rec
+		}
+	}
+	return entries
+}
+
+// head returns the ID of the latest record of name, "" if there is none.
+func (v *vaultFile) head(name string) string {
+	for i := len(v.records) - 1; i >= 0; i-- {
+		if v.records[i].meta.Name == name {
+			return v.records[i].meta.ID
+		}
+	}
+	return ""
+}
+
+// link gives a new record of meta.Name an ID and the current head as its
+// parent.
+func (v *vaultFile) link(meta *vaultMeta) {
+	meta.ID = newRecordID()
+	meta.Parents = nil
+	if head := v.head(meta.Name); head != "" {
+		meta.Parents = []string{head}
+	}
+}
+
+func newRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// history returns the records of name, oldest first, with the version
+// of every put filled in.
+func (v *vaultFile) history(name string) []vaultRecord {
+	var out []vaultRecord
+	version := 0
+	for _, rec := range v.records {
+		if rec.meta.Name != name {
+			continue
+		}
+		if rec.meta.Op == vaultPut {
+			if rec.meta.Version == 0 {
+				rec.meta.Version = version + 1
+			}
+			version = rec.meta.Version
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// nextVersion is the version the next put of name gets.
+func (v *vaultFile) nextVersion(name string) int {
+	last := 0
+	for _, rec := range v.history(name) {
+		last = max(last, rec.meta.Version)
+	}
+	return last + 1
+}
+
+func sortedNames(entries map[string]vaultRecord) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// appendRecord encrypts and appends one record to w.
+func appendRecord(w io.Writer, meta vaultMeta, content []byte, recipients []encutil.Recipient) error {
+	var sealedData []byte
+	if meta.Op == vaultPut {
+		compression, err := payloadCompression(content)
+		if err != nil {
+			return err
+		}
+		if sealedData, err = encutil.EncryptCompressed(content, compression, recipients...); err != nil {
+			return err
+		}
+	}
+	return writeRecord(w, meta, sealedData, recipients)
+}
+
+// writeRecord encrypts meta and writes it with the already encrypted
+// data.
+func writeRecord(w io.Writer, meta vaultMeta, sealedData []byte, recipients []encutil.Recipient) error {
+	sealedMeta, err := sealMeta(meta, recipients)
+	if err != nil {
+		return err
+	}
+	return writeSealed(w, sealedMeta, sealedData)
+}
+
+func sealMeta(meta vaultMeta, recipients []encutil.Recipient) ([]byte, error) {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return encutil.Encrypt(metaJSON, recipients...)
+}
+
+// writeSealed writes a record whose meta is already encrypted too.
+func writeSealed(w io.Writer, sealedMeta, sealedData []byte) error {
+	bw := bufio.NewWriter(w)
+	binary.Write(bw, binary.BigEndian, uint32(len(sealedMeta)))
+	bw.Write(sealedMeta)
+	binary.Write(bw, binary.BigEndian, uint64(len(sealedData)))
+	bw.Write(sealedData)
+	return bw.Flush()
+}
+
+// appendToVault opens path for appending, creating the vault if needed.
+func appendToVault(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if st, err := f.Stat(); err == nil && st.Size() == 0 {
+		_, err = f.Write(vaultMagic)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// entryName validates a name given on the command line.
+func entryName(name string) (string, error) {
+	name = path.Clean(filepath.ToSlash(name))
+	if !fs.ValidPath(name) || name == "." {
+		return "", fmt.Errorf("invalid entry name %q", name)
+	}
+	return name, nil
+}
+
+func runVaultAdd(args []string) {
+	fs := flag.NewFlagSet("vault add", flag.ExitOnError)
+	name := fs.String("name", "", "Entry name when adding a single file (default the file name)")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() < 2 || (*name != "" && fs.NArg() != 2) {
+		fail(exitUsage, "Usage: vault add [--name NAME] VAULT FILE...")
+		return
+	}
+	vaultPath, files := fs.Arg(0), fs.Args()[1:]
+	v := &vaultFile{path: vaultPath}
+	if _, err := os.Stat(vaultPath); err == nil {
+		// Fail early on a wrong file or key rather than after appending.
+		if v, err = openVault(vaultPath); err != nil {
+			failVault(err)
+			return
+		}
+	}
+	recipients, err := encryptRecipients()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	f, err := appendToVault(vaultPath)
+	if err != nil {
+		fail(exitIO, tr("Vault error:"), err)
+		return
+	}
+	defer f.Close()
+	for _, file := range files {
+		n := filepath.Base(file)
+		if *name != "" {
+			n = *name
+		}
+		entry, err := entryName(n)
+		if err != nil {
+			fail(exitUsage, tr("Error:"), err)
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			continue
+		}
+		content, err := readFileRetry(file)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			continue
+		}
+		version := v.nextVersion(entry)
+		meta := vaultMeta{Op: vaultPut, Name: entry, Size: int64(len(content)), Mode: info.Mode().Perm(), ModTime: info.ModTime().UTC(), Added: time.Now().UTC(), Version: version}
+		v.link(&meta)
+		if err := appendRecord(f, meta, content, recipients); err != nil {
+			fail(exitIO, tr("Vault error:"), err)
+			return
+		}
+		// Later files of the same name follow this one.
+		v.records = append(v.records, vaultRecord{meta: meta})
+		if version > 1 {
+			fmt.Printf(tr("Added %s (version %d)")+"\n", entry, version)
+		} else {
+			fmt.Println(tr("Added"), entry)
+		}
+	}
+}
+
+func runVaultList(args []string) {
+	fs := flag.NewFlagSet("vault list", flag.ExitOnError)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(exitUsage, "Usage: vault list VAULT")
+		return
+	}
+	v, err := openVault(fs.Arg(0))
+	if err != nil {
+		failVault(err)
+		return
+	}
+	entries := v.current()
+	for _, name := range sortedNames(entries) {
+		m := entries[name].meta
+		line := fmt.Sprintf("%s %10d %s %s", m.Mode, m.Size, m.ModTime.Local().Format("2006-01-02 15:04"), name)
+		if m.Conflict {
+			line += " (conflict)"
+		}
+		fmt.Println(line)
+	}
+}
+
+func runVaultExtract(args []string) {
+	fs := flag.NewFlagSet("vault extract", flag.ExitOnError)
+	outDir := fs.String("o", ".", "Directory to extract into")
+	fs.StringVar(onConflict, "on-conflict", *onConflict, "When a file exists: ask, overwrite, skip, rename or fail")
+	fs.StringVar(reportFlag, "report", "", "Write a signed JSON report of extracted files to this path")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fail(exitUsage, "Usage: vault extract [-o DIR] [--report FILE] VAULT [NAME...]")
+		return
+	}
+	v, err := openVault(fs.Arg(0))
+	if err != nil {
+		failVault(err)
+		return
+	}
+	entries := v.current()
+	names := fs.Args()[1:]
+	if len(names) == 0 {
+		names = sortedNames(entries)
+	}
+	for _, name := range names {
+		rec, ok := entries[name]
+		if !ok {
+			fail(exitUsage, tr("Error: no entry"), name)
+			continue
+		}
+		content, stanza, err := v.openStanza(rec.data)
+		if err != nil {
+			fail(exitAuth, tr("Decryption error:"), name+":", err)
+			continue
+		}
+		src := newRestoreSource(v.path+"#"+name+"@"+rec.meta.Added.UTC().Format(time.RFC3339), rec.data, stanza)
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			fail(exitIO, tr("Write error:"), fmt.Errorf("refusing entry name %q", name))
+			continue
+		}
+		out := filepath.Join(*outDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			continue
+		}
+		if out, err = resolveConflict(out, content); err != nil || out == "" {
+			if err != nil {
+				fail(exitIO, tr("Write error:"), err)
+			}
+			continue
+		}
+		mode := rec.meta.Mode
+		if mode == 0 {
+			mode = 0600
+		}
+		if err := os.WriteFile(out, content, mode); err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			continue
+		}
+		os.Chtimes(out, time.Now(), rec.meta.ModTime)
+		src.record(out, content)
+		fmt.Printf(tr("Extracted %s to %s")+"\n", name, out)
+	}
+}
+
+func runVaultRemove(args []string) {
+	fs := flag.NewFlagSet("vault remove", flag.ExitOnError)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fail(exitUsage, "Usage: vault remove VAULT NAME...")
+		return
+	}
+	v, err := openVault(fs.Arg(0))
+	if err != nil {
+		failVault(err)
+		return
+	}
+	entries := v.current()
+	recipients, err := encryptRecipients()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	f, err := appendToVault(v.path)
+	if err != nil {
+		fail(exitIO, tr("Vault error:"), err)
+		return
+	}
+	defer f.Close()
+	for _, name := range fs.Args()[1:] {
+		if _, ok := entries[name]; !ok {
+			fail(exitUsage, tr("Error: no entry"), name)
+			continue
+		}
+		meta := vaultMeta{Op: vaultRemove, Name: name, Added: time.Now().UTC()}
+		v.link(&meta)
+		if err := appendRecord(f, meta, nil, recipients); err != nil {
+			fail(exitIO, tr("Vault error:"), err)
+			return
+		}
+		v.records = append(v.records, vaultRecord{meta: meta})
+		fmt.Printf(tr("Removed %s (run vault compact to drop its data from the file)")+"\n", name)
+	}
+}
+
+// runVaultCompact rewrites the vault with the last --keep versions of
+// the live entries and replaces the file atomically. Removed entries are
+// dropped with their whole history.
+func runVaultCompact(args []string) {
+	fs := flag.NewFlagSet("vault compact", flag.ExitOnError)
+	keep := fs.Int("keep", 1, "Versions of each entry to keep, the current one included")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 || *keep < 1 {
+		fail(exitUsage, "Usage: vault compact [--keep N] VAULT")
+		return
+	}
+	v, err := openVault(fs.Arg(0))
+	if err != nil {
+		failVault(err)
+		return
+	}
+	recipients, err := encryptRecipients()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	entries := v.current()
+	kept := 0
+	tmp := v.path + ".compact"
+	err = func() error {
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Write(vaultMagic); err != nil {
+			return err
+		}
+		for _, name := range sortedNames(entries) {
+			var puts []vaultRecord
+			for _, rec := range v.history(name) {
+				if rec.meta.Op == vaultPut {
+					puts = append(puts, rec)
+				}
+			}
+			for _, rec := range puts[max(len(puts)-*keep, 0):] {
+				// Data blobs are copied as they are; metas are
+				// re-encrypted, with their version numbers.
+				if err := writeRecord(f, rec.meta, rec.data, recipients); err != nil {
+					return err
+				}
+				kept++
+			}
+		}
+		return f.Sync()
+	}()
+	if err == nil {
+		err = os.Rename(tmp, v.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fail(exitIO, tr("Vault error:"), err)
+		return
+	}
+	fmt.Printf(tr("Compacted %s: %d entries kept, %d records dropped")+"\n", v.path, len(entries), len(v.records)-kept)
+}
+
+func runVaultHistory(args []string) {
+	fs := flag.NewFlagSet("vault history", flag.ExitOnError)
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fail(exitUsage, "Usage: vault history VAULT NAME")
+		return
+	}
+	v, err := openVault(fs.Arg(0))
+	if err != nil {
+		failVault(err)
+		return
+	}
+	name := fs.Arg(1)
+	records := v.history(name)
+	if len(records) == 0 {
+		fail(exitUsage, tr("Error: no entry"), name)
+		return
+	}
+	for i, rec := range records {
+		m := rec.meta
+		added := m.Added.Local().Format("2006-01-02 15:04")
+		switch {
+		case *a11yFlag && m.Op == vaultRemove:
+			fmt.Printf(tr("Removed on %s.")+"\n", added)
+			continue
+		case m.Op == vaultRemove:
+			fmt.Printf(tr("%-5s %s removed")+"\n", "", added)
+			continue
+		case *a11yFlag:
+			line := fmt.Sprintf(tr("Version %d, %d bytes, added on %s"), m.Version, m.Size, added)
+			if m.RestoredFrom > 0 {
+				line += fmt.Sprintf(tr(", restored from version %d"), m.RestoredFrom)
+			}
+			if i == len(records)-1 {
+				line += tr(", the current one")
+			}
+			fmt.Println(line + ".")
+			continue
+		}
+		line := fmt.Sprintf("v%-4d %s %10d", m.Version, added, m.Size)
+		if m.RestoredFrom > 0 {
+			line += fmt.Sprintf(" restored from v%d", m.RestoredFrom)
+		}
+		if i == len(records)-1 {
+			line += " (current)"
+		}
+		fmt.Println(line)
+	}
+}
+
+// runVaultRestore makes an earlier version current again by appending a
+// copy of it; the versions in between stay in the history.
+func runVaultRestore(args []string) {
+	fs := flag.NewFlagSet("vault restore", flag.ExitOnError)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fail(exitUsage, "Usage: vault restore VAULT NAME@VERSION")
+		return
+	}
+	name, ver, ok := strings.Cut(fs.Arg(1), "@")
+	version, err := strconv.Atoi(strings.TrimPrefix(ver, "v"))
+	if !ok || err != nil || version < 1 {
+		fail(exitUsage, "Usage: vault restore VAULT NAME@VERSION")
+		return
+	}
+	v, err := openVault(fs.Arg(0))
+	if err != nil {
+		failVault(err)
+		return
+	}
+	var found *vaultRecord
+	for _, rec := range v.history(name) {
+		if rec.meta.Op == vaultPut && rec.meta.Version == version {
+			found = &rec
+		}
+	}
+	if found == nil {
+		failf(exitUsage, tr("Error: %s has no version %d (see vault history)"), name, version)
+		return
+	}
+	// Check the old content still opens before making it current.
+	if _, err := v.open(found.data); err != nil {
+		fail(exitAuth, tr("Decryption error:"), err)
+		return
+	}
+	recipients, err := encryptRecipients()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	f, err := appendToVault(v.path)
+	if err != nil {
+		fail(exitIO, tr("Vault error:"), err)
+		return
+	}
+	defer f.Close()
+	meta := found.meta
+	meta.Added = time.Now().UTC()
+	meta.Version = v.nextVersion(name)
+	meta.RestoredFrom = version
+	meta.Conflict = false
+	v.link(&meta)
+	if err := writeRecord(f, meta, found.data, recipients); err != nil {
+		fail(exitIO, tr("Vault error:"), err)
+		return
+	}
+	fmt.Printf(tr("Restored %s version %d as version %d")+"\n", name, version, meta.Version)
+}
@@ -0,0 +1,206 @@
+// Command cshared is encutil as a C shared library, so Python, Ruby or
+// C++ programs link the same implementation instead of running the
+// binary:
+//
+//	go build -buildmode=c-shared -o libencutil.so ./cshared
+//
+// which also writes libencutil.h. Every call returns 0 or an
+// ENCUTIL_ERR_* code, and on failure sets *err to a message the caller
+// releases with encutil_free, as it does the output buffers:
+//
+//	uint8_t *out; size_t out_len; char *err;
+//	if (encutil_decrypt(data, len, key, 32, 0, &out, &out_len, &err) != 0) {
+//		fprintf(stderr, "%s\n", err);
+//		encutil_free(err);
+//	}
+//
+// key may be NULL when decrypting once a key provider is set: it is
+// called with the key ID a file names (as inspect shows it) and writes
+// the 32-byte key, returning 0, or returns nonzero if it has none.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+
+enum {
+	ENCUTIL_OK = 0,
+	ENCUTIL_ERR = 1,           // anything else, see the message
+	ENCUTIL_ERR_AUTH = 2,      // wrong key, or the data was tampered with
+	ENCUTIL_ERR_KEY = 3,       // no key for any of the file's recipients
+	ENCUTIL_ERR_TOO_LARGE = 4, // over max_size
+	ENCUTIL_ERR_FORMAT = 5,    // malformed or unknown format
+};
+
+typedef int (*encutil_key_provider)(const char *key_id, uint8_t *key, void *user);
+
+static int call_key_provider(encutil_key_provider fn, const char *key_id, uint8_t *key, void *user) {
+	return fn(key_id, key, user);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+func main() {} // required for -buildmode=c-shared
+
+var (
+	providerMu   sync.Mutex
+	providerFn   C.encutil_key_provider
+	providerUser unsafe.Pointer
+)
+
+//export encutil_set_key_provider
+func encutil_set_key_provider(fn C.encutil_key_provider, user unsafe.Pointer) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	providerFn, providerUser = fn, user
+}
+
+//export encutil_free
+func encutil_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+// encutil_encrypt encrypts to key, if not NULL, and to the recipients,
+// a NUL-terminated list of ssh or encpq1 public keys, one per line, if
+// not NULL.
+//
+//export encutil_encrypt
+func encutil_encrypt(data *C.uint8_t, dataLen C.size_t, key *C.uint8_t, keyLen C.size_t, recipients *C.char,
+	out **C.uint8_t, outLen *C.size_t, errOut **C.char) C.int {
+	var list []encutil.Recipient
+	if key != nil {
+		r, err := encutil.NewKeyRecipient(C.GoBytes(unsafe.Pointer(key), C.int(keyLen)))
+		if err != nil {
+			return fail(errOut, err)
+		}
+		list = append(list, r)
+	}
+	if recipients != nil {
+		for _, line := range strings.Split(C.GoString(recipients), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			var r encutil.Recipient
+			var err error
+			if encutil.IsHybridRecipient(line) {
+				r, err = encutil.ParseHybridRecipient(line)
+			} else {
+				r, err = encutil.ParseSSHRecipient(line)
+			}
+			if err != nil {
+				return fail(errOut, err)
+			}
+			list = append(list, r)
+		}
+	}
+	if len(list) == 0 {
+		return fail(errOut, errors.New("no key or recipients to encrypt to"))
+	}
+	sealed, err := encutil.Encrypt(goBytes(data, dataLen), list...)
+	if err != nil {
+		return fail(errOut, err)
+	}
+	*out, *outLen = cBytes(sealed)
+	return C.ENCUTIL_OK
+}
+
+// encutil_decrypt decrypts with key, or the key provider when key is
+// NULL, writing at most max_size bytes (0 for no limit).
+//
+//export encutil_decrypt
+func encutil_decrypt(data *C.uint8_t, dataLen C.size_t, key *C.uint8_t, keyLen C.size_t, maxSize C.size_t,
+	out **C.uint8_t, outLen *C.size_t, errOut **C.char) C.int {
+	var identities []encutil.Identity
+	var legacyKey []byte
+	if key != nil {
+		legacyKey = C.GoBytes(unsafe.Pointer(key), C.int(keyLen))
+		r, err := encutil.NewKeyRecipient(legacyKey)
+		if err != nil {
+			return fail(errOut, err)
+		}
+		identities = append(identities, r)
+	} else {
+		identities = append(identities, providerIdentity{})
+	}
+	var buf bytes.Buffer
+	opts := encutil.DecryptOptions{LegacyKey: legacyKey, MaxSize: int64(maxSize)}
+	if _, _, err := encutil.DecryptWith(&buf, goBytes(data, dataLen), opts, identities...); err != nil {
+		return fail(errOut, err)
+	}
+	*out, *outLen = cBytes(buf.Bytes())
+	return C.ENCUTIL_OK
+}
+
+// providerIdentity asks the key provider for the key a stanza names.
+type providerIdentity struct{}
+
+func (providerIdentity) Unwrap(s *encutil.Stanza) ([]byte, error) {
+	if s.Type != "key" || len(s.Args) != 1 {
+		return nil, encutil.ErrIncorrectIdentity
+	}
+	providerMu.Lock()
+	fn, user := providerFn, providerUser
+	providerMu.Unlock()
+	if fn == nil {
+		return nil, errors.New("no key given and no key provider set")
+	}
+	id := C.CString(s.Args[0])
+	defer C.free(unsafe.Pointer(id))
+	key := (*C.uint8_t)(C.calloc(32, 1))
+	defer func() {
+		C.memset(unsafe.Pointer(key), 0, 32)
+		C.free(unsafe.Pointer(key))
+	}()
+	if C.call_key_provider(fn, id, key, user) != 0 {
+		return nil, encutil.ErrIncorrectIdentity
+	}
+	r, err := encutil.NewKeyRecipient(C.GoBytes(unsafe.Pointer(key), 32))
+	if err != nil {
+		return nil, err
+	}
+	return r.Unwrap(s)
+}
+
+func goBytes(p *C.uint8_t, n C.size_t) []byte {
+	if p == nil || n == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(p)), int(n))
+}
+
+// cBytes copies b to C memory for the caller to encutil_free.
+func cBytes(b []byte) (*C.uint8_t, C.size_t) {
+	p := (*C.uint8_t)(C.malloc(C.size_t(max(len(b), 1))))
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(p)), len(b)), b)
+	return p, C.size_t(len(b))
+}
+
+func fail(errOut **C.char, err error) C.int {
+	if errOut != nil {
+		*errOut = C.CString(err.Error())
+	}
+	switch {
+	case errors.Is(err, encutil.ErrOutputTooLarge):
+		return C.ENCUTIL_ERR_TOO_LARGE
+	case errors.Is(err, encutil.ErrNoIdentityMatched):
+		return C.ENCUTIL_ERR_KEY
+	case errors.Is(err, encutil.ErrMalformed):
+		return C.ENCUTIL_ERR_FORMAT
+	case errors.Is(err, encutil.ErrIncorrectIdentity), errors.Is(err, encutil.ErrAADRequired),
+		err.Error() == "cipher: message authentication failed":
+		return C.ENCUTIL_ERR_AUTH
+	}
+	return C.ENCUTIL_ERR
+}
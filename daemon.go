@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// encutitl daemon loads key.bin and the identities once, asking for
+// passphrases and unsealing at startup, keeps them in locked memory and
+// encrypts and decrypts for scripts over a unix socket, as gpg-agent does
+// for gpg. Every message, both ways, is two frames, each a big-endian u32
+// length and that many bytes: a JSON header, then the data.
+//
+//	{"op": "encrypt"}  plaintext    {"ok": true}  encutitl file
+//	{"op": "decrypt"}  any format   {"ok": true}  plaintext
+//	{"op": "ping"}     empty        {"ok": true}  empty
+//	{"op": "jobs"}     empty        {"ok": true}  JSON job records
+//	{"op": "cancel-job"}  job ID    {"ok": true}  job ID
+//	{"op": "resume-job"}  job ID    {"ok": true}  job ID
+//
+// Failures are {"ok": false, "code": ..., "error": ...} with the codes of
+// the HTTP APIs and an empty data frame. A connection can carry any number
+// of requests. Data frames are capped by --max-input-size (default 256M)
+// and decryption by the usual output limits.
+//
+// `daemon encrypt` and `daemon decrypt` are the client side, stdin to
+// stdout, finding the socket through ENCUTITL_DAEMON_SOCK like the agent's.
+
+const (
+	daemonSockEnv    = "ENCUTITL_DAEMON_SOCK"
+	daemonMaxHeader  = 64 << 10
+	serveDefaultSize = 256 << 20 // request limit without --max-input-size
+)
+
+type daemonRequest struct {
+	Op string `json:"op"`
+}
+
+type daemonResponse struct {
+	OK    bool   `json:"ok"`
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type daemon struct {
+	key        []byte // key.bin, for legacy and JWE files
+	identities []encutil.Identity
+	recipients []encutil.Recipient
+	maxSize    int64
+}
+
+func runDaemon(args []string) {
+	if len(args) > 0 && (args[0] == "encrypt" || args[0] == "decrypt") {
+		runDaemonClient(args[0], args[1:])
+		return
+	}
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	sock := fs.String("a", "", "Socket path (default daemon.sock in a new private directory)")
+	requireLock := fs.Bool("require-mlock", false, "Refuse to start when memory cannot be locked")
+	fs.Var(&recipientFlags, "recipient", "Recipient to encrypt to (repeatable, default key.bin)")
+	fs.Var(&identityFlags, "i", "Identity file to decrypt with (repeatable, default as for -d)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.Var(&maxInputSize, "max-input-size", "Largest data frame accepted (default 256M)")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fail(exitUsage, "Usage: daemon [-a SOCKET] [--require-mlock] [--recipient KEY...] [-i KEY...] [--max-input-size N]")
+		return
+	}
+	// Before the keys are loaded, so they never reach swap.
+	if err := lockMemory(); err != nil {
+		if *requireLock {
+			fail(exitError, tr("Error: locking memory:"), err)
+			return
+		}
+		fmt.Fprintln(os.Stderr, tr("Warning: keys may be swapped out:"), err)
+	}
+	d, err := loadDaemonKeys()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	d.maxSize = int64(maxInputSize)
+	if d.maxSize == 0 {
+		d.maxSize = serveDefaultSize
+	}
+
+	path := *sock
+	if path == "" {
+		dir, err := os.MkdirTemp("", "encutitl-daemon-")
+		if err != nil {
+			fail(exitIO, tr("Error:"), err)
+			return
+		}
+		defer os.Remove(dir)
+		path = filepath.Join(dir, "daemon.sock")
+	}
+	spec := &listenSpec{network: "unix", addr: path, mode: 0600}
+	ln, err := spec.listen()
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+	defer os.Remove(path)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		ln.Close()
+	}()
+
+	fmt.Printf("%s=%s; export %s;\n", daemonSockEnv, path, daemonSockEnv)
+	fmt.Fprintf(os.Stderr, tr("Serving %d identities, encrypting to %d recipients")+"\n", len(d.identities), len(d.recipients))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // closed by a signal
+		}
+		go d.serve(conn)
+	}
+}
+
+// loadDaemonKeys reads every key now, decrypting SSH keys, so nothing is
+// asked for while serving.
+func loadDaemonKeys() (*daemon, error) {
+	d := &daemon{}
+	key, err := envKey()
+	if key == nil && err == nil {
+		if _, statErr := os.Stat(keyFilePath()); statErr == nil {
+			key, err = readKeyFile()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		r, err := encutil.NewKeyRecipient(key)
+		if err != nil {
+			return nil, err
+		}
+		d.key = key
+		d.identities = append(d.identities, r)
+		if len(recipientFlags) == 0 {
+			d.recipients = append(d.recipients, r)
+		}
+	}
+	ids, err := sshIdentities()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if sshID, ok := id.(*encutil.SSHIdentity); ok {
+			if _, err := sshID.Signer(); err != nil {
+				return nil, err
+			}
+		}
+		d.identities = append(d.identities, id)
+	}
+	if len(recipientFlags) > 0 {
+		if d.recipients, err = parseRecipients(recipientFlags); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.identities) == 0 && len(d.recipients) == 0 {
+		return nil, errors.New("no key.bin, identities or recipients to serve")
+	}
+	return d, nil
+}
+
+func (d *daemon) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var req daemonRequest
+		data, err := readDaemonMessage(r, &req, d.maxSize)
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			// The stream is out of step, there is no reading on.
+			writeDaemonMessage(conn, &daemonResponse{Code: errorCode(err), Error: err.Error()}, nil)
+			return
+		}
+		start := time.Now()
+		out, err := d.handle(req.Op, data)
+		resp := &daemonResponse{OK: err == nil}
+		if err != nil {
+			resp.Code, resp.Error = errorCode(err), err.Error()
+			if errors.Is(err, errUnknownOp) {
+				resp.Code = codeBadRequest
+			}
+			out = nil
+		}
+		fmt.Fprintf(os.Stderr, "%s op=%s in=%d out=%d code=%s took=%s\n", time.Now().UTC().Format(time.RFC3339), req.Op, len(data), len(out), resp.Code, time.Since(start).Round(time.Millisecond))
+		clear(data)
+		err = writeDaemonMessage(conn, resp, out)
+		clear(out)
+		if err != nil {
+			return
+		}
+	}
+}
+
+var errUnknownOp = errors.New("unknown op")
+
+func (d *daemon) handle(op string, data []byte) ([]byte, error) {
+	switch op {
+	case "ping":
+		return nil, nil
+	case "encrypt":
+		if len(d.recipients) == 0 {
+			return nil, errors.New("the daemon has no recipients to encrypt to")
+		}
+		compression, err := payloadCompression(data)
+		if err != nil {
+			return nil, err
+		}
+		return encutil.EncryptWith(data, encutil.EncryptOptions{Compression: compression}, d.recipients...)
+	case "decrypt":
+		if isAgeArmor(string(data)) {
+			raw, err := dearmorAge(string(data))
+			if err != nil {
+				return nil, err
+			}
+			data = raw
+		}
+		var buf bytes.Buffer
+		_, _, err := decryptTo(&buf, data, d.key, d.identities)
+		return buf.Bytes(), err
+	case "jobs":
+		jobs, err := listJobs()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(jobs)
+	case "cancel-job":
+		rec, err := cancelJob(string(data))
+		return []byte(rec.ID), err
+	case "resume-job":
+		rec, err := startJobInBackground(string(data), d.key)
+		return []byte(rec.ID), err
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownOp, op)
+}
+
+// readDaemonMessage reads a header into v and returns the data frame.
+func readDaemonMessage(r io.Reader, v any, maxSize int64) ([]byte, error) {
+	header, err := readDaemonFrame(r, daemonMaxHeader)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(header, v); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", encutil.ErrMalformed, err)
+	}
+	data, err := readDaemonFrame(r, maxSize)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+func readDaemonFrame(r io.Reader, max int64) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if int64(n) > max {
+		return nil, fmt.Errorf("%w: frame of %d bytes, the limit is %d", encutil.ErrOutputTooLarge, n, max)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeDaemonMessage(w io.Writer, v any, data []byte) error {
+	header, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	binary.Write(bw, binary.BigEndian, uint32(len(header)))
+	bw.Write(header)
+	binary.Write(bw, binary.BigEndian, uint32(len(data)))
+	bw.Write(data)
+	return bw.Flush()
+}
+
+func runDaemonClient(op string, args []string) {
+	fs := flag.NewFlagSet("daemon "+op, flag.ExitOnError)
+	sock := fs.String("a", os.Getenv(daemonSockEnv), "Daemon socket")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *sock == "" || fs.NArg() != 0 {
+		failf(exitUsage, "Usage: daemon %s [-a SOCKET] < INPUT > OUTPUT (or set %s)", op, daemonSockEnv)
+		return
+	}
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	if out, ok := daemonCall(*sock, op, in); ok {
+		os.Stdout.Write(out)
+	}
+}
+
+// daemonCall sends one request to the daemon at sock and returns the
+// data of the response. It reports failures itself.
+func daemonCall(sock, op string, in []byte) ([]byte, bool) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		fail(exitIO, tr("Connect error:"), err)
+		return nil, false
+	}
+	defer conn.Close()
+	if err := writeDaemonMessage(conn, &daemonRequest{Op: op}, in); err != nil {
+		fail(exitIO, tr("Connect error:"), err)
+		return nil, false
+	}
+	var resp daemonResponse
+	out, err := readDaemonMessage(bufio.NewReader(conn), &resp, 1<<32-1)
+	if err != nil {
+		fail(exitIO, tr("Connect error:"), err)
+		return nil, false
+	}
+	if !resp.OK {
+		code := exitError
+		switch resp.Code {
+		case codeAuthFailed:
+			code = exitAuth
+		case codeKeyNotFound:
+			code = exitKey
+		}
+		failf(code, "Error: %s: %s", resp.Code, resp.Error)
+		return nil, false
+	}
+	return out, true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"flag"
+)
+
+// --deterministic encrypts equal inputs to equal files, for backups that
+// deduplicate what they store. The convergence secret comes from key.bin,
+// so files only converge between holders of the same key, and the output
+// reveals nothing to anyone else that they could not learn by comparing
+// files. Recipients other than key.bin use fresh randomness every time
+// and cannot be combined with it.
+
+var deterministicFlag = flag.Bool("deterministic", false, "Encrypt equal inputs to equal output, for deduplicating storage (key.bin only)")
+
+// convergenceSecret is derived from key.bin when --deterministic is set.
+var convergenceSecret []byte
+
+func loadConvergence() error {
+	switch {
+	case !*deterministicFlag:
+		return nil
+	case *formatFlag != "encutitl":
+		return errors.New("--deterministic needs the encutitl format")
+	case len(recipientFlags) > 0 || *keyBackend != "local":
+		return errors.New("--deterministic only works with key.bin, not --recipient or --key-backend")
+	case *canaryFlag:
+		return errors.New("--deterministic cannot be combined with --canary")
+	}
+	key, err := loadKey()
+	if err != nil {
+		return err
+	}
+	convergenceSecret, err = hkdf.Key(sha256.New, key, nil, "encutitl convergence", 32)
+	return err
+}
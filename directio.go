@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// --direct-io keeps the streamed jobs, --chunk-size encryption and
+// decryption to a file, out of the page cache, so a multi-terabyte backup
+// does not evict everything else the machine has cached. On Linux the
+// files are switched to O_DIRECT, which needs block-aligned buffers,
+// offsets and lengths: reads and writes here go in whole aligned blocks,
+// and the partial block at the end of an output is written with O_DIRECT
+// turned off for that one write. Where a filesystem refuses O_DIRECT
+// (tmpfs, some network mounts) I/O goes through the cache as usual and
+// the pages are dropped once read or written back. Other systems do
+// ordinary I/O.
+
+const (
+	directAlign = 4096
+	directBuf   = 4 << 20
+)
+
+var directIOFlag = flag.Bool("direct-io", false, "Bypass the page cache for --chunk-size encryption and decryption to a file")
+
+// syncWriter is an output file, or an uncachedWriter in front of one.
+type syncWriter interface {
+	io.Writer
+	Sync() error
+}
+
+// flushUncached flushes w if it is an uncachedWriter.
+func flushUncached(w io.Writer) error {
+	if uw, ok := w.(*uncachedWriter); ok {
+		return uw.Flush()
+	}
+	return nil
+}
+
+// alignedBuffer returns n bytes starting on a directAlign boundary.
+func alignedBuffer(n int) []byte {
+	b := make([]byte, n+directAlign)
+	off := int(uintptr(unsafe.Pointer(&b[0])) & (directAlign - 1))
+	if off != 0 {
+		off = directAlign - off
+	}
+	return b[off : off+n : off+n]
+}
+
+// uncachedReader reads a file from its current offset around the cache.
+type uncachedReader struct {
+	f      *os.File
+	direct bool
+	buf    []byte
+	r, w   int   // the unread part of buf
+	skip   int   // bytes before the starting offset, read for alignment
+	off    int64 // file offset of the next read
+	err    error
+}
+
+func newUncachedReader(f *os.File) (io.Reader, error) {
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	r := &uncachedReader{f: f, buf: alignedBuffer(directBuf), off: off}
+	if setDirect(f, true) == nil {
+		r.direct = true
+		aligned := off &^ (directAlign - 1)
+		if _, err := f.Seek(aligned, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r.skip, r.off = int(off-aligned), aligned
+	}
+	return r, nil
+}
+
+func (r *uncachedReader) Read(p []byte) (int, error) {
+	for r.r == r.w {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.f.Read(r.buf)
+		if !r.direct && n > 0 {
+			dropCache(r.f, r.off, int64(n))
+		}
+		r.off += int64(n)
+		r.r, r.w, r.err = 0, n, err
+		if r.skip > 0 {
+			k := min(r.skip, n)
+			r.r += k
+			r.skip -= k
+		}
+	}
+	n := copy(p, r.buf[r.r:r.w])
+	r.r += n
+	return n, nil
+}
+
+// uncachedWriter writes a file from its current offset around the cache.
+// Flush or Sync before closing the file.
+type uncachedWriter struct {
+	f      *os.File
+	direct bool
+	buf    []byte
+	n      int   // bytes in buf
+	off    int64 // file offset of buf[0]
+}
+
+func newUncachedWriter(f *os.File) (*uncachedWriter, error) {
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	w := &uncachedWriter{f: f, buf: alignedBuffer(directBuf), off: off}
+	// Start on a block boundary, with what the file already has of that
+	// block in buf, read before O_DIRECT would need that aligned too.
+	aligned := off &^ (directAlign - 1)
+	head := int(off - aligned)
+	if head > 0 {
+		if _, err := f.ReadAt(w.buf[:head], aligned); err != nil {
+			return nil, err
+		}
+	}
+	if setDirect(f, true) == nil {
+		w.direct = true
+		w.n, w.off = head, aligned
+	}
+	return w, nil
+}
+
+func (w *uncachedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		k := copy(w.buf[w.n:], p)
+		w.n += k
+		written += k
+		p = p[k:]
+		if w.n == len(w.buf) {
+			if err := w.writeOut(w.n); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeOut writes the first n bytes of buf, a whole number of blocks for
+// a direct writer, and keeps the rest.
+func (w *uncachedWriter) writeOut(n int) error {
+	if _, err := w.f.WriteAt(w.buf[:n], w.off); err != nil {
+		return err
+	}
+	if !w.direct {
+		dropCache(w.f, w.off, int64(n))
+	}
+	w.n = copy(w.buf, w.buf[n:w.n])
+	w.off += int64(n)
+	return nil
+}
+
+// Flush writes everything buffered. A direct writer writes the partial
+// block at the end without O_DIRECT and keeps it, to write again whole
+// once more data arrives.
+func (w *uncachedWriter) Flush() error {
+	if !w.direct {
+		return w.writeOut(w.n)
+	}
+	if err := w.writeOut(w.n &^ (directAlign - 1)); err != nil || w.n == 0 {
+		return err
+	}
+	if err := setDirect(w.f, false); err != nil {
+		return err
+	}
+	_, err := w.f.WriteAt(w.buf[:w.n], w.off)
+	if derr := setDirect(w.f, true); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// Sync is Flush followed by syncing the file.
+func (w *uncachedWriter) Sync() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
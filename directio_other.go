@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func setDirect(f *os.File, on bool) error {
+	return errors.ErrUnsupported
+}
+
+func dropCache(f *os.File, off, n int64) {}
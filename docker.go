@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// docker-credential is a Docker credential helper keeping registry logins
+// encrypted in docker-credentials.bin in the config directory. Installed
+// as docker-credential-encutitl on the PATH (a link to encutitl will do)
+// and named in ~/.docker/config.json,
+//
+//	{"credsStore": "encutitl"}
+//
+// docker calls it with store, get, erase or list and the request on
+// stdin. The file is encrypted to the key in ENCUTITL_KEY if set, else to
+// the public halves of the default SSH identities, ~/.ssh/id_ed25519.pub
+// and ~/.ssh/id_rsa.pub; key.bin is not used, as docker runs helpers from
+// any directory.
+
+const (
+	dockerCredentialsFile = "docker-credentials.bin"
+	dockerHelperName      = "docker-credential-encutitl"
+	dockerNotFound        = "credentials not found in native keychain"
+)
+
+type dockerCredential struct {
+	ServerURL string `json:"ServerURL,omitempty"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func runDockerCredential(args []string) {
+	if len(args) != 1 {
+		fail(exitUsage, "Usage: docker-credential store|get|erase|list")
+		return
+	}
+	in, err := io.ReadAll(io.LimitReader(os.Stdin, 1<<20))
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	creds, err := loadDockerCredentials()
+	if err != nil {
+		fail(exitAuth, tr("Decryption error:"), err)
+		return
+	}
+	server := strings.TrimSpace(string(in))
+	switch args[0] {
+	case "get":
+		c, ok := creds[server]
+		if !ok {
+			fmt.Println(dockerNotFound)
+			exitCode = exitError
+			return
+		}
+		c.ServerURL = server
+		json.NewEncoder(os.Stdout).Encode(c)
+	case "list":
+		out := map[string]string{}
+		for url, c := range creds {
+			out[url] = c.Username
+		}
+		json.NewEncoder(os.Stdout).Encode(out)
+	case "store":
+		var c dockerCredential
+		if err := json.Unmarshal(in, &c); err != nil || c.ServerURL == "" {
+			fail(exitUsage, tr("Error: store wants {\"ServerURL\", \"Username\", \"Secret\"} on stdin"))
+			return
+		}
+		server, c.ServerURL = c.ServerURL, ""
+		creds[server] = c
+		err = saveDockerCredentials(creds)
+	case "erase":
+		if _, ok := creds[server]; !ok {
+			fmt.Println(dockerNotFound)
+			exitCode = exitError
+			return
+		}
+		delete(creds, server)
+		err = saveDockerCredentials(creds)
+	default:
+		fail(exitUsage, "Usage: docker-credential store|get|erase|list")
+		return
+	}
+	if err != nil {
+		fail(exitIO, tr("Write error:"), err)
+	}
+}
+
+func dockerCredentialsPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, dockerCredentialsFile), nil
+}
+
+func loadDockerCredentials() (map[string]dockerCredential, error) {
+	creds := map[string]dockerCredential{}
+	path, err := dockerCredentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := openData(path, data)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plain)
+	return creds, json.Unmarshal(plain, &creds)
+}
+
+func saveDockerCredentials(creds map[string]dockerCredential) error {
+	recipients, err := dockerRecipients()
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	defer clear(plain)
+	sealed, err := encutil.Encrypt(plain, recipients...)
+	if err != nil {
+		return err
+	}
+	path, err := dockerCredentialsPath()
+	if err != nil {
+		return err
+	}
+	return writeDurable(path, sealed, 0600)
+}
+
+// dockerRecipients are ENCUTITL_KEY, or the default SSH identities.
+func dockerRecipients() ([]encutil.Recipient, error) {
+	key, err := envKey()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		r, err := encutil.NewKeyRecipient(key)
+		if err != nil {
+			return nil, err
+		}
+		return []encutil.Recipient{r}, nil
+	}
+	var specs []string
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range []string{"id_ed25519", "id_rsa"} {
+			path := filepath.Join(home, ".ssh", name+".pub")
+			if _, err := os.Stat(path); err == nil {
+				specs = append(specs, path)
+			}
+		}
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("set ENCUTITL_KEY or create ~/.ssh/id_ed25519 to keep docker credentials")
+	}
+	return parseRecipients(specs)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// --durability picks how hard an output is pushed to disk before the run
+// moves on:
+//
+//	none       written straight to its path; a crash can leave it partial
+//	flush      written to a temporary file and renamed into place, so the
+//	           path holds the old file or the whole new one, but a power
+//	           loss may still lose the new one
+//	fsync      flush, with the file synced before the rename
+//	fsync-dir  fsync, with the directory synced after the rename, so the
+//	           rename itself survives a power loss
+//
+// Single files default to fsync. -R and watch default to flush: syncing
+// every one of thousands of files costs more than running them again.
+// --in-place always works as fsync-dir.
+
+const (
+	durabilityNone = iota
+	durabilityFlush
+	durabilityFsync
+	durabilityFsyncDir
+)
+
+var durabilityLevels = map[string]int{
+	"none":      durabilityNone,
+	"flush":     durabilityFlush,
+	"fsync":     durabilityFsync,
+	"fsync-dir": durabilityFsyncDir,
+}
+
+var durabilityFlag = flag.String("durability", "", "How outputs reach the disk: none, flush, fsync or fsync-dir (default fsync, flush for -R and watch)")
+
+// bulkRun is set by the commands that write many files, for the default.
+var bulkRun bool
+
+func checkDurability() error {
+	if _, ok := durabilityLevels[*durabilityFlag]; !ok && *durabilityFlag != "" {
+		return fmt.Errorf("unknown --durability %q, use none, flush, fsync or fsync-dir", *durabilityFlag)
+	}
+	return nil
+}
+
+func durability() int {
+	if level, ok := durabilityLevels[*durabilityFlag]; ok {
+		return level
+	}
+	if bulkRun {
+		return durabilityFlush
+	}
+	return durabilityFsync
+}
+
+// writeDurable writes data to path as --durability asks.
+func writeDurable(path string, data []byte, perm os.FileMode) error {
+	level := durability()
+	if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+		level = durabilityNone // a device or pipe, nothing to rename over
+	}
+	if level == durabilityNone {
+		return retryLocked(path, func() error { return os.WriteFile(path, data, perm) })
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".encutitl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = syncDurable(tmp, level)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return renameDurable(tmp.Name(), path, level)
+}
+
+// syncDurable syncs a finished temporary file if the level asks for it.
+func syncDurable(f *os.File, level int) error {
+	if level < durabilityFsync {
+		return nil
+	}
+	return f.Sync()
+}
+
+// renameDurable moves a finished temporary file into place.
+func renameDurable(src, dst string, level int) error {
+	if level == durabilityFsyncDir {
+		return renameSynced(src, dst)
+	}
+	return retryLocked(dst, func() error { return os.Rename(src, dst) })
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// edit decrypts a file into a private temporary directory, on tmpfs
+// where there is one so the plaintext never reaches a disk, runs
+// $VISUAL or $EDITOR on it and encrypts the result back over the
+// original, atomically. The temporary copy is overwritten and removed
+// afterwards, also when the editor fails.
+//
+// The new version goes to the same recipients with the same padding and
+// --sensitive mark. Only their public keys can encrypt and the file does
+// not hold those, so they come from --recipient, --key-backend or the
+// defaults as with -e; edit checks they match the file's stanzas, and
+// refuses a silent change of recipients unless --recipient is given.
+// A passphrase stanza matches any passphrase recipient, as its salt is
+// new every time.
+
+func runEdit(args []string) {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	fs.Var(&recipientFlags, "recipient", "Recipient to encrypt the edited file to (repeatable, default those it has)")
+	fs.Var(&identityFlags, "i", "Identity file used for decryption (repeatable)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	addKeyBackendFlags(fs)
+	fs.StringVar(aadFlag, "aad", *aadFlag, "Associated data the file was encrypted with")
+	fs.StringVar(reasonFlag, "reason", *reasonFlag, "Why a sensitive file is edited, for the audit log")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(exitUsage, "Usage: edit [--recipient KEY...] [--key-backend NAME] [-i KEY...] [--aad DATA] [--reason TEXT] FILE")
+		return
+	}
+	if err := loadAAD(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	path := fs.Arg(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	if !encutil.IsEncutitl(data) {
+		failf(exitUsage, tr("Error: %s is not an encutitl file"), path)
+		return
+	}
+	hdr, _, err := encutil.ParseHeader(data)
+	if err != nil {
+		fail(exitAuth, tr("Decode input error:"), err)
+		return
+	}
+	if err := checkReason(path, data); err != nil {
+		fail(exitUsage, tr("Error:"), fmt.Errorf("%s: %w", path, err))
+		return
+	}
+	recipients, err := encryptRecipients()
+	if err == nil && len(recipientFlags) == 0 {
+		err = checkSameRecipients(hdr, recipients)
+	}
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	identities, key, err := decryptIdentities(data)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	var plain bytes.Buffer
+	var canary *encutil.Canary
+	keep := func(c *encutil.Canary) { raiseCanary(c); canary = c }
+	if _, _, err := decryptCanary(&plain, data, key, identities, keep); err != nil {
+		fail(exitAuth, tr("Decryption error:"), err)
+		return
+	}
+
+	edited, err := editTemp(filepath.Base(strings.TrimSuffix(path, ".bin")), plain.Bytes())
+	if err != nil {
+		fail(exitIO, tr("Edit error:"), err)
+		return
+	}
+	if bytes.Equal(edited, plain.Bytes()) {
+		fmt.Printf(tr("No changes, left %s as it was")+"\n", path)
+		return
+	}
+	compression, err := payloadCompression(edited)
+	if err != nil {
+		fail(exitError, tr("Encryption error:"), err)
+		return
+	}
+	out, err := encutil.EncryptWith(edited, encutil.EncryptOptions{Compression: compression, AAD: aadData, Padding: hdr.Padding, Sensitive: hdr.Sensitive, Canary: canary}, recipients...)
+	if err != nil {
+		fail(exitError, tr("Encryption error:"), err)
+		return
+	}
+	if err := replaceFile(path, out); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Println(tr("Saved"), path)
+}
+
+// editTemp writes content to a private temporary file named name, runs
+// the editor on it and returns what it saved.
+func editTemp(name string, content []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp(secureTempDir(), "encutitl-edit-")
+	if err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(dir, name)
+	defer func() {
+		wipeFile(tmp)
+		os.RemoveAll(dir)
+	}()
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+	argv := append(strings.Fields(editor), tmp)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// Ctrl-C belongs to the editor; we must live to clean up.
+	signal.Ignore(os.Interrupt)
+	defer signal.Reset(os.Interrupt)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w (file left unchanged)", argv[0], err)
+	}
+	return os.ReadFile(tmp)
+}
+
+// secureTempDir prefers a RAM-backed directory.
+func secureTempDir() string {
+	for _, dir := range []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"} {
+		if st, err := os.Stat(dir); dir != "" && err == nil && st.IsDir() {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+// wipeFile overwrites a file with zeros before it is removed, which
+// matters where the temporary directory is on disk. Editors that save by
+// renaming leave their own copies, which the directory removal takes.
+func wipeFile(path string) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if f, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+		f.Write(make([]byte, st.Size()))
+		f.Sync()
+		f.Close()
+	}
+}
+
+// checkSameRecipients compares the stanzas recipients would write with
+// the ones in hdr, by type and key tag.
+func checkSameRecipients(hdr *encutil.Header, recipients []encutil.Recipient) error {
+	if hdr == nil {
+		return nil // legacy format, key.bin only
+	}
+	probe := make([]byte, 32)
+	rand.Read(probe)
+	want := map[string]int{}
+	for _, s := range hdr.Recipients {
+		want[stanzaID(s)]++
+	}
+	for _, r := range recipients {
+		s, err := r.Wrap(probe)
+		if err != nil {
+			return err
+		}
+		want[stanzaID(s)]--
+	}
+	for _, n := range want {
+		if n != 0 {
+			return errors.New("the file has other recipients than the defaults, give them with --recipient")
+		}
+	}
+	return nil
+}
+
+func stanzaID(s *encutil.Stanza) string {
+	if len(s.Args) == 0 || s.Type == encutil.PassphraseStanza {
+		return s.Type
+	}
+	return s.Type + " " + s.Args[0]
+}
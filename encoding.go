@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/ascii85"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// Encrypted output printed with --to-stdout is base64url unless
+// --encoding picks another form: standard base64, base32 (unpadded
+// lowercase, fit for DNS labels), base85 (Ascii85) or hex. Decryption
+// works out which one it is given, so the flag does not have to be
+// remembered; --encoding only settles input that several decode.
+
+var encodingFlag = flag.String("encoding", "", "Text encoding of --to-stdout output and -s input: base64url (default), base64, base32, base85 or hex")
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// outputEncoding is --encoding, with --output-as-hex as the older way to
+// ask for hex.
+func outputEncoding() string {
+	switch {
+	case *encodingFlag != "":
+		return *encodingFlag
+	case *outputAsHex:
+		return "hex"
+	}
+	return "base64url"
+}
+
+func checkEncoding() error {
+	switch *encodingFlag {
+	case "", "base64url", "base64", "base32", "base85", "hex":
+		return nil
+	}
+	return fmt.Errorf("unknown --encoding %q, want base64url, base64, base32, base85 or hex", *encodingFlag)
+}
+
+func encodeText(enc string, data []byte) string {
+	switch enc {
+	case "base64":
+		return base64.StdEncoding.EncodeToString(data)
+	case "base32":
+		return base32Lower.EncodeToString(data)
+	case "base85":
+		out := make([]byte, ascii85.MaxEncodedLen(len(data)))
+		return string(out[:ascii85.Encode(out, data)])
+	case "hex":
+		return hex.EncodeToString(data)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeText decodes s as enc, ignoring whitespace. Both base64
+// alphabets are accepted, with or without padding.
+func decodeText(enc, s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	switch enc {
+	case "base64", "base64url":
+		s = strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(s, "="))
+		return base64.RawURLEncoding.DecodeString(s)
+	case "base32":
+		return base32Lower.DecodeString(strings.ToLower(strings.TrimRight(s, "=")))
+	case "base85":
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "<~"), "~>")
+		out := make([]byte, 4*len(s))
+		n, _, err := ascii85.Decode(out, []byte(s), true)
+		return out[:n], err
+	case "hex":
+		return hex.DecodeString(s)
+	}
+	return nil, fmt.Errorf("unknown encoding %q", enc)
+}
+
+// decodeInput decodes an encrypted file in any of the text encodings.
+// The first reading that gives a recognizable header wins; failing that
+// (legacy files have none), a string of hex digits is taken as hex, since
+// other encodings almost never use only those characters, then base64,
+// base32 and base85 are tried in that order.
+func decodeInput(s string) ([]byte, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, errors.New("empty input")
+	}
+	order := []string{"hex", "base64", "base32", "base85"}
+	if enc := outputEncoding(); *encodingFlag != "" || *outputAsHex {
+		order = append([]string{enc}, order...)
+	}
+	var first []byte
+	found := false
+	for _, enc := range order {
+		data, err := decodeText(enc, s)
+		if err != nil {
+			continue
+		}
+		if recognized(data) {
+			return data, nil
+		}
+		if !found {
+			first, found = data, true
+		}
+	}
+	if !found {
+		return nil, errors.New("input is not base64, base32, base85 or hex")
+	}
+	return first, nil
+}
+
+// recognized reports whether data starts like a file encutitl writes.
+func recognized(data []byte) bool {
+	return encutil.IsEncutitl(data) || isAge(data)
+}
+
+// isEncodedText reports whether a file holds encrypted output in text
+// form rather than the binary file itself.
+func isEncodedText(data []byte) bool {
+	if recognized(data) || len(bytes.TrimSpace(data)) == 0 {
+		return false
+	}
+	// Printable ASCII covers base85; binary files are never all of it.
+	for _, c := range data {
+		if (c < '!' || c > '~') && !strings.ContainsRune("\r\n\t ", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package encutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+)
+
+// The header bytes in a file are whatever JSON the writing version
+// produced: field order follows the Go struct and string escaping follows
+// encoding/json, both of which may change. Anything that signs, caches
+// or compares headers uses CanonicalBytes instead, which is fixed:
+//
+//	"encutitl-header-v1\n" JSON
+//
+// where JSON has the header's fields as in the file, fields at their
+// zero value left out, object keys sorted bytewise, no whitespace,
+// integers in decimal, byte strings in padded standard base64, and
+// strings with only '"', '\\' and control characters escaped, the
+// latter as \b \t \n \f \r or \u00XX with lower-case hex. Recipients keep
+// their order, which decryption follows.
+
+const canonicalPrefix = "encutitl-header-v1\n"
+
+// CanonicalBytes returns the canonical serialization of h. Two headers
+// with the same contents have the same canonical bytes whichever version
+// or platform wrote them.
+func (h *Header) CanonicalBytes() ([]byte, error) {
+	raw, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	out := []byte(canonicalPrefix)
+	return appendCanonical(out, v)
+}
+
+// CanonicalID is a hex SHA-256 of the canonical bytes, for use as a
+// cache or dedup key.
+func (h *Header) CanonicalID() (string, error) {
+	b, err := h.CanonicalBytes()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func appendCanonical(out []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(out, "null"...), nil
+	case bool:
+		return strconv.AppendBool(out, v), nil
+	case json.Number:
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("header number %s is not an integer", v)
+		}
+		return strconv.AppendInt(out, n, 10), nil
+	case string:
+		return appendCanonicalString(out, v), nil
+	case []any:
+		out = append(out, '[')
+		for i, e := range v {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			var err error
+			if out, err = appendCanonical(out, e); err != nil {
+				return nil, err
+			}
+		}
+		return append(out, ']'), nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k, e := range v {
+			if !isZero(e) {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		out = append(out, '{')
+		for i, k := range keys {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			out = appendCanonicalString(out, k)
+			out = append(out, ':')
+			var err error
+			if out, err = appendCanonical(out, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return append(out, '}'), nil
+	}
+	return nil, fmt.Errorf("unexpected %T in header", v)
+}
+
+func isZero(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case json.Number:
+		return v == "0"
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+func appendCanonicalString(out []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	out = append(out, '"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"' || r == '\\':
+			out = append(out, '\\', byte(r))
+		case r == '\b':
+			out = append(out, `\b`...)
+		case r == '\t':
+			out = append(out, `\t`...)
+		case r == '\n':
+			out = append(out, `\n`...)
+		case r == '\f':
+			out = append(out, `\f`...)
+		case r == '\r':
+			out = append(out, `\r`...)
+		case r < 0x20:
+			out = append(out, '\\', 'u', '0', '0', hex[r>>4], hex[r&0xf])
+		default:
+			out = append(out, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(out, '"')
+}
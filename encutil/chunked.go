@@ -0,0 +1,719 @@
+package encutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Chunked files, those with a chunk_size in the header, seal the payload
+// in pieces of that many bytes so that it can be written and read as a
+// stream instead of being held in memory whole. Every chunk is sealed on
+// its own under the payload key, with the header as associated data and
+// the nonce
+//
+//	7 byte random prefix || 4 byte chunk number || 1 byte last-chunk flag
+//
+// after the STREAM construction, so chunks cannot be reordered or dropped
+// and the file cannot be cut short at a chunk boundary without decryption
+// failing. The nonce prefix is stored once, after the header. Chunked
+// payloads are neither compressed nor padded, but can carry parity to
+// repair damage, see fec.go.
+
+const (
+	// MinChunkSize and MaxChunkSize bound Header.ChunkSize.
+	MinChunkSize = 4 << 10
+	MaxChunkSize = 64 << 20
+
+	noncePrefixSize = 7
+	gcmTagSize      = 16
+)
+
+// ChunkState is what it takes to carry on writing a chunked file after
+// the chunks sealed so far. It holds the file key, so it has to be kept
+// as secret as the plaintext.
+type ChunkState struct {
+	FileKey     []byte
+	Header      []byte // the raw header, magic included
+	NoncePrefix []byte
+	AAD         []byte
+	ChunkSize   int
+	FEC         string
+	Chunks      uint32 // full chunks sealed and written
+}
+
+// StoredChunkSize is the size of a full chunk in the file.
+func (st *ChunkState) StoredChunkSize() int {
+	fec, _ := parseFEC(st.FEC)
+	return fec.stored(st.ChunkSize + gcmTagSize)
+}
+
+// Offset is the size of the file up to the end of the sealed chunks.
+func (st *ChunkState) Offset() int64 {
+	return int64(len(st.Header)+noncePrefixSize) + int64(st.Chunks)*int64(st.StoredChunkSize())
+}
+
+// OpenChunk decrypts chunk i of the file from its StoredChunkSize bytes.
+// It has to be one of the full chunks before the last; this is for
+// checking what an interrupted run wrote.
+func (st *ChunkState) OpenChunk(i uint32, stored []byte) ([]byte, error) {
+	aead, err := payloadAEAD(st.FileKey)
+	if err != nil {
+		return nil, err
+	}
+	fec, err := parseFEC(st.FEC)
+	if err != nil {
+		return nil, err
+	}
+	return openChunk(aead, fec, chunkNonce(st.NoncePrefix, i, false), stored, st.ChunkSize+gcmTagSize, associatedData(st.Header, st.AAD), nil)
+}
+
+// ChunkWriter encrypts a stream into a chunked file. Nothing is written
+// for the last chunk until Close.
+type ChunkWriter struct {
+	w    io.Writer
+	st   ChunkState
+	aead cipher.AEAD
+	fec  *fecCode
+	ad   []byte
+	buf  []byte
+	err  error
+}
+
+// NewChunkWriter writes the header of a chunked file to w and returns a
+// writer for its plaintext. opts.Compression may only be none, and
+// padding and convergent encryption are not supported.
+func NewChunkWriter(w io.Writer, chunkSize int, opts EncryptOptions, recipients ...Recipient) (*ChunkWriter, error) {
+	switch {
+	case len(recipients) == 0:
+		return nil, errors.New("no recipients")
+	case chunkSize < MinChunkSize || chunkSize > MaxChunkSize:
+		return nil, fmt.Errorf("chunk size %d is outside %d to %d", chunkSize, MinChunkSize, MaxChunkSize)
+	case opts.Compression != "" && opts.Compression != CompressionNone:
+		return nil, errors.New("chunked files are not compressed")
+	case opts.Padding != "" || opts.Convergent != nil:
+		return nil, errors.New("chunked files cannot be padded or convergent")
+	}
+	if _, err := parseFEC(opts.FEC); err != nil {
+		return nil, err
+	}
+	fileKey := make([]byte, FileKeySize)
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+	stanzas, err := wrapAll(fileKey, recipients, false)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealMeta(fileKey, sealedMeta{Canary: opts.Canary})
+	if err != nil {
+		return nil, err
+	}
+	hdr := &Header{Cipher: "aes-256-gcm", Compression: CompressionNone, AAD: opts.AAD != nil, ChunkSize: chunkSize, FEC: opts.FEC, Sensitive: opts.Sensitive, Sealed: sealed, Recipients: stanzas}
+	prefix, err := marshalHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(prefix[:len(prefix):len(prefix)], noncePrefix...)); err != nil {
+		return nil, err
+	}
+	return ResumeChunkWriter(w, ChunkState{FileKey: fileKey, Header: prefix, NoncePrefix: noncePrefix, AAD: opts.AAD, ChunkSize: chunkSize, FEC: opts.FEC})
+}
+
+// ResumeChunkWriter carries on a file from st, with w positioned at
+// st.Offset.
+func ResumeChunkWriter(w io.Writer, st ChunkState) (*ChunkWriter, error) {
+	hdr, _, err := ParseHeader(st.Header)
+	if err != nil {
+		return nil, err
+	}
+	if hdr == nil || hdr.ChunkSize != st.ChunkSize || hdr.FEC != st.FEC || hdr.AAD != (st.AAD != nil) || len(st.NoncePrefix) != noncePrefixSize {
+		return nil, errors.New("chunk state does not match its header")
+	}
+	aead, err := payloadAEAD(st.FileKey)
+	if err != nil {
+		return nil, err
+	}
+	fec, err := parseFEC(st.FEC)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkWriter{w: w, st: st, aead: aead, fec: fec, ad: associatedData(st.Header, st.AAD), buf: make([]byte, 0, st.ChunkSize)}, nil
+}
+
+// RewriteChunkState unwraps the key of the chunked file of size bytes in
+// r and returns what it takes to write a new version of it: the same
+// header and file key, so its recipients stay as they are, under a fresh
+// nonce prefix, as no chunk may be sealed twice under one nonce. Write
+// Header and NoncePrefix, then the plaintext through ResumeChunkWriter;
+// Rewrite gives the state for the version after that.
+func RewriteChunkState(r io.ReaderAt, size int64, opts DecryptOptions, identities ...Identity) (ChunkState, error) {
+	prefix, hdr, err := readChunkedHeader(r, size)
+	if err != nil {
+		return ChunkState{}, err
+	}
+	if err := checkOpen(hdr, opts); err != nil {
+		return ChunkState{}, err
+	}
+	fileKey, _, err := unwrapFileKey(hdr, identities)
+	if err != nil {
+		return ChunkState{}, err
+	}
+	st := ChunkState{FileKey: fileKey, Header: prefix, ChunkSize: hdr.ChunkSize, FEC: hdr.FEC}
+	if hdr.AAD {
+		st.AAD = opts.AAD
+	}
+	return st.Rewrite()
+}
+
+// Rewrite returns st for a new version of its file, with a fresh nonce
+// prefix and no chunks written.
+func (st *ChunkState) Rewrite() (ChunkState, error) {
+	next := *st
+	next.NoncePrefix = make([]byte, noncePrefixSize)
+	next.Chunks = 0
+	if _, err := rand.Read(next.NoncePrefix); err != nil {
+		return ChunkState{}, err
+	}
+	return next, nil
+}
+
+// State returns the state after the chunks written so far. Plaintext
+// still buffered for the next chunk is not part of it.
+func (cw *ChunkWriter) State() ChunkState {
+	return cw.st
+}
+
+func (cw *ChunkWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data shows it was not
+		// the last chunk.
+		if len(cw.buf) == cw.st.ChunkSize {
+			if err := cw.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(cw.buf[len(cw.buf):cw.st.ChunkSize], p)
+		cw.buf = cw.buf[:len(cw.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close seals and writes the last chunk. It does not close the
+// underlying writer.
+func (cw *ChunkWriter) Close() error {
+	if cw.err != nil {
+		return cw.err
+	}
+	if err := cw.seal(true); err != nil {
+		return err
+	}
+	cw.err = errors.New("write to closed ChunkWriter")
+	return nil
+}
+
+func (cw *ChunkWriter) seal(last bool) error {
+	if cw.st.Chunks == 1<<32-1 {
+		cw.err = errors.New("too many chunks for the chunk size")
+		return cw.err
+	}
+	nonce := chunkNonce(cw.st.NoncePrefix, cw.st.Chunks, last)
+	sealed := cw.aead.Seal(nil, nonce, cw.buf, cw.ad)
+	if cw.fec != nil {
+		parity, err := cw.fec.encode(sealed)
+		if err != nil {
+			cw.err = err
+			return err
+		}
+		sealed = append(sealed, parity...)
+	}
+	if _, err := cw.w.Write(sealed); err != nil {
+		cw.err = err
+		return err
+	}
+	cw.buf = cw.buf[:0]
+	if !last {
+		cw.st.Chunks++
+	}
+	return nil
+}
+
+func chunkNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := binary.BigEndian.AppendUint32(append(make([]byte, 0, gcmNonceSize), prefix...), i)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// DecryptStream is DecryptWith reading the file from r. Chunked files are
+// decrypted a chunk at a time, and a chunk's plaintext is written as soon
+// as it is authenticated, so on an error w may have been sent the part of
+// the file before the bad chunk; write to a temporary file and discard it
+// on error. Other files are read whole first.
+func DecryptStream(w io.Writer, r io.Reader, opts DecryptOptions, identities ...Identity) (int64, *Stanza, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	start, err := br.Peek(len(Magic) + 5)
+	if err != nil || !IsEncutitl(start) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return 0, nil, err
+		}
+		return DecryptWith(w, data, opts, identities...)
+	}
+	n := binary.BigEndian.Uint32(start[len(Magic)+1:])
+	if n > maxHeader {
+		return 0, nil, fmt.Errorf("%w: header claims %d bytes", ErrMalformed, n)
+	}
+	prefix := make([]byte, len(Magic)+5+int(n))
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return 0, nil, fmt.Errorf("%w: truncated header", ErrMalformed)
+	}
+	hdr, _, err := ParseHeader(prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	if hdr.ChunkSize == 0 {
+		rest, err := io.ReadAll(br)
+		if err != nil {
+			return 0, nil, err
+		}
+		return DecryptWith(w, append(prefix, rest...), opts, identities...)
+	}
+	if err := checkOpen(hdr, opts); err != nil {
+		return 0, nil, err
+	}
+	fileKey, stanza, err := unwrapFileKey(hdr, identities)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer clear(fileKey)
+	written, err := openChunks(w, br, fileKey, prefix, hdr, opts)
+	if err == nil {
+		err = opened(fileKey, hdr, opts)
+	}
+	return written, stanza, err
+}
+
+// openChunks decrypts the chunked payload in r to w.
+func openChunks(w io.Writer, r *bufio.Reader, fileKey, prefix []byte, hdr *Header, opts DecryptOptions) (int64, error) {
+	aead, err := payloadAEAD(fileKey)
+	if err != nil {
+		return 0, err
+	}
+	fec, err := parseFEC(hdr.FEC)
+	if err != nil {
+		return 0, err
+	}
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, noncePrefix); err != nil {
+		return 0, fmt.Errorf("%w: payload too short", ErrMalformed)
+	}
+	ad := associatedData(prefix, opts.AAD)
+	full := hdr.ChunkSize + gcmTagSize
+	stored := make([]byte, fec.stored(full))
+	var written int64
+	for i := uint32(0); ; i++ {
+		k, err := io.ReadFull(r, stored)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return written, err
+		}
+		last := k < len(stored)
+		if !last {
+			_, perr := r.Peek(1)
+			last = perr == io.EOF
+		}
+		sealed := full
+		if last {
+			var ok bool
+			if sealed, ok = fec.sealedSize(k); !ok || sealed < gcmTagSize {
+				return written, fmt.Errorf("%w: truncated chunk", ErrMalformed)
+			}
+		}
+		var repaired func(int)
+		if opts.OnRepair != nil {
+			repaired = func(damaged int) { opts.OnRepair(i, damaged) }
+		}
+		plain, err := openChunk(aead, fec, chunkNonce(noncePrefix, i, last), stored[:k], sealed, ad, repaired)
+		if err != nil {
+			if opts.AAD != nil && !errors.Is(err, ErrTooDamaged) {
+				err = fmt.Errorf("%w (or the associated data does not match)", err)
+			}
+			return written, err
+		}
+		if opts.MaxSize > 0 && written+int64(len(plain)) > opts.MaxSize {
+			return written, ErrOutputTooLarge
+		}
+		n, err := w.Write(plain)
+		written += int64(n)
+		if err != nil || last {
+			return written, err
+		}
+		if i == 1<<32-1 {
+			return written, fmt.Errorf("%w: too many chunks", ErrMalformed)
+		}
+	}
+}
+
+// openChunk authenticates and decrypts one stored chunk whose first
+// sealedLen bytes are the ciphertext, repairing it from its parity if it
+// has some and needs it.
+func openChunk(aead cipher.AEAD, fec *fecCode, nonce, stored []byte, sealedLen int, ad []byte, repaired func(damaged int)) ([]byte, error) {
+	plain, err := aead.Open(nil, nonce, stored[:sealedLen], ad)
+	if err == nil || fec == nil {
+		return plain, err
+	}
+	sealed, damaged, ferr := fec.repair(stored, sealedLen)
+	if ferr != nil {
+		return nil, fmt.Errorf("%w: %d of %d shards", ferr, damaged, fec.data+fec.parity)
+	}
+	if sealed == nil {
+		return nil, err
+	}
+	if plain, err = aead.Open(nil, nonce, sealed, ad); err == nil && repaired != nil {
+		repaired(damaged)
+	}
+	return plain, err
+}
+
+// openChunksBuffered is openChunks for a payload in memory.
+func openChunksBuffered(payload, fileKey, prefix []byte, hdr *Header, opts DecryptOptions) ([]byte, error) {
+	var out bytes.Buffer
+	_, err := openChunks(&out, bufio.NewReader(bytes.NewReader(payload)), fileKey, prefix, hdr, DecryptOptions{AAD: opts.AAD, OnRepair: opts.OnRepair})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// ChunkedSize returns the number of chunks and the plaintext size of a
+// chunked file whose payload, after the header, is n bytes.
+func ChunkedSize(hdr *Header, n int64) (chunks, size int64, err error) {
+	fec, err := parseFEC(hdr.FEC)
+	if err != nil {
+		return 0, 0, err
+	}
+	n -= noncePrefixSize
+	stride := int64(fec.stored(hdr.ChunkSize + gcmTagSize))
+	if n <= 0 {
+		return 0, 0, fmt.Errorf("%w: payload too short", ErrMalformed)
+	}
+	chunks = (n + stride - 1) / stride
+	last, ok := fec.sealedSize(int(n - (chunks-1)*stride))
+	if !ok || last < gcmTagSize {
+		return 0, 0, fmt.Errorf("%w: truncated chunk", ErrMalformed)
+	}
+	return chunks, (chunks-1)*int64(hdr.ChunkSize) + int64(last-gcmTagSize), nil
+}
+
+// ChunkReader reads the plaintext of a chunked file at any offset,
+// decrypting only the chunks a read covers, for callers that need random
+// access such as mount. It keeps the last chunk it decrypted, and is safe
+// for concurrent use.
+//
+// Once two chunks in a row have been read in order, the next ones are
+// read and decrypted in the background, so a sequential reader finds them
+// ready rather than waiting for the disk and the cipher in turn. Reading
+// anywhere else drops them. SetReadAhead sets how many; OnRepair may then
+// be called from several goroutines.
+type ChunkReader struct {
+	r         io.ReaderAt
+	aead      cipher.AEAD
+	fec       *fecCode
+	prefix    []byte // nonce prefix
+	ad        []byte
+	stanza    *Stanza
+	onRepair  func(chunk uint32, damaged int)
+	canary    *Canary // until the first chunk authenticates
+	onCanary  func(*Canary)
+	start     int64 // file offset of chunk 0
+	end       int64 // file size
+	stride    int64
+	chunkSize int
+	chunks    int64
+	size      int64
+
+	mu        sync.Mutex
+	cached    int64 // chunk number of plain, -1 for none
+	plain     []byte
+	inOrder   int // chunks read in order up to cached
+	readAhead int
+	ahead     map[int64]*prefetch
+}
+
+// prefetch is a chunk being decrypted ahead of a sequential reader.
+type prefetch struct {
+	done  chan struct{}
+	plain []byte
+	err   error
+}
+
+// DefaultReadAhead is how many chunks a ChunkReader prefetches unless
+// SetReadAhead says otherwise.
+var DefaultReadAhead = min(runtime.NumCPU(), 4)
+
+// NewChunkReader reads the header of the chunked file of size bytes in r
+// and unwraps its key. opts.MaxSize is not used, and opts.OnCanary is
+// called once the first chunk read has authenticated.
+func NewChunkReader(r io.ReaderAt, size int64, opts DecryptOptions, identities ...Identity) (*ChunkReader, error) {
+	prefix, hdr, err := readChunkedHeader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOpen(hdr, opts); err != nil {
+		return nil, err
+	}
+	if _, _, err := ChunkedSize(hdr, size-int64(len(prefix))); err != nil {
+		return nil, err
+	}
+	fileKey, stanza, err := unwrapFileKey(hdr, identities)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(fileKey)
+	cr, err := newChunkReader(r, size, prefix, hdr, fileKey, opts.AAD, opts.OnRepair)
+	if err != nil {
+		return nil, err
+	}
+	cr.stanza = stanza
+	if opts.OnCanary != nil {
+		m, err := openMeta(fileKey, hdr)
+		if err != nil {
+			return nil, err
+		}
+		cr.canary, cr.onCanary = m.Canary, opts.OnCanary
+	}
+	return cr, nil
+}
+
+// ReopenChunkReader reads a chunked file written from st, such as a new
+// version written after RewriteChunkState, without unwrapping its key
+// again. Only opts.OnRepair is used; the associated data is st's.
+func ReopenChunkReader(r io.ReaderAt, size int64, st ChunkState, opts DecryptOptions) (*ChunkReader, error) {
+	prefix, hdr, err := readChunkedHeader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix, st.Header) {
+		return nil, errors.New("chunk state does not match the file's header")
+	}
+	return newChunkReader(r, size, prefix, hdr, st.FileKey, st.AAD, opts.OnRepair)
+}
+
+// readChunkedHeader reads and parses the raw header at the start of the
+// chunked file of size bytes in r.
+func readChunkedHeader(r io.ReaderAt, size int64) ([]byte, *Header, error) {
+	start := make([]byte, len(Magic)+5)
+	if _, err := r.ReadAt(start, 0); err != nil || !IsEncutitl(start) {
+		return nil, nil, fmt.Errorf("%w: not an encutitl file", ErrMalformed)
+	}
+	n := binary.BigEndian.Uint32(start[len(Magic)+1:])
+	if n > maxHeader || int64(len(start))+int64(n) > size {
+		return nil, nil, fmt.Errorf("%w: truncated header", ErrMalformed)
+	}
+	prefix := make([]byte, len(start)+int(n))
+	if _, err := r.ReadAt(prefix, 0); err != nil {
+		return nil, nil, err
+	}
+	hdr, _, err := ParseHeader(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.ChunkSize == 0 {
+		return nil, nil, errors.New("not a chunked file")
+	}
+	return prefix, hdr, nil
+}
+
+func newChunkReader(r io.ReaderAt, size int64, prefix []byte, hdr *Header, fileKey, aad []byte, onRepair func(uint32, int)) (*ChunkReader, error) {
+	chunks, plainSize, err := ChunkedSize(hdr, size-int64(len(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := payloadAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	fec, err := parseFEC(hdr.FEC)
+	if err != nil {
+		return nil, err
+	}
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := r.ReadAt(noncePrefix, int64(len(prefix))); err != nil {
+		return nil, err
+	}
+	return &ChunkReader{
+		r:         r,
+		aead:      aead,
+		fec:       fec,
+		prefix:    noncePrefix,
+		ad:        associatedData(prefix, aad),
+		onRepair:  onRepair,
+		start:     int64(len(prefix) + noncePrefixSize),
+		end:       size,
+		stride:    int64(fec.stored(hdr.ChunkSize + gcmTagSize)),
+		chunkSize: hdr.ChunkSize,
+		chunks:    chunks,
+		size:      plainSize,
+		cached:    -1,
+		readAhead: DefaultReadAhead,
+		ahead:     map[int64]*prefetch{},
+	}, nil
+}
+
+// SetReadAhead sets how many chunks are decrypted ahead of sequential
+// reads, 0 to turn it off.
+func (cr *ChunkReader) SetReadAhead(chunks int) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.readAhead = max(chunks, 0)
+}
+
+// Size is the size of the plaintext.
+func (cr *ChunkReader) Size() int64 { return cr.size }
+
+// Stanza is the recipient stanza that unwrapped the key.
+func (cr *ChunkReader) Stanza() *Stanza { return cr.stanza }
+
+// ReadAt reads plaintext at off, authenticating every chunk it covers.
+func (cr *ChunkReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	n := 0
+	for n < len(p) && off < cr.size {
+		i := off / int64(cr.chunkSize)
+		if err := cr.load(i); err != nil {
+			return n, err
+		}
+		k := copy(p[n:], cr.plain[off-i*int64(cr.chunkSize):])
+		n += k
+		off += int64(k)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// load decrypts chunk i into cr.plain, or takes it from the chunks read
+// ahead.
+func (cr *ChunkReader) load(i int64) error {
+	if cr.cached == i {
+		return nil
+	}
+	if i == cr.cached+1 {
+		cr.inOrder++
+	} else {
+		cr.inOrder = 0
+		cr.dropAhead()
+	}
+	var plain []byte
+	var err error
+	if p, ok := cr.ahead[i]; ok {
+		delete(cr.ahead, i)
+		<-p.done
+		plain, err = p.plain, p.err
+	} else {
+		plain, err = cr.decrypt(i)
+	}
+	if err != nil {
+		cr.inOrder = 0
+		return err
+	}
+	clear(cr.plain)
+	cr.cached, cr.plain = i, plain
+	if cr.canary != nil {
+		cr.onCanary(cr.canary)
+		cr.canary = nil
+	}
+	if cr.inOrder > 0 {
+		for next := i + 1; next <= i+int64(cr.readAhead) && next < cr.chunks; next++ {
+			if _, ok := cr.ahead[next]; !ok {
+				cr.ahead[next] = cr.prefetch(next)
+			}
+		}
+	}
+	return nil
+}
+
+func (cr *ChunkReader) prefetch(i int64) *prefetch {
+	p := &prefetch{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.plain, p.err = cr.decrypt(i)
+	}()
+	return p
+}
+
+// dropAhead forgets the chunks read ahead, clearing each once its worker
+// is done with it.
+func (cr *ChunkReader) dropAhead() {
+	for i, p := range cr.ahead {
+		delete(cr.ahead, i)
+		go func() {
+			<-p.done
+			clear(p.plain)
+		}()
+	}
+}
+
+// decrypt reads and decrypts chunk i. It does not touch cr's mutable
+// state, so prefetch workers run it without the lock.
+func (cr *ChunkReader) decrypt(i int64) ([]byte, error) {
+	last := i == cr.chunks-1
+	off := cr.start + i*cr.stride
+	stored := make([]byte, min(cr.stride, cr.end-off))
+	if _, err := cr.r.ReadAt(stored, off); err != nil {
+		return nil, err
+	}
+	sealed := cr.chunkSize + gcmTagSize
+	if last {
+		var ok bool
+		if sealed, ok = cr.fec.sealedSize(len(stored)); !ok || sealed < gcmTagSize {
+			return nil, fmt.Errorf("%w: truncated chunk", ErrMalformed)
+		}
+	}
+	var repaired func(int)
+	if cr.onRepair != nil {
+		repaired = func(damaged int) { cr.onRepair(uint32(i), damaged) }
+	}
+	plain, err := openChunk(cr.aead, cr.fec, chunkNonce(cr.prefix, uint32(i), last), stored, sealed, cr.ad, repaired)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %w", i, err)
+	}
+	return plain, nil
+}
+
+// Close forgets the cached plaintext, also what was read ahead.
+func (cr *ChunkReader) Close() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.dropAhead()
+	cr.inOrder = 0
+	clear(cr.plain)
+	cr.cached, cr.plain = -1, nil
+	return nil
+}
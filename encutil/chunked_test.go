@@ -0,0 +1,210 @@
+package encutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealChunked encrypts plain as a chunked file of MinChunkSize chunks.
+func sealChunked(t *testing.T, plain []byte, opts EncryptOptions, k *KeyRecipient) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	cw, err := NewChunkWriter(&buf, MinChunkSize, opts, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	k := testKey(t, 1)
+	fec, err := FECPercent(25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 1, MinChunkSize - 1, MinChunkSize, 3*MinChunkSize + 17} {
+		for _, opts := range []EncryptOptions{{}, {AAD: []byte("a")}, {FEC: fec}} {
+			plain := make([]byte, n)
+			rand.Read(plain)
+			sealed := sealChunked(t, plain, opts, k)
+
+			var out bytes.Buffer
+			if _, _, err := DecryptStream(&out, bytes.NewReader(sealed), DecryptOptions{AAD: opts.AAD}, k); err != nil {
+				t.Fatalf("%d bytes, fec %q: %v", n, opts.FEC, err)
+			}
+			if !bytes.Equal(out.Bytes(), plain) {
+				t.Fatalf("%d bytes, fec %q: plaintext differs after a round trip", n, opts.FEC)
+			}
+
+			cr, err := NewChunkReader(bytes.NewReader(sealed), int64(len(sealed)), DecryptOptions{AAD: opts.AAD}, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cr.Size() != int64(n) {
+				t.Fatalf("ChunkReader.Size() = %d, want %d", cr.Size(), n)
+			}
+			got, err := io.ReadAll(io.NewSectionReader(cr, 0, cr.Size()))
+			cr.Close()
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Fatalf("%d bytes, fec %q: ChunkReader: %v", n, opts.FEC, err)
+			}
+		}
+	}
+}
+
+func TestChunkedTampering(t *testing.T) {
+	k := testKey(t, 1)
+	plain := make([]byte, 3*MinChunkSize)
+	sealed := sealChunked(t, plain, EncryptOptions{}, k)
+	hdr, prefix, err := ParseHeader(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := len(prefix) + noncePrefixSize
+	stored := hdr.ChunkSize + gcmTagSize
+
+	swapped := bytes.Clone(sealed)
+	copy(swapped[start:], sealed[start+stored:start+2*stored])
+	copy(swapped[start+stored:], sealed[start:start+stored])
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"cut at a chunk boundary", sealed[:start+2*stored]},
+		{"cut inside a chunk", sealed[:len(sealed)-1]},
+		{"chunks swapped", swapped},
+		{"byte flipped", func() []byte { b := bytes.Clone(sealed); b[start+stored+5] ^= 1; return b }()},
+		{"extra bytes", append(bytes.Clone(sealed), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := DecryptStream(io.Discard, bytes.NewReader(tt.data), DecryptOptions{}, k); err == nil {
+				t.Fatal("decrypted")
+			}
+		})
+	}
+}
+
+func TestChunkedFECRepair(t *testing.T) {
+	k := testKey(t, 1)
+	fec, err := FECPercent(10) // rs:32+4
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 2*MinChunkSize+100)
+	rand.Read(plain)
+	sealed := sealChunked(t, plain, EncryptOptions{FEC: fec}, k)
+	_, prefix, err := ParseHeader(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := parseFEC(fec)
+	start := len(prefix) + noncePrefixSize
+	shard := code.shardSize(MinChunkSize + gcmTagSize)
+
+	// damage flips a byte in each of the first shards of chunk 1.
+	damage := func(shards int) []byte {
+		b := bytes.Clone(sealed)
+		for i := range shards {
+			b[start+code.stored(MinChunkSize+gcmTagSize)+i*shard] ^= 0xff
+		}
+		return b
+	}
+
+	var repaired []uint32
+	opts := DecryptOptions{OnRepair: func(chunk uint32, damaged int) {
+		repaired = append(repaired, chunk)
+		if damaged != code.parity {
+			t.Errorf("chunk %d: %d damaged shards reported, want %d", chunk, damaged, code.parity)
+		}
+	}}
+	var out bytes.Buffer
+	if _, _, err := DecryptStream(&out, bytes.NewReader(damage(code.parity)), opts, k); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plain) {
+		t.Fatal("repaired plaintext differs")
+	}
+	if len(repaired) != 1 || repaired[0] != 1 {
+		t.Fatalf("repairs reported for chunks %v, want [1]", repaired)
+	}
+
+	_, _, err = DecryptStream(io.Discard, bytes.NewReader(damage(code.parity+1)), DecryptOptions{}, k)
+	if !errors.Is(err, ErrTooDamaged) {
+		t.Fatalf("got %v, want ErrTooDamaged", err)
+	}
+}
+
+func TestFECSizes(t *testing.T) {
+	for _, fec := range []string{"rs:32+1", "rs:32+4", "rs:32+32", "rs:1+1", "rs:200+56"} {
+		code, err := parseFEC(fec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for sealed := 1; sealed < 3000; sealed++ {
+			if got, ok := code.sealedSize(code.stored(sealed)); !ok || got != sealed {
+				t.Fatalf("%s: sealedSize(stored(%d)) = %d, %v", fec, sealed, got, ok)
+			}
+		}
+	}
+}
+
+func TestFECParse(t *testing.T) {
+	for pct, want := range map[int]string{1: "rs:32+1", 10: "rs:32+4", 50: "rs:32+16", 100: "rs:32+32"} {
+		if got, err := FECPercent(pct); err != nil || got != want {
+			t.Errorf("FECPercent(%d) = %q, %v, want %q", pct, got, err, want)
+		}
+	}
+	for _, pct := range []int{-1, 0, 101} {
+		if _, err := FECPercent(pct); err == nil {
+			t.Errorf("FECPercent(%d) accepted", pct)
+		}
+	}
+	for _, bad := range []string{"rs", "rs:", "rs:32", "rs:32+", "rs:+4", "rs:0+4", "rs:32+0", "rs:200+57", "xx:32+4", "rs:32+4x"} {
+		if _, err := parseFEC(bad); err == nil {
+			t.Errorf("parseFEC(%q) accepted", bad)
+		}
+	}
+}
+
+func TestChunkedCanary(t *testing.T) {
+	k := testKey(t, 1)
+	c := &Canary{Token: "t"}
+	sealed := sealChunked(t, make([]byte, 2*MinChunkSize), EncryptOptions{Canary: c}, k)
+	calls := 0
+	opts := DecryptOptions{OnCanary: func(got *Canary) {
+		calls++
+		if *got != *c {
+			t.Errorf("got canary %+v, want %+v", got, c)
+		}
+	}}
+	if _, _, err := DecryptStream(io.Discard, bytes.NewReader(sealed), opts, k); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := NewChunkReader(bytes.NewReader(sealed), int64(len(sealed)), opts, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	if calls != 1 {
+		t.Fatalf("canary reported %d times before reading, want 1", calls)
+	}
+	buf := make([]byte, 10)
+	for _, off := range []int64{0, MinChunkSize, 0} {
+		if _, err := cr.ReadAt(buf, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("canary reported %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,74 @@
+package encutil
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Convergent encryption: with EncryptOptions.Convergent set, the file key
+// is an HMAC of the plaintext (and of every option that changes the
+// output) under that secret, and the nonces derive from it, so the same
+// input encrypts to the same bytes. This is what deduplicating storage
+// needs, and exactly what it costs: anyone who can see the files learns
+// which of them are equal, and anyone holding the secret can confirm a
+// guessed plaintext without decrypting.
+//
+// Each plaintext gets its own file key, so the fixed nonces never repeat
+// under one key.
+
+// DeterministicRecipient is a Recipient that can wrap a file key without
+// randomness. Convergent encryption needs every recipient to be one.
+type DeterministicRecipient interface {
+	Recipient
+	WrapDeterministic(fileKey []byte) (*Stanza, error)
+}
+
+// convergentFileKey derives the file key from everything that goes into
+// the output: the header as it is before the recipients are added, so
+// every option recorded there counts, and the AAD. No two different
+// outputs then share a key and nonce, which under GCM would give away
+// the authentication key.
+func convergentFileKey(secret, plaintext []byte, hdr *Header, aad []byte) ([]byte, error) {
+	prefix, err := marshalHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	for _, field := range [][]byte{prefix, aad, plaintext} {
+		mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(field))))
+		mac.Write(field)
+	}
+	if aad != nil {
+		mac.Write([]byte{1}) // empty AAD is not the same as none
+	}
+	return mac.Sum(nil), nil
+}
+
+func deterministicNonce(key []byte, label string, size int) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, nil, "encutitl nonce "+label, size)
+}
+
+func wrapAll(fileKey []byte, recipients []Recipient, deterministic bool) ([]*Stanza, error) {
+	var stanzas []*Stanza
+	for _, r := range recipients {
+		var s *Stanza
+		var err error
+		if deterministic {
+			dr, ok := r.(DeterministicRecipient)
+			if !ok {
+				return nil, fmt.Errorf("recipient %T cannot be used for convergent encryption", r)
+			}
+			s, err = dr.WrapDeterministic(fileKey)
+		} else {
+			s, err = r.Wrap(fileKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, s)
+	}
+	return stanzas, nil
+}
@@ -0,0 +1,101 @@
+// Package enctest provides test doubles for programs that use encutil:
+// an in-memory keyring, a seeded random source and a fake KMS speaking the
+// Vault transit API, so encryption paths can be tested without key files,
+// network access or flaky randomness.
+//
+// Everything here is for tests only. Keys are derived from their names
+// and are not secret.
+package enctest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"math/rand/v2"
+	"sync"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// NewRand returns a random source that yields the same bytes for the same
+// seed, for tests that need reproducible keys or inputs. encutil itself
+// always draws nonces from crypto/rand; for byte-identical ciphertexts use
+// EncryptOptions.Convergent, see ConvergentOptions.
+func NewRand(seed string) io.Reader {
+	return rand.NewChaCha8(sha256.Sum256([]byte(seed)))
+}
+
+// ConvergentOptions makes EncryptWith output a function of its input only,
+// so expected ciphertexts can be kept as golden files. It only works with
+// KeyRecipients.
+func ConvergentOptions() encutil.EncryptOptions {
+	return encutil.EncryptOptions{Convergent: []byte("enctest convergence")}
+}
+
+// Keyring hands out symmetric and hybrid keys by name, creating them on
+// first use from the name, so two Keyrings agree on every key. It is safe
+// for concurrent use.
+type Keyring struct {
+	mu     sync.Mutex
+	keys   map[string]*encutil.KeyRecipient
+	hybrid map[string]*encutil.HybridIdentity
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string]*encutil.KeyRecipient{}, hybrid: map[string]*encutil.HybridIdentity{}}
+}
+
+// Key returns the raw 32-byte symmetric key called name.
+func (k *Keyring) Key(name string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(NewRand("key "+name), key)
+	return key
+}
+
+// Recipient returns the symmetric key called name, as a Recipient that is
+// also its own Identity.
+func (k *Keyring) Recipient(name string) *encutil.KeyRecipient {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if r, ok := k.keys[name]; ok {
+		return r
+	}
+	r, err := encutil.NewKeyRecipient(k.Key(name))
+	if err != nil {
+		panic(err) // the key is always 32 bytes
+	}
+	k.keys[name] = r
+	return r
+}
+
+// Hybrid returns the hybrid ML-KEM-768 + X25519 key pair called name;
+// encrypt to its Recipient().
+func (k *Keyring) Hybrid(name string) *encutil.HybridIdentity {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id, ok := k.hybrid[name]; ok {
+		return id
+	}
+	raw := make([]byte, 64+32) // ML-KEM seed, X25519 scalar
+	io.ReadFull(NewRand("hybrid "+name), raw)
+	ids, err := encutil.ParseHybridIdentities([]byte("ENCUTITL-PQ-SECRET-1" + base64.RawURLEncoding.EncodeToString(raw)))
+	if err != nil {
+		panic(err)
+	}
+	k.hybrid[name] = ids[0]
+	return ids[0]
+}
+
+// Identities returns every key handed out so far, to pass to Decrypt.
+func (k *Keyring) Identities() []encutil.Identity {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var out []encutil.Identity
+	for _, r := range k.keys {
+		out = append(out, r)
+	}
+	for _, id := range k.hybrid {
+		out = append(out, id)
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+package enctest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// KMS is a fake of the Vault transit engine, the KMS encutitl's
+// --key-backend vault talks to: POST /v1/<mount>/encrypt/<key> and
+// /v1/<mount>/decrypt/<key>, with ciphertexts in Vault's "vault:v1:"
+// form. Keys are created on first use. Point the encutitl CLI at it with
+// VAULT_ADDR=URL and VAULT_TOKEN=Token, or use Recipient in process.
+type KMS struct {
+	URL   string
+	Token string
+
+	mu    sync.Mutex
+	keys  map[string]cipher.AEAD
+	down  bool
+	calls map[string]int
+}
+
+// NewKMS starts a fake KMS that is shut down when the test ends.
+func NewKMS(t testing.TB) *KMS {
+	k := &KMS{Token: "enctest-token", keys: map[string]cipher.AEAD{}, calls: map[string]int{}}
+	srv := httptest.NewServer(k)
+	t.Cleanup(srv.Close)
+	k.URL = srv.URL
+	return k
+}
+
+// SetDown makes every request fail with 503 until called with false, to
+// test how callers handle an unavailable KMS.
+func (k *KMS) SetDown(down bool) {
+	k.mu.Lock()
+	k.down = down
+	k.mu.Unlock()
+}
+
+// Calls returns how many times op ("encrypt" or "decrypt") succeeded.
+func (k *KMS) Calls(op string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.calls[op]
+}
+
+func (k *KMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	switch {
+	case k.down:
+		vaultError(w, http.StatusServiceUnavailable, "Vault is sealed")
+		return
+	case r.Header.Get("X-Vault-Token") != k.Token:
+		vaultError(w, http.StatusForbidden, "permission denied")
+		return
+	case r.Method != http.MethodPost || len(parts) != 3:
+		vaultError(w, http.StatusNotFound, "unsupported path")
+		return
+	}
+	mount, op, name := parts[0], parts[1], parts[2]
+	var req struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		vaultError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	aead := k.key(mount + "/" + name)
+	var data map[string]string
+	switch op {
+	case "encrypt":
+		plain, err := base64.StdEncoding.DecodeString(req.Plaintext)
+		if err != nil {
+			vaultError(w, http.StatusBadRequest, "plaintext is not base64")
+			return
+		}
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+		sealed := aead.Seal(nonce, nonce, plain, nil)
+		data = map[string]string{"ciphertext": "vault:v1:" + base64.StdEncoding.EncodeToString(sealed)}
+	case "decrypt":
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Ciphertext, "vault:v1:"))
+		if err != nil || len(sealed) < aead.NonceSize() {
+			vaultError(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+		if err != nil {
+			vaultError(w, http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		data = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plain)}
+	default:
+		vaultError(w, http.StatusNotFound, "unsupported operation "+op)
+		return
+	}
+	k.calls[op]++
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func (k *KMS) key(name string) cipher.AEAD {
+	if aead, ok := k.keys[name]; ok {
+		return aead
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	k.keys[name] = aead
+	return aead
+}
+
+func vaultError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+}
+
+// Recipient wraps file keys with the KMS key mount/name, writing the same
+// vault-transit stanzas as the encutitl CLI. It is also the Identity
+// that unwraps them.
+func (k *KMS) Recipient(mount, name string) *KMSKey {
+	return &KMSKey{kms: k, mount: mount, name: name}
+}
+
+// KMSKey is a key held by a fake KMS.
+type KMSKey struct {
+	kms   *KMS
+	mount string
+	name  string
+}
+
+const vaultStanza = "vault-transit"
+
+func (r *KMSKey) Wrap(fileKey []byte) (*encutil.Stanza, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := r.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(fileKey)}, &out); err != nil {
+		return nil, err
+	}
+	return &encutil.Stanza{Type: vaultStanza, Args: []string{r.mount, r.name}, Body: []byte(out.Ciphertext)}, nil
+}
+
+func (r *KMSKey) Unwrap(s *encutil.Stanza) ([]byte, error) {
+	if s.Type != vaultStanza || len(s.Args) != 2 || s.Args[0] != r.mount || s.Args[1] != r.name {
+		return nil, encutil.ErrIncorrectIdentity
+	}
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := r.call("decrypt", map[string]string{"ciphertext": string(s.Body)}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+func (r *KMSKey) call(op string, req, out any) error {
+	body, _ := json.Marshal(req)
+	hr, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/%s/%s/%s", r.kms.URL, r.mount, op, r.name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("X-Vault-Token", r.kms.Token)
+	resp, err := http.DefaultClient.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("kms " + op + ": " + strings.Join(reply.Errors, "; "))
+	}
+	return json.Unmarshal(reply.Data, out)
+}
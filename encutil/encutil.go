@@ -0,0 +1,581 @@
+// Package encutil implements the encutitl file format: a small header
+// listing the recipients that can unwrap the file key, followed by the
+// compressed and AES-256-GCM encrypted payload.
+package encutil
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+const (
+	// Magic starts every file written in the current format. Files without
+	// it are treated as the legacy headerless format (nonce || ciphertext
+	// under key.bin directly).
+	Magic         = "encutitl"
+	formatVersion = 1
+
+	FileKeySize  = 32
+	maxHeader    = 1 << 20
+	gcmNonceSize = 12
+	gcmOverhead  = gcmNonceSize + 16 // nonce and tag
+
+	// Bounds on what a header may declare. Real files have a handful of
+	// recipients with bodies of a few hundred bytes at most (RSA-4096).
+	maxRecipients = 1024
+	maxStanzaArgs = 8
+	maxStanzaArg  = 256
+	maxStanzaBody = 4096
+)
+
+var (
+	// ErrIncorrectIdentity is returned by an Identity that does not match
+	// a stanza, so the next identity can be tried.
+	ErrIncorrectIdentity = errors.New("incorrect identity for recipient stanza")
+	ErrNoIdentityMatched = errors.New("no identity matched any of the recipients")
+	// ErrOutputTooLarge is returned when decrypting would write more than
+	// the caller's size limit.
+	ErrOutputTooLarge = errors.New("decrypted output exceeds the size limit")
+	// ErrAADRequired is returned for files encrypted with associated data
+	// when none is given.
+	ErrAADRequired = errors.New("file was encrypted with associated data, which has to be given to decrypt it")
+	// ErrMalformed is wrapped by errors for input that is structurally
+	// invalid: truncated, with impossible sizes, or a header no encoder
+	// writes. It is returned before any key is tried.
+	ErrMalformed = errors.New("malformed ciphertext")
+)
+
+// Header is the plaintext part of a file. It is authenticated as
+// associated data of the payload.
+type Header struct {
+	Cipher      string    `json:"cipher"`
+	Compression string    `json:"compression"`
+	AAD         bool      `json:"aad,omitempty"`
+	Padding     string    `json:"padding,omitempty"`
+	Convergent  bool      `json:"convergent,omitempty"`
+	ChunkSize   int       `json:"chunk_size,omitempty"` // see chunked.go
+	FEC         string    `json:"fec,omitempty"`        // see fec.go
+	Sensitive   bool      `json:"sensitive,omitempty"`
+	Sealed      []byte    `json:"sealed,omitempty"` // see sealed.go
+	Recipients  []*Stanza `json:"recipients"`
+}
+
+// Canary marks a honeytoken, a decoy file whose decryption should raise
+// an alert wherever it happens. It is sealed in the header, see
+// sealed.go, so only someone who can decrypt the file sees it.
+type Canary struct {
+	Token   string `json:"token"`             // also in the decoy's plaintext
+	Webhook string `json:"webhook,omitempty"` // where to report decryption
+}
+
+// Stanza holds the file key wrapped for a single recipient.
+type Stanza struct {
+	Type string   `json:"type"`
+	Args []string `json:"args,omitempty"`
+	Body []byte   `json:"body"`
+}
+
+// Recipient wraps a file key for one reader of the file.
+type Recipient interface {
+	Wrap(fileKey []byte) (*Stanza, error)
+}
+
+// Identity unwraps a file key from a stanza addressed to it. It returns
+// ErrIncorrectIdentity for stanzas meant for someone else.
+type Identity interface {
+	Unwrap(s *Stanza) ([]byte, error)
+}
+
+// Payload compressions. CompressionNone is for inputs that are already
+// compressed, where deflate only costs time.
+const (
+	CompressionDeflate = "deflate"
+	CompressionNone    = "none"
+)
+
+// Encrypt compresses plaintext and encrypts it to all recipients.
+func Encrypt(plaintext []byte, recipients ...Recipient) ([]byte, error) {
+	return EncryptCompressed(plaintext, CompressionDeflate, recipients...)
+}
+
+// EncryptCompressed is Encrypt with a choice of payload compression.
+func EncryptCompressed(plaintext []byte, compression string, recipients ...Recipient) ([]byte, error) {
+	return EncryptWith(plaintext, EncryptOptions{Compression: compression}, recipients...)
+}
+
+// EncryptOptions are the less common settings of EncryptWith.
+type EncryptOptions struct {
+	// Compression is one of the Compression constants, deflate if empty.
+	Compression string
+	// AAD is bound into the payload authentication but not stored: the
+	// same bytes have to be passed to decrypt the file. The header only
+	// records that there was some.
+	AAD []byte
+	// Padding is "", PaddingPadme or "block:N"; see CheckPadding.
+	Padding string
+	// Convergent, when set, makes the output a function of the plaintext
+	// and this secret, so equal inputs encrypt to equal files. All
+	// recipients have to be DeterministicRecipients.
+	Convergent []byte
+	// FEC adds Reed-Solomon parity to a chunked file, see FECPercent.
+	// Only NewChunkWriter takes it.
+	FEC string
+	// Sensitive marks the file in its header, which is authenticated, so
+	// the mark cannot be stripped without breaking the file.
+	Sensitive bool
+	// Canary is sealed in the header, readable only by the recipients.
+	// It cannot be combined with Convergent.
+	Canary *Canary
+}
+
+// DecryptOptions are the less common settings of DecryptWith.
+type DecryptOptions struct {
+	// LegacyKey opens legacy headerless files.
+	LegacyKey []byte
+	// MaxSize makes decryption stop with ErrOutputTooLarge rather than
+	// write more, 0 for no limit.
+	MaxSize int64
+	// AAD is the associated data the file was encrypted with, if any.
+	AAD []byte
+	// OnRepair, if set, is told about each chunk of a file with FEC that
+	// had to be rebuilt from its parity, and how many shards were bad.
+	OnRepair func(chunk uint32, damaged int)
+	// OnCanary, if set, is given the file's Canary once the payload has
+	// authenticated. Files without one do not call it.
+	OnCanary func(*Canary)
+}
+
+// EncryptWith is Encrypt with options.
+func EncryptWith(plaintext []byte, opts EncryptOptions, recipients ...Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	compression := opts.Compression
+	if compression == "" {
+		compression = CompressionDeflate
+	}
+	if compression != CompressionDeflate && compression != CompressionNone {
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+	if err := CheckPadding(opts.Padding); err != nil {
+		return nil, err
+	}
+	if opts.FEC != "" {
+		return nil, errors.New("FEC needs the chunked format")
+	}
+	if opts.Canary != nil && opts.Convergent != nil {
+		return nil, errors.New("a canary cannot be encrypted convergently")
+	}
+	convergent := opts.Convergent != nil
+	hdr := &Header{Cipher: "aes-256-gcm", Compression: compression, AAD: opts.AAD != nil, Padding: opts.Padding, Convergent: convergent, Sensitive: opts.Sensitive}
+	fileKey := make([]byte, FileKeySize)
+	if convergent {
+		var err error
+		if fileKey, err = convergentFileKey(opts.Convergent, plaintext, hdr, opts.AAD); err != nil {
+			return nil, err
+		}
+	} else if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	defer clear(fileKey)
+	sealed, err := sealMeta(fileKey, sealedMeta{Canary: opts.Canary})
+	if err != nil {
+		return nil, err
+	}
+	hdr.Sealed = sealed
+	stanzas, err := wrapAll(fileKey, recipients, convergent)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Recipients = stanzas
+	prefix, err := marshalHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := plaintext
+	if compression == CompressionDeflate {
+		compressed := new(bytes.Buffer)
+		w, _ := flate.NewWriter(compressed, flate.BestCompression)
+		if _, err := w.Write(plaintext); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		payload = compressed.Bytes()
+	}
+	if opts.Padding != "" {
+		if payload, err = pad(payload, opts.Padding); err != nil {
+			return nil, err
+		}
+	}
+
+	gcm, err := payloadAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if convergent {
+		nonce, err = deterministicNonce(fileKey, "payload", gcm.NonceSize())
+	} else {
+		_, err = rand.Read(nonce)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ad := associatedData(prefix, opts.AAD)
+	out := append(prefix, nonce...)
+	return gcm.Seal(out, nonce, payload, ad), nil
+}
+
+// associatedData authenticates the header and the caller's AAD. The
+// header is self-delimiting, so plain concatenation is unambiguous.
+func associatedData(prefix, aad []byte) []byte {
+	return append(append(make([]byte, 0, len(prefix)+len(aad)), prefix...), aad...)
+}
+
+// Decrypt opens a file with the first identity that can unwrap its file
+// key. Legacy headerless files are opened with legacyKey, which may be nil
+// if the caller knows the input is not legacy.
+func Decrypt(data []byte, legacyKey []byte, identities ...Identity) ([]byte, error) {
+	plain, _, err := DecryptStanza(data, legacyKey, identities...)
+	return plain, err
+}
+
+// DecryptStanza is Decrypt that also returns the stanza the file key was
+// unwrapped from, nil for legacy files.
+func DecryptStanza(data []byte, legacyKey []byte, identities ...Identity) ([]byte, *Stanza, error) {
+	var buf bytes.Buffer
+	_, stanza, err := DecryptTo(&buf, data, legacyKey, 0, identities...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), stanza, nil
+}
+
+// DecryptTo is DecryptStanza that decompresses straight into w instead of
+// memory, and stops with ErrOutputTooLarge rather than write more than
+// maxSize bytes (0 for no limit). The payload is authenticated before
+// anything is written.
+func DecryptTo(w io.Writer, data []byte, legacyKey []byte, maxSize int64, identities ...Identity) (int64, *Stanza, error) {
+	return DecryptWith(w, data, DecryptOptions{LegacyKey: legacyKey, MaxSize: maxSize}, identities...)
+}
+
+// DecryptWith is DecryptTo with options.
+func DecryptWith(w io.Writer, data []byte, opts DecryptOptions, identities ...Identity) (int64, *Stanza, error) {
+	payload, compression, stanza, err := OpenPayload(data, opts, identities...)
+	if err != nil {
+		return 0, nil, err
+	}
+	var n int64
+	if compression == CompressionNone {
+		n, err = CopyLimited(w, bytes.NewReader(payload), opts.MaxSize)
+	} else {
+		n, err = inflateTo(w, payload, opts.MaxSize)
+	}
+	return n, stanza, err
+}
+
+// OpenPayload unwraps the file key and authenticates and decrypts the
+// payload, but leaves decompression to the caller, who may want to do it
+// somewhere with fewer privileges. compression is one of the Compression
+// constants. opts.MaxSize is not used.
+func OpenPayload(data []byte, opts DecryptOptions, identities ...Identity) (payload []byte, compression string, stanza *Stanza, err error) {
+	hdr, prefix, err := ParseHeader(data)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if hdr == nil {
+		if opts.AAD != nil {
+			return nil, "", nil, errors.New("legacy files have no associated data")
+		}
+		payload, err := openLegacy(opts.LegacyKey, data)
+		return payload, CompressionDeflate, nil, err
+	}
+	if err := checkOpen(hdr, opts); err != nil {
+		return nil, "", nil, err
+	}
+	minPayload := gcmOverhead
+	if hdr.ChunkSize > 0 {
+		minPayload = noncePrefixSize + gcmTagSize
+	}
+	if len(data)-len(prefix) < minPayload {
+		return nil, "", nil, fmt.Errorf("%w: payload too short", ErrMalformed)
+	}
+	fileKey, stanza, err := unwrapFileKey(hdr, identities)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer clear(fileKey)
+	if hdr.ChunkSize > 0 {
+		if payload, err = openChunksBuffered(data[len(prefix):], fileKey, prefix, hdr, opts); err == nil {
+			err = opened(fileKey, hdr, opts)
+		}
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return payload, hdr.Compression, stanza, nil
+	}
+	gcm, err := payloadAEAD(fileKey)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	payload = data[len(prefix):]
+	nonce, ct := payload[:gcm.NonceSize()], payload[gcm.NonceSize():]
+	if payload, err = gcm.Open(nil, nonce, ct, associatedData(prefix, opts.AAD)); err != nil {
+		if hdr.AAD {
+			err = fmt.Errorf("%w (or the associated data does not match)", err)
+		}
+		return nil, "", nil, err
+	}
+	if hdr.Padding != "" {
+		if payload, err = unpad(payload); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if err := opened(fileKey, hdr, opts); err != nil {
+		return nil, "", nil, err
+	}
+	return payload, hdr.Compression, stanza, nil
+}
+
+// checkOpen refuses files this package cannot open, or not with opts,
+// before any key is tried.
+func checkOpen(hdr *Header, opts DecryptOptions) error {
+	if hdr.Cipher != "aes-256-gcm" || (hdr.Compression != CompressionDeflate && hdr.Compression != CompressionNone) {
+		return fmt.Errorf("unsupported cipher %q / compression %q", hdr.Cipher, hdr.Compression)
+	}
+	if err := CheckPadding(hdr.Padding); err != nil {
+		return err
+	}
+	switch {
+	case hdr.AAD && opts.AAD == nil:
+		return ErrAADRequired
+	case !hdr.AAD && opts.AAD != nil:
+		return errors.New("file was encrypted without associated data")
+	}
+	return nil
+}
+
+// ParseHeader returns the header of data and the raw header bytes
+// (magic included). A nil header means data is in the legacy format.
+func ParseHeader(data []byte) (*Header, []byte, error) {
+	if !IsEncutitl(data) {
+		return nil, nil, nil
+	}
+	if len(data) < len(Magic)+5 {
+		return nil, nil, fmt.Errorf("%w: truncated header", ErrMalformed)
+	}
+	if v := data[len(Magic)]; v != formatVersion {
+		return nil, nil, fmt.Errorf("unsupported format version %d", v)
+	}
+	n := binary.BigEndian.Uint32(data[len(Magic)+1:])
+	end := len(Magic) + 5 + int(n)
+	if n > maxHeader {
+		return nil, nil, fmt.Errorf("%w: header claims %d bytes", ErrMalformed, n)
+	}
+	if end > len(data) {
+		return nil, nil, fmt.Errorf("%w: truncated header", ErrMalformed)
+	}
+	hdr := new(Header)
+	if err := json.Unmarshal(data[len(Magic)+5:end], hdr); err != nil {
+		return nil, nil, fmt.Errorf("%w: header: %w", ErrMalformed, err)
+	}
+	if err := checkHeader(hdr); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return hdr, data[:end], nil
+}
+
+// checkHeader rejects headers that parse but that no encoder writes, so
+// a crafted file cannot make decryption try thousands of stanzas or hand
+// identities bodies of arbitrary size.
+func checkHeader(hdr *Header) error {
+	switch {
+	case len(hdr.Recipients) == 0:
+		return errors.New("no recipients")
+	case len(hdr.Recipients) > maxRecipients:
+		return fmt.Errorf("%d recipients", len(hdr.Recipients))
+	}
+	if hdr.ChunkSize != 0 {
+		switch {
+		case hdr.ChunkSize < MinChunkSize || hdr.ChunkSize > MaxChunkSize:
+			return fmt.Errorf("chunk size %d", hdr.ChunkSize)
+		case hdr.Compression != CompressionNone || hdr.Padding != "" || hdr.Convergent:
+			return errors.New("chunked payload with compression, padding or convergence")
+		}
+	}
+	if _, err := parseFEC(hdr.FEC); err != nil {
+		return err
+	}
+	if hdr.FEC != "" && hdr.ChunkSize == 0 {
+		return errors.New("fec without chunks")
+	}
+	if len(hdr.Sealed) > maxSealed {
+		return fmt.Errorf("%d byte sealed header", len(hdr.Sealed))
+	}
+	for i, s := range hdr.Recipients {
+		switch {
+		case s == nil || s.Type == "":
+			return fmt.Errorf("recipient %d has no type", i)
+		case len(s.Args) > maxStanzaArgs:
+			return fmt.Errorf("recipient %d has %d arguments", i, len(s.Args))
+		case len(s.Body) == 0 || len(s.Body) > maxStanzaBody:
+			return fmt.Errorf("recipient %d has a %d byte body", i, len(s.Body))
+		}
+		for _, arg := range s.Args {
+			if arg == "" || len(arg) > maxStanzaArg {
+				return fmt.Errorf("recipient %d has a %d byte argument", i, len(arg))
+			}
+		}
+	}
+	return nil
+}
+
+// IsEncutitl reports whether data starts with the current format magic.
+func IsEncutitl(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+func marshalHeader(hdr *Header) ([]byte, error) {
+	body, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(Magic), formatVersion)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(body)))
+	return append(out, body...), nil
+}
+
+func unwrapFileKey(hdr *Header, identities []Identity) ([]byte, *Stanza, error) {
+	for _, s := range hdr.Recipients {
+		for _, id := range identities {
+			fileKey, err := id.Unwrap(s)
+			if errors.Is(err, ErrIncorrectIdentity) {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(fileKey) != FileKeySize {
+				return nil, nil, errors.New("unwrapped file key has wrong size")
+			}
+			return fileKey, s, nil
+		}
+	}
+	return nil, nil, ErrNoIdentityMatched
+}
+
+func payloadAEAD(fileKey []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nil, "encutitl payload", 32)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	return newGCM(key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealKey and openKey wrap a file key under a recipient specific key.
+// Callers derive wrapKey for the one call, so it is zeroed once used.
+func sealKey(wrapKey, fileKey []byte) ([]byte, error) {
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return sealKeyNonce(wrapKey, fileKey, nonce)
+}
+
+// sealKeyDeterministic is sealKey with the nonce derived from both keys,
+// for convergent encryption.
+func sealKeyDeterministic(wrapKey, fileKey []byte) ([]byte, error) {
+	both := append(slices.Clone(wrapKey), fileKey...)
+	nonce, err := deterministicNonce(both, "wrap", gcmNonceSize)
+	clear(both)
+	if err != nil {
+		return nil, err
+	}
+	return sealKeyNonce(wrapKey, fileKey, nonce)
+}
+
+func sealKeyNonce(wrapKey, fileKey, nonce []byte) ([]byte, error) {
+	gcm, err := newGCM(wrapKey)
+	clear(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, fileKey, nil), nil
+}
+
+func openKey(wrapKey, body []byte) ([]byte, error) {
+	gcm, err := newGCM(wrapKey)
+	clear(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: stanza body too short", ErrMalformed)
+	}
+	return gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], nil)
+}
+
+// openLegacy authenticates and decrypts a legacy file, returning its
+// still compressed payload.
+func openLegacy(key []byte, ciphertext []byte) ([]byte, error) {
+	if key == nil {
+		return nil, errors.New("legacy file requires key.bin")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrMalformed)
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	ciphertext = ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func inflateTo(w io.Writer, compressed []byte, maxSize int64) (int64, error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	return CopyLimited(w, r, maxSize)
+}
+
+// CopyLimited copies r to w like io.Copy, but fails with
+// ErrOutputTooLarge instead of copying more than maxSize bytes (0 for no
+// limit).
+func CopyLimited(w io.Writer, r io.Reader, maxSize int64) (int64, error) {
+	if maxSize <= 0 {
+		return io.Copy(w, r)
+	}
+	n, err := io.Copy(w, io.LimitReader(r, maxSize))
+	if err != nil {
+		return n, err
+	}
+	// Anything left means the limit cut the output short.
+	if m, _ := io.ReadFull(r, make([]byte, 1)); m > 0 {
+		return n, ErrOutputTooLarge
+	}
+	return n, nil
+}
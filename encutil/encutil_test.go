@@ -0,0 +1,254 @@
+package encutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKey(t testing.TB, seed byte) *KeyRecipient {
+	t.Helper()
+	k, err := NewKeyRecipient(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := testKey(t, 1)
+	plain := []byte(strings.Repeat("the quick brown fox ", 100))
+	tests := []struct {
+		name string
+		opts EncryptOptions
+	}{
+		{"deflate", EncryptOptions{}},
+		{"none", EncryptOptions{Compression: CompressionNone}},
+		{"aad", EncryptOptions{AAD: []byte("context")}},
+		{"padme", EncryptOptions{Padding: PaddingPadme}},
+		{"block", EncryptOptions{Padding: "block:4096"}},
+		{"convergent", EncryptOptions{Convergent: []byte("secret")}},
+		{"sensitive and canary", EncryptOptions{Sensitive: true, Canary: &Canary{Token: "t", Webhook: "https://example.com/"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := EncryptWith(plain, tt.opts, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			var canary *Canary
+			opts := DecryptOptions{AAD: tt.opts.AAD, OnCanary: func(c *Canary) { canary = c }}
+			if _, _, err := DecryptWith(&out, sealed, opts, k); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), plain) {
+				t.Fatal("plaintext differs after a round trip")
+			}
+			hdr, _, err := ParseHeader(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Sensitive != tt.opts.Sensitive || (canary == nil) != (tt.opts.Canary == nil) || canary != nil && *canary != *tt.opts.Canary {
+				t.Fatalf("header marks not kept: %+v, canary %+v", hdr, canary)
+			}
+		})
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	k := testKey(t, 1)
+	sealed, err := EncryptWith([]byte("hello"), EncryptOptions{AAD: []byte("a")}, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptWith(new(bytes.Buffer), sealed, DecryptOptions{AAD: []byte("a")}, testKey(t, 2)); !errors.Is(err, ErrNoIdentityMatched) {
+		t.Errorf("wrong key: got %v, want ErrNoIdentityMatched", err)
+	}
+	if _, _, err := DecryptWith(new(bytes.Buffer), sealed, DecryptOptions{}, k); !errors.Is(err, ErrAADRequired) {
+		t.Errorf("missing aad: got %v, want ErrAADRequired", err)
+	}
+	if _, _, err := DecryptWith(new(bytes.Buffer), sealed, DecryptOptions{AAD: []byte("b")}, k); err == nil {
+		t.Error("wrong aad decrypted")
+	}
+
+	// Flipping any byte of the header or payload breaks authentication
+	// or parsing, including the header's marks.
+	for i := len(Magic) + 5; i < len(sealed); i++ {
+		bad := bytes.Clone(sealed)
+		bad[i] ^= 0x01
+		if _, _, err := DecryptWith(new(bytes.Buffer), bad, DecryptOptions{AAD: []byte("a")}, k); err == nil {
+			t.Fatalf("byte %d flipped and the file still decrypted", i)
+		}
+	}
+}
+
+func TestCanarySealed(t *testing.T) {
+	k := testKey(t, 1)
+	c := &Canary{Token: "0123456789abcdef", Webhook: "https://alerts.example/hook"}
+	sealed, err := EncryptWith([]byte("decoy"), EncryptOptions{Canary: c}, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte(c.Token)) || bytes.Contains(sealed, []byte(c.Webhook)) {
+		t.Fatal("canary readable without the key")
+	}
+	if _, err := EncryptWith([]byte("decoy"), EncryptOptions{Canary: c, Convergent: []byte("s")}, k); err == nil {
+		t.Fatal("convergent canary accepted")
+	}
+
+	// A file that does not decrypt never reports its canary.
+	bad := bytes.Clone(sealed)
+	bad[len(bad)-1] ^= 1
+	called := false
+	opts := DecryptOptions{OnCanary: func(*Canary) { called = true }}
+	if _, _, err := DecryptWith(new(bytes.Buffer), bad, opts, k); err == nil || called {
+		t.Fatalf("tampered file: err %v, canary reported %v", err, called)
+	}
+}
+
+func TestDecryptMaxSize(t *testing.T) {
+	k := testKey(t, 1)
+	sealed, err := Encrypt(make([]byte, 1<<20), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = DecryptWith(new(bytes.Buffer), sealed, DecryptOptions{MaxSize: 1 << 10}, k)
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("got %v, want ErrOutputTooLarge", err)
+	}
+}
+
+// header builds a raw header around body, as marshalHeader does.
+func header(body string) []byte {
+	out := append([]byte(Magic), formatVersion)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestParseHeaderMalformed(t *testing.T) {
+	stanza := `{"type":"key","args":["abcd"],"body":"AAAA"}`
+	many := strings.Repeat(stanza+",", maxRecipients) + stanza
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated length", []byte(Magic + "\x01\x00")},
+		{"length past the end", header(`{}`)[:len(Magic)+6]},
+		{"huge length", append([]byte(Magic+"\x01"), 0xff, 0xff, 0xff, 0xff)},
+		{"not json", header(`{`)},
+		{"no recipients", header(`{"cipher":"aes-256-gcm","recipients":[]}`)},
+		{"too many recipients", header(`{"recipients":[` + many + `]}`)},
+		{"null stanza", header(`{"recipients":[null]}`)},
+		{"no type", header(`{"recipients":[{"body":"AAAA"}]}`)},
+		{"empty body", header(`{"recipients":[{"type":"key"}]}`)},
+		{"body too large", header(`{"recipients":[{"type":"key","body":"` + strings.Repeat("A", (maxStanzaBody/3+1)*4) + `"}]}`)},
+		{"too many args", header(`{"recipients":[{"type":"key","args":["a","a","a","a","a","a","a","a","a"],"body":"AAAA"}]}`)},
+		{"empty arg", header(`{"recipients":[{"type":"key","args":[""],"body":"AAAA"}]}`)},
+		{"arg too long", header(`{"recipients":[{"type":"key","args":["` + strings.Repeat("a", maxStanzaArg+1) + `"],"body":"AAAA"}]}`)},
+		{"chunk size too small", header(`{"compression":"none","chunk_size":1,"recipients":[` + stanza + `]}`)},
+		{"chunk size too large", header(`{"compression":"none","chunk_size":1073741824,"recipients":[` + stanza + `]}`)},
+		{"compressed chunks", header(`{"compression":"deflate","chunk_size":65536,"recipients":[` + stanza + `]}`)},
+		{"bad fec", header(`{"compression":"none","chunk_size":65536,"fec":"rs:0+0","recipients":[` + stanza + `]}`)},
+		{"fec without chunks", header(`{"fec":"rs:32+4","recipients":[` + stanza + `]}`)},
+		{"sealed too large", header(`{"sealed":"` + strings.Repeat("A", (maxSealed/3+1)*4) + `","recipients":[` + stanza + `]}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseHeader(tt.data); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("got %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestParseHeaderVersion(t *testing.T) {
+	data := header(`{"recipients":[{"type":"key","body":"AAAA"}]}`)
+	data[len(Magic)] = formatVersion + 1
+	if _, _, err := ParseHeader(data); err == nil {
+		t.Fatal("unknown format version accepted")
+	}
+}
+
+func TestParseHeaderLegacy(t *testing.T) {
+	hdr, prefix, err := ParseHeader([]byte("not an encutitl file"))
+	if hdr != nil || prefix != nil || err != nil {
+		t.Fatalf("got %v, %q, %v for a legacy file", hdr, prefix, err)
+	}
+}
+
+func FuzzParseHeader(f *testing.F) {
+	k := testKey(f, 1)
+	sealed, err := Encrypt([]byte("seed"), k)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(sealed)
+	f.Add(header(`{"compression":"none","chunk_size":65536,"fec":"rs:32+4","recipients":[{"type":"key","args":["abcd"],"body":"AAAA"}]}`))
+	f.Add([]byte(Magic + "\x01\x00\x00\x00\x02{}"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hdr, prefix, err := ParseHeader(data)
+		if err != nil || hdr == nil {
+			return
+		}
+		if !bytes.HasPrefix(data, prefix) {
+			t.Fatal("prefix is not the start of data")
+		}
+		// Whatever parses has to pass checkHeader again after a round
+		// trip through JSON, and decrypting it must fail cleanly.
+		body, err := json.Marshal(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ParseHeader(header(string(body))); err != nil {
+			t.Fatalf("re-encoded header rejected: %v", err)
+		}
+		DecryptWith(new(bytes.Buffer), data, DecryptOptions{MaxSize: 1 << 20}, k)
+	})
+}
+
+func TestConvergent(t *testing.T) {
+	k := testKey(t, 1)
+	plain := []byte(strings.Repeat("same input ", 50))
+	secret := []byte("secret")
+	seal := func(opts EncryptOptions) []byte {
+		t.Helper()
+		opts.Convergent = secret
+		out, err := EncryptWith(plain, opts, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if !bytes.Equal(seal(EncryptOptions{}), seal(EncryptOptions{})) {
+		t.Fatal("same input and options encrypted differently")
+	}
+
+	// Every option that changes the header or the AAD has to change the
+	// file key, and with it the payload nonce.
+	nonce := func(data []byte) []byte {
+		_, prefix, err := ParseHeader(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data[len(prefix) : len(prefix)+gcmNonceSize]
+	}
+	seen := map[string]string{}
+	for name, opts := range map[string]EncryptOptions{
+		"default":   {},
+		"none":      {Compression: CompressionNone},
+		"padme":     {Padding: PaddingPadme},
+		"sensitive": {Sensitive: true},
+		"aad":       {AAD: []byte("a")},
+		"empty aad": {AAD: []byte{}},
+	} {
+		n := string(nonce(seal(opts)))
+		if other, ok := seen[n]; ok {
+			t.Errorf("%s and %s share a nonce", name, other)
+		}
+		seen[n] = name
+	}
+}
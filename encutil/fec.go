@@ -0,0 +1,157 @@
+package encutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Chunked files can carry Reed-Solomon parity, for media that rot
+// (Header.FEC "rs:K+M"). Every sealed chunk is split into K shards, the
+// last padded with zeros, and stored followed by M parity shards and the
+// CRC-32C of each of the K+M shards:
+//
+//	sealed chunk || parity shards || CRC-32C * (K+M)
+//
+// A chunk that fails to authenticate is rebuilt from the shards whose CRC
+// still matches, as long as no more than M are damaged, and authenticated
+// again. The parity is over the ciphertext, so repairing needs no key and
+// cannot make a forged chunk pass. The header and nonce prefix, a few
+// hundred bytes at the start, are not covered.
+
+// fecShards is K, the data shards per chunk.
+const fecShards = 32
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrTooDamaged is returned for a chunk with more damaged shards than its
+// parity can rebuild.
+var ErrTooDamaged = errors.New("chunk is damaged beyond what its parity can repair")
+
+// FECPercent returns the Header.FEC value for parity of pct percent of
+// the data, 1 to 100.
+func FECPercent(pct int) (string, error) {
+	if pct < 1 || pct > 100 {
+		return "", fmt.Errorf("parity of %d%%, expected 1 to 100", pct)
+	}
+	return fmt.Sprintf("rs:%d+%d", fecShards, (fecShards*pct+99)/100), nil
+}
+
+type fecCode struct {
+	data, parity int
+	rs           reedsolomon.Encoder
+}
+
+// parseFEC returns the code for a Header.FEC value, nil for none.
+func parseFEC(s string) (*fecCode, error) {
+	if s == "" {
+		return nil, nil
+	}
+	k, m, ok := strings.Cut(strings.TrimPrefix(s, "rs:"), "+")
+	data, err1 := strconv.Atoi(k)
+	parity, err2 := strconv.Atoi(m)
+	if !strings.HasPrefix(s, "rs:") || !ok || err1 != nil || err2 != nil || data < 1 || parity < 1 || data+parity > 256 {
+		return nil, fmt.Errorf("unsupported fec %q", s)
+	}
+	rs, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	return &fecCode{data: data, parity: parity, rs: rs}, nil
+}
+
+func (c *fecCode) shardSize(sealed int) int {
+	return (sealed + c.data - 1) / c.data
+}
+
+// stored is the size on disk of a chunk of sealed bytes.
+func (c *fecCode) stored(sealed int) int {
+	if c == nil {
+		return sealed
+	}
+	return sealed + c.parity*c.shardSize(sealed) + 4*(c.data+c.parity)
+}
+
+// sealedSize is the inverse of stored, for the last chunk, whose size
+// only the end of the file gives.
+func (c *fecCode) sealedSize(stored int) (int, bool) {
+	if c == nil {
+		return stored, true
+	}
+	n := stored - 4*(c.data+c.parity)
+	// A shard size s holds sealed sizes (s-1)*K+1 to s*K, so n falls
+	// between s*(K+M)-K and s*(K+M), starting the search at most one
+	// step below the answer.
+	for s := max(n/(c.data+c.parity), 1); s*(c.data+c.parity)-c.data < n; s++ {
+		if sealed := n - c.parity*s; sealed > 0 && c.shardSize(sealed) == s {
+			return sealed, true
+		}
+	}
+	return 0, false
+}
+
+// shards lays out sealed, padded, and room for the parity.
+func (c *fecCode) shards(sealed []byte) [][]byte {
+	s := c.shardSize(len(sealed))
+	buf := make([]byte, (c.data+c.parity)*s)
+	copy(buf, sealed)
+	shards := make([][]byte, c.data+c.parity)
+	for i := range shards {
+		shards[i] = buf[i*s : (i+1)*s : (i+1)*s]
+	}
+	return shards
+}
+
+// encode returns the parity shards and CRCs that follow sealed.
+func (c *fecCode) encode(sealed []byte) ([]byte, error) {
+	shards := c.shards(sealed)
+	if err := c.rs.Encode(shards); err != nil {
+		return nil, err
+	}
+	var out []byte
+	for _, p := range shards[c.data:] {
+		out = append(out, p...)
+	}
+	for _, sh := range shards {
+		out = binary.BigEndian.AppendUint32(out, crc32.Checksum(sh, castagnoli))
+	}
+	return out, nil
+}
+
+// repair rebuilds the sealed bytes of a stored chunk, returning them and
+// the number of shards that were damaged, nil if none were.
+func (c *fecCode) repair(stored []byte, sealedLen int) ([]byte, int, error) {
+	s := c.shardSize(sealedLen)
+	shards := c.shards(stored[:sealedLen])
+	parity := stored[sealedLen : sealedLen+c.parity*s]
+	sums := stored[sealedLen+c.parity*s:]
+	for i := range c.parity {
+		copy(shards[c.data+i], parity[i*s:])
+	}
+	damaged := 0
+	for i, sh := range shards {
+		if crc32.Checksum(sh, castagnoli) != binary.BigEndian.Uint32(sums[4*i:]) {
+			shards[i] = sh[:0]
+			damaged++
+		}
+	}
+	switch {
+	case damaged == 0:
+		return nil, 0, nil // intact, so the key or AAD is wrong
+	case damaged > c.parity:
+		return nil, damaged, ErrTooDamaged
+	}
+	if err := c.rs.ReconstructData(shards); err != nil {
+		return nil, damaged, err
+	}
+	sealed := make([]byte, 0, c.data*s)
+	for _, sh := range shards[:c.data] {
+		sealed = append(sealed, sh...)
+	}
+	return sealed[:sealedLen], damaged, nil
+}
@@ -0,0 +1,200 @@
+package encutil
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Hybrid recipients wrap the file key under both X25519 and ML-KEM-768,
+// so a file stays confidential unless both are broken: ML-KEM covers a
+// future quantum computer decrypting archives recorded today, X25519
+// covers ML-KEM turning out weaker than believed. The two shared secrets
+// go through one HKDF together with the ciphertexts and the recipient
+// key, as in X-Wing.
+//
+// Public keys are "encpq1" and private keys "ENCUTITL-PQ-SECRET-1", each
+// followed by unpadded base64url. The stanza has the usual tag and
+// ephemeral X25519 share as arguments; the 1088 byte ML-KEM ciphertext
+// goes in the body ahead of the wrapped key.
+
+const (
+	HybridStanza = "mlkem768x25519"
+
+	hybridPublicPrefix = "encpq1"
+	hybridSecretPrefix = "ENCUTITL-PQ-SECRET-1"
+	hybridLabel        = "encutitl/mlkem768x25519"
+)
+
+type HybridRecipient struct {
+	ek *mlkem.EncapsulationKey768
+	x  *ecdh.PublicKey
+}
+
+// HybridIdentity is the private half of a HybridRecipient.
+type HybridIdentity struct {
+	dk *mlkem.DecapsulationKey768
+	x  *ecdh.PrivateKey
+}
+
+// GenerateHybridIdentity creates a new key pair.
+func GenerateHybridIdentity() (*HybridIdentity, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	x, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &HybridIdentity{dk: dk, x: x}, nil
+}
+
+// IsHybridRecipient reports whether s looks like a hybrid public key.
+func IsHybridRecipient(s string) bool {
+	return strings.HasPrefix(s, hybridPublicPrefix)
+}
+
+// IsHybridIdentity reports whether data holds a hybrid private key.
+func IsHybridIdentity(data []byte) bool {
+	return strings.Contains(string(data), hybridSecretPrefix)
+}
+
+// ParseHybridRecipient parses an "encpq1..." public key.
+func ParseHybridRecipient(s string) (*HybridRecipient, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, hybridPublicPrefix))
+	if !IsHybridRecipient(s) || err != nil || len(raw) != mlkem.EncapsulationKeySize768+32 {
+		return nil, errors.New("malformed hybrid public key")
+	}
+	ek, err := mlkem.NewEncapsulationKey768(raw[:mlkem.EncapsulationKeySize768])
+	if err != nil {
+		return nil, fmt.Errorf("malformed hybrid public key: %w", err)
+	}
+	x, err := ecdh.X25519().NewPublicKey(raw[mlkem.EncapsulationKeySize768:])
+	if err != nil {
+		return nil, fmt.Errorf("malformed hybrid public key: %w", err)
+	}
+	return &HybridRecipient{ek: ek, x: x}, nil
+}
+
+// ParseHybridIdentities reads every private key in an identity file,
+// skipping blank lines and # comments.
+func ParseHybridIdentities(data []byte) ([]*HybridIdentity, error) {
+	var out []*HybridIdentity
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, hybridSecretPrefix))
+		if !strings.HasPrefix(line, hybridSecretPrefix) || err != nil || len(raw) != mlkem.SeedSize+32 {
+			return nil, errors.New("malformed hybrid private key")
+		}
+		dk, err := mlkem.NewDecapsulationKey768(raw[:mlkem.SeedSize])
+		if err != nil {
+			return nil, err
+		}
+		x, err := ecdh.X25519().NewPrivateKey(raw[mlkem.SeedSize:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &HybridIdentity{dk: dk, x: x})
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no hybrid private keys found")
+	}
+	return out, nil
+}
+
+func (i *HybridIdentity) String() string {
+	return hybridSecretPrefix + base64.RawURLEncoding.EncodeToString(append(i.dk.Bytes(), i.x.Bytes()...))
+}
+
+// Recipient returns the public key files are encrypted to.
+func (i *HybridIdentity) Recipient() *HybridRecipient {
+	return &HybridRecipient{ek: i.dk.EncapsulationKey(), x: i.x.PublicKey()}
+}
+
+func (r *HybridRecipient) String() string {
+	return hybridPublicPrefix + base64.RawURLEncoding.EncodeToString(r.bytes())
+}
+
+func (r *HybridRecipient) bytes() []byte {
+	return append(r.ek.Bytes(), r.x.Bytes()...)
+}
+
+func (r *HybridRecipient) tag() string {
+	sum := sha256.Sum256(r.bytes())
+	return base64.RawStdEncoding.EncodeToString(sum[:4])
+}
+
+func (r *HybridRecipient) Wrap(fileKey []byte) (*Stanza, error) {
+	kemShared, ct := r.ek.Encapsulate()
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	xShared, err := eph.ECDH(r.x)
+	if err != nil {
+		return nil, err
+	}
+	share := eph.PublicKey().Bytes()
+	wrapKey, err := hybridWrapKey(kemShared, xShared, ct, share, r.bytes())
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealKey(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Stanza{
+		Type: HybridStanza,
+		Args: []string{r.tag(), base64.RawStdEncoding.EncodeToString(share)},
+		Body: append(ct, sealed...),
+	}, nil
+}
+
+func (i *HybridIdentity) Unwrap(s *Stanza) ([]byte, error) {
+	r := i.Recipient()
+	if s.Type != HybridStanza || len(s.Args) == 0 || s.Args[0] != r.tag() {
+		return nil, ErrIncorrectIdentity
+	}
+	share, err := base64.RawStdEncoding.DecodeString(s.Args[len(s.Args)-1])
+	if len(s.Args) != 2 || err != nil || len(s.Body) < mlkem.CiphertextSize768 {
+		return nil, fmt.Errorf("%w: %s stanza", ErrMalformed, HybridStanza)
+	}
+	ct := s.Body[:mlkem.CiphertextSize768]
+	kemShared, err := i.dk.Decapsulate(ct)
+	if err != nil {
+		return nil, err
+	}
+	ephPub, err := ecdh.X25519().NewPublicKey(share)
+	if err != nil {
+		return nil, err
+	}
+	xShared, err := i.x.ECDH(ephPub)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := hybridWrapKey(kemShared, xShared, ct, share, r.bytes())
+	if err != nil {
+		return nil, err
+	}
+	return openKey(wrapKey, s.Body[mlkem.CiphertextSize768:])
+}
+
+// hybridWrapKey zeroes the shared secrets it is given.
+func hybridWrapKey(kemShared, xShared, ct, share, recipient []byte) ([]byte, error) {
+	ikm := append(append([]byte{}, kemShared...), xShared...)
+	defer clear(ikm)
+	clear(kemShared)
+	clear(xShared)
+	salt := append(append(append([]byte{}, ct...), share...), recipient...)
+	return hkdf.Key(sha256.New, ikm, salt, hybridLabel, 32)
+}
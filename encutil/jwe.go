@@ -0,0 +1,139 @@
+package encutil
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// JWE compact serialization (RFC 7516) with the symmetric key used
+// directly as the A256GCM content encryption key ("alg":"dir"). Payloads
+// are raw DEFLATE compressed ("zip":"DEF"), which JOSE libraries support
+// out of the box.
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Zip string `json:"zip,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// EncryptJWE encrypts plaintext under a 32-byte key and returns a compact
+// JWE.
+func EncryptJWE(key, plaintext []byte) (string, error) {
+	if len(key) != 32 {
+		return "", errors.New("JWE A256GCM needs a 32 byte key")
+	}
+	hdr, err := json.Marshal(jweHeader{Alg: "dir", Enc: "A256GCM", Zip: "DEF", Kid: KeyID(key)})
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(hdr)
+
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	if _, err := w.Write(plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, compressed.Bytes(), []byte(protected))
+	ct, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	enc := base64.RawURLEncoding.EncodeToString
+	return strings.Join([]string{protected, "", enc(iv), enc(ct), enc(tag)}, "."), nil
+}
+
+// DecryptJWE opens a compact JWE produced by EncryptJWE or any other
+// "dir"/"A256GCM" producer.
+func DecryptJWE(key []byte, token string) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := DecryptJWETo(&buf, key, token, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecryptJWETo is DecryptJWE writing to w, with DecryptTo's size limit.
+func DecryptJWETo(w io.Writer, key []byte, token string, maxSize int64) (int64, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 5 {
+		return 0, fmt.Errorf("%w: not a compact JWE", ErrMalformed)
+	}
+	dec := base64.RawURLEncoding.DecodeString
+	raw, err := dec(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("%w: JWE header: %w", ErrMalformed, err)
+	}
+	var hdr jweHeader
+	if err := json.Unmarshal(raw, &hdr); err != nil {
+		return 0, fmt.Errorf("%w: JWE header: %w", ErrMalformed, err)
+	}
+	if hdr.Alg != "dir" || hdr.Enc != "A256GCM" {
+		return 0, fmt.Errorf("unsupported JWE alg %q / enc %q", hdr.Alg, hdr.Enc)
+	}
+	if hdr.Zip != "" && hdr.Zip != "DEF" {
+		return 0, fmt.Errorf("unsupported JWE zip %q", hdr.Zip)
+	}
+	if parts[1] != "" {
+		return 0, errors.New("JWE with \"dir\" must have an empty encrypted key")
+	}
+	iv, err := dec(parts[2])
+	if err != nil {
+		return 0, fmt.Errorf("%w: JWE iv: %w", ErrMalformed, err)
+	}
+	ct, err := dec(parts[3])
+	if err != nil {
+		return 0, fmt.Errorf("%w: JWE ciphertext: %w", ErrMalformed, err)
+	}
+	tag, err := dec(parts[4])
+	if err != nil {
+		return 0, fmt.Errorf("%w: JWE tag: %w", ErrMalformed, err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return 0, fmt.Errorf("%w: JWE iv of %d bytes, tag of %d", ErrMalformed, len(iv), len(tag))
+	}
+	plain, err := gcm.Open(nil, iv, append(ct, tag...), []byte(parts[0]))
+	if err != nil {
+		return 0, err
+	}
+	if hdr.Zip == "DEF" {
+		return inflateTo(w, plain, maxSize)
+	}
+	return CopyLimited(w, bytes.NewReader(plain), maxSize)
+}
+
+// IsJWE reports whether s looks like a compact JWE.
+func IsJWE(s string) bool {
+	s = strings.TrimSpace(s)
+	if strings.Count(s, ".") != 4 {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s[:strings.IndexByte(s, '.')])
+	if err != nil {
+		return false
+	}
+	var hdr jweHeader
+	return json.Unmarshal(raw, &hdr) == nil && hdr.Enc != ""
+}
@@ -0,0 +1,76 @@
+package encutil
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// KeyRecipient wraps the file key under a shared 32-byte symmetric key
+// (the classic key.bin). It is both a Recipient and an Identity.
+type KeyRecipient struct {
+	key []byte
+}
+
+// NewKeyRecipient keeps key, not a copy, so a caller that locked it in
+// memory keeps it there. Wipe zeroes it.
+func NewKeyRecipient(key []byte) (*KeyRecipient, error) {
+	if len(key) != 32 {
+		return nil, errors.New("symmetric key must be 32 bytes")
+	}
+	return &KeyRecipient{key: key}, nil
+}
+
+// KeyID is a short non-secret identifier of a symmetric key, stored in the
+// stanza so the wrong key.bin can be reported as such.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("encutitl key id"), key...))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (k *KeyRecipient) Wrap(fileKey []byte) (*Stanza, error) {
+	wrapKey, err := k.wrapKey()
+	if err != nil {
+		return nil, err
+	}
+	body, err := sealKey(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Stanza{Type: "key", Args: []string{KeyID(k.key)}, Body: body}, nil
+}
+
+// WrapDeterministic makes KeyRecipient a DeterministicRecipient.
+func (k *KeyRecipient) WrapDeterministic(fileKey []byte) (*Stanza, error) {
+	wrapKey, err := k.wrapKey()
+	if err != nil {
+		return nil, err
+	}
+	body, err := sealKeyDeterministic(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Stanza{Type: "key", Args: []string{KeyID(k.key)}, Body: body}, nil
+}
+
+func (k *KeyRecipient) Unwrap(s *Stanza) ([]byte, error) {
+	if s.Type != "key" || len(s.Args) != 1 || s.Args[0] != KeyID(k.key) {
+		return nil, ErrIncorrectIdentity
+	}
+	wrapKey, err := k.wrapKey()
+	if err != nil {
+		return nil, err
+	}
+	return openKey(wrapKey, s.Body)
+}
+
+// Wipe zeroes the key, for when it is no longer needed. The recipient is
+// unusable afterwards.
+func (k *KeyRecipient) Wipe() {
+	clear(k.key)
+}
+
+func (k *KeyRecipient) wrapKey() ([]byte, error) {
+	return hkdf.Key(sha256.New, k.key, nil, "encutitl key wrap", 32)
+}
@@ -0,0 +1,76 @@
+package encutil
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPaddedSize(t *testing.T) {
+	tests := []struct {
+		scheme string
+		n      int
+		want   int
+	}{
+		{"block:16", 0, 16},
+		{"block:16", 15, 16},
+		{"block:16", 16, 32},
+		{"block:1", 7, 8},
+		{PaddingPadme, 0, 1},
+		{PaddingPadme, 8, 10},
+		{PaddingPadme, 1000, 1024},
+		{PaddingPadme, 1 << 20, 1<<20 + 1<<15},
+	}
+	for _, tt := range tests {
+		got, err := paddedSize(tt.scheme, tt.n)
+		if err != nil || got != tt.want {
+			t.Errorf("paddedSize(%q, %d) = %d, %v, want %d", tt.scheme, tt.n, got, err, tt.want)
+		}
+	}
+}
+
+func TestPadmeOverhead(t *testing.T) {
+	for n := 1; n < 1<<16; n++ {
+		p := padme(n)
+		if p < n || float64(p-n) > 0.12*float64(n)+1 {
+			t.Fatalf("padme(%d) = %d", n, p)
+		}
+	}
+}
+
+func TestCheckPadding(t *testing.T) {
+	for _, ok := range []string{"", PaddingPadme, "block:1", "block:16777216"} {
+		if err := CheckPadding(ok); err != nil {
+			t.Errorf("CheckPadding(%q): %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"pad", "block:", "block:0", "block:-1", "block:16777217", "block:x"} {
+		if err := CheckPadding(bad); err == nil {
+			t.Errorf("CheckPadding(%q) accepted", bad)
+		}
+	}
+}
+
+func TestPadUnpad(t *testing.T) {
+	for _, payload := range [][]byte{nil, {0}, {0x80}, {1, 0, 0}, bytes.Repeat([]byte{0x80, 0}, 100)} {
+		padded, err := pad(payload, "block:64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(padded)%64 != 0 {
+			t.Fatalf("padded to %d bytes", len(padded))
+		}
+		got, err := unpad(padded)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("unpad(pad(%x)) = %x, %v", payload, got, err)
+		}
+	}
+}
+
+func TestUnpadMalformed(t *testing.T) {
+	for _, bad := range [][]byte{nil, {0}, {0, 0}, {1}, {0x80, 1}} {
+		if _, err := unpad(bad); !errors.Is(err, ErrMalformed) {
+			t.Errorf("unpad(%x): got %v, want ErrMalformed", bad, err)
+		}
+	}
+}
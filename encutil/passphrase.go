@@ -0,0 +1,220 @@
+package encutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Passphrase files wrap the file key under a key stretched from a
+// passphrase with Argon2id. The salt and cost parameters go into the
+// stanza, so a file opens with the parameters it was written with
+// whatever the defaults are by then, and a file whose cost was raised
+// for it needs nothing more than the passphrase.
+
+// PassphraseStanza is the stanza type of passphrase recipients.
+const PassphraseStanza = "argon2id"
+
+const (
+	argon2SaltSize = 16
+
+	// Upper bounds on what a stanza may ask an identity to spend, so a
+	// crafted file cannot make decryption allocate or loop without end.
+	MaxArgon2Memory  = 4 << 20 // KiB, 4 GiB
+	MaxArgon2Time    = 64
+	MaxArgon2Threads = 64
+	minArgon2Memory  = 8 // KiB per thread, as the spec requires
+)
+
+// Argon2Params are the Argon2id cost parameters: passes over memory,
+// memory in KiB and parallelism.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// KDF presets, as libsodium names them: interactive for keys typed often,
+// moderate as the default, sensitive for files opened rarely.
+var kdfPresets = map[string]Argon2Params{
+	"interactive": {Time: 2, Memory: 64 << 10, Threads: 1},
+	"moderate":    {Time: 3, Memory: 256 << 10, Threads: 1},
+	"sensitive":   {Time: 4, Memory: 1 << 20, Threads: 1},
+}
+
+// KDFPresetNames lists the names KDFPreset accepts, cheapest first.
+func KDFPresetNames() []string {
+	names := make([]string, 0, len(kdfPresets))
+	for name := range kdfPresets {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return int(kdfPresets[a].Memory) - int(kdfPresets[b].Memory)
+	})
+	return names
+}
+
+// KDFPreset returns the parameters of a named preset, or parses them from
+// the "t=3,m=262144,p=1" form String writes.
+func KDFPreset(name string) (Argon2Params, error) {
+	if p, ok := kdfPresets[name]; ok {
+		return p, nil
+	}
+	if !strings.Contains(name, "=") {
+		return Argon2Params{}, fmt.Errorf("unknown kdf preset %q, want %s or t=N,m=KIB,p=N", name, strings.Join(KDFPresetNames(), ", "))
+	}
+	return ParseArgon2Params(name)
+}
+
+// ParseArgon2Params parses parameters in the form String writes.
+func ParseArgon2Params(s string) (Argon2Params, error) {
+	var p Argon2Params
+	seen := map[string]bool{}
+	for _, field := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(field, "=")
+		n, err := strconv.ParseUint(v, 10, 32)
+		if !ok || err != nil || seen[k] {
+			return p, fmt.Errorf("malformed argon2id parameters %q", s)
+		}
+		seen[k] = true
+		switch k {
+		case "t":
+			p.Time = uint32(n)
+		case "m":
+			p.Memory = uint32(n)
+		case "p":
+			if n > 255 {
+				return p, fmt.Errorf("argon2id parallelism %d", n)
+			}
+			p.Threads = uint8(n)
+		default:
+			return p, fmt.Errorf("malformed argon2id parameters %q", s)
+		}
+	}
+	if len(seen) != 3 {
+		return p, fmt.Errorf("argon2id parameters %q need t, m and p", s)
+	}
+	return p, p.check()
+}
+
+func (p Argon2Params) String() string {
+	return fmt.Sprintf("t=%d,m=%d,p=%d", p.Time, p.Memory, p.Threads)
+}
+
+func (p Argon2Params) check() error {
+	switch {
+	case p.Time < 1 || p.Time > MaxArgon2Time:
+		return fmt.Errorf("argon2id time %d, want 1 to %d", p.Time, MaxArgon2Time)
+	case p.Threads < 1 || p.Threads > MaxArgon2Threads:
+		return fmt.Errorf("argon2id parallelism %d, want 1 to %d", p.Threads, MaxArgon2Threads)
+	case p.Memory < minArgon2Memory*uint32(p.Threads) || p.Memory > MaxArgon2Memory:
+		return fmt.Errorf("argon2id memory %d KiB, want %d to %d", p.Memory, minArgon2Memory*uint32(p.Threads), MaxArgon2Memory)
+	}
+	return nil
+}
+
+func (p Argon2Params) key(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Threads, 32)
+}
+
+// CalibrateArgon2 picks the number of passes that makes one derivation
+// with the given memory and parallelism take about target on this
+// machine. If a single pass already takes longer, memory is halved until
+// it does not, down to 64 MiB.
+func CalibrateArgon2(target time.Duration, memory uint32, threads uint8) (Argon2Params, time.Duration, error) {
+	p := Argon2Params{Time: 1, Memory: memory, Threads: threads}
+	if err := p.check(); err != nil {
+		return p, 0, err
+	}
+	salt := make([]byte, argon2SaltSize)
+	measure := func() time.Duration {
+		start := time.Now()
+		p.key([]byte("calibration"), salt)
+		return time.Since(start)
+	}
+	took := measure()
+	for took > target && p.Memory/2 >= 64<<10 {
+		p.Memory /= 2
+		took = measure()
+	}
+	if n := target / max(took, time.Millisecond); n > 1 {
+		p.Time = uint32(min(n, MaxArgon2Time))
+		took = measure()
+	}
+	return p, took, nil
+}
+
+// PassphraseRecipient wraps the file key under a passphrase. It is both
+// a Recipient and an Identity; as an Identity the parameters are taken
+// from the stanza.
+type PassphraseRecipient struct {
+	passphrase []byte
+	params     Argon2Params
+}
+
+func NewPassphraseRecipient(passphrase []byte, params Argon2Params) (*PassphraseRecipient, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if err := params.check(); err != nil {
+		return nil, err
+	}
+	return &PassphraseRecipient{passphrase: passphrase, params: params}, nil
+}
+
+func (r *PassphraseRecipient) Wrap(fileKey []byte) (*Stanza, error) {
+	salt := make([]byte, argon2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	body, err := sealKey(r.params.key(r.passphrase, salt), fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Stanza{
+		Type: PassphraseStanza,
+		Args: []string{base64.RawStdEncoding.EncodeToString(salt), r.params.String()},
+		Body: body,
+	}, nil
+}
+
+func (r *PassphraseRecipient) Unwrap(s *Stanza) ([]byte, error) {
+	if s.Type != PassphraseStanza {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(s.Args) != 2 {
+		return nil, fmt.Errorf("%w: argon2id stanza with %d arguments", ErrMalformed, len(s.Args))
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(s.Args[0])
+	if err != nil || len(salt) != argon2SaltSize {
+		return nil, fmt.Errorf("%w: argon2id salt", ErrMalformed)
+	}
+	params, err := ParseArgon2Params(s.Args[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	fileKey, err := openKey(params.key(r.passphrase, salt), s.Body)
+	if errors.Is(err, ErrMalformed) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return fileKey, nil
+}
+
+// StanzaArgon2Params returns the parameters recorded in a passphrase
+// stanza.
+func StanzaArgon2Params(s *Stanza) (Argon2Params, error) {
+	if s.Type != PassphraseStanza || len(s.Args) != 2 {
+		return Argon2Params{}, errors.New("not a passphrase stanza")
+	}
+	return ParseArgon2Params(s.Args[1])
+}
@@ -0,0 +1,100 @@
+package encutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// EncryptPipe and DecryptPipe connect a producer or consumer goroutine to
+// encryption with an io.Pipe, so embedders do not have to get the
+// shutdown order right themselves: whichever side fails first closes the
+// pipe with its error, which unblocks the other side, and the first error
+// is returned once both have stopped. Cancelling ctx does the same.
+//
+// The format authenticates the whole payload at once, so the plaintext is
+// buffered before encryption and the ciphertext before decryption, up to
+// the given limit. produce and consume should return once a write or
+// read fails.
+
+// ErrInputTooLarge is returned when a pipe's producer writes more than
+// the buffering limit.
+var ErrInputTooLarge = errors.New("input exceeds the buffering limit")
+
+// EncryptPipe runs produce in a goroutine, encrypts everything it writes
+// (at most maxSize bytes, 0 for no limit) and writes the result to dst.
+func EncryptPipe(ctx context.Context, dst io.Writer, produce func(w io.Writer) error, maxSize int64, opts EncryptOptions, recipients ...Recipient) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	stop := context.AfterFunc(ctx, func() { pw.CloseWithError(ctx.Err()) })
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		err := produce(pw)
+		pw.CloseWithError(err) // nil closes with EOF
+		done <- err
+	}()
+
+	var plain bytes.Buffer
+	_, err := CopyLimited(&plain, pr, maxSize)
+	if errors.Is(err, ErrOutputTooLarge) {
+		err = ErrInputTooLarge
+	}
+	pr.CloseWithError(err) // unblock a producer still writing
+	if perr := <-done; err == nil {
+		err = perr
+	}
+	if err != nil {
+		return err
+	}
+	out, err := EncryptWith(plain.Bytes(), opts, recipients...)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(out)
+	return err
+}
+
+// DecryptPipe reads a file from src (at most maxInput bytes, 0 for no
+// limit), and runs consume on the decrypted stream while it is
+// decompressed, with opts.MaxSize bounding what consume can be sent.
+// If consume returns early, decryption stops.
+func DecryptPipe(ctx context.Context, src io.Reader, consume func(r io.Reader) error, maxInput int64, opts DecryptOptions, identities ...Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var data bytes.Buffer
+	_, err := CopyLimited(&data, src, maxInput)
+	if errors.Is(err, ErrOutputTooLarge) {
+		err = ErrInputTooLarge
+	}
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	stop := context.AfterFunc(ctx, func() { pw.CloseWithError(ctx.Err()) })
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := DecryptWith(pw, data.Bytes(), opts, identities...)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	err = consume(pr)
+	if err != nil {
+		pr.CloseWithError(err) // unblock the decryptor
+	} else {
+		// Drain so an authentication or size error after the last byte
+		// consume wanted is still reported.
+		_, err = io.Copy(io.Discard, pr)
+	}
+	if derr := <-done; err == nil {
+		err = derr
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package encutil
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// Header.Sealed holds metadata that only the recipients may read, for
+// now a Canary. It is sealed under a key derived from the file key, and
+// sits in the header, so it is also authenticated as associated data of
+// the payload. Decryption only opens it once the payload has
+// authenticated, so nothing in it is acted on for a file that does not
+// decrypt.
+
+// maxSealed bounds Header.Sealed.
+const maxSealed = 4096
+
+type sealedMeta struct {
+	Canary *Canary `json:"canary,omitempty"`
+}
+
+func sealedAEAD(fileKey []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, fileKey, nil, "encutitl sealed header", 32)
+}
+
+// sealMeta returns the Header.Sealed value for m, nil if m is empty.
+func sealMeta(fileKey []byte, m sealedMeta) ([]byte, error) {
+	if m.Canary == nil {
+		return nil, nil
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	key, err := sealedAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	clear(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, body, nil), nil
+}
+
+// openMeta opens hdr.Sealed.
+func openMeta(fileKey []byte, hdr *Header) (sealedMeta, error) {
+	var m sealedMeta
+	if hdr.Sealed == nil {
+		return m, nil
+	}
+	key, err := sealedAEAD(fileKey)
+	if err != nil {
+		return m, err
+	}
+	gcm, err := newGCM(key)
+	clear(key)
+	if err != nil {
+		return m, err
+	}
+	if len(hdr.Sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return m, fmt.Errorf("%w: sealed header too short", ErrMalformed)
+	}
+	body, err := gcm.Open(nil, hdr.Sealed[:gcm.NonceSize()], hdr.Sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return m, fmt.Errorf("sealed header: %w", err)
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, fmt.Errorf("%w: sealed header: %w", ErrMalformed, err)
+	}
+	return m, nil
+}
+
+// opened tells opts.OnCanary about the canary in hdr, once the payload
+// has authenticated.
+func opened(fileKey []byte, hdr *Header, opts DecryptOptions) error {
+	if opts.OnCanary == nil || hdr.Sealed == nil {
+		return nil
+	}
+	m, err := openMeta(fileKey, hdr)
+	if err != nil {
+		return err
+	}
+	if m.Canary != nil {
+		opts.OnCanary(m.Canary)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package encutil
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shamir secret sharing over GF(2^8) with the AES polynomial
+// x^8 + x^4 + x^3 + x + 1, one random polynomial per secret byte. Share
+// x coordinates are 1..n; the secret is the value at x = 0.
+
+// Share is one point set of a split secret.
+type Share struct {
+	Threshold byte
+	X         byte
+	Y         []byte
+}
+
+// SplitSecret splits secret into n shares, any threshold of which recover
+// it.
+func SplitSecret(secret []byte, n, threshold int) ([]Share, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("need 2 <= threshold <= shares <= 255, got %d of %d", threshold, n)
+	}
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{Threshold: byte(threshold), X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	coeffs := make([]byte, threshold)
+	for b, s := range secret {
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		coeffs[0] = s
+		for i := range shares {
+			// Horner's rule.
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, shares[i].X) ^ coeffs[c]
+			}
+			shares[i].Y[b] = y
+		}
+	}
+	clear(coeffs)
+	return shares, nil
+}
+
+// CombineShares recovers the secret by Lagrange interpolation at x = 0.
+func CombineShares(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	t := int(shares[0].Threshold)
+	if t < 2 {
+		return nil, fmt.Errorf("invalid share threshold %d", t)
+	}
+	if len(shares) < t {
+		return nil, fmt.Errorf("need %d shares, have %d", t, len(shares))
+	}
+	shares = shares[:t]
+	seen := map[byte]bool{}
+	for _, s := range shares {
+		if int(s.Threshold) != t || len(s.Y) != len(shares[0].Y) {
+			return nil, errors.New("shares are from different splits")
+		}
+		if s.X == 0 || seen[s.X] {
+			return nil, fmt.Errorf("duplicate or invalid share %d", s.X)
+		}
+		seen[s.X] = true
+	}
+
+	secret := make([]byte, len(shares[0].Y))
+	for i, si := range shares {
+		// Lagrange basis at 0: prod x_j / (x_j - x_i), and - is ^ here.
+		basis := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(sj.X, sj.X^si.X))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(si.Y[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// gfMul is branch free so timing does not depend on secret bytes.
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gfDiv computes a / b as a * b^254, since b^255 = 1.
+func gfDiv(a, b byte) byte {
+	inv := byte(1)
+	for range 254 {
+		inv = gfMul(inv, b)
+	}
+	return gfMul(a, inv)
+}
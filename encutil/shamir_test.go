@@ -0,0 +1,78 @@
+package encutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	for _, tt := range []struct{ n, threshold int }{{2, 2}, {3, 2}, {5, 3}, {10, 10}, {255, 4}} {
+		shares, err := SplitSecret(secret, tt.n, tt.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Any threshold shares will do, in any order.
+		for start := 0; start+tt.threshold <= tt.n; start += tt.threshold {
+			subset := shares[start : start+tt.threshold]
+			got, err := CombineShares([]Share{subset[len(subset)-1]})
+			if err == nil && tt.threshold > 1 {
+				t.Fatalf("%d of %d: one share recovered %x", tt.threshold, tt.n, got)
+			}
+			got, err = CombineShares(subset)
+			if err != nil {
+				t.Fatalf("%d of %d: %v", tt.threshold, tt.n, err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Fatalf("%d of %d: recovered %x", tt.threshold, tt.n, got)
+			}
+		}
+	}
+}
+
+func TestSplitSecretBounds(t *testing.T) {
+	for _, tt := range []struct{ n, threshold int }{{3, 1}, {3, 0}, {2, 3}, {256, 2}} {
+		if _, err := SplitSecret([]byte("x"), tt.n, tt.threshold); err == nil {
+			t.Errorf("split %d of %d accepted", tt.threshold, tt.n)
+		}
+	}
+}
+
+func TestCombineSharesMalformed(t *testing.T) {
+	shares, err := SplitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := SplitSecret([]byte("other secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		shares []Share
+	}{
+		{"none", nil},
+		{"threshold 0", []Share{{Threshold: 0, X: 1, Y: []byte("a")}}},
+		{"threshold 1", []Share{{Threshold: 1, X: 1, Y: []byte("a")}}},
+		{"too few", shares[:1]},
+		{"duplicate", []Share{shares[0], shares[0]}},
+		{"x of 0", []Share{shares[0], {Threshold: 2, X: 0, Y: shares[1].Y}}},
+		{"different thresholds", []Share{shares[0], {Threshold: 3, X: 2, Y: shares[1].Y}}},
+		{"different lengths", []Share{shares[0], other[1]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CombineShares(tt.shares); err == nil {
+				t.Fatal("combined")
+			}
+		})
+	}
+}
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul(gfDiv(1, byte(a)), byte(a)); got != 1 {
+			t.Fatalf("%d * 1/%d = %d", a, a, got)
+		}
+	}
+}
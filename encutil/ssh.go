@@ -0,0 +1,257 @@
+package encutil
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH recipients let files be encrypted to the ssh-ed25519 and ssh-rsa
+// keys people already have. Ed25519 keys are converted to their X25519
+// form and used for an ephemeral-static ECDH, RSA keys wrap the file key
+// with OAEP. A plain ssh-agent cannot be used for decryption since
+// agents only expose signing; encutitl's own agent adds an extension for
+// unwrapping.
+
+const (
+	sshEd25519Label = "encutitl/ssh-ed25519"
+	sshRSALabel     = "encutitl/ssh-rsa"
+)
+
+type SSHRecipient struct {
+	pub ssh.PublicKey
+}
+
+// ParseSSHRecipient parses a public key in authorized_keys format. For a
+// certificate the certified key is the recipient.
+func ParseSSHRecipient(line string) (*SSHRecipient, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("malformed ssh public key: %w", err)
+	}
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+	switch pub.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoRSA:
+	default:
+		return nil, fmt.Errorf("unsupported ssh key type %q", pub.Type())
+	}
+	return &SSHRecipient{pub: pub}, nil
+}
+
+func (r *SSHRecipient) String() string {
+	return ssh.FingerprintSHA256(r.pub)
+}
+
+func (r *SSHRecipient) Wrap(fileKey []byte) (*Stanza, error) {
+	tag := sshTag(r.pub)
+	switch r.pub.Type() {
+	case ssh.KeyAlgoED25519:
+		edPub := r.pub.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey)
+		xPub, err := ed25519PublicToX25519(edPub)
+		if err != nil {
+			return nil, err
+		}
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := eph.ECDH(xPub)
+		if err != nil {
+			return nil, err
+		}
+		share := eph.PublicKey().Bytes()
+		wrapKey, err := x25519WrapKey(shared, share, xPub.Bytes(), sshEd25519Label)
+		if err != nil {
+			return nil, err
+		}
+		body, err := sealKey(wrapKey, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		return &Stanza{
+			Type: ssh.KeyAlgoED25519,
+			Args: []string{tag, base64.RawStdEncoding.EncodeToString(share)},
+			Body: body,
+		}, nil
+	case ssh.KeyAlgoRSA:
+		rsaPub := r.pub.(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey)
+		body, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, fileKey, []byte(sshRSALabel))
+		if err != nil {
+			return nil, err
+		}
+		return &Stanza{Type: ssh.KeyAlgoRSA, Args: []string{tag}, Body: body}, nil
+	}
+	return nil, fmt.Errorf("unsupported ssh key type %q", r.pub.Type())
+}
+
+// SSHIdentity decrypts stanzas addressed to an SSH private key. Encrypted
+// private keys are only decrypted once a matching stanza is found.
+type SSHIdentity struct {
+	pub        ssh.PublicKey
+	pemBytes   []byte
+	passphrase func() ([]byte, error)
+	key        crypto.PrivateKey
+}
+
+// ParseSSHIdentity parses an OpenSSH or PEM private key. passphrase is
+// called at most once, and only if the key is encrypted and needed.
+func ParseSSHIdentity(pemBytes []byte, passphrase func() ([]byte, error)) (*SSHIdentity, error) {
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if missing.PublicKey == nil {
+			return nil, errors.New("encrypted ssh key without embedded public key, convert it to the OpenSSH format")
+		}
+		return &SSHIdentity{pub: missing.PublicKey, pemBytes: pemBytes, passphrase: passphrase}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHIdentity{pub: signer.PublicKey(), key: key}, nil
+}
+
+func (i *SSHIdentity) Unwrap(s *Stanza) ([]byte, error) {
+	if s.Type != i.pub.Type() || len(s.Args) == 0 || s.Args[0] != sshTag(i.pub) {
+		return nil, ErrIncorrectIdentity
+	}
+	key, err := i.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		return unwrapSSHEd25519(*k, s)
+	case ed25519.PrivateKey:
+		return unwrapSSHEd25519(k, s)
+	case *rsa.PrivateKey:
+		return rsa.DecryptOAEP(sha256.New(), nil, k, s.Body, []byte(sshRSALabel))
+	}
+	return nil, fmt.Errorf("unsupported ssh private key %T", key)
+}
+
+// PublicKey returns the public half of the identity.
+func (i *SSHIdentity) PublicKey() ssh.PublicKey { return i.pub }
+
+// Signer returns the key for signing, decrypting it first if needed.
+func (i *SSHIdentity) Signer() (ssh.Signer, error) {
+	key, err := i.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+func (i *SSHIdentity) privateKey() (crypto.PrivateKey, error) {
+	if i.key != nil {
+		return i.key, nil
+	}
+	if i.passphrase == nil {
+		return nil, errors.New("ssh key is encrypted and no passphrase is available")
+	}
+	pass, err := i.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(i.pemBytes, pass)
+	if err != nil {
+		return nil, err
+	}
+	i.key = key
+	return key, nil
+}
+
+func unwrapSSHEd25519(priv ed25519.PrivateKey, s *Stanza) ([]byte, error) {
+	if len(s.Args) != 2 {
+		return nil, errors.New("malformed ssh-ed25519 stanza")
+	}
+	share, err := base64.RawStdEncoding.DecodeString(s.Args[1])
+	if err != nil {
+		return nil, errors.New("malformed ssh-ed25519 stanza")
+	}
+	h := sha512.Sum512(priv.Seed())
+	xPriv, err := ecdh.X25519().NewPrivateKey(h[:32])
+	clear(h[:])
+	if err != nil {
+		return nil, err
+	}
+	ephPub, err := ecdh.X25519().NewPublicKey(share)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := xPriv.ECDH(ephPub)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := x25519WrapKey(shared, share, xPriv.PublicKey().Bytes(), sshEd25519Label)
+	if err != nil {
+		return nil, err
+	}
+	return openKey(wrapKey, s.Body)
+}
+
+// x25519WrapKey zeroes the shared secret it is given.
+func x25519WrapKey(shared, share, recipient []byte, label string) ([]byte, error) {
+	defer clear(shared)
+	salt := append(append([]byte{}, share...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, label, 32)
+}
+
+func sshTag(pub ssh.PublicKey) string {
+	sum := sha256.Sum256(pub.Marshal())
+	return base64.RawStdEncoding.EncodeToString(sum[:4])
+}
+
+var curve25519P, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+
+// ed25519PublicToX25519 maps an Edwards point to its Montgomery u
+// coordinate, u = (1 + y) / (1 - y).
+func ed25519PublicToX25519(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	le := make([]byte, 32)
+	copy(le, pub)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	den.ModInverse(den, curve25519P)
+	u := num.Mul(num, den)
+	u.Mod(u, curve25519P)
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	return ecdh.X25519().NewPublicKey(reverse(out))
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
@@ -0,0 +1,5 @@
+// Package encutilpb holds the generated Go client and server stubs of the
+// encutitl gRPC service defined in encutitl.proto.
+package encutilpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative encutitl.proto
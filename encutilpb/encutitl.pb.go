@@ -0,0 +1,489 @@
+// The encutitl gRPC service, served by `encutitl serve-grpc`. The Go
+// stubs in this directory are generated from it, see doc.go.
+//
+// Requests need an "authorization: Bearer TOKEN" metadata entry unless
+// the server runs with --no-auth. Errors use the standard gRPC codes.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: encutitl.proto
+
+package encutilpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type KeyType int32
+
+const (
+	KeyType_KEY_TYPE_UNSPECIFIED KeyType = 0
+	// A 32-byte symmetric key, as in key.bin.
+	KeyType_KEY_TYPE_SYMMETRIC KeyType = 1
+	// An SSH ed25519 key pair.
+	KeyType_KEY_TYPE_ED25519 KeyType = 2
+	// A hybrid ML-KEM-768 + X25519 key pair, as in pq.key.
+	KeyType_KEY_TYPE_HYBRID KeyType = 3
+)
+
+// Enum value maps for KeyType.
+var (
+	KeyType_name = map[int32]string{
+		0: "KEY_TYPE_UNSPECIFIED",
+		1: "KEY_TYPE_SYMMETRIC",
+		2: "KEY_TYPE_ED25519",
+		3: "KEY_TYPE_HYBRID",
+	}
+	KeyType_value = map[string]int32{
+		"KEY_TYPE_UNSPECIFIED": 0,
+		"KEY_TYPE_SYMMETRIC":   1,
+		"KEY_TYPE_ED25519":     2,
+		"KEY_TYPE_HYBRID":      3,
+	}
+)
+
+func (x KeyType) Enum() *KeyType {
+	p := new(KeyType)
+	*p = x
+	return p
+}
+
+func (x KeyType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (KeyType) Descriptor() protoreflect.EnumDescriptor {
+	return file_encutitl_proto_enumTypes[0].Descriptor()
+}
+
+func (KeyType) Type() protoreflect.EnumType {
+	return &file_encutitl_proto_enumTypes[0]
+}
+
+func (x KeyType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use KeyType.Descriptor instead.
+func (KeyType) EnumDescriptor() ([]byte, []int) {
+	return file_encutitl_proto_rawDescGZIP(), []int{0}
+}
+
+type Chunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Chunk) Reset() {
+	*x = Chunk{}
+	mi := &file_encutitl_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Chunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chunk) ProtoMessage() {}
+
+func (x *Chunk) ProtoReflect() protoreflect.Message {
+	mi := &file_encutitl_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chunk.ProtoReflect.Descriptor instead.
+func (*Chunk) Descriptor() ([]byte, []int) {
+	return file_encutitl_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Chunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type GenerateKeyRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Type  KeyType                `protobuf:"varint,1,opt,name=type,proto3,enum=encutitl.v1.KeyType" json:"type,omitempty"`
+	// Comment of an ed25519 public key.
+	Comment string `protobuf:"bytes,2,opt,name=comment,proto3" json:"comment,omitempty"`
+	// Encrypts an ed25519 private key, if set.
+	Passphrase    string `protobuf:"bytes,3,opt,name=passphrase,proto3" json:"passphrase,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GenerateKeyRequest) Reset() {
+	*x = GenerateKeyRequest{}
+	mi := &file_encutitl_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GenerateKeyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GenerateKeyRequest) ProtoMessage() {}
+
+func (x *GenerateKeyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encutitl_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GenerateKeyRequest.ProtoReflect.Descriptor instead.
+func (*GenerateKeyRequest) Descriptor() ([]byte, []int) {
+	return file_encutitl_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *GenerateKeyRequest) GetType() KeyType {
+	if x != nil {
+		return x.Type
+	}
+	return KeyType_KEY_TYPE_UNSPECIFIED
+}
+
+func (x *GenerateKeyRequest) GetComment() string {
+	if x != nil {
+		return x.Comment
+	}
+	return ""
+}
+
+func (x *GenerateKeyRequest) GetPassphrase() string {
+	if x != nil {
+		return x.Passphrase
+	}
+	return ""
+}
+
+type GenerateKeyResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The key file: raw bytes for symmetric keys, OpenSSH PEM for ed25519,
+	// the identity file for hybrid keys.
+	PrivateKey []byte `protobuf:"bytes,1,opt,name=private_key,json=privateKey,proto3" json:"private_key,omitempty"`
+	// The recipient to encrypt to, or the key ID of a symmetric key.
+	PublicKey     string `protobuf:"bytes,2,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GenerateKeyResponse) Reset() {
+	*x = GenerateKeyResponse{}
+	mi := &file_encutitl_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GenerateKeyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GenerateKeyResponse) ProtoMessage() {}
+
+func (x *GenerateKeyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_encutitl_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GenerateKeyResponse.ProtoReflect.Descriptor instead.
+func (*GenerateKeyResponse) Descriptor() ([]byte, []int) {
+	return file_encutitl_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *GenerateKeyResponse) GetPrivateKey() []byte {
+	if x != nil {
+		return x.PrivateKey
+	}
+	return nil
+}
+
+func (x *GenerateKeyResponse) GetPublicKey() string {
+	if x != nil {
+		return x.PublicKey
+	}
+	return ""
+}
+
+type InspectRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InspectRequest) Reset() {
+	*x = InspectRequest{}
+	mi := &file_encutitl_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InspectRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InspectRequest) ProtoMessage() {}
+
+func (x *InspectRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encutitl_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InspectRequest.ProtoReflect.Descriptor instead.
+func (*InspectRequest) Descriptor() ([]byte, []int) {
+	return file_encutitl_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *InspectRequest) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type InspectResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// encutitl, legacy, jwe or age.
+	Format      string `protobuf:"bytes,1,opt,name=format,proto3" json:"format,omitempty"`
+	Cipher      string `protobuf:"bytes,2,opt,name=cipher,proto3" json:"cipher,omitempty"`
+	Compression string `protobuf:"bytes,3,opt,name=compression,proto3" json:"compression,omitempty"`
+	AadRequired bool   `protobuf:"varint,4,opt,name=aad_required,json=aadRequired,proto3" json:"aad_required,omitempty"`
+	Padding     string `protobuf:"bytes,5,opt,name=padding,proto3" json:"padding,omitempty"`
+	Convergent  bool   `protobuf:"varint,6,opt,name=convergent,proto3" json:"convergent,omitempty"`
+	// One entry per recipient, e.g. "ssh-ed25519 SHA256:..." or "key 1a2b3c4d".
+	Recipients    []string `protobuf:"bytes,7,rep,name=recipients,proto3" json:"recipients,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InspectResponse) Reset() {
+	*x = InspectResponse{}
+	mi := &file_encutitl_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InspectResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InspectResponse) ProtoMessage() {}
+
+func (x *InspectResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_encutitl_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InspectResponse.ProtoReflect.Descriptor instead.
+func (*InspectResponse) Descriptor() ([]byte, []int) {
+	return file_encutitl_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *InspectResponse) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *InspectResponse) GetCipher() string {
+	if x != nil {
+		return x.Cipher
+	}
+	return ""
+}
+
+func (x *InspectResponse) GetCompression() string {
+	if x != nil {
+		return x.Compression
+	}
+	return ""
+}
+
+func (x *InspectResponse) GetAadRequired() bool {
+	if x != nil {
+		return x.AadRequired
+	}
+	return false
+}
+
+func (x *InspectResponse) GetPadding() string {
+	if x != nil {
+		return x.Padding
+	}
+	return ""
+}
+
+func (x *InspectResponse) GetConvergent() bool {
+	if x != nil {
+		return x.Convergent
+	}
+	return false
+}
+
+func (x *InspectResponse) GetRecipients() []string {
+	if x != nil {
+		return x.Recipients
+	}
+	return nil
+}
+
+var File_encutitl_proto protoreflect.FileDescriptor
+
+const file_encutitl_proto_rawDesc = "" +
+	"\n" +
+	"\x0eencutitl.proto\x12\vencutitl.v1\"\x1b\n" +
+	"\x05Chunk\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\"x\n" +
+	"\x12GenerateKeyRequest\x12(\n" +
+	"\x04type\x18\x01 \x01(\x0e2\x14.encutitl.v1.KeyTypeR\x04type\x12\x18\n" +
+	"\acomment\x18\x02 \x01(\tR\acomment\x12\x1e\n" +
+	"\n" +
+	"passphrase\x18\x03 \x01(\tR\n" +
+	"passphrase\"U\n" +
+	"\x13GenerateKeyResponse\x12\x1f\n" +
+	"\vprivate_key\x18\x01 \x01(\fR\n" +
+	"privateKey\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\x02 \x01(\tR\tpublicKey\"$\n" +
+	"\x0eInspectRequest\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\"\xe0\x01\n" +
+	"\x0fInspectResponse\x12\x16\n" +
+	"\x06format\x18\x01 \x01(\tR\x06format\x12\x16\n" +
+	"\x06cipher\x18\x02 \x01(\tR\x06cipher\x12 \n" +
+	"\vcompression\x18\x03 \x01(\tR\vcompression\x12!\n" +
+	"\faad_required\x18\x04 \x01(\bR\vaadRequired\x12\x18\n" +
+	"\apadding\x18\x05 \x01(\tR\apadding\x12\x1e\n" +
+	"\n" +
+	"convergent\x18\x06 \x01(\bR\n" +
+	"convergent\x12\x1e\n" +
+	"\n" +
+	"recipients\x18\a \x03(\tR\n" +
+	"recipients*f\n" +
+	"\aKeyType\x12\x18\n" +
+	"\x14KEY_TYPE_UNSPECIFIED\x10\x00\x12\x16\n" +
+	"\x12KEY_TYPE_SYMMETRIC\x10\x01\x12\x14\n" +
+	"\x10KEY_TYPE_ED25519\x10\x02\x12\x13\n" +
+	"\x0fKEY_TYPE_HYBRID\x10\x032\x90\x02\n" +
+	"\bEncutitl\x125\n" +
+	"\aEncrypt\x12\x12.encutitl.v1.Chunk\x1a\x12.encutitl.v1.Chunk(\x010\x01\x125\n" +
+	"\aDecrypt\x12\x12.encutitl.v1.Chunk\x1a\x12.encutitl.v1.Chunk(\x010\x01\x12P\n" +
+	"\vGenerateKey\x12\x1f.encutitl.v1.GenerateKeyRequest\x1a .encutitl.v1.GenerateKeyResponse\x12D\n" +
+	"\aInspect\x12\x1b.encutitl.v1.InspectRequest\x1a\x1c.encutitl.v1.InspectResponseB/Z-gitlab.com/EvnMiller/encryptutiltui/encutilpbb\x06proto3"
+
+var (
+	file_encutitl_proto_rawDescOnce sync.Once
+	file_encutitl_proto_rawDescData []byte
+)
+
+func file_encutitl_proto_rawDescGZIP() []byte {
+	file_encutitl_proto_rawDescOnce.Do(func() {
+		file_encutitl_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_encutitl_proto_rawDesc), len(file_encutitl_proto_rawDesc)))
+	})
+	return file_encutitl_proto_rawDescData
+}
+
+var file_encutitl_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_encutitl_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_encutitl_proto_goTypes = []any{
+	(KeyType)(0),                // 0: encutitl.v1.KeyType
+	(*Chunk)(nil),               // 1: encutitl.v1.Chunk
+	(*GenerateKeyRequest)(nil),  // 2: encutitl.v1.GenerateKeyRequest
+	(*GenerateKeyResponse)(nil), // 3: encutitl.v1.GenerateKeyResponse
+	(*InspectRequest)(nil),      // 4: encutitl.v1.InspectRequest
+	(*InspectResponse)(nil),     // 5: encutitl.v1.InspectResponse
+}
+var file_encutitl_proto_depIdxs = []int32{
+	0, // 0: encutitl.v1.GenerateKeyRequest.type:type_name -> encutitl.v1.KeyType
+	1, // 1: encutitl.v1.Encutitl.Encrypt:input_type -> encutitl.v1.Chunk
+	1, // 2: encutitl.v1.Encutitl.Decrypt:input_type -> encutitl.v1.Chunk
+	2, // 3: encutitl.v1.Encutitl.GenerateKey:input_type -> encutitl.v1.GenerateKeyRequest
+	4, // 4: encutitl.v1.Encutitl.Inspect:input_type -> encutitl.v1.InspectRequest
+	1, // 5: encutitl.v1.Encutitl.Encrypt:output_type -> encutitl.v1.Chunk
+	1, // 6: encutitl.v1.Encutitl.Decrypt:output_type -> encutitl.v1.Chunk
+	3, // 7: encutitl.v1.Encutitl.GenerateKey:output_type -> encutitl.v1.GenerateKeyResponse
+	5, // 8: encutitl.v1.Encutitl.Inspect:output_type -> encutitl.v1.InspectResponse
+	5, // [5:9] is the sub-list for method output_type
+	1, // [1:5] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_encutitl_proto_init() }
+func file_encutitl_proto_init() {
+	if File_encutitl_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_encutitl_proto_rawDesc), len(file_encutitl_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_encutitl_proto_goTypes,
+		DependencyIndexes: file_encutitl_proto_depIdxs,
+		EnumInfos:         file_encutitl_proto_enumTypes,
+		MessageInfos:      file_encutitl_proto_msgTypes,
+	}.Build()
+	File_encutitl_proto = out.File
+	file_encutitl_proto_goTypes = nil
+	file_encutitl_proto_depIdxs = nil
+}
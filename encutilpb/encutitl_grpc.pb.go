@@ -0,0 +1,244 @@
+// The encutitl gRPC service, served by `encutitl serve-grpc`. The Go
+// stubs in this directory are generated from it, see doc.go.
+//
+// Requests need an "authorization: Bearer TOKEN" metadata entry unless
+// the server runs with --no-auth. Errors use the standard gRPC codes.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: encutitl.proto
+
+package encutilpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Encutitl_Encrypt_FullMethodName     = "/encutitl.v1.Encutitl/Encrypt"
+	Encutitl_Decrypt_FullMethodName     = "/encutitl.v1.Encutitl/Decrypt"
+	Encutitl_GenerateKey_FullMethodName = "/encutitl.v1.Encutitl/GenerateKey"
+	Encutitl_Inspect_FullMethodName     = "/encutitl.v1.Encutitl/Inspect"
+)
+
+// EncutitlClient is the client API for Encutitl service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type EncutitlClient interface {
+	// Encrypt encrypts the data of all request chunks, in order, to the
+	// server's recipients and streams back the encrypted file.
+	Encrypt(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Chunk, Chunk], error)
+	// Decrypt takes a file in any format the server reads, in chunks, and
+	// streams back the plaintext.
+	Decrypt(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Chunk, Chunk], error)
+	// GenerateKey makes a new key pair. The server keeps no copy.
+	GenerateKey(ctx context.Context, in *GenerateKeyRequest, opts ...grpc.CallOption) (*GenerateKeyResponse, error)
+	// Inspect reports what can be read off a file without its key. The
+	// start of the file, up to the end of its header, is enough.
+	Inspect(ctx context.Context, in *InspectRequest, opts ...grpc.CallOption) (*InspectResponse, error)
+}
+
+type encutitlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEncutitlClient(cc grpc.ClientConnInterface) EncutitlClient {
+	return &encutitlClient{cc}
+}
+
+func (c *encutitlClient) Encrypt(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Chunk, Chunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Encutitl_ServiceDesc.Streams[0], Encutitl_Encrypt_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Chunk, Chunk]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Encutitl_EncryptClient = grpc.BidiStreamingClient[Chunk, Chunk]
+
+func (c *encutitlClient) Decrypt(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Chunk, Chunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Encutitl_ServiceDesc.Streams[1], Encutitl_Decrypt_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Chunk, Chunk]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Encutitl_DecryptClient = grpc.BidiStreamingClient[Chunk, Chunk]
+
+func (c *encutitlClient) GenerateKey(ctx context.Context, in *GenerateKeyRequest, opts ...grpc.CallOption) (*GenerateKeyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GenerateKeyResponse)
+	err := c.cc.Invoke(ctx, Encutitl_GenerateKey_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *encutitlClient) Inspect(ctx context.Context, in *InspectRequest, opts ...grpc.CallOption) (*InspectResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(InspectResponse)
+	err := c.cc.Invoke(ctx, Encutitl_Inspect_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EncutitlServer is the server API for Encutitl service.
+// All implementations must embed UnimplementedEncutitlServer
+// for forward compatibility.
+type EncutitlServer interface {
+	// Encrypt encrypts the data of all request chunks, in order, to the
+	// server's recipients and streams back the encrypted file.
+	Encrypt(grpc.BidiStreamingServer[Chunk, Chunk]) error
+	// Decrypt takes a file in any format the server reads, in chunks, and
+	// streams back the plaintext.
+	Decrypt(grpc.BidiStreamingServer[Chunk, Chunk]) error
+	// GenerateKey makes a new key pair. The server keeps no copy.
+	GenerateKey(context.Context, *GenerateKeyRequest) (*GenerateKeyResponse, error)
+	// Inspect reports what can be read off a file without its key. The
+	// start of the file, up to the end of its header, is enough.
+	Inspect(context.Context, *InspectRequest) (*InspectResponse, error)
+	mustEmbedUnimplementedEncutitlServer()
+}
+
+// UnimplementedEncutitlServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedEncutitlServer struct{}
+
+func (UnimplementedEncutitlServer) Encrypt(grpc.BidiStreamingServer[Chunk, Chunk]) error {
+	return status.Errorf(codes.Unimplemented, "method Encrypt not implemented")
+}
+func (UnimplementedEncutitlServer) Decrypt(grpc.BidiStreamingServer[Chunk, Chunk]) error {
+	return status.Errorf(codes.Unimplemented, "method Decrypt not implemented")
+}
+func (UnimplementedEncutitlServer) GenerateKey(context.Context, *GenerateKeyRequest) (*GenerateKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GenerateKey not implemented")
+}
+func (UnimplementedEncutitlServer) Inspect(context.Context, *InspectRequest) (*InspectResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Inspect not implemented")
+}
+func (UnimplementedEncutitlServer) mustEmbedUnimplementedEncutitlServer() {}
+func (UnimplementedEncutitlServer) testEmbeddedByValue()                  {}
+
+// UnsafeEncutitlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EncutitlServer will
+// result in compilation errors.
+type UnsafeEncutitlServer interface {
+	mustEmbedUnimplementedEncutitlServer()
+}
+
+func RegisterEncutitlServer(s grpc.ServiceRegistrar, srv EncutitlServer) {
+	// If the following call pancis, it indicates UnimplementedEncutitlServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Encutitl_ServiceDesc, srv)
+}
+
+func _Encutitl_Encrypt_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EncutitlServer).Encrypt(&grpc.GenericServerStream[Chunk, Chunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Encutitl_EncryptServer = grpc.BidiStreamingServer[Chunk, Chunk]
+
+func _Encutitl_Decrypt_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EncutitlServer).Decrypt(&grpc.GenericServerStream[Chunk, Chunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Encutitl_DecryptServer = grpc.BidiStreamingServer[Chunk, Chunk]
+
+func _Encutitl_GenerateKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GenerateKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncutitlServer).GenerateKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encutitl_GenerateKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncutitlServer).GenerateKey(ctx, req.(*GenerateKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Encutitl_Inspect_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InspectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncutitlServer).Inspect(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encutitl_Inspect_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncutitlServer).Inspect(ctx, req.(*InspectRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Encutitl_ServiceDesc is the grpc.ServiceDesc for Encutitl service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Encutitl_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "encutitl.v1.Encutitl",
+	HandlerType: (*EncutitlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GenerateKey",
+			Handler:    _Encutitl_GenerateKey_Handler,
+		},
+		{
+			MethodName: "Inspect",
+			Handler:    _Encutitl_Inspect_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Encrypt",
+			Handler:       _Encutitl_Encrypt_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Decrypt",
+			Handler:       _Encutitl_Decrypt_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "encutitl.proto",
+}
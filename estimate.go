@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// estimate samples the inputs instead of compressing them in full: up to
+// --sample percent of every file is read in 1 MiB blocks spread across the
+// file, deflated at the level encryption uses, and the ratio extrapolated.
+// Files with the same size and sampled content are counted as duplicates.
+
+const (
+	sampleBlock  = 1 << 20
+	fileOverhead = 256 // header, stanza, nonce and tag, roughly
+)
+
+// s3Pricing is USD per GB-month and per 1000 PUT requests in us-east-1.
+// Use --price to match a different region, provider or negotiated rate.
+var s3Pricing = map[string][2]float64{
+	"STANDARD":            {0.023, 0.005},
+	"INTELLIGENT_TIERING": {0.023, 0.005},
+	"STANDARD_IA":         {0.0125, 0.01},
+	"ONEZONE_IA":          {0.01, 0.01},
+	"GLACIER_IR":          {0.004, 0.02},
+	"GLACIER":             {0.0036, 0.03},
+	"DEEP_ARCHIVE":        {0.00099, 0.05},
+}
+
+type sizeEstimate struct {
+	files, dupFiles int
+	raw, dupRaw     int64
+	sampled         int64
+	compressed      int64 // extrapolated, excluding duplicates
+	requests        int64
+}
+
+func runEstimate(args []string) {
+	fset := flag.NewFlagSet("estimate", flag.ExitOnError)
+	sample := fset.Float64("sample", 5, "Percentage of each file to sample")
+	class := fset.String("storage-class", "", "Only price this storage class")
+	var prices listFlag
+	fset.Var(&prices, "price", "Override pricing as CLASS=USD_per_GB_month[/USD_per_1000_puts] (repeatable)")
+	fset.IntVar(partSizeMiB, "part-size", *partSizeMiB, "Multipart part size in MiB, for request counts")
+	addA11yFlag(fset)
+	addLangFlag(fset)
+	fset.Parse(args)
+	if fset.NArg() == 0 {
+		fail(exitUsage, "Usage: estimate [flags] <file or directory>...")
+		return
+	}
+	if *sample <= 0 || *sample > 100 {
+		fail(exitUsage, tr("Error: --sample must be between 0 and 100"))
+		return
+	}
+	pricing, err := parsePrices(prices)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+
+	est, err := estimateSize(fset.Args(), *sample/100, int64(*partSizeMiB)<<20)
+	if err != nil {
+		fail(exitIO, tr("Estimate error:"), err)
+		return
+	}
+	upload := est.compressed + int64(est.files-est.dupFiles)*fileOverhead
+
+	fmt.Printf(tr("%d files, %s")+"\n", est.files, formatBytes(est.raw))
+	if unique := est.raw - est.dupRaw; unique > 0 {
+		fmt.Printf(tr("Sampled %s, compresses to %.1f%%")+"\n", formatBytes(est.sampled), float64(est.compressed)/float64(unique)*100)
+	}
+	if est.dupFiles > 0 {
+		fmt.Printf(tr("%d likely duplicate files (%s) could be skipped")+"\n", est.dupFiles, formatBytes(est.dupRaw))
+	}
+	fmt.Printf(tr("Estimated upload: %s in %d requests")+"\n", formatBytes(upload), est.requests)
+
+	classes := make([]string, 0, len(pricing))
+	for c := range pricing {
+		if *class == "" || strings.EqualFold(*class, c) {
+			classes = append(classes, c)
+		}
+	}
+	if len(classes) == 0 {
+		fail(exitUsage, tr("Error: no pricing for storage class"), *class)
+		return
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if pricing[classes[i]][0] != pricing[classes[j]][0] {
+			return pricing[classes[i]][0] > pricing[classes[j]][0]
+		}
+		return classes[i] < classes[j]
+	})
+	if !*a11yFlag {
+		fmt.Printf("\n%-20s %12s %12s\n", "storage class", "per month", "uploads")
+	}
+	for _, c := range classes {
+		p := pricing[c]
+		monthly := float64(upload) / (1 << 30) * p[0]
+		puts := float64(est.requests) / 1000 * p[1]
+		if *a11yFlag {
+			fmt.Printf(tr("%s costs %.4f dollars per month plus %.4f dollars for the uploads.")+"\n", c, monthly, puts)
+			continue
+		}
+		fmt.Printf("%-20s %12s %12s\n", c, fmt.Sprintf("$%.4f", monthly), fmt.Sprintf("$%.4f", puts))
+	}
+	if len(prices) == 0 {
+		fmt.Println(tr("(S3 us-east-1 list prices, override with --price)"))
+	}
+}
+
+func parsePrices(overrides []string) (map[string][2]float64, error) {
+	pricing := make(map[string][2]float64, len(s3Pricing))
+	for c, p := range s3Pricing {
+		pricing[c] = p
+	}
+	for _, o := range overrides {
+		c, v, ok := strings.Cut(o, "=")
+		if !ok {
+			return nil, fmt.Errorf("--price %q: expected CLASS=USD", o)
+		}
+		c = strings.ToUpper(c)
+		storage, puts, hasPuts := strings.Cut(v, "/")
+		p := pricing[c]
+		var err error
+		if p[0], err = strconv.ParseFloat(storage, 64); err != nil {
+			return nil, fmt.Errorf("--price %q: %w", o, err)
+		}
+		if hasPuts {
+			if p[1], err = strconv.ParseFloat(puts, 64); err != nil {
+				return nil, fmt.Errorf("--price %q: %w", o, err)
+			}
+		}
+		pricing[c] = p
+	}
+	return pricing, nil
+}
+
+func estimateSize(paths []string, fraction float64, partSize int64) (*sizeEstimate, error) {
+	est := &sizeEstimate{}
+	seen := map[string]bool{}
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fp, ratio, err := sampleFile(path, info.Size(), fraction, est)
+			if err != nil {
+				return err
+			}
+			est.files++
+			est.raw += info.Size()
+			if seen[fp] {
+				est.dupFiles++
+				est.dupRaw += info.Size()
+				return nil
+			}
+			seen[fp] = true
+			est.compressed += int64(float64(info.Size()) * ratio)
+			if parts := (info.Size() + fileOverhead + partSize - 1) / partSize; parts > 1 {
+				est.requests += parts + 2 // create and complete
+			} else {
+				est.requests++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return est, nil
+}
+
+// sampleFile deflates evenly spaced blocks of the file and returns a
+// fingerprint of its size and sampled content along with the compression
+// ratio of the sample.
+func sampleFile(path string, size int64, fraction float64, est *sizeEstimate) (string, float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	blocks := (size + sampleBlock - 1) / sampleBlock
+	n := max(int64(float64(blocks)*fraction), 1)
+	h := sha256.New()
+	fmt.Fprint(h, size)
+	buf := make([]byte, sampleBlock)
+	var comp bytes.Buffer
+	var in, out int64
+	w, _ := flate.NewWriter(&comp, flate.BestCompression)
+	for i := int64(0); i < n && i < blocks; i++ {
+		off := i * blocks / n * sampleBlock
+		m, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return "", 0, err
+		}
+		h.Write(buf[:m])
+		comp.Reset()
+		w.Reset(&comp)
+		w.Write(buf[:m])
+		w.Close()
+		in += int64(m)
+		out += int64(comp.Len())
+	}
+	est.sampled += in
+	if in == 0 {
+		return string(h.Sum(nil)), 1, nil
+	}
+	return string(h.Sum(nil)), float64(out) / float64(in), nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// exec runs a command with secrets it needs decrypted only into its
+// environment or into memory-backed files, never onto disk, for use as a
+// container entrypoint:
+//
+//	encutitl exec --env-file secrets.env.bin --secret-file tls.key.bin:/run/secrets/tls.key -- server
+//
+// --env-file (or -f) decrypts KEY=VALUE lines into the command's
+// environment, over anything inherited. The values never enter
+// encutitl's own environment, and its copies are zeroed once the command
+// has started. --secret-file writes a decrypted file only to
+// a tmpfs or ramfs, such as a container's /run/secrets or /dev/shm, and
+// wipes and removes it when the command exits. Signals are passed on to
+// the command, and its exit status becomes encutitl's.
+
+func runExec(args []string) {
+	const usage = "Usage: exec [-f|--env-file FILE...] [--secret-file FILE:DEST...] [-i KEY...] -- COMMAND [ARG...]"
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	var envFiles, secretFiles listFlag
+	fs.Var(&envFiles, "env-file", "Encrypted KEY=VALUE file to add to the command's environment (repeatable)")
+	fs.Var(&envFiles, "f", "Shorthand for --env-file")
+	fs.Var(&secretFiles, "secret-file", "Encrypted file to decrypt to DEST on a tmpfs, as FILE:DEST (repeatable)")
+	fs.Var(&identityFlags, "i", "Identity file to decrypt with (repeatable, default as for -d)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.StringVar(reasonFlag, "reason", *reasonFlag, "Why sensitive files are being decrypted, for the audit log")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fail(exitUsage, usage)
+		return
+	}
+
+	var secrets []string
+	defer func() {
+		for _, v := range secrets {
+			wipeString(v)
+		}
+	}()
+	for _, name := range envFiles {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			return
+		}
+		vars, err := decryptEnv(name, data)
+		if err != nil {
+			fail(exitAuth, tr("Decryption error:"), fmt.Sprintf("%s: %v", name, err))
+			return
+		}
+		secrets = append(secrets, vars...)
+	}
+
+	var written []string
+	defer func() {
+		for _, path := range written {
+			wipeFile(path)
+			os.Remove(path)
+		}
+	}()
+	for _, spec := range secretFiles {
+		src, dest, ok := strings.Cut(spec, ":")
+		if !ok || src == "" || dest == "" {
+			fail(exitUsage, usage)
+			return
+		}
+		if err := checkMemoryFS(filepath.Dir(dest)); err != nil {
+			fail(exitIO, tr("Write error:"), fmt.Sprintf("%s: %v", dest, err))
+			return
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			return
+		}
+		plain, err := openData(src, data)
+		if err != nil {
+			fail(exitAuth, tr("Decryption error:"), fmt.Sprintf("%s: %v", src, err))
+			return
+		}
+		err = os.WriteFile(dest, plain, 0400)
+		clear(plain)
+		if err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+		written = append(written, dest)
+	}
+
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Env = append(os.Environ(), secrets...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// Signals are the command's to handle; we must live to clean up.
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	if err := cmd.Start(); err != nil {
+		fail(exitError, tr("Exec error:"), err)
+		return
+	}
+	// The command has its own copy now; ours can go while it runs.
+	cmd.Env = nil
+	for _, v := range secrets {
+		wipeString(v)
+	}
+	secrets = nil
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// As a shell reports it: 128 plus the signal that killed it.
+			exitCode = exitErr.ExitCode()
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				exitCode = 128 + int(ws.Signal())
+			}
+			return
+		}
+		fail(exitError, tr("Exec error:"), err)
+	}
+}
+
+// decryptEnv decrypts a dotenv file into KEY=VALUE pairs.
+func decryptEnv(name string, data []byte) ([]string, error) {
+	plain, err := openData(name, data)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plain)
+	text := string(plain)
+	defer wipeString(text)
+	var vars []string
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: want KEY=VALUE", n+1)
+		}
+		value = strings.TrimSpace(value)
+		unquoted := false
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			unquoted = true
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		vars = append(vars, key+"="+value)
+		if unquoted {
+			wipeString(value) // a copy when it had escapes
+		}
+	}
+	return vars, nil
+}
+
+// wipeString zeroes the bytes of a string built at run time from secret
+// data. Only for strings nothing else refers to: Go assumes strings never
+// change.
+func wipeString(s string) {
+	if len(s) > 0 {
+		clear(unsafe.Slice(unsafe.StringData(s), len(s)))
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkMemoryFS refuses a directory whose filesystem is backed by disk.
+func checkMemoryFS(dir string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return err
+	}
+	switch st.Type {
+	case unix.TMPFS_MAGIC, unix.RAMFS_MAGIC:
+		return nil
+	}
+	return fmt.Errorf("%s is not on a tmpfs or ramfs, so the secret would reach disk", dir)
+}
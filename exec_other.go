@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func checkMemoryFS(dir string) error {
+	return fmt.Errorf("--secret-file is not supported on this platform")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Diagnostics go to stderr and the first failure decides the exit status,
+// so scripts can tell what went wrong. Flag parse errors exit with
+// exitUsage from the flag package itself.
+const (
+	exitError       = 1 // anything not covered below
+	exitUsage       = 2 // bad flags, arguments or configuration
+	exitKey         = 3 // keys, identities or tokens unavailable
+	exitAuth        = 4 // decryption, signature or peer authentication failed
+	exitIO          = 5 // reading, writing or network failures
+	exitInterrupted = 130
+)
+
+var exitCode int
+
+// fail reports an error on stderr and records code as the exit status
+// unless an earlier failure already set one.
+func fail(code int, a ...any) {
+	fmt.Fprintln(os.Stderr, a...)
+	if exitCode == 0 {
+		exitCode = code
+	}
+}
+
+func failf(code int, format string, a ...any) {
+	fail(code, fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Recipient keys can carry an expiry: the expiry-time="YYYYMMDD[HHMM[SS]]"
+// option of authorized_keys files, in front of any key type, or the end
+// of an SSH certificate's validity. Encrypting to a key that expires
+// within --expiry-warn-days, or has expired, prints a warning; nothing
+// is refused, rotation is the key owner's job and a revoked key belongs
+// on the revocation list.
+//
+// With --key-directory the warning first tries the directory for a
+// newer key: GET <url>/<name>, name being the comment of the key line
+// (usually an email address), returning key lines in the same format.
+// The first one that expires later, or never, is used in its place.
+
+var (
+	expiryWarnDays   = flag.Int("expiry-warn-days", 30, "Warn about recipient keys that expire within this many days")
+	keyDirectoryFlag = flag.String("key-directory", "", "URL to fetch updated keys from when a recipient key is expiring, as <url>/<key comment>")
+)
+
+// recipientExpiry splits a key line into the key, as the parsers take it,
+// its expiry (zero for none) and its name.
+func recipientExpiry(line string) (key string, expires time.Time, name string, err error) {
+	if pub, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+		if cert, ok := pub.(*ssh.Certificate); ok && cert.ValidBefore != ssh.CertTimeInfinity {
+			expires = time.Unix(int64(cert.ValidBefore), 0)
+		}
+		for _, opt := range options {
+			if v, ok := strings.CutPrefix(opt, "expiry-time="); ok {
+				t, err := parseExpiryTime(v)
+				if err != nil {
+					return "", time.Time{}, "", err
+				}
+				if expires.IsZero() || t.Before(expires) {
+					expires = t
+				}
+			}
+		}
+		return line, expires, comment, nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) > 1 {
+		if v, ok := strings.CutPrefix(fields[0], "expiry-time="); ok {
+			if expires, err = parseExpiryTime(v); err != nil {
+				return "", time.Time{}, "", err
+			}
+			fields = fields[1:]
+		}
+	}
+	return fields[0], expires, strings.Join(fields[1:], " "), nil
+}
+
+// parseExpiryTime reads the OpenSSH expiry-time format, in local time.
+func parseExpiryTime(v string) (time.Time, error) {
+	v = strings.Trim(v, `"`)
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(v) == len(layout) {
+			return time.ParseInLocation(layout, v, time.Local)
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad expiry-time %q, want YYYYMMDD[HHMM[SS]]", v)
+}
+
+// checkExpiry warns about an expiring recipient key line and returns the
+// key to encrypt to, which is a newer one from --key-directory if there
+// is one.
+func checkExpiry(line string) (string, error) {
+	key, expires, name, err := recipientExpiry(line)
+	if err != nil || expires.IsZero() || time.Until(expires) > time.Duration(*expiryWarnDays)*24*time.Hour {
+		return key, err
+	}
+	label := name
+	if label == "" {
+		label = revokedKeyName(revocationKey(key))
+	}
+	if *keyDirectoryFlag != "" && name != "" {
+		newer, err := fetchNewerKey(name, expires)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, tr("Warning: key directory: %s: %v")+"\n", name, err)
+		case newer != "":
+			fmt.Fprintf(os.Stderr, tr("Using the updated key of %s from %s")+"\n", name, *keyDirectoryFlag)
+			return newer, nil
+		}
+	}
+	if time.Now().After(expires) {
+		fmt.Fprintf(os.Stderr, tr("Warning: recipient key %s expired on %s")+"\n", label, expires.Format(time.DateOnly))
+	} else {
+		days := int(time.Until(expires).Hours() / 24)
+		fmt.Fprintf(os.Stderr, tr("Warning: recipient key %s expires on %s, in %d days")+"\n", label, expires.Format(time.DateOnly), days)
+	}
+	return key, nil
+}
+
+// fetchNewerKey returns the first key listed for name in the key
+// directory that outlives expires, or "".
+func fetchNewerKey(name string, expires time.Time) (string, error) {
+	client, err := httpClient()
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Get(strings.TrimSuffix(*keyDirectoryFlag, "/") + "/" + url.PathEscape(name))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", errors.New(resp.Status)
+	}
+	sc := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	sc.Buffer(nil, 64<<10) // hybrid keys are long lines
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, exp, _, err := recipientExpiry(line)
+		if err == nil && (exp.IsZero() || exp.After(expires)) {
+			return key, nil
+		}
+	}
+	return "", sc.Err()
+}
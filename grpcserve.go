@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"gitlab.com/EvnMiller/encryptutiltui/encutilpb"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// serve-grpc is serve for gRPC clients, with the service in
+// encutilpb/encutitl.proto and its generated Go stubs in encutilpb.
+// Encrypt and Decrypt take the input as a stream of chunks, so payloads
+// are not bound by gRPC's message size, and stream the result back the
+// same way. Tokens, TLS, key loading and size limits work as for serve.
+
+// grpcChunkSize is the size of the chunks replies are streamed in, well
+// under gRPC's default 4 MiB message limit.
+const grpcChunkSize = 1 << 20
+
+var grpcCodes = map[string]codes.Code{
+	codeAuthFailed:        codes.PermissionDenied,
+	codeKeyNotFound:       codes.NotFound,
+	codePayloadTooLarge:   codes.ResourceExhausted,
+	codeFormatUnsupported: codes.InvalidArgument,
+	codeReplayed:          codes.AlreadyExists,
+	codeInternal:          codes.Internal,
+}
+
+type grpcServer struct {
+	encutilpb.UnimplementedEncutitlServer
+	*server
+}
+
+func runServeGRPC(args []string) {
+	fs := flag.NewFlagSet("serve-grpc", flag.ExitOnError)
+	var listen listFlag
+	fs.Var(&listen, "listen", "Listen spec, e.g. :9090 or :9443,cert=server.pem,key=server.key (repeatable, default :9090)")
+	tokenFile := fs.String("token-file", "", "File of accepted bearer tokens, one per line")
+	noAuth := fs.Bool("no-auth", false, "Accept requests without a token")
+	fs.Var(&recipientFlags, "recipient", "Recipient to encrypt to (repeatable, default key.bin)")
+	fs.Var(&identityFlags, "i", "Identity file to decrypt with (repeatable, default as for -d)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.Var(&maxInputSize, "max-input-size", "Largest input accepted (default 256M)")
+	replayWindow := fs.Duration("replay-window", 0, "Refuse to decrypt a file again within this long, e.g. 24h")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fail(exitUsage, "Usage: serve-grpc [--listen SPEC...] [--token-file FILE | --no-auth] [--recipient KEY...] [-i KEY...] [--replay-window D]")
+		return
+	}
+	if len(listen) == 0 {
+		listen = listFlag{":9090"}
+	}
+	tokens, err := loadServeTokens(*tokenFile)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	if len(tokens) == 0 && !*noAuth {
+		failf(exitUsage, tr("Error: serve-grpc needs --token-file or %s, or --no-auth"), serveTokenEnv)
+		return
+	}
+	d, err := loadDaemonKeys()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	d.maxSize = int64(maxInputSize)
+	if d.maxSize == 0 {
+		d.maxSize = serveDefaultSize
+	}
+	lns, err := listenAll(listen)
+	if err != nil {
+		fail(exitIO, tr("Listen error:"), err)
+		return
+	}
+
+	g := &grpcServer{server: &server{daemon: d, tokens: tokens, replay: newReplayGuard(*replayWindow)}}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(g.unaryAuth), grpc.StreamInterceptor(g.streamAuth))
+	encutilpb.RegisterEncutitlServer(srv, g)
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		fmt.Println(tr("Serving gRPC on"), ln.Addr())
+		go func() { errs <- srv.Serve(ln) }()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		fail(exitIO, tr("Serve error:"), err)
+	case <-sigs:
+		srv.GracefulStop()
+	}
+}
+
+func (g *grpcServer) check(ctx context.Context, method string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := ""
+	if v := md.Get("authorization"); len(v) > 0 {
+		token, _ = strings.CutPrefix(v[0], "Bearer ")
+	}
+	if !g.authorized(token) {
+		fmt.Fprintf(os.Stderr, "%s code=%s %s\n", time.Now().UTC().Format(time.RFC3339), codes.Unauthenticated, method)
+		return status.Error(codes.Unauthenticated, "missing or unknown token")
+	}
+	return nil
+}
+
+func (g *grpcServer) unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := g.check(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logGRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+func (g *grpcServer) streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.check(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := handler(srv, ss)
+	logGRPC(info.FullMethod, start, err)
+	return err
+}
+
+func logGRPC(method string, start time.Time, err error) {
+	line := fmt.Sprintf("%s code=%s %s took=%s", time.Now().UTC().Format(time.RFC3339), status.Code(err), method, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		line += ": " + err.Error()
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// grpcError turns a decryption or encryption error into a status with the
+// code the HTTP API would use. The client gets the status, the log the
+// error itself.
+func grpcError(err error) error {
+	code := errorCode(err)
+	return &grpcFailure{status: status.New(grpcCodes[code], codeMessage[code]), cause: err}
+}
+
+type grpcFailure struct {
+	status *status.Status
+	cause  error
+}
+
+func (e *grpcFailure) Error() string              { return e.cause.Error() }
+func (e *grpcFailure) GRPCStatus() *status.Status { return e.status }
+
+// receiveAll reads every chunk of a client stream, up to the size limit.
+func (g *grpcServer) receiveAll(stream grpc.ServerStream) ([]byte, error) {
+	var data []byte
+	for {
+		chunk := new(encutilpb.Chunk)
+		err := stream.RecvMsg(chunk)
+		if errors.Is(err, io.EOF) {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)+len(chunk.Data)) > g.maxSize {
+			clear(data)
+			return nil, status.Errorf(codes.ResourceExhausted, "input over %s", formatBytes(g.maxSize))
+		}
+		data = append(data, chunk.Data...)
+	}
+}
+
+// chunkSender streams what is written to it as Chunks.
+type chunkSender struct {
+	stream grpc.ServerStream
+}
+
+func (c chunkSender) Write(p []byte) (int, error) {
+	for off := 0; off < len(p); off += grpcChunkSize {
+		if err := c.stream.SendMsg(&encutilpb.Chunk{Data: p[off:min(off+grpcChunkSize, len(p))]}); err != nil {
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+func (g *grpcServer) Encrypt(stream encutilpb.Encutitl_EncryptServer) error {
+	if len(g.recipients) == 0 {
+		return status.Error(codes.FailedPrecondition, "this server has no recipients to encrypt to")
+	}
+	data, err := g.receiveAll(stream)
+	if err != nil {
+		return err
+	}
+	out, err := g.handle("encrypt", data)
+	clear(data)
+	if err != nil {
+		return grpcError(err)
+	}
+	_, err = chunkSender{stream}.Write(out)
+	return err
+}
+
+func (g *grpcServer) Decrypt(stream encutilpb.Encutitl_DecryptServer) error {
+	data, err := g.receiveAll(stream)
+	if err != nil {
+		return err
+	}
+	defer clear(data)
+	if isAgeArmor(string(data)) {
+		if data, err = dearmorAge(string(data)); err != nil {
+			return status.Error(codes.InvalidArgument, codeMessage[codeFormatUnsupported])
+		}
+	}
+	id, err := g.replay.claim(data)
+	if err != nil {
+		return grpcError(err)
+	}
+	_, stanza, err := decryptTo(chunkSender{stream}, data, g.key, g.identities)
+	g.replay.finish(id, stanza, data, err)
+	if err != nil {
+		// Over --max-output-size after some chunks went out is reported
+		// the same way; the client must not use a stream that failed.
+		return grpcError(err)
+	}
+	return nil
+}
+
+func (g *grpcServer) GenerateKey(ctx context.Context, req *encutilpb.GenerateKeyRequest) (*encutilpb.GenerateKeyResponse, error) {
+	switch req.Type {
+	case encutilpb.KeyType_KEY_TYPE_SYMMETRIC:
+		key := make([]byte, keySize)
+		rand.Read(key)
+		return &encutilpb.GenerateKeyResponse{PrivateKey: key, PublicKey: "key " + encutil.KeyID(key)}, nil
+	case encutilpb.KeyType_KEY_TYPE_ED25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		block, err := marshalSSHKey(priv, req.Comment, []byte(req.Passphrase))
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		sshPub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+		if req.Comment != "" {
+			line += " " + req.Comment
+		}
+		return &encutilpb.GenerateKeyResponse{PrivateKey: pem.EncodeToMemory(block), PublicKey: line}, nil
+	case encutilpb.KeyType_KEY_TYPE_HYBRID:
+		id, err := encutil.GenerateHybridIdentity()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		pub := id.Recipient().String()
+		priv := fmt.Sprintf("# encutitl hybrid ML-KEM-768 + X25519 identity\n# public key: %s\n%s\n", pub, id)
+		return &encutilpb.GenerateKeyResponse{PrivateKey: []byte(priv), PublicKey: pub}, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unsupported key type %v", req.Type)
+}
+
+func (g *grpcServer) Inspect(ctx context.Context, req *encutilpb.InspectRequest) (*encutilpb.InspectResponse, error) {
+	data := req.Data
+	switch {
+	case encutil.IsJWE(string(data)):
+		return &encutilpb.InspectResponse{Format: "jwe"}, nil
+	case isAgeArmor(string(data)), isAge(data):
+		return &encutilpb.InspectResponse{Format: "age", Cipher: "chacha20-poly1305"}, nil
+	}
+	hdr, _, err := encutil.ParseHeader(data)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if hdr == nil {
+		return &encutilpb.InspectResponse{Format: "legacy", Cipher: "aes-256-gcm", Compression: encutil.CompressionDeflate}, nil
+	}
+	resp := &encutilpb.InspectResponse{
+		Format:      "encutitl",
+		Cipher:      hdr.Cipher,
+		Compression: hdr.Compression,
+		AadRequired: hdr.AAD,
+		Padding:     hdr.Padding,
+		Convergent:  hdr.Convergent,
+	}
+	for _, s := range hdr.Recipients {
+		resp.Recipients = append(resp.Recipients, stanzaKeyID(s, data))
+	}
+	return resp, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// User-facing messages go through tr, keyed by their English text so the
+// source stays readable and English needs no catalog. Catalogs are JSON
+// objects from English to translated text: the ones in locales/ are built
+// in, and <config dir>/locales/<lang>.json adds a language or overrides
+// entries of a built-in one. Missing entries fall back to English.
+
+//go:embed locales/*.json
+var builtinLocales embed.FS
+
+var langFlag = flag.String("lang", "", "Message language, e.g. es (default from LC_ALL, LC_MESSAGES or LANG)")
+
+// addLangFlag offers --lang on a subcommand.
+func addLangFlag(fs *flag.FlagSet) {
+	fs.StringVar(langFlag, "lang", *langFlag, "Message language, e.g. es (default from LC_ALL, LC_MESSAGES or LANG)")
+}
+
+var (
+	catalogOnce sync.Once
+	catalog     map[string]string
+)
+
+// messageLang returns the two letter language from --lang or the locale
+// environment, e.g. "es" for es_MX.UTF-8.
+func messageLang() string {
+	lang := *langFlag
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if lang != "" {
+			break
+		}
+		lang = os.Getenv(env)
+	}
+	lang, _, _ = strings.Cut(lang, ".")
+	lang, _, _ = strings.Cut(lang, "_")
+	return strings.ToLower(lang)
+}
+
+func loadCatalog(lang string) map[string]string {
+	msgs := map[string]string{}
+	if lang == "" || lang == "en" || lang == "c" || lang == "posix" {
+		return msgs
+	}
+	if data, err := builtinLocales.ReadFile("locales/" + lang + ".json"); err == nil {
+		json.Unmarshal(data, &msgs)
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		if data, err := os.ReadFile(filepath.Join(dir, "encutitl", "locales", lang+".json")); err == nil {
+			json.Unmarshal(data, &msgs)
+		}
+	}
+	return msgs
+}
+
+// tr translates msg into the message language. It must not be called
+// before flags are parsed.
+func tr(msg string) string {
+	catalogOnce.Do(func() { catalog = loadCatalog(messageLang()) })
+	if t, ok := catalog[msg]; ok {
+		return t
+	}
+	return msg
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// identity import copies existing SSH and age private keys into the
+// identities directory next to the other encutitl state, where decryption
+// finds them like the default SSH keys and pq.key, so moving over from
+// ssh-keygen or age needs no -i on every run.
+//
+// Imported keys keep their protection: an encrypted SSH key is stored
+// encrypted with the same passphrase (in the OpenSSH format, whatever it
+// came in) and a passphrase-encrypted age key file stays as it is.
+// --passphrase sets a new one instead, or removes it when left empty.
+// SSH keys open both encutitl and age files; age keys only age files, the
+// encutitl format has no X25519 stanza.
+
+const identitiesDir = "identities"
+
+func importedIdentitiesPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, identitiesDir), nil
+}
+
+// importedIdentities returns the files in the identities directory.
+func importedIdentities() ([]string, error) {
+	dir, err := importedIdentitiesPath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			out = append(out, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func runIdentityImport(args []string) {
+	fs := flag.NewFlagSet("identity import", flag.ExitOnError)
+	name := fs.String("n", "", "Name to store the key under (default the file name)")
+	newPass := fs.Bool("passphrase", false, "Ask for a new passphrase for the imported copy (empty for none)")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 || (*name != "" && fs.NArg() > 1) {
+		fail(exitUsage, "Usage: identity import [-n NAME] [--passphrase] KEYFILE...")
+		return
+	}
+	dir, err := importedIdentitiesPath()
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+	for _, path := range fs.Args() {
+		dest := *name
+		if dest == "" {
+			dest = filepath.Base(path)
+		}
+		dest = filepath.Join(dir, dest)
+		if _, err := os.Stat(dest); err == nil {
+			failf(exitUsage, tr("Error: %s is already imported, remove it or pick another -n"), dest)
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			return
+		}
+		var out []byte
+		var public []string
+		if isAgeIdentityFile(data) || isAge(data) || isAgeArmor(string(data)) {
+			out, public, err = importAgeIdentity(path, data, *newPass)
+		} else {
+			out, public, err = importSSHIdentity(path, data, *newPass)
+		}
+		if err != nil {
+			fail(exitKey, tr("Key error:"), fmt.Errorf("%s: %w", path, err))
+			return
+		}
+		if err := writePrivateKey(dest, out); err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+		fmt.Printf(tr("Imported %s as %s")+"\n", path, dest)
+		for _, p := range public {
+			fmt.Println(tr("  public key:"), p)
+		}
+	}
+}
+
+// importSSHIdentity decrypts an SSH private key and marshals it again in
+// the OpenSSH format.
+func importSSHIdentity(path string, data []byte, newPass bool) ([]byte, []string, error) {
+	var pass []byte
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if pass, err = passphrasePrompt(path)(); err != nil {
+			return nil, nil, err
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, pass)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	public := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	if _, err := encutil.ParseSSHRecipient(public); err != nil {
+		return nil, nil, err
+	}
+	if newPass {
+		if pass, err = askNewPassphrase(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	block, err := marshalSSHKey(key, filepath.Base(path), pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(block), []string{public}, nil
+}
+
+func marshalSSHKey(key crypto.PrivateKey, comment string, pass []byte) (*pem.Block, error) {
+	if len(pass) == 0 {
+		return ssh.MarshalPrivateKey(key, comment)
+	}
+	return ssh.MarshalPrivateKeyWithPassphrase(key, comment, pass)
+}
+
+// importAgeIdentity checks an age identity file, plain or encrypted with
+// a passphrase as `age -p` writes them, and returns what to store.
+func importAgeIdentity(path string, data []byte, newPass bool) ([]byte, []string, error) {
+	plain := data
+	if !isAgeIdentityFile(data) {
+		var err error
+		if plain, err = decryptAgeIdentityFile(path, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	ids, err := age.ParseIdentities(bytes.NewReader(plain))
+	if err != nil {
+		return nil, nil, err
+	}
+	var public []string
+	for _, id := range ids {
+		switch id := id.(type) {
+		case *age.X25519Identity:
+			public = append(public, id.Recipient().String())
+		case *age.HybridIdentity:
+			public = append(public, id.Recipient().String())
+		}
+	}
+	if !newPass {
+		return data, public, nil
+	}
+	pass, err := askNewPassphrase(path)
+	if err != nil || len(pass) == 0 {
+		return plain, public, err
+	}
+	r, err := age.NewScryptRecipient(string(pass))
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), public, nil
+}
+
+// decryptAgeIdentityFile opens an age identity file encrypted with a
+// passphrase, binary or armored.
+func decryptAgeIdentityFile(path string, data []byte) ([]byte, error) {
+	var in io.Reader = bytes.NewReader(data)
+	if isAgeArmor(string(data)) {
+		in = armor.NewReader(in)
+	}
+	pass, err := passphrasePrompt(path)()
+	if err != nil {
+		return nil, err
+	}
+	id, err := age.NewScryptIdentity(string(pass))
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(in, id)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func askNewPassphrase(path string) ([]byte, error) {
+	pass, err := promptSecret(fmt.Sprintf("New passphrase for the imported %s (empty for none): ", filepath.Base(path)))
+	if err != nil || len(pass) == 0 {
+		return nil, err
+	}
+	again, err := promptSecret("Repeat it: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pass, again) {
+		return nil, errors.New("the passphrases do not match")
+	}
+	return pass, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// -e -R dir encrypts every file under dir, next to the originals or into
+// a mirrored tree under -o. Each run records size, mtime and hash of what
+// it encrypted in state.json in the config directory; --changed-only
+// skips files whose size and mtime (or, failing that, hash) match and
+// whose output is still there, so nightly runs only touch what changed.
+// The state is saved every stateCheckpoint as well as at the end, so a
+// run that is interrupted can be resumed with --changed-only.
+
+const (
+	stateFile       = "state.json"
+	stateCheckpoint = 30 * time.Second
+)
+
+var (
+	recurseFlag = flag.String("R", "", "Encrypt every file under this directory")
+	changedOnly = flag.Bool("changed-only", false, "With -R, skip files unchanged since they were last encrypted")
+)
+
+type fileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+	Output  string    `json:"output"`
+}
+
+func statePath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, stateFile), nil
+}
+
+func loadState() (map[string]fileState, error) {
+	path, err := statePath()
+	if err != nil {
+		return nil, err
+	}
+	state := map[string]fileState{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+func saveState(state map[string]fileState) error {
+	path, err := statePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// outputExists reports whether a recorded output is still there. S3
+// outputs are trusted rather than checked.
+func outputExists(out string) bool {
+	if isRemoteURL(out) {
+		return true
+	}
+	_, err := os.Stat(out)
+	return err == nil
+}
+
+// isOutput reports whether path looks like an output of an earlier run
+// written next to its input, which must not be encrypted again.
+func isOutput(path string) bool {
+	for _, ext := range []string{".bin", ".age", ".jwe", ".sig", ".meta"} {
+		orig, ok := strings.CutSuffix(path, ext)
+		if !ok {
+			continue
+		}
+		// --recompress names outputs of tarballs after the .tar.
+		candidates := []string{orig}
+		if base, ok := strings.CutSuffix(orig, ".tar"); ok {
+			candidates = append(candidates, orig+".gz", orig+".zst", base+".tgz", base+".tzst")
+		}
+		for _, c := range candidates {
+			if _, err := os.Stat(c); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func encryptTree(root string) {
+	if *decrypt || *toStdout {
+		fail(exitUsage, tr("Error: -R encrypts to files, it does not work with -d or --to-stdout"))
+		return
+	}
+	bulkRun = true
+	root, err := filepath.Abs(root)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	var recipients []encutil.Recipient
+	if *formatFlag == "encutitl" {
+		if recipients, err = encryptRecipients(); err != nil {
+			fail(exitKey, tr("Key error:"), err)
+			return
+		}
+	}
+	state, err := loadState()
+	if err != nil {
+		fail(exitIO, tr("State error:"), err)
+		return
+	}
+
+	outDir := ""
+	if *outputFlag != "" && !isRemoteURL(*outputFlag) {
+		outDir, _ = filepath.Abs(*outputFlag)
+	}
+	startJob(jobFiles, 0, "--changed-only")
+	var done, skipped, failed int
+	saved := time.Now()
+	walk := func(src string) error {
+		return filepath.WalkDir(src, func(frozen string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// With --snapshot, src is root in the snapshot: files are read
+			// from there, and named and tracked by their live path.
+			rel, _ := filepath.Rel(src, frozen)
+			path := filepath.Join(root, rel)
+			if d.IsDir() && path == outDir {
+				return filepath.SkipDir
+			}
+			if d.IsDir() || !d.Type().IsRegular() {
+				return nil
+			}
+			if isOutput(path) {
+				return nil
+			}
+			defer jobProgress(1)
+			if time.Since(saved) >= stateCheckpoint {
+				if err := saveState(state); err != nil {
+					fail(exitIO, tr("State error:"), err)
+				}
+				saved = time.Now()
+			}
+			if *recompressFlag {
+				rel = recompressedName(rel)
+			}
+			out := encryptedName(filepath.Join(filepath.Dir(path), filepath.Base(rel)))
+			switch {
+			case *outputFlag == "":
+			case isRemoteURL(*outputFlag):
+				out = strings.TrimSuffix(*outputFlag, "/") + "/" + filepath.ToSlash(encryptedName(rel))
+			default:
+				out = filepath.Join(outDir, encryptedName(rel))
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			prev, seen := state[path]
+			unchanged := seen && prev.Output == out && prev.Size == info.Size() && outputExists(out)
+			if *changedOnly && unchanged && prev.ModTime.Equal(info.ModTime()) {
+				skipped++
+				return nil
+			}
+
+			data, err := readFileRetry(frozen)
+			if err != nil {
+				fail(exitIO, tr("Input read error:"), err)
+				failed++
+				return nil
+			}
+			sum := sha256.Sum256(data)
+			hash := hex.EncodeToString(sum[:])
+			cur := fileState{Size: info.Size(), ModTime: info.ModTime(), SHA256: hash, Output: out}
+			if *changedOnly && unchanged && prev.SHA256 == hash {
+				// Touched but not modified.
+				state[path] = cur
+				skipped++
+				return nil
+			}
+			if !isRemoteURL(out) {
+				if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
+					return err
+				}
+			}
+			name := path
+			if *recompressFlag {
+				if data, name, err = recompress(data, path); err != nil {
+					fail(exitIO, tr("Input read error:"), err)
+					failed++
+					return nil
+				}
+			}
+			if !encryptInput(data, name, out, recipients) {
+				failed++
+				return nil
+			}
+			state[path] = cur
+			done++
+			return nil
+		})
+	}
+	if *snapshotFlag != "" {
+		err = withSnapshot(root, walk)
+	} else {
+		err = walk(root)
+	}
+	if serr := saveState(state); serr != nil {
+		fail(exitIO, tr("State error:"), serr)
+	}
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+	}
+	fmt.Printf(tr("Encrypted %d files, skipped %d unchanged, %d failed")+"\n", done, skipped, failed)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+// --in-place replaces the input with the result under the same name: the
+// result goes to a temporary file in the same directory, is synced, and
+// is then renamed over the original, so at every moment the path holds
+// either the complete original or the complete result.
+
+var inPlaceFlag = flag.Bool("in-place", false, "Replace the input file with the encrypted (or decrypted) result, atomically")
+
+// replaceFile atomically replaces path with data, keeping path's mode.
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".encutitl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return renameSynced(tmp.Name(), path)
+}
+
+// renameSynced renames a synced file over dst and syncs the directory, so
+// the rename itself survives a crash.
+func renameSynced(src, dst string) error {
+	if err := retryLocked(dst, func() error { return os.Rename(src, dst) }); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(dst)); err == nil {
+		dir.Sync() // not supported everywhere, the rename stands either way
+		dir.Close()
+	}
+	return nil
+}
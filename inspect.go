@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// inspect prints what can be read off an encrypted file without its key:
+// format, cipher, how the payload key is derived, compression, recipients
+// and whether a detached signature checks out. --open also decrypts it,
+// for the original size and hash.
+
+const (
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	open := fs.Bool("open", false, "Also decrypt, to report the original size and SHA-256")
+	pub := fs.String("pub", "", "Public key to check a <file>.sig signature with (default sign.pub in the config directory)")
+	fs.Var(&identityFlags, "i", "SSH private key or age identity file for --open (repeatable)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.StringVar(reasonFlag, "reason", *reasonFlag, "Why a sensitive file is opened, for the audit log")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fail(exitUsage, "Usage: inspect [--open] [--reason TEXT] [--pub FILE] FILE...")
+		return
+	}
+	for i, path := range fs.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		data, err := readFileRetry(path)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			continue
+		}
+		fmt.Println(tr("File:"), path)
+		fmt.Println(tr("Size:"), formatBytes(int64(len(data))))
+		if err := inspectFormat(data); err != nil {
+			fail(exitAuth, tr("Decode input error:"), err)
+			continue
+		}
+		if _, err := os.Stat(path + ".meta"); err == nil {
+			fmt.Printf(tr("Metadata: %s (encrypted)")+"\n", path+".meta")
+		}
+		status, ok := signatureStatus(path, data, *pub)
+		fmt.Println(tr("Signature:"), status)
+		if !ok {
+			fail(exitAuth, tr("Signature INVALID:"), path+".sig")
+		}
+		if *open {
+			plain, err := openData(path, data)
+			if err != nil {
+				fail(exitAuth, tr("Decryption error:"), err)
+				continue
+			}
+			sum := sha256.Sum256(plain)
+			fmt.Println(tr("Original size:"), formatBytes(int64(len(plain))))
+			fmt.Println(tr("Original SHA-256:"), hex.EncodeToString(sum[:]))
+		}
+	}
+}
+
+func inspectFormat(data []byte) error {
+	switch {
+	case encutil.IsJWE(string(data)):
+		return inspectJWE(string(data))
+	case isAgeArmor(string(data)):
+		raw, err := dearmorAge(string(data))
+		if err != nil {
+			return err
+		}
+		fmt.Println(tr("Armor: PEM"))
+		return inspectAge(raw)
+	case isAge(data):
+		return inspectAge(data)
+	}
+	hdr, prefix, err := encutil.ParseHeader(data)
+	if err != nil {
+		return err
+	}
+	if hdr == nil {
+		fmt.Println(tr("Format: legacy (no header)"))
+		fmt.Println(tr("Cipher: aes-256-gcm, directly under key.bin"))
+		fmt.Println(tr("Compression: deflate"))
+		if key := localKeyID(); key != "" {
+			fmt.Printf(tr("Local key: key %s (legacy files do not record theirs)")+"\n", key)
+		}
+		printPayload(len(data)-gcmNonceSize-gcmTagSize, "deflate")
+		return nil
+	}
+	fmt.Println(tr("Format: encutitl version"), int(data[len(encutil.Magic)]))
+	if id, err := hdr.CanonicalID(); err == nil {
+		fmt.Println(tr("Header ID:"), id[:32])
+	}
+	fmt.Println(tr("Cipher:"), hdr.Cipher)
+	fmt.Println(tr("KDF: HKDF-SHA256 from a random per-file key, wrapped for each recipient"))
+	for _, s := range hdr.Recipients {
+		if p, err := encutil.StanzaArgon2Params(s); err == nil {
+			fmt.Printf(tr("Passphrase KDF: Argon2id, %d passes over %s, parallelism %d")+"\n", p.Time, formatBytes(int64(p.Memory)<<10), p.Threads)
+		}
+	}
+	fmt.Println(tr("Compression:"), hdr.Compression)
+	if hdr.AAD {
+		fmt.Println(tr("Associated data: required (--aad)"))
+	}
+	if hdr.Padding != "" {
+		fmt.Println(tr("Padding:"), hdr.Padding)
+	}
+	if hdr.Convergent {
+		fmt.Println(tr("Convergent: yes, equal inputs give equal files (--deterministic)"))
+	}
+	if hdr.Sensitive {
+		fmt.Println(tr("Sensitive: yes, decryption is audited (--sensitive)"))
+	}
+	local := localKeyID()
+	fmt.Printf(tr("Recipients: %d")+"\n", len(hdr.Recipients))
+	for _, s := range hdr.Recipients {
+		id := stanzaKeyID(s, data)
+		if s.Type == "key" && len(s.Args) == 1 && s.Args[0] == local {
+			id += " (local key)"
+		}
+		fmt.Println("  " + id)
+	}
+	if hdr.ChunkSize > 0 {
+		chunks, size, err := encutil.ChunkedSize(hdr, int64(len(data)-len(prefix)))
+		if err != nil {
+			fmt.Println(tr("Payload: truncated"))
+			return nil
+		}
+		fmt.Printf(tr("Chunks: %d of %s (STREAM, --chunk-size)")+"\n", chunks, formatBytes(int64(hdr.ChunkSize)))
+		if hdr.FEC != "" {
+			fmt.Printf(tr("Error correction: %s Reed-Solomon shards per chunk (--fec)")+"\n", hdr.FEC)
+		}
+		printPayload(int(size), hdr.Compression)
+		return nil
+	}
+	n := len(data) - len(prefix) - gcmNonceSize - gcmTagSize
+	if hdr.Padding != "" {
+		fmt.Printf(tr("Payload: %s padded, original size needs the key (--open)")+"\n", formatBytes(int64(n)))
+		return nil
+	}
+	printPayload(n, hdr.Compression)
+	return nil
+}
+
+func printPayload(n int, compression string) {
+	if n < 0 {
+		fmt.Println(tr("Payload: truncated"))
+		return
+	}
+	if compression == encutil.CompressionNone {
+		fmt.Printf(tr("Original size: %s (stored uncompressed)")+"\n", formatBytes(int64(n)))
+		return
+	}
+	fmt.Printf(tr("Payload: %s compressed, original size needs the key (--open)")+"\n", formatBytes(int64(n)))
+}
+
+// inspectAge lists the stanzas of an age header, one "-> type args" line
+// each. scrypt stanzas are passphrase files and carry the KDF cost.
+func inspectAge(data []byte) error {
+	fmt.Println(tr("Format: age v1"))
+	fmt.Println(tr("Cipher: chacha20-poly1305 (STREAM, 64 KiB chunks)"))
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Scan() // version line
+	var stanzas []string
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "---") {
+			break
+		}
+		args, ok := strings.CutPrefix(line, "-> ")
+		if !ok {
+			continue // wrapped body
+		}
+		f := strings.Fields(args)
+		switch {
+		case len(f) == 3 && f[0] == "scrypt":
+			fmt.Println(tr("KDF: scrypt, work factor 2^") + f[2])
+			stanzas = append(stanzas, "scrypt (passphrase)")
+		case len(f) > 1 && (f[0] == "ssh-ed25519" || f[0] == "ssh-rsa"):
+			stanzas = append(stanzas, f[0]+" "+f[1])
+		case len(f) > 0:
+			stanzas = append(stanzas, f[0])
+		}
+	}
+	fmt.Println(tr("Compression: none"))
+	fmt.Printf(tr("Recipients: %d")+"\n", len(stanzas))
+	for _, s := range stanzas {
+		fmt.Println("  " + s)
+	}
+	return sc.Err()
+}
+
+func inspectJWE(token string) error {
+	protected, _, _ := strings.Cut(strings.TrimSpace(token), ".")
+	raw, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return err
+	}
+	var hdr map[string]any
+	if err := json.Unmarshal(raw, &hdr); err != nil {
+		return err
+	}
+	fmt.Println(tr("Format: JWE compact"))
+	fmt.Printf(tr("Cipher: %v, key management %v")+"\n", hdr["enc"], hdr["alg"])
+	if p2c, ok := hdr["p2c"]; ok {
+		fmt.Printf(tr("KDF: PBES2, %v iterations")+"\n", p2c)
+	}
+	zip := "none"
+	if z, ok := hdr["zip"]; ok {
+		zip = fmt.Sprint(z)
+	}
+	fmt.Println(tr("Compression:"), zip)
+	if kid, ok := hdr["kid"].(string); ok {
+		if kid == localKeyID() {
+			kid += " (local key)"
+		}
+		fmt.Println(tr("Key ID:"), kid)
+	}
+	return nil
+}
+
+// localKeyID is the ID of ENCUTITL_KEY or key.bin, or "" if neither is a
+// plain key. TPM sealed keys are left alone, unsealing them is not worth
+// a label.
+func localKeyID() string {
+	key, err := envKey()
+	if err == nil && key == nil {
+		key, err = readPrivateKey(keyFilePath())
+	}
+	if err != nil || len(key) != keySize {
+		return ""
+	}
+	return encutil.KeyID(key)
+}
+
+// signatureStatus checks <path>.sig, if there is one. ok is false only
+// for a signature that does not verify.
+func signatureStatus(path string, data []byte, pubFile string) (status string, ok bool) {
+	sig, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return "none", true
+	}
+	if pubFile == "" {
+		pubFile = signPubPath()
+	}
+	pub, err := readPublicKey(pubFile)
+	if err != nil {
+		return fmt.Sprintf("present, not checked (%v)", err), true
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return "INVALID for " + pubFile, false
+	}
+	return "OK, signed by " + base64.RawURLEncoding.EncodeToString(pub), true
+}
+
+// openData decrypts data the way -d does, under the same output limits.
+func openData(name string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := openTo(&buf, name, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openTo streams the plaintext of data, in any format or text encoding,
+// to w. name is for the audit log.
+func openTo(w io.Writer, name string, data []byte) error {
+	var err error
+	switch {
+	case encutil.IsJWE(string(data)):
+	case isAgeArmor(string(data)):
+		data, err = dearmorAge(string(data))
+	case isEncodedText(data):
+		data, err = decodeInput(string(data))
+	}
+	if err == nil {
+		err = checkReason(name, data)
+	}
+	if err != nil {
+		return err
+	}
+	var identities []encutil.Identity
+	var key []byte
+	switch {
+	case encutil.IsJWE(string(data)):
+		key, err = loadKey()
+	case isAge(data):
+	default:
+		identities, key, err = decryptIdentities(data)
+	}
+	defer releaseLocked(key)
+	if err != nil {
+		return keyError{err}
+	}
+	_, _, err = decryptTo(w, data, key, identities)
+	return err
+}
+
+// keyError marks an openTo failure to get at the keys, as opposed to the
+// file not opening with them.
+type keyError struct{ error }
+
+func (e keyError) Unwrap() error { return e.error }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// --isolate splits decryption between a broker and a worker. The broker
+// (this process) holds the keys: it unwraps the file key and
+// authenticates and decrypts the payload. Decompressing it, the part
+// that chews on attacker-chosen bytes, happens in a worker: a fresh copy
+// of the binary started with an empty environment, dropped to nobody when
+// run as root, sandboxed with no file or network access at all, and
+// talking to the broker only through stdin (compressed bytes) and stdout
+// (plaintext). A memory-safety bug in the decompressor then reaches
+// neither keys nor files.
+
+const (
+	workerArg          = "__inflate-worker"
+	workerExitTooLarge = 3
+)
+
+var isolateFlag = flag.Bool("isolate", false, "Decompress in a separate unprivileged worker process that holds no keys")
+
+// runInflateWorker is the worker side: stdin to stdout, no more than the
+// limit given as its argument.
+func runInflateWorker(args []string) {
+	limit, err := strconv.ParseInt(strings.Join(args, ""), 10, 64)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "worker: bad limit")
+		os.Exit(exitUsage)
+	}
+	// Nothing to read or write but the pipes.
+	applySandbox(&sandboxPolicy{})
+	r := flate.NewReader(os.Stdin)
+	_, err = encutil.CopyLimited(os.Stdout, r, limit)
+	if errors.Is(err, encutil.ErrOutputTooLarge) {
+		os.Exit(workerExitTooLarge)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+}
+
+// decryptIsolated is encutil.DecryptTo with decompression in a worker.
+func decryptIsolated(w io.Writer, data, key []byte, identities []encutil.Identity, limit int64, onCanary func(*encutil.Canary)) (int64, *encutil.Stanza, error) {
+	payload, compression, stanza, err := encutil.OpenPayload(data, encutil.DecryptOptions{LegacyKey: key, AAD: aadData, OnCanary: onCanary}, identities...)
+	if err != nil {
+		return 0, nil, err
+	}
+	if compression == encutil.CompressionNone {
+		n, err := encutil.CopyLimited(w, bytes.NewReader(payload), limit)
+		return n, stanza, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, nil, err
+	}
+	cmd := exec.Command(exe, workerArg, strconv.FormatInt(limit, 10))
+	cmd.Env = []string{} // no ENCUTITL_KEY or passphrases
+	cmd.Dir = "/"
+	cmd.Stdin = bytes.NewReader(payload)
+	out := &countingWriter{w: w}
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = out, &stderr
+	dropPrivileges(cmd)
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == workerExitTooLarge:
+		err = encutil.ErrOutputTooLarge
+	case exitErr != nil:
+		err = fmt.Errorf("decompression worker: %s", strings.TrimSpace(stderr.String()))
+	}
+	return out.n, stanza, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// nobody's IDs on most systems.
+const nobodyID = 65534
+
+func dropPrivileges(cmd *exec.Cmd) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: nobodyID, Gid: nobodyID, NoSetGroups: true},
+	}
+}
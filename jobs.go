@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Long runs are jobs: -R, --chunk-size encryption and decryption, and
+// watch. Each gets an ID and a record in jobs/ in the config directory,
+// kept up to date with its progress, so from any terminal
+//
+//	jobs list         shows the running jobs and those that ran
+//	jobs cancel ID    stops a running job
+//	jobs resume ID    runs an interrupted, failed or canceled job again
+//
+// Resuming picks up where the job left off as far as its checkpoints
+// allow: --chunk-size encryption gets --resume, and carries on from its
+// index if the first run had one; -R gets --changed-only and skips the
+// files the state it saves as it goes says are done. A resumed job keeps
+// its ID and runs in the foreground.
+//
+// With -a or ENCUTITL_DAEMON_SOCK the commands go to the daemon, which
+// acts on the jobs of the user it runs as, and so lets a job that user
+// started be listed and canceled from a session that could not signal it.
+// The daemon resumes jobs in the background with the key.bin it holds,
+// logging to ID.log next to the record.
+
+const (
+	jobsDir  = "jobs"
+	jobEnv   = "ENCUTITL_JOB"      // the ID of the job a resumed run continues
+	jobKeep  = 30 * 24 * time.Hour // finished records older than this go
+	jobWrite = time.Second         // how often progress is written
+)
+
+const (
+	jobRunning     = "running"
+	jobDone        = "done"
+	jobFailed      = "failed"
+	jobInterrupted = "interrupted"
+	jobCanceled    = "canceled"
+)
+
+// Units of jobRecord.Done and Total.
+const (
+	jobBytes = "bytes"
+	jobFiles = "files"
+)
+
+type jobRecord struct {
+	ID         string    `json:"id"`
+	Args       []string  `json:"args"`
+	ResumeArgs []string  `json:"resume_args,omitempty"`
+	Dir        string    `json:"dir"`
+	PID        int       `json:"pid"`
+	State      string    `json:"state"`
+	Started    time.Time `json:"started"`
+	Updated    time.Time `json:"updated"`
+	Runs       int       `json:"runs"`
+	Unit       string    `json:"unit"`
+	Done       int64     `json:"done"`
+	Total      int64     `json:"total,omitempty"`
+	ExitCode   int       `json:"exit_code,omitempty"`
+}
+
+// job is the record of this run, if it is one.
+type job struct {
+	mu      sync.Mutex
+	rec     jobRecord
+	path    string
+	written time.Time
+}
+
+var currentJob *job
+
+func jobsPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, jobsDir)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// startJob makes this run a job counting unit up to total (0 if not
+// known), which resumeArgs make pick up where it stopped. A run started
+// by jobs resume continues the record of its job. Jobs are bookkeeping:
+// if the record cannot be written the run goes on without one.
+func startJob(unit string, total int64, resumeArgs ...string) {
+	if currentJob != nil {
+		return
+	}
+	dir, err := jobsPath()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("Warning: not recording the job:"), err)
+		return
+	}
+	pruneJobs(dir)
+	now := time.Now()
+	var rec jobRecord
+	if id := os.Getenv(jobEnv); id != "" {
+		os.Unsetenv(jobEnv) // not for the subprocesses of this run
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.Base(id)+".json")); err == nil {
+			json.Unmarshal(data, &rec)
+		}
+	}
+	if rec.ID == "" {
+		b := make([]byte, 4)
+		rand.Read(b)
+		wd, _ := os.Getwd()
+		rec = jobRecord{ID: hex.EncodeToString(b), Args: os.Args[1:], Dir: wd, Started: now}
+	}
+	rec.ResumeArgs = resumeArgs
+	rec.PID = os.Getpid()
+	rec.State = jobRunning
+	rec.Runs++
+	rec.Unit, rec.Done, rec.Total, rec.ExitCode = unit, 0, total, 0
+	j := &job{rec: rec, path: filepath.Join(dir, rec.ID+".json")}
+	if err := j.write(); err != nil {
+		fmt.Fprintln(os.Stderr, tr("Warning: not recording the job:"), err)
+		return
+	}
+	currentJob = j
+	fmt.Fprintf(os.Stderr, tr("Job %s")+"\n", rec.ID)
+}
+
+// write saves the record; the caller holds j.mu or owns j.
+func (j *job) write() error {
+	j.rec.Updated = time.Now()
+	j.written = j.rec.Updated
+	return writeJobRecord(j.path, j.rec)
+}
+
+func writeJobRecord(path string, rec jobRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".encutitl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// jobProgress adds n to the progress of the job, if this run is one.
+func jobProgress(n int64) {
+	jobUpdate(func(rec *jobRecord) { rec.Done += n })
+}
+
+// jobProgressAt sets the progress of the job, for a run that starts
+// part of the way through.
+func jobProgressAt(n int64) {
+	jobUpdate(func(rec *jobRecord) { rec.Done = n })
+}
+
+func jobUpdate(f func(rec *jobRecord)) {
+	j := currentJob
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(&j.rec)
+	if time.Since(j.written) >= jobWrite {
+		j.write()
+	}
+}
+
+// jobReader counts what is read from r as progress.
+func jobReader(r io.Reader) io.Reader {
+	if currentJob == nil {
+		return r
+	}
+	return &countingJobReader{r}
+}
+
+type countingJobReader struct {
+	r io.Reader
+}
+
+func (cr *countingJobReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	jobProgress(int64(n))
+	return n, err
+}
+
+// endJob records how the run ended: with exitCode, or interrupted by a
+// signal. Either is a cancel if jobs cancel asked for it, as commands
+// that catch signals themselves end normally.
+func endJob(interrupted bool) {
+	j := currentJob
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch {
+	case os.Remove(cancelMarker(j.path)) == nil:
+		j.rec.State = jobCanceled
+	case interrupted:
+		j.rec.State = jobInterrupted
+	case exitCode != 0:
+		j.rec.State = jobFailed
+	default:
+		j.rec.State = jobDone
+	}
+	j.rec.ExitCode = exitCode
+	if err := j.write(); err != nil {
+		fmt.Fprintln(os.Stderr, tr("Warning: recording the end of the job:"), err)
+	}
+}
+
+// cancelMarker is created by jobs cancel before it signals the job.
+func cancelMarker(recordPath string) string {
+	return strings.TrimSuffix(recordPath, ".json") + ".cancel"
+}
+
+// listJobs returns every record, newest first. Jobs whose process is
+// gone without saying how it ended were interrupted, or canceled by a
+// kill that could not be caught.
+func listJobs() ([]jobRecord, error) {
+	dir, err := jobsPath()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var jobs []jobRecord
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // finished and pruned meanwhile
+		}
+		var rec jobRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if rec.State == jobRunning && !processAlive(rec.PID) {
+			rec.State = jobInterrupted
+			if os.Remove(cancelMarker(path)) == nil {
+				rec.State = jobCanceled
+			}
+			writeJobRecord(path, rec)
+		}
+		jobs = append(jobs, rec)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Started.After(jobs[b].Started) })
+	return jobs, nil
+}
+
+// findJob returns the record of id, or of the one job whose ID starts
+// with it.
+func findJob(id string) (jobRecord, error) {
+	jobs, err := listJobs()
+	if err != nil {
+		return jobRecord{}, err
+	}
+	var found []jobRecord
+	for _, rec := range jobs {
+		if rec.ID == id {
+			return rec, nil
+		}
+		if id != "" && strings.HasPrefix(rec.ID, id) {
+			found = append(found, rec)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return jobRecord{}, fmt.Errorf("no job %q", id)
+	case 1:
+		return found[0], nil
+	}
+	return jobRecord{}, fmt.Errorf("%q matches %d jobs", id, len(found))
+}
+
+func pruneJobs(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, path := range paths {
+		var rec jobRecord
+		data, err := os.ReadFile(path)
+		if err != nil || json.Unmarshal(data, &rec) != nil {
+			continue
+		}
+		if rec.State != jobRunning && time.Since(rec.Updated) > jobKeep {
+			os.Remove(path)
+			os.Remove(strings.TrimSuffix(path, ".json") + ".log")
+		}
+	}
+}
+
+// cancelJob stops a running job.
+func cancelJob(id string) (jobRecord, error) {
+	rec, err := findJob(id)
+	if err != nil {
+		return rec, err
+	}
+	if rec.State != jobRunning {
+		return rec, fmt.Errorf("job %s is not running, it is %s", rec.ID, rec.State)
+	}
+	dir, err := jobsPath()
+	if err != nil {
+		return rec, err
+	}
+	marker := cancelMarker(filepath.Join(dir, rec.ID+".json"))
+	if err := os.WriteFile(marker, nil, 0600); err != nil {
+		return rec, err
+	}
+	if err := stopProcess(rec.PID); err != nil {
+		os.Remove(marker)
+		return rec, err
+	}
+	return rec, nil
+}
+
+// resumeCommand returns the command that runs rec again.
+func resumeCommand(id string) (*exec.Cmd, jobRecord, error) {
+	rec, err := findJob(id)
+	if err != nil {
+		return nil, rec, err
+	}
+	switch rec.State {
+	case jobRunning:
+		return nil, rec, fmt.Errorf("job %s is still running", rec.ID)
+	case jobDone:
+		return nil, rec, fmt.Errorf("job %s is done", rec.ID)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, rec, err
+	}
+	args := slices.Clone(rec.Args)
+	for _, a := range rec.ResumeArgs {
+		if !slices.Contains(args, a) {
+			args = append(args, a)
+		}
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = rec.Dir
+	cmd.Env = append(os.Environ(), jobEnv+"="+rec.ID)
+	return cmd, rec, nil
+}
+
+// startJobInBackground is jobs resume for the daemon: the job runs with
+// key, if there is one, and its output goes to ID.log.
+func startJobInBackground(id string, key []byte) (jobRecord, error) {
+	cmd, rec, err := resumeCommand(id)
+	if err != nil {
+		return rec, err
+	}
+	dir, err := jobsPath()
+	if err != nil {
+		return rec, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, rec.ID+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return rec, err
+	}
+	defer log.Close()
+	if key != nil && os.Getenv("ENCUTITL_KEY") == "" {
+		cmd.Env = append(cmd.Env, "ENCUTITL_KEY="+base64.StdEncoding.EncodeToString(key))
+	}
+	cmd.Stdout, cmd.Stderr = log, log
+	if err := cmd.Start(); err != nil {
+		return rec, err
+	}
+	go cmd.Wait()
+	return rec, nil
+}
+
+func runJobs(args []string) {
+	fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+	sock := fs.String("a", os.Getenv(daemonSockEnv), "Daemon socket, to act on the daemon's jobs")
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	usage := "Usage: jobs [-a SOCKET] list|cancel ID|resume ID"
+	if fs.NArg() == 0 {
+		fail(exitUsage, usage)
+		return
+	}
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	if cmd == "list" && len(rest) != 0 || cmd != "list" && len(rest) != 1 {
+		fail(exitUsage, usage)
+		return
+	}
+	id := strings.Join(rest, "")
+	if *sock != "" {
+		runJobsDaemon(*sock, cmd, id)
+		return
+	}
+	switch cmd {
+	case "list":
+		jobs, err := listJobs()
+		if err != nil {
+			fail(exitIO, tr("Jobs error:"), err)
+			return
+		}
+		printJobs(jobs)
+	case "cancel":
+		rec, err := cancelJob(id)
+		if err != nil {
+			fail(exitError, tr("Jobs error:"), err)
+			return
+		}
+		fmt.Println(tr("Canceled job"), rec.ID)
+	case "resume":
+		c, _, err := resumeCommand(id)
+		if err != nil {
+			fail(exitError, tr("Jobs error:"), err)
+			return
+		}
+		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := c.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				exitCode = exitErr.ExitCode()
+				return
+			}
+			fail(exitError, tr("Jobs error:"), err)
+		}
+	default:
+		fail(exitUsage, usage)
+	}
+}
+
+// runJobsDaemon sends a jobs command to the daemon.
+func runJobsDaemon(sock, cmd, id string) {
+	ops := map[string]string{"list": "jobs", "cancel": "cancel-job", "resume": "resume-job"}
+	op, ok := ops[cmd]
+	if !ok {
+		fail(exitUsage, "Usage: jobs [-a SOCKET] list|cancel ID|resume ID")
+		return
+	}
+	out, ok := daemonCall(sock, op, []byte(id))
+	if !ok {
+		return
+	}
+	switch cmd {
+	case "list":
+		var jobs []jobRecord
+		if err := json.Unmarshal(out, &jobs); err != nil {
+			fail(exitIO, tr("Jobs error:"), err)
+			return
+		}
+		printJobs(jobs)
+	case "cancel":
+		fmt.Println(tr("Canceled job"), string(out))
+	case "resume":
+		fmt.Printf(tr("Resumed job %s in the daemon")+"\n", out)
+	}
+}
+
+func printJobs(jobs []jobRecord) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !*a11yFlag {
+		fmt.Fprintln(tw, "ID\tSTATE\tPROGRESS\tSTARTED\tUPDATED\tCOMMAND")
+	}
+	for _, rec := range jobs {
+		progress := fmt.Sprintf("%d files", rec.Done)
+		switch {
+		case rec.Unit == jobFiles && rec.Done == 1:
+			progress = "1 file"
+		case rec.Unit == jobBytes:
+			progress = formatBytes(rec.Done)
+			if rec.Total > 0 {
+				progress += fmt.Sprintf(" of %s (%d%%)", formatBytes(rec.Total), rec.Done*100/rec.Total)
+			}
+		}
+		state := rec.State
+		if rec.ExitCode != 0 {
+			state += fmt.Sprintf(" (%d)", rec.ExitCode)
+		}
+		if *a11yFlag {
+			fmt.Printf(tr("Job %s is %s after %s, started %s, updated %s: %s")+"\n", rec.ID, state, progress,
+				rec.Started.Local().Format(time.DateTime), rec.Updated.Local().Format(time.DateTime), strings.Join(rec.Args, " "))
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", rec.ID, state, progress,
+			rec.Started.Local().Format(time.DateTime), rec.Updated.Local().Format(time.DateTime), strings.Join(rec.Args, " "))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// processAlive reports whether pid is a running process. FindProcess
+// only succeeds for those on Windows.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// stopProcess ends pid. Windows has no signal a job could catch, so the
+// job cannot record the cancel itself; jobs list does.
+func stopProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// With --key-backend passphrase the file key is wrapped under a key
+// stretched from a passphrase with Argon2id, at the cost --kdf-preset
+// names. The parameters are recorded in the header, so decrypting only
+// needs the passphrase. kdf-calibrate measures this machine and prints
+// parameters that take a given time, to use as the preset:
+//
+//	encutitl kdf-calibrate --target 500ms
+//	encutitl -e -f notes.txt --key-backend passphrase --kdf-preset t=6,m=262144,p=4
+
+var kdfPreset = flag.String("kdf-preset", "moderate", "Argon2id cost for --key-backend passphrase: interactive, moderate, sensitive, or t=N,m=KIB,p=N from kdf-calibrate")
+
+// passphraseRecipient asks for a new passphrase, twice when prompting.
+func passphraseRecipient() (*encutil.PassphraseRecipient, error) {
+	params, err := encutil.KDFPreset(*kdfPreset)
+	if err != nil {
+		return nil, err
+	}
+	pass, err := configuredPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if pass == nil {
+		if pass, err = promptSecret(tr("Passphrase: ")); err != nil {
+			return nil, err
+		}
+		again, err := promptSecret(tr("Repeat it: "))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pass, again) {
+			return nil, errors.New("the passphrases do not match")
+		}
+	}
+	return encutil.NewPassphraseRecipient(pass, params)
+}
+
+// passphraseIdentity asks for the passphrase of a file. Any parameters
+// will do here; the stanza's are used.
+func passphraseIdentity() (*encutil.PassphraseRecipient, error) {
+	pass, err := configuredPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if pass == nil {
+		if pass, err = promptSecret(tr("Passphrase: ")); err != nil {
+			return nil, err
+		}
+	}
+	params, _ := encutil.KDFPreset("interactive")
+	return encutil.NewPassphraseRecipient(pass, params)
+}
+
+func runKDFCalibrate(args []string) {
+	fs := flag.NewFlagSet("kdf-calibrate", flag.ExitOnError)
+	target := fs.Duration("target", 500*time.Millisecond, "How long deriving the key should take")
+	memory := fs.String("memory", "256M", "Memory to use, halved if one pass already takes longer than --target")
+	threads := fs.Int("threads", min(runtime.NumCPU(), 4), "Parallelism")
+	addLangFlag(fs)
+	fs.Parse(args)
+	mem, err := parseSize(*memory)
+	if err != nil || mem < 1<<10 || *threads < 1 || *threads > encutil.MaxArgon2Threads || *target <= 0 {
+		fail(exitUsage, "Usage: kdf-calibrate [--target DURATION] [--memory SIZE] [--threads N]")
+		return
+	}
+	params, took, err := encutil.CalibrateArgon2(*target, uint32(min(mem>>10, encutil.MaxArgon2Memory)), uint8(*threads))
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	fmt.Printf(tr("Argon2id %s takes %s here (%s of memory)")+"\n", params, took.Round(time.Millisecond), formatBytes(int64(params.Memory)<<10))
+	fmt.Println(tr("Use it with: --kdf-preset"), params)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The key is key.bin in the encutitl config directory (~/.config/encutitl
+// on linux, ~/Library/Application Support/encutitl on macOS,
+// %AppData%\encutitl on windows), not the working directory, where it is
+// one git add away from being committed next to the files it protects.
+// --keyfile or ENCUTITL_KEYFILE put it elsewhere. A key.bin in the
+// working directory, where older versions kept it, is still used while
+// the config directory has none, with a warning to move it. sign.key,
+// sign.pub, pq.key and pq.pub are kept in the config directory the same
+// way.
+
+const keyFileName = "key.bin"
+
+var keyFileFlag = flag.String("keyfile", os.Getenv("ENCUTITL_KEYFILE"), "Key file (default key.bin in the config directory, also ENCUTITL_KEYFILE)")
+
+// addKeyFileFlag offers --keyfile on a subcommand.
+func addKeyFileFlag(fs *flag.FlagSet) {
+	fs.StringVar(keyFileFlag, "keyfile", *keyFileFlag, "Key file (default key.bin in the config directory, also ENCUTITL_KEYFILE)")
+}
+
+var legacyWarnings sync.Map
+
+// keyFilePath is where the key is read from and keygen writes it.
+func keyFilePath() string {
+	if *keyFileFlag != "" {
+		return *keyFileFlag
+	}
+	return configDirFile(keyFileName)
+}
+
+// signKeyPath and signPubPath are where the signing key pair is read
+// from and generated to.
+func signKeyPath() string { return configDirFile(signKeyFile) }
+func signPubPath() string { return configDirFile(signPubFile) }
+
+// pqKeyPath and pqPubPath are the same for the hybrid key pair.
+func pqKeyPath() string { return configDirFile(pqKeyFile) }
+func pqPubPath() string { return configDirFile(pqPubFile) }
+
+// configDirFile is name in the config directory, or in the working
+// directory if only that has one.
+func configDirFile(name string) string {
+	dir, err := configDir()
+	if err != nil {
+		return name
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(name); err == nil {
+			if _, warned := legacyWarnings.LoadOrStore(name, true); !warned {
+				fmt.Fprintf(os.Stderr, tr("Warning: using %s in the working directory, move it to %s")+"\n", name, path)
+			}
+			return name
+		}
+	}
+	return path
+}
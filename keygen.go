@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// keygen is the only command that creates key.bin. Encrypting without
+// one is an error pointing here, and an existing key is never replaced
+// without --force: files encrypted with it cannot be opened by a new one.
+//
+//	encutitl keygen --out key.bin
+
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "", "Where to write the key (default the key file, see --keyfile)")
+	force := fs.Bool("force", false, "Replace an existing key; files encrypted with it can no longer be decrypted without a copy")
+	addKeyFileFlag(fs)
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fail(exitUsage, "Usage: keygen [--out FILE] [--force]")
+		return
+	}
+	if *out == "" {
+		*out = keyFilePath()
+	}
+
+	if _, err := os.Stat(*out); err == nil {
+		if !*force {
+			failf(exitUsage, tr("Error: %s already exists and files encrypted with it need it; use --out, or --force to replace it"), *out)
+			return
+		}
+		fmt.Fprintf(os.Stderr, tr("Replacing %s; keep a copy of it for files already encrypted with it")+"\n", *out)
+	}
+	key, err := generateKeyFile(*out)
+	defer releaseLocked(key)
+	if err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Println(tr("Key saved to:"), *out)
+	fmt.Println(tr("Key ID:"), encutil.KeyID(key))
+	fmt.Println(tr("Fingerprint:"), displayFingerprint(key))
+}
+
+func generateKeyFile(path string) ([]byte, error) {
+	key := lockedCopy(make([]byte, keySize))
+	if _, err := rand.Read(key); err != nil {
+		releaseLocked(key)
+		return nil, err
+	}
+	err := writePrivateKey(path, key)
+	return key, err
+}
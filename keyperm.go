@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Private key files are refused, as OpenSSH does, when other users can
+// read or write them or when they belong to someone else: a key anyone
+// can read is no longer private, and one someone else owns can be
+// swapped. --insecure-key-permissions skips the check. Keys encutitl
+// writes are created, or tightened to, owner read and write only.
+
+var insecureKeyPerms = flag.Bool("insecure-key-permissions", false, "Use private key files that other users can access or that someone else owns")
+
+// addKeyPermsFlag offers --insecure-key-permissions on a subcommand.
+func addKeyPermsFlag(fs *flag.FlagSet) {
+	fs.BoolVar(insecureKeyPerms, "insecure-key-permissions", *insecureKeyPerms, "Use private key files that other users can access or that someone else owns")
+}
+
+// readPrivateKey reads a private key file after checking who can get at
+// it, on the open file so it cannot be swapped in between.
+func readPrivateKey(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if !*insecureKeyPerms {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkKeyPermissions(info); err != nil {
+			return nil, fmt.Errorf("%s: %w (fix it, or pass --insecure-key-permissions)", path, err)
+		}
+	}
+	return io.ReadAll(f)
+}
+
+// writePrivateKey writes a private key readable by its owner only, also
+// when the file already existed with wider permissions. The key goes to a
+// synced temporary file that is renamed over path, so replacing a key,
+// as tpm seal and unseal do, never leaves a partial one behind.
+func writePrivateKey(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".encutitl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return renameSynced(tmp.Name(), path)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// key split prints key.bin as Shamir shares for offline backup, key
+// recover reads them back. A share is
+//
+//	encutitl-share-XXXX-XXXX-...
+//
+// base32 of threshold, x, y and a two byte checksum, so a mistyped share
+// is caught before it silently produces a wrong key.
+
+const sharePrefix = "encutitl-share-"
+
+func runKey(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "Usage: key split|recover|export|import|pq-generate [flags]")
+		return
+	}
+	switch args[0] {
+	case "split":
+		runKeySplit(args[1:])
+	case "recover":
+		runKeyRecover(args[1:])
+	case "export":
+		runKeyExport(args[1:])
+	case "import":
+		runKeyImport(args[1:])
+	case "pq-generate":
+		runKeyPQGenerate(args[1:])
+	default:
+		fail(exitUsage, tr("Error: unknown key command"), args[0])
+	}
+}
+
+func runKeySplit(args []string) {
+	fs := flag.NewFlagSet("key split", flag.ExitOnError)
+	n := fs.Int("shares", 5, "Number of shares to create")
+	k := fs.Int("threshold", 3, "Shares needed to recover the key")
+	addKeyFileFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+
+	key, err := readKeyFile()
+	defer releaseLocked(key)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	shares, err := encutil.SplitSecret(key, *n, *k)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	fmt.Printf(tr("%s split into %d shares, any %d recover it:")+"\n\n", keyFilePath(), *n, *k)
+	for _, s := range shares {
+		fmt.Println(encodeShare(s))
+	}
+}
+
+func runKeyRecover(args []string) {
+	fs := flag.NewFlagSet("key recover", flag.ExitOnError)
+	out := fs.String("o", "", "Where to write the recovered key (default the key file, see --keyfile)")
+	addKeyFileFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *out == "" {
+		*out = keyFilePath()
+	}
+
+	if _, err := os.Stat(*out); err == nil {
+		failf(exitUsage, tr("Error: %s already exists, move it away or use -o"), *out)
+		return
+	}
+	var shares []encutil.Share
+	fmt.Println(tr("Enter shares, one per line:"))
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		s, err := decodeShare(line)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, tr("Bad share:"), err)
+			continue
+		}
+		shares = append(shares, s)
+		if len(shares) >= int(shares[0].Threshold) {
+			break
+		}
+		fmt.Printf(tr("%d of %d")+"\n", len(shares), shares[0].Threshold)
+	}
+	key, err := encutil.CombineShares(shares)
+	if err != nil {
+		fail(exitKey, tr("Recover error:"), err)
+		return
+	}
+	if err := writePrivateKey(*out, key); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Printf(tr("Recovered key %s saved to: %s")+"\n", encutil.KeyID(key), *out)
+}
+
+func encodeShare(s encutil.Share) string {
+	raw := append([]byte{s.Threshold, s.X}, s.Y...)
+	sum := sha256.Sum256(raw)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(append(raw, sum[:2]...))
+	var groups []string
+	for len(enc) > 4 {
+		groups = append(groups, enc[:4])
+		enc = enc[4:]
+	}
+	return sharePrefix + strings.Join(append(groups, enc), "-")
+}
+
+func decodeShare(line string) (encutil.Share, error) {
+	line = strings.ToUpper(strings.TrimPrefix(strings.ToLower(line), sharePrefix))
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ReplaceAll(line, "-", ""))
+	if err != nil {
+		return encutil.Share{}, err
+	}
+	if len(raw) < 5 {
+		return encutil.Share{}, errors.New("too short")
+	}
+	body, check := raw[:len(raw)-2], raw[len(raw)-2:]
+	if sum := sha256.Sum256(body); sum[0] != check[0] || sum[1] != check[1] {
+		return encutil.Share{}, errors.New("checksum mismatch, check for typos")
+	}
+	if body[0] < 2 {
+		return encutil.Share{}, fmt.Errorf("invalid threshold %d", body[0])
+	}
+	return encutil.Share{Threshold: body[0], X: body[1], Y: body[2:]}, nil
+}
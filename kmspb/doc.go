@@ -0,0 +1,5 @@
+// Package kmspb holds the generated Go server stubs of the Kubernetes KMS
+// v2 plugin API defined in kms.proto, served by `encutitl kms-plugin`.
+package kmspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kms.proto
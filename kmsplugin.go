@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"gitlab.com/EvnMiller/encryptutiltui/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// kms-plugin serves the Kubernetes KMS v2 plugin API on a unix socket,
+// for envelope encryption of etcd secrets with encutitl keys. The API
+// server hands Encrypt the key its data encryption keys derive from, and
+// stores what comes back; kms-plugin encrypts it to the recipients as -e
+// would, key.bin by default, and decrypts with every key it loaded, so
+// ciphertexts from before a rotation still open.
+//
+// The key_id reported is a hash of the recipients. Changing them changes
+// it, which makes the API server re-encrypt with the new ones. Point the
+// cluster's EncryptionConfiguration at the socket:
+//
+//	- kms:
+//	    apiVersion: v2
+//	    name: encutitl
+//	    endpoint: unix:///var/run/encutitl-kms.sock
+
+// kmsMaxCiphertext is the largest ciphertext the API server accepts.
+const kmsMaxCiphertext = 1 << 10
+
+type kmsServer struct {
+	kmspb.UnimplementedKeyManagementServiceServer
+	*daemon
+	keyID string
+}
+
+func runKMSPlugin(args []string) {
+	fs := flag.NewFlagSet("kms-plugin", flag.ExitOnError)
+	sock := fs.String("socket", "/var/run/encutitl-kms.sock", "Unix socket to serve on")
+	fs.Var(&recipientFlags, "recipient", "Recipient to encrypt to (repeatable, default key.bin)")
+	fs.Var(&identityFlags, "i", "Identity file to decrypt with (repeatable, default as for -d)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fail(exitUsage, "Usage: kms-plugin [--socket PATH] [--recipient KEY...] [-i KEY...]")
+		return
+	}
+	d, err := loadDaemonKeys()
+	if err == nil && len(d.recipients) == 0 {
+		err = errors.New("no key.bin or --recipient to encrypt to")
+	}
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	k := &kmsServer{daemon: d}
+	if k.keyID, err = kmsKeyID(d.recipients); err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	spec := &listenSpec{network: "unix", addr: *sock, mode: 0600}
+	ln, err := spec.listen()
+	if err != nil {
+		fail(exitIO, tr("Listen error:"), err)
+		return
+	}
+	defer os.Remove(*sock)
+
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		if info.FullMethod != kmspb.KeyManagementService_Status_FullMethodName || err != nil {
+			logGRPC(info.FullMethod, start, err)
+		}
+		return resp, err
+	}))
+	kmspb.RegisterKeyManagementServiceServer(srv, k)
+	errs := make(chan error, 1)
+	fmt.Fprintf(os.Stderr, tr("Serving KMS v2 on %s, key %s")+"\n", *sock, k.keyID)
+	go func() { errs <- srv.Serve(ln) }()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		fail(exitIO, tr("Serve error:"), err)
+	case <-sigs:
+		srv.GracefulStop()
+	}
+}
+
+// kmsKeyID names a set of recipients, whatever order they are given in.
+func kmsKeyID(recipients []encutil.Recipient) (string, error) {
+	var ids []string
+	for _, r := range recipients {
+		s, err := r.Wrap(make([]byte, encutil.FileKeySize))
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, stanzaID(s))
+	}
+	sort.Strings(ids)
+	sum := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintln(sum, id)
+	}
+	return "encutitl-" + hex.EncodeToString(sum.Sum(nil))[:16], nil
+}
+
+// Status checks that a key encrypts and decrypts, as the API server
+// polls it for health.
+func (k *kmsServer) Status(ctx context.Context, req *kmspb.StatusRequest) (*kmspb.StatusResponse, error) {
+	health := "ok"
+	probe := []byte("kms-plugin health check")
+	sealed, err := encutil.EncryptCompressed(probe, encutil.CompressionNone, k.recipients...)
+	if err == nil {
+		var plain []byte
+		if plain, err = encutil.Decrypt(sealed, k.key, k.identities...); err == nil && !bytes.Equal(plain, probe) {
+			err = errors.New("round trip mismatch")
+		}
+	}
+	if err != nil {
+		health = err.Error()
+	}
+	return &kmspb.StatusResponse{Version: "v2", Healthz: health, KeyId: k.keyID}, nil
+}
+
+func (k *kmsServer) Encrypt(ctx context.Context, req *kmspb.EncryptRequest) (*kmspb.EncryptResponse, error) {
+	sealed, err := encutil.EncryptCompressed(req.Plaintext, encutil.CompressionNone, k.recipients...)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if len(sealed) > kmsMaxCiphertext {
+		return nil, status.Errorf(codes.FailedPrecondition, "ciphertext is %d bytes, over the API server's %d; use fewer or smaller recipients", len(sealed), kmsMaxCiphertext)
+	}
+	return &kmspb.EncryptResponse{Ciphertext: sealed, KeyId: k.keyID}, nil
+}
+
+func (k *kmsServer) Decrypt(ctx context.Context, req *kmspb.DecryptRequest) (*kmspb.DecryptResponse, error) {
+	plain, err := encutil.Decrypt(req.Ciphertext, k.key, k.identities...)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kmspb.DecryptResponse{Plaintext: plain}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// --max-output-size caps how much one decryption may write, so a small
+// crafted ciphertext cannot inflate into gigabytes. Decrypting to a file
+// or stdout streams the plaintext as it is decompressed; only --archive
+// extraction and vault entries are held in memory, under the same cap.
+// --max-ratio bounds the output relative to the input instead, which
+// suits batches of mixed sizes. Both also apply to --recompress unpacking
+// archives before encryption.
+
+// ratioFloor is the output every input may expand to regardless of
+// --max-ratio, so small files of repetitive text are not refused.
+const ratioFloor = 1 << 20
+
+var (
+	maxOutputSize sizeFlag
+	maxRatio      = flag.Int64("max-ratio", 0, "Abort decompression that expands its input more than this many times, beyond the first 1 MiB (0 for no limit)")
+)
+
+// --max-input-size refuses inputs over a size before reading them whole,
+// for callers that decrypt whatever they are handed.
+var maxInputSize sizeFlag
+
+// checkInputSize enforces --max-input-size on an input of n bytes.
+func checkInputSize(n int64) error {
+	if maxInputSize > 0 && n > int64(maxInputSize) {
+		return fmt.Errorf("input of %s is over --max-input-size %s", formatBytes(n), formatBytes(int64(maxInputSize)))
+	}
+	return nil
+}
+
+// readStdin reads -f -, stopping just past --max-input-size.
+func readStdin() ([]byte, error) {
+	r := io.Reader(os.Stdin)
+	if maxInputSize > 0 {
+		r = io.LimitReader(r, int64(maxInputSize)+1)
+	}
+	return io.ReadAll(r)
+}
+
+// readLimited reads a download whole, giving up as soon as it runs past
+// --max-input-size rather than after holding all of it.
+func readLimited(r io.Reader) ([]byte, error) {
+	if maxInputSize > 0 {
+		r = io.LimitReader(r, int64(maxInputSize)+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxInputSize > 0 && int64(len(data)) > int64(maxInputSize) {
+		return nil, fmt.Errorf("input is over --max-input-size %s", formatBytes(int64(maxInputSize)))
+	}
+	return data, nil
+}
+
+// checkInputFile is checkInputSize for a local file, before reading it.
+func checkInputFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil // left to the read to report
+	}
+	return checkInputSize(info.Size())
+}
+
+func init() {
+	flag.Var(&maxInputSize, "max-input-size", "Refuse inputs larger than this, e.g. 64M (0 for no limit)")
+	flag.Var(&maxOutputSize, "max-output-size", "Abort decompression that would write more than this, e.g. 512M or 4G (0 for no limit)")
+}
+
+// decompressLimit is how much decompressing n input bytes may produce,
+// 0 for no limit.
+func decompressLimit(n int) int64 {
+	limit := int64(maxOutputSize)
+	if *maxRatio > 0 {
+		byRatio := max(int64(n)*(*maxRatio), ratioFloor)
+		if limit == 0 || byRatio < limit {
+			limit = byRatio
+		}
+	}
+	return limit
+}
+
+// limitError says which limit an encutil.ErrOutputTooLarge for n input
+// bytes ran into. Other errors are returned as they are.
+func limitError(err error, n int) error {
+	if !errors.Is(err, encutil.ErrOutputTooLarge) {
+		return err
+	}
+	limit := decompressLimit(n)
+	if limit != int64(maxOutputSize) {
+		return fmt.Errorf("%w: %s of input expands more than %d times (--max-ratio)", err, formatBytes(int64(n)), *maxRatio)
+	}
+	return fmt.Errorf("%w (--max-output-size %s)", err, formatBytes(limit))
+}
+
+// sizeFlag is a byte count given as a number with an optional K, M, G or
+// T suffix (powers of 1024).
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(n)
+	return nil
+}
+
+func parseSize(orig string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(orig))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	shift := 0
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		shift = 10 * (strings.IndexByte("KMGT", s[i]) + 1)
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("bad size %q", orig)
+	}
+	return n << shift, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// With --objects DIR, serve hands out links for downloading the files
+// stored there decrypted, so a web app can give a user a link rather
+// than passing the plaintext through itself:
+//
+//	POST /links  body: {"object": "reports/q3.pdf.bin", "ttl": "5m", "max_size": "64M"}
+//	             reply: {"url": "https://host/download/TOKEN", "expires_at": "..."}
+//	GET  /download/TOKEN  reply: plaintext
+//
+// Minting a link needs a bearer token as the other endpoints do; the
+// link itself is the credential for the download. It is signed with a
+// key made when serve starts, names one object, expires after its ttl
+// (at most --link-max-ttl), and is good for one download: a second one,
+// even while the first is running, is refused with REPLAYED. A download
+// that fails before sending anything leaves the link usable. Downloads
+// stop at max_size bytes of plaintext (at most --max-output-size, if
+// set) and are paced at --link-rate bytes a second. Restarting serve
+// invalidates every link.
+
+const (
+	linkDefaultTTL = 5 * time.Minute
+	linkPath       = "/download/"
+)
+
+var errLinkInvalid = errors.New("link is invalid or expired")
+
+// linkClaims is what a link grants, signed into its token.
+type linkClaims struct {
+	Object  string `json:"o"`
+	Expires int64  `json:"e"`
+	MaxSize int64  `json:"m,omitempty"`
+	Nonce   string `json:"n"`
+}
+
+type linkSigner struct {
+	dir    string
+	key    []byte
+	maxTTL time.Duration
+	rate   int64
+	mu     sync.Mutex
+	used   map[string]time.Time // nonce to expiry
+}
+
+func newLinkSigner(dir string, maxTTL time.Duration, rate int64) (*linkSigner, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &linkSigner{dir: dir, key: key, maxTTL: maxTTL, rate: rate, used: map[string]time.Time{}}, nil
+}
+
+func (l *linkSigner) sign(c linkClaims) string {
+	payload, _ := json.Marshal(c)
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (l *linkSigner) verify(token string) (linkClaims, error) {
+	var c linkClaims
+	p, s, ok := strings.Cut(token, ".")
+	payload, err1 := base64.RawURLEncoding.DecodeString(p)
+	sig, err2 := base64.RawURLEncoding.DecodeString(s)
+	if !ok || err1 != nil || err2 != nil {
+		return c, errLinkInvalid
+	}
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) || json.Unmarshal(payload, &c) != nil {
+		return c, errLinkInvalid
+	}
+	if time.Now().Unix() > c.Expires {
+		return c, errLinkInvalid
+	}
+	return c, nil
+}
+
+// claim marks a link used, failing if it already was.
+func (l *linkSigner) claim(c linkClaims) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for n, exp := range l.used {
+		if now.After(exp) {
+			delete(l.used, n)
+		}
+	}
+	if _, ok := l.used[c.Nonce]; ok {
+		return errors.New("link already used")
+	}
+	l.used[c.Nonce] = time.Unix(c.Expires, 0).Add(time.Second)
+	return nil
+}
+
+func (l *linkSigner) release(c linkClaims) {
+	l.mu.Lock()
+	delete(l.used, c.Nonce)
+	l.mu.Unlock()
+}
+
+// objectPath resolves an object name inside the objects directory.
+func (l *linkSigner) objectPath(name string) (string, error) {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("object %q is outside the objects directory", name)
+	}
+	p := filepath.Join(l.dir, filepath.FromSlash(name))
+	st, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !st.Mode().IsRegular() {
+		return "", fmt.Errorf("object %q is not a file", name)
+	}
+	return p, nil
+}
+
+func (s *server) mintLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Object  string `json:"object"`
+		TTL     string `json:"ttl"`
+		MaxSize string `json:"max_size"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.Object == "" {
+		writeAPIError(w, r, codeBadRequest, `want {"object": NAME, "ttl": DURATION, "max_size": SIZE}`, err)
+		return
+	}
+	ttl := linkDefaultTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			writeAPIError(w, r, codeBadRequest, "ttl: want a positive duration such as 5m", err)
+			return
+		}
+	}
+	if ttl > s.links.maxTTL {
+		writeAPIError(w, r, codeBadRequest, fmt.Sprintf("ttl is over --link-max-ttl %s", s.links.maxTTL), nil)
+		return
+	}
+	c := linkClaims{Expires: time.Now().Add(ttl).Unix(), MaxSize: int64(maxOutputSize)}
+	if req.MaxSize != "" {
+		n, err := parseSize(req.MaxSize)
+		if err != nil || n <= 0 {
+			writeAPIError(w, r, codeBadRequest, "max_size: want a size such as 64M", err)
+			return
+		}
+		if c.MaxSize == 0 || n < c.MaxSize {
+			c.MaxSize = n
+		}
+	}
+	if _, err := s.links.objectPath(req.Object); err != nil {
+		writeAPIError(w, r, codeNotFound, "no such object", err)
+		return
+	}
+	c.Object = path.Clean(strings.TrimPrefix(req.Object, "/"))
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	c.Nonce = hex.EncodeToString(nonce)
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"url":        scheme + "://" + r.Host + linkPath + s.links.sign(c),
+		"expires_at": time.Unix(c.Expires, 0).UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *server) download(w http.ResponseWriter, r *http.Request) {
+	id := requestID(r)
+	r.Header.Set("X-Request-Id", id)
+	w.Header().Set("X-Request-Id", id)
+	token := strings.TrimPrefix(r.URL.Path, linkPath)
+	r.URL.Path = linkPath + "TOKEN" // kept out of the log
+	if r.Method != http.MethodGet {
+		writeAPIError(w, r, codeMethodNotAllowed, r.Method+" not allowed on links", nil)
+		return
+	}
+	c, err := s.links.verify(token)
+	if err != nil {
+		writeAPIError(w, r, codeAuthFailed, err.Error(), nil)
+		return
+	}
+	if err := s.links.claim(c); err != nil {
+		writeAPIError(w, r, codeReplayed, "this link was already used", err)
+		return
+	}
+	start := time.Now()
+	lw := &lazyWriter{w: w}
+	err = s.serveObject(lw, c)
+	fmt.Fprintf(os.Stderr, "%s request_id=%s GET %s%s took=%s\n", time.Now().UTC().Format(time.RFC3339), id, linkPath, c.Object, time.Since(start).Round(time.Millisecond))
+	if err == nil {
+		return
+	}
+	if lw.started {
+		fmt.Fprintf(os.Stderr, "%s request_id=%s %s: %v\n", time.Now().UTC().Format(time.RFC3339), id, c.Object, err)
+		panic(http.ErrAbortHandler)
+	}
+	s.links.release(c)
+	w.Header().Del("Content-Disposition")
+	code := errorCode(err)
+	writeAPIError(w, r, code, codeMessage[code], err)
+}
+
+func (s *server) serveObject(lw *lazyWriter, c linkClaims) error {
+	p, err := s.links.objectPath(c.Object)
+	if err != nil {
+		return err
+	}
+	if st, err := os.Stat(p); err == nil && st.Size() > s.maxSize {
+		return fmt.Errorf("%w: object is over --max-input-size", encutil.ErrOutputTooLarge)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if isAgeArmor(string(data)) {
+		if data, err = dearmorAge(string(data)); err != nil {
+			return err
+		}
+	}
+	name := strings.TrimSuffix(decryptedName(path.Base(c.Object)), ".dec")
+	lw.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	var out io.Writer = &capWriter{w: lw, left: c.MaxSize}
+	if c.MaxSize == 0 {
+		out = lw
+	}
+	if s.links.rate > 0 {
+		out = &paceWriter{w: out, rate: s.links.rate, start: time.Now()}
+	}
+	_, _, err = decryptTo(out, data, s.key, s.identities)
+	return err
+}
+
+// capWriter fails once more than left bytes are written.
+type capWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.left {
+		return 0, fmt.Errorf("%w: over the link's max_size", encutil.ErrOutputTooLarge)
+	}
+	c.left -= int64(len(p))
+	return c.w.Write(p)
+}
+
+// paceWriter holds writes to rate bytes a second on average.
+type paceWriter struct {
+	w     io.Writer
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (p *paceWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(int64(len(b)), max(p.rate/10, 1))]
+		n, err := p.w.Write(chunk)
+		written += n
+		p.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+		due := p.start.Add(time.Duration(float64(p.n) / float64(p.rate) * float64(time.Second)))
+		time.Sleep(time.Until(due))
+	}
+	return written, nil
+}
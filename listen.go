@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A listen spec is [scheme:]address[,option=value...], for example
+//
+//	:7788                      all addresses, dual-stack where the OS allows
+//	tcp6:[::]:8443             IPv6 only
+//	tcp4:0.0.0.0:8443,cert=server.pem,key=server.key
+//	unix:/run/encutitl.sock,mode=0660
+//
+// cert/key enable TLS on that listener, client-ca additionally requires
+// client certificates signed by that CA.
+
+type listenSpec struct {
+	network  string
+	addr     string
+	certFile string
+	keyFile  string
+	clientCA string
+	mode     os.FileMode
+}
+
+func parseListenSpec(s string) (*listenSpec, error) {
+	parts := strings.Split(s, ",")
+	spec := &listenSpec{network: "tcp", addr: parts[0]}
+	for _, scheme := range []string{"tcp4", "tcp6", "tcp", "unix"} {
+		if strings.HasPrefix(parts[0], scheme+":") {
+			spec.network = scheme
+			spec.addr = strings.TrimPrefix(parts[0], scheme+":")
+			break
+		}
+	}
+	if spec.network == "unix" {
+		spec.addr = strings.TrimPrefix(spec.addr, "//")
+	}
+	if spec.addr == "" {
+		return nil, fmt.Errorf("listen %q: missing address", s)
+	}
+
+	for _, opt := range parts[1:] {
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok {
+			return nil, fmt.Errorf("listen %q: option %q is not key=value", s, opt)
+		}
+		switch k {
+		case "cert":
+			spec.certFile = v
+		case "key":
+			spec.keyFile = v
+		case "client-ca":
+			spec.clientCA = v
+		case "mode":
+			m, err := strconv.ParseUint(v, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("listen %q: bad mode %q", s, v)
+			}
+			spec.mode = os.FileMode(m)
+		default:
+			return nil, fmt.Errorf("listen %q: unknown option %q", s, k)
+		}
+	}
+	if (spec.certFile == "") != (spec.keyFile == "") {
+		return nil, fmt.Errorf("listen %q: cert and key must be given together", s)
+	}
+	if spec.clientCA != "" && spec.certFile == "" {
+		return nil, fmt.Errorf("listen %q: client-ca needs cert and key", s)
+	}
+	if spec.mode != 0 && spec.network != "unix" {
+		return nil, fmt.Errorf("listen %q: mode only applies to unix sockets", s)
+	}
+	return spec, nil
+}
+
+func (spec *listenSpec) String() string {
+	if spec.network == "tcp" {
+		return spec.addr
+	}
+	return spec.network + ":" + spec.addr
+}
+
+func (spec *listenSpec) listen() (net.Listener, error) {
+	if spec.network == "unix" {
+		// Only clean up a stale socket, never an arbitrary file.
+		if st, err := os.Lstat(spec.addr); err == nil && st.Mode()&os.ModeSocket != 0 {
+			os.Remove(spec.addr)
+		}
+	}
+	ln, err := net.Listen(spec.network, spec.addr)
+	if err != nil {
+		return nil, err
+	}
+	if spec.mode != 0 {
+		if err := os.Chmod(spec.addr, spec.mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if spec.certFile == "" {
+		return ln, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(spec.certFile, spec.keyFile)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	// h2 for gRPC, which needs it negotiated, and HTTP/2 clients.
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}}
+	if spec.clientCA != "" {
+		pem, err := os.ReadFile(spec.clientCA)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			ln.Close()
+			return nil, fmt.Errorf("%s: no certificates found", spec.clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls.NewListener(ln, cfg), nil
+}
+
+// listenAll opens every spec, closing the ones already opened on failure.
+func listenAll(specs []string) ([]net.Listener, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no listen address")
+	}
+	var lns []net.Listener
+	for _, s := range specs {
+		spec, err := parseListenSpec(s)
+		if err == nil {
+			var ln net.Listener
+			ln, err = spec.listen()
+			if err == nil {
+				lns = append(lns, ln)
+				continue
+			}
+		}
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, err
+	}
+	return lns, nil
+}
+
+// acceptAny returns the first connection accepted on any listener.
+func acceptAny(lns []net.Listener) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			conn, err := ln.Accept()
+			ch <- result{conn, err}
+		}(ln)
+	}
+	r := <-ch
+	return r.conn, r.err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// On Windows a file opened by another process without sharing (an open
+// Outlook PST, a running database) fails with a sharing violation. Rather
+// than surfacing that as a raw error, input reads and output writes wait
+// up to --lock-wait for the lock to go away and otherwise say which file
+// is locked. Elsewhere locks are advisory and isLocked is always false.
+
+var lockWait = flag.Duration("lock-wait", 0, "On Windows, how long to retry files locked by another process, e.g. 30s")
+
+// retryLocked runs op until it succeeds, fails for another reason, or the
+// file stays locked past --lock-wait.
+func retryLocked(path string, op func() error) error {
+	deadline := time.Now().Add(*lockWait)
+	for announced := false; ; announced = true {
+		err := op()
+		if !isLocked(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is locked by another process", path)
+		}
+		if !announced {
+			fmt.Fprintf(os.Stderr, tr("%s is locked by another process, retrying for up to %s")+"\n", path, *lockWait)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func readFileRetry(path string) ([]byte, error) {
+	var data []byte
+	err := retryLocked(path, func() (err error) {
+		data, err = os.ReadFile(path)
+		return err
+	})
+	return data, err
+}
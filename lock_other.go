@@ -0,0 +1,5 @@
+//go:build !windows
+
+package main
+
+func isLocked(err error) bool { return false }
@@ -1,207 +1,817 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"compress/flate"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
 )
 
 const (
-	keyFile = "key.bin"
-	keySize = 32 // AES-256
+	keySize     = 32 // AES-256
+	signKeyFile = "sign.key"
+	signPubFile = "sign.pub"
 )
 
 var (
-	fileFlag     = flag.String("f", "", "Input file path")
-	stringFlag   = flag.String("s", "", "Input string")
-	encrypt      = flag.Bool("e", false, "Encrypt mode")
-	decrypt      = flag.Bool("d", false, "Decrypt mode")
-	outputAsHex  = flag.Bool("output-as-hex", false, "Output in hex instead of base64")
-	toStdout     = flag.Bool("to-stdout", false, "Write encrypted/decrypted data to stdout instead of file")
+	fileFlag    = flag.String("f", "", "Input file path, s3://bucket/key, or - for stdin")
+	stringFlag  = flag.String("s", "", "Input string")
+	encrypt     = flag.Bool("e", false, "Encrypt mode")
+	decrypt     = flag.Bool("d", false, "Decrypt mode")
+	outputAsHex = flag.Bool("output-as-hex", false, "Output in hex instead of base64")
+	toStdout    = flag.Bool("to-stdout", false, "Write encrypted/decrypted data to stdout instead of file")
+	signOutput  = flag.Bool("sign", false, "Sign the encrypted output with the Ed25519 signing key")
+	outputFlag  = flag.String("o", "", "Output file or s3://bucket/key (default <input>.bin when encrypting, <input>.dec when decrypting)")
+	formatFlag  = flag.String("format", "encutitl", "Encryption output format: encutitl, age, jwe or sops (values of YAML, JSON and .env files)")
 )
 
 func main() {
-	flag.Parse()
-
 	// Handle Ctrl+C gracefully
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		fmt.Println("\nInterrupted.")
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "\n"+tr("Interrupted."))
+		exitCode = exitInterrupted
+		endJob(true)
+		os.Exit(exitInterrupted)
 	}()
 
+	run()
+	if err := writeReport(); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+	}
+	endJob(false)
+	os.Exit(exitCode)
+}
+
+func run() {
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == dockerHelperName {
+		runDockerCredential(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case workerArg:
+			runInflateWorker(os.Args[2:])
+			return
+		case clearArg:
+			runClipboardClear(os.Args[2:])
+			return
+		case "sign":
+			runSign(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "peers":
+			runPeers(os.Args[2:])
+			return
+		case "send":
+			runSend(os.Args[2:])
+			return
+		case "receive":
+			runReceive(os.Args[2:])
+			return
+		case "identity":
+			runIdentity(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "estimate":
+			runEstimate(os.Args[2:])
+			return
+		case "inspect":
+			runInspect(os.Args[2:])
+			return
+		case "tpm":
+			runTPM(os.Args[2:])
+			return
+		case "key":
+			runKey(os.Args[2:])
+			return
+		case "vault":
+			runVault(os.Args[2:])
+			return
+		case "transparency":
+			runTransparency(os.Args[2:])
+			return
+		case "native-host":
+			runNativeHost(os.Args[2:])
+			return
+		case "tui":
+			runTUI(os.Args[2:])
+			return
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		case "cat":
+			runCat(os.Args[2:])
+			return
+		case "grep":
+			runGrep(os.Args[2:])
+			return
+		case "revocations":
+			runRevocations(os.Args[2:])
+			return
+		case "watch":
+			runWatch(os.Args[2:])
+			return
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "serve-grpc":
+			runServeGRPC(os.Args[2:])
+			return
+		case "directory":
+			runDirectory(os.Args[2:])
+			return
+		case "proof":
+			runProof(os.Args[2:])
+			return
+		case "msg":
+			runMsg(os.Args[2:])
+			return
+		case "edit":
+			runEdit(os.Args[2:])
+			return
+		case "mount":
+			runMount(os.Args[2:])
+			return
+		case "jobs":
+			runJobs(os.Args[2:])
+			return
+		case "rekey":
+			runRekey(os.Args[2:])
+			return
+		case "scan":
+			runScan(os.Args[2:])
+			return
+		case "kms-plugin":
+			runKMSPlugin(os.Args[2:])
+			return
+		case "docker-credential":
+			runDockerCredential(os.Args[2:])
+			return
+		case "exec":
+			runExec(os.Args[2:])
+			return
+		case "kdf-calibrate":
+			runKDFCalibrate(os.Args[2:])
+			return
+		case "keygen":
+			runKeygen(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Parse()
+	if err := applyProfile(); err != nil {
+		fail(exitUsage, tr("Profile error:"), err)
+		return
+	}
+
 	if *encrypt == *decrypt {
-		fmt.Println("Error: use exactly one of -e or -d")
+		fail(exitUsage, tr("Error: use exactly one of -e or -d"))
+		return
+	}
+	if err := checkEncoding(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	if err := checkDurability(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	if err := applyPriority(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
 		return
 	}
 
-	key, err := loadOrGenerateKey()
-	if err != nil {
-		fmt.Println("Key error:", err)
+	if *encrypt {
+		if *metadataFlag && *toStdout {
+			fail(exitUsage, tr("Error: --metadata needs file output, not --to-stdout"))
+			return
+		}
+		if *sensitiveFlag && *formatFlag != "encutitl" {
+			fail(exitUsage, tr("Error: --sensitive needs the encutitl format"))
+			return
+		}
+		if *canaryFlag && (*toStdout || *formatFlag != "encutitl") {
+			fail(exitUsage, tr("Error: --canary needs file output in the encutitl format"))
+			return
+		}
+		if *metadataFlag && *formatFlag != "encutitl" && len(metaRecipients) == 0 {
+			failf(exitUsage, tr("Error: --metadata with --format %s needs --meta-recipient"), *formatFlag)
+			return
+		}
+		if err := checkPad(); err != nil {
+			fail(exitUsage, tr("Error:"), err)
+			return
+		}
+		if err := loadConvergence(); err != nil {
+			fail(exitUsage, tr("Error:"), err)
+			return
+		}
+		if err := checkChunked(); err != nil {
+			fail(exitUsage, tr("Error:"), err)
+			return
+		}
+	}
+
+	if err := checkClipboard(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+
+	if err := loadAAD(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+
+	if *inPlaceFlag {
+		switch {
+		case *fileFlag == "" || *fileFlag == "-" || isRemoteURL(*fileFlag):
+			fail(exitUsage, tr("Error: --in-place needs a local -f file"))
+			return
+		case *outputFlag != "" || *toStdout || *archiveFlag || *recompressFlag || *recurseFlag != "":
+			fail(exitUsage, tr("Error: --in-place cannot be combined with -o, --to-stdout, --archive, --recompress or -R"))
+			return
+		}
+	}
+
+	if err := enterSandbox(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+
+	if *recurseFlag != "" {
+		encryptTree(*recurseFlag)
+		return
+	}
+	if *encrypt && chunkedRun() {
+		encryptChunked()
+		return
+	}
+	if *decrypt && !*archiveFlag && !*copyFlag && !*isolateFlag && *snapshotFlag == "" && !*pasteFlag && isChunkedFile(*fileFlag) {
+		decryptChunked(*fileFlag)
 		return
 	}
 
 	var inputData []byte
 	var inputName string
+	var err error
 
-	if *fileFlag != "" {
-		inputData, err = os.ReadFile(*fileFlag)
+	if isRemoteURL(*fileFlag) {
+		inputData, err = downloadRemote(context.Background(), *fileFlag)
+		inputName = remoteBase(*fileFlag) // results are written locally
+	} else if *pasteFlag {
+		inputData, err = readClipboard()
+		inputName = "clipboard"
+	} else if *fileFlag == "-" {
+		inputData, err = readStdin()
+		inputName = "stdin"
+	} else if *fileFlag != "" && *archiveFlag && *encrypt {
+		if *snapshotFlag != "" {
+			inputData, err = tarFromSnapshot(*fileFlag)
+		} else {
+			inputData, err = tarDir(*fileFlag)
+		}
+		inputName = filepath.Clean(*fileFlag) + ".tar"
+	} else if *fileFlag != "" && *snapshotFlag != "" {
+		inputData, err = readFromSnapshot(*fileFlag)
+		inputName = *fileFlag
+	} else if *fileFlag != "" {
+		if err = checkInputFile(*fileFlag); err == nil {
+			inputData, err = readFileRetry(*fileFlag)
+		}
 		inputName = *fileFlag
 	} else if *stringFlag != "" {
 		inputData = []byte(*stringFlag)
 		inputName = "input"
 	} else {
-		fmt.Println("Error: provide input via -f <file> or -s <string>")
+		fail(exitUsage, tr("Error: provide input via -f <file>, -s <string> or --paste"))
 		return
 	}
+	if err == nil {
+		err = checkInputSize(int64(len(inputData)))
+	}
 	if err != nil {
-		fmt.Println("Input read error:", err)
+		fail(exitIO, tr("Input read error:"), err)
 		return
 	}
 
 	if *encrypt {
-		result, err := compressEncrypt(key, inputData)
-		if err != nil {
-			fmt.Println("Encryption error:", err)
-			return
+		if *recompressFlag {
+			if inputData, inputName, err = recompress(inputData, inputName); err != nil {
+				fail(exitIO, tr("Input read error:"), err)
+				return
+			}
 		}
-		if *toStdout {
-			outputEncoded(result)
-		} else {
-			outFile := inputName + ".bin"
-			err = os.WriteFile(outFile, result, 0600)
-			if err != nil {
-				fmt.Println("Write error:", err)
-			} else {
-				fmt.Println("Encrypted file saved to:", outFile)
+		var recipients []encutil.Recipient
+		if *formatFlag == "encutitl" {
+			if recipients, err = encryptRecipients(); err != nil {
+				fail(exitKey, tr("Key error:"), err)
+				return
 			}
 		}
+		outFile := *outputFlag
+		if *inPlaceFlag {
+			outFile = inputName
+		} else if outFile == "" {
+			outFile = encryptedName(inputName)
+		}
+		encryptInput(inputData, inputName, outFile, recipients)
+	} else if isSOPS(inputData) {
+		decryptSOPSInput(inputData, inputName)
 	} else {
 		var data []byte
-		if *fileFlag != "" {
+		switch {
+		case encutil.IsJWE(string(inputData)):
 			data = inputData
-		} else {
-			if *outputAsHex {
-				data, err = hex.DecodeString(strings.TrimSpace(string(inputData)))
-			} else {
-				data, err = base64.RawURLEncoding.DecodeString(strings.TrimSpace(string(inputData)))
-			}
-			if err != nil {
-				fmt.Println("Decode input error:", err)
-				return
-			}
+		case isAgeArmor(string(inputData)):
+			data, err = dearmorAge(string(inputData))
+		case *fileFlag != "" && !isEncodedText(inputData):
+			data = inputData
+		default:
+			data, err = decodeInput(string(inputData))
+		}
+		if err == nil && encutil.IsEncutitl(data) {
+			// Refuse a malformed header before loading any keys for it.
+			_, _, err = encutil.ParseHeader(data)
+		}
+		if err != nil {
+			fail(exitAuth, tr("Decode input error:"), err)
+			return
+		}
+		if err := checkReason(inputName, data); err != nil {
+			fail(exitUsage, tr("Error:"), fmt.Errorf("%s: %w", inputName, err))
+			return
 		}
 
-		plain, err := decryptDecompress(key, data)
+		var identities []encutil.Identity
+		var key []byte
+		switch {
+		case encutil.IsJWE(string(data)):
+			key, err = loadKey()
+		case isAge(data):
+		default:
+			identities, key, err = decryptIdentities(data)
+		}
+		defer releaseLocked(key)
 		if err != nil {
-			fmt.Println("Decryption error:", err)
+			fail(exitKey, tr("Key error:"), err)
 			return
 		}
-		if *toStdout {
-			fmt.Print(string(plain))
-		} else {
-			outFile := strings.TrimSuffix(inputName, ".bin") + ".dec"
-			err := os.WriteFile(outFile, plain, 0600)
+		if *archiveFlag {
+			var plain bytes.Buffer
+			_, stanza, err := decryptTo(&plain, data, key, identities)
 			if err != nil {
-				fmt.Println("Write error:", err)
-			} else {
-				fmt.Println("Decrypted file saved to:", outFile)
+				fail(exitAuth, tr("Decryption error:"), err)
+				return
+			}
+			extractArchive(plain.Bytes(), inputName, newRestoreSource(inputName, data, stanza))
+		} else if *toStdout {
+			if _, _, err := decryptTo(os.Stdout, data, key, identities); err != nil {
+				fail(exitAuth, tr("Decryption error:"), err)
+			}
+		} else if *copyFlag {
+			var plain bytes.Buffer
+			if _, _, err := decryptTo(&plain, data, key, identities); err != nil {
+				fail(exitAuth, tr("Decryption error:"), err)
+				return
+			}
+			if err := copyOutput(plain.Bytes(), true); err != nil {
+				fail(exitIO, tr("Clipboard error:"), err)
+			}
+		} else {
+			outFile := decryptedName(inputName)
+			if *inPlaceFlag {
+				outFile = inputName
 			}
+			decryptToFile(data, inputName, outFile, key, identities)
 		}
 	}
 }
 
-func compressEncrypt(key []byte, input []byte) ([]byte, error) {
-	compressed := new(bytes.Buffer)
-	writer, _ := flate.NewWriter(compressed, flate.BestCompression)
-	_, err := writer.Write(input)
-	if err != nil {
-		return nil, err
+// decryptTo decrypts data, in any format, to w. key is the JWE or legacy
+// key, identities open encutitl files.
+func decryptTo(w io.Writer, data, key []byte, identities []encutil.Identity) (int64, *encutil.Stanza, error) {
+	return decryptCanary(w, data, key, identities, raiseCanary)
+}
+
+// decryptCanary is decryptTo handing a decoy's canary to onCanary, for
+// callers that carry it over to a new version of the file instead.
+func decryptCanary(w io.Writer, data, key []byte, identities []encutil.Identity, onCanary func(*encutil.Canary)) (int64, *encutil.Stanza, error) {
+	limit := decompressLimit(len(data))
+	var n int64
+	var stanza *encutil.Stanza
+	var err error
+	switch {
+	case aadData != nil && (encutil.IsJWE(string(data)) || isAge(data)):
+		err = errors.New("JWE and age files carry no --aad")
+	case encutil.IsJWE(string(data)):
+		n, err = encutil.DecryptJWETo(w, key, string(data), limit)
+	case isAge(data):
+		n, err = ageDecryptTo(w, data, limit)
+	case *isolateFlag:
+		n, stanza, err = decryptIsolated(w, data, key, identities, limit, onCanary)
+	default:
+		n, stanza, err = encutil.DecryptWith(w, data, encutil.DecryptOptions{LegacyKey: key, MaxSize: limit, AAD: aadData, OnRepair: reportRepair, OnCanary: onCanary}, identities...)
 	}
-	writer.Close()
+	return n, stanza, limitError(err, len(data))
+}
+
+// decryptedName is the output name for decrypting inputName to a file.
+func decryptedName(inputName string) string {
+	if *outputFlag != "" {
+		return *outputFlag
+	}
+	return decryptedBase(inputName)
+}
 
-	block, err := aes.NewCipher(key)
+// decryptedBase is decryptedName without -o.
+func decryptedBase(inputName string) string {
+	out := inputName
+	for _, ext := range []string{".bin", ".age", ".jwe"} {
+		out = strings.TrimSuffix(out, ext)
+	}
+	return out + ".dec"
+}
+
+func decryptToFile(data []byte, inputName, out string, key []byte, identities []encutil.Identity) {
+	decryptIntoFile(out, func(w io.Writer) (int64, restoreSource, error) {
+		n, stanza, err := decryptTo(w, data, key, identities)
+		return n, newRestoreSource(inputName, data, stanza), err
+	})
+}
+
+// decryptIntoFile streams the plaintext into a temporary file and moves it
+// into place once decryption has finished, so a failed or oversized
+// decryption leaves nothing half written behind.
+func decryptIntoFile(out string, decrypt func(w io.Writer) (int64, restoreSource, error)) {
+	dir := filepath.Dir(out)
+	if isRemoteURL(out) {
+		dir = ""
+	}
+	tmp, err := os.CreateTemp(dir, ".encutitl-*")
 	if err != nil {
-		return nil, err
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	var w io.Writer = tmp
+	if *directIOFlag {
+		if w, err = newUncachedWriter(tmp); err != nil {
+			tmp.Close()
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+	}
+	h := sha256.New()
+	n, src, err := decrypt(io.MultiWriter(w, h))
+	if err == nil {
+		err = flushUncached(w)
 	}
-	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, err
+		tmp.Close()
+		fail(exitAuth, tr("Decryption error:"), err)
+		return
+	}
+	if *inPlaceFlag {
+		if info, err := os.Stat(out); err == nil {
+			tmp.Chmod(info.Mode().Perm())
+		}
+		err = tmp.Sync()
+	} else if !isRemoteURL(out) {
+		err = syncDurable(tmp, durability())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
+	if !*inPlaceFlag {
+		out, err = resolveConflictDiff(out, func() {
+			if plain, err := os.ReadFile(tmp.Name()); err == nil {
+				showDiff(out, plain)
+			}
+		})
+		if err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+		if out == "" {
+			return
+		}
+	}
+	if *inPlaceFlag {
+		err = renameSynced(tmp.Name(), out)
+	} else if isRemoteURL(out) {
+		var f *os.File
+		if f, err = os.Open(tmp.Name()); err == nil {
+			err = uploadRemote(context.Background(), out, f)
+			f.Close()
+		}
+	} else {
+		err = renameDurable(tmp.Name(), out, durability())
 	}
+	if err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	src.recordSum(out, int(n), h.Sum(nil))
+	fmt.Println(tr("Decrypted file saved to:"), out)
+}
 
-	encrypted := gcm.Seal(nonce, nonce, compressed.Bytes(), nil)
+// encryptedName is the default output name for inputName.
+func encryptedName(inputName string) string {
+	if *formatFlag == "sops" {
+		ext := filepath.Ext(inputName)
+		return strings.TrimSuffix(inputName, ext) + ".enc" + ext
+	}
+	if *formatFlag != "encutitl" {
+		return inputName + "." + *formatFlag
+	}
+	return inputName + ".bin"
+}
 
+// encryptInput encrypts one input to outFile (or stdout), reporting
+// errors itself; recipients are only used for the encutitl format.
+func encryptInput(inputData []byte, inputName, outFile string, recipients []encutil.Recipient) bool {
+	var result []byte
+	var err error
+	var canaryEntry string
+	if *canaryFlag && *archiveFlag {
+		if inputData, canaryEntry, err = addCanaryEntry(inputData, recipients); err != nil {
+			fail(exitIO, tr("Canary error:"), err)
+			return false
+		}
+	}
+	switch *formatFlag {
+	case "encutitl":
+		var compression string
+		if compression, err = payloadCompression(inputData); err == nil {
+			result, err = encutil.EncryptWith(inputData, encutil.EncryptOptions{Compression: compression, AAD: aadData, Padding: *padFlag, Convergent: convergenceSecret, Sensitive: *sensitiveFlag}, recipients...)
+		}
+	case "age":
+		result, err = ageEncrypt(inputData, recipientFlags)
+	case "jwe":
+		result, err = jweEncrypt(inputData)
+	case "sops":
+		var prev []byte
+		if !isRemoteURL(outFile) && outFile != inputName {
+			prev, _ = os.ReadFile(outFile)
+		}
+		result, err = sopsEncrypt(inputData, inputName, prev)
+	default:
+		err = fmt.Errorf("unknown format %q", *formatFlag)
+	}
+	if err != nil {
+		fail(exitError, tr("Encryption error:"), err)
+		return false
+	}
+	var sig []byte
+	if *signOutput {
+		if sig, err = signBytes(result); err != nil {
+			fail(exitKey, tr("Signing key error:"), err)
+			return false
+		}
+	}
+	if *toStdout || *qrFlag != "" || *copyFlag {
+		text, err := encodeOutput(result)
+		if err != nil {
+			fail(exitError, tr("Encryption error:"), err)
+			return false
+		}
+		if *qrFlag != "" {
+			if err := writeQR(*qrFlag, strings.TrimSpace(text)); err != nil {
+				fail(exitIO, tr("QR error:"), err)
+				return false
+			}
+		}
+		if *toStdout {
+			fmt.Print(text)
+		}
+		if *copyFlag {
+			if err := copyOutput([]byte(strings.TrimSpace(text)), false); err != nil {
+				fail(exitIO, tr("Clipboard error:"), err)
+				return false
+			}
+			return true
+		}
+	}
 	if *toStdout {
-		return encrypted, nil
+		if sig != nil {
+			outputEncoded(sig)
+		}
+	} else {
+		if *inPlaceFlag {
+			err = replaceFile(outFile, result)
+		} else {
+			err = writeOutput(outFile, result, 0600)
+		}
+		if err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return false
+		}
+		fmt.Println(tr("Encrypted file saved to:"), outFile)
+		if sig != nil {
+			if err := writeOutput(outFile+".sig", sig, 0644); err != nil {
+				fail(exitIO, tr("Write error:"), err)
+				return false
+			}
+			fmt.Println(tr("Signature saved to:"), outFile+".sig")
+		}
+		if *metadataFlag {
+			if err := writeMetadata(outFile, inputName, inputData, result, recipients); err != nil {
+				fail(exitIO, tr("Metadata error:"), err)
+				return false
+			}
+			fmt.Println(tr("Metadata saved to:"), outFile+".meta")
+		}
+		if canaryEntry != "" {
+			fmt.Println(tr("Canary entry:"), canaryEntry)
+		} else if *canaryFlag {
+			path, err := writeCanary(outFile, recipients)
+			if err != nil {
+				fail(exitIO, tr("Canary error:"), err)
+				return false
+			}
+			fmt.Println(tr("Canary saved to:"), path)
+		}
 	}
-
-	// default: return raw binary
-	return encrypted, nil
+	return true
 }
 
-func decryptDecompress(key []byte, ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+func encryptRecipients() ([]encutil.Recipient, error) {
+	switch *keyBackend {
+	case "local":
+	case "vault":
+		v, err := newVaultTransit(*vaultMount, *keyName)
+		if err != nil {
+			return nil, err
+		}
+		recipients, err := parseRecipients(recipientFlags)
+		return append(recipients, v), err
+	case "pkcs11":
+		k, err := newPKCS11Recipient(*keyName)
+		if err != nil {
+			return nil, err
+		}
+		recipients, err := parseRecipients(recipientFlags)
+		return append(recipients, k), err
+	case "passphrase":
+		p, err := passphraseRecipient()
+		if err != nil {
+			return nil, err
+		}
+		recipients, err := parseRecipients(recipientFlags)
+		return append(recipients, p), err
+	default:
+		return nil, fmt.Errorf("unknown --key-backend %q", *keyBackend)
+	}
+	if len(recipientFlags) > 0 {
+		return parseRecipients(recipientFlags)
+	}
+	key, err := loadKey()
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	r, err := encutil.NewKeyRecipient(key)
 	if err != nil {
 		return nil, err
 	}
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, fmt.Errorf("ciphertext too short")
+	return []encutil.Recipient{r}, nil
+}
+
+// JWE output is always keyed by key.bin ("alg":"dir").
+func jweEncrypt(plain []byte) ([]byte, error) {
+	if len(recipientFlags) > 0 {
+		return nil, fmt.Errorf("--format jwe uses key.bin and does not support --recipient")
 	}
-	nonce := ciphertext[:gcm.NonceSize()]
-	ciphertext = ciphertext[gcm.NonceSize():]
-	decrypted, err := gcm.Open(nil, nonce, ciphertext, nil)
+	key, err := loadKey()
 	if err != nil {
 		return nil, err
 	}
+	token, err := encutil.EncryptJWE(key, plain)
+	return []byte(token), err
+}
 
-	r := flate.NewReader(bytes.NewReader(decrypted))
-	defer r.Close()
-	return io.ReadAll(r)
+// decryptIdentities only asks for key.bin, SSH keys, Vault or a token
+// when the header says they can be used.
+func decryptIdentities(data []byte) ([]encutil.Identity, []byte, error) {
+	hdr, _, err := encutil.ParseHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	needKey := hdr == nil
+	needSSH, needVault, needToken, needPass := false, false, false, false
+	if hdr != nil {
+		for _, s := range hdr.Recipients {
+			switch s.Type {
+			case "key":
+				needKey = true
+			case vaultStanza:
+				needVault = true
+			case pkcs11Stanza:
+				needToken = true
+			case encutil.PassphraseStanza:
+				needPass = true
+			default:
+				needSSH = true
+			}
+		}
+	}
+
+	var identities []encutil.Identity
+	var key []byte
+	if needKey {
+		key, err = loadKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		r, err := encutil.NewKeyRecipient(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		identities = append(identities, r)
+	}
+	if needSSH {
+		ids, err := sshIdentities()
+		if err != nil {
+			return nil, nil, err
+		}
+		identities = append(identities, ids...)
+	}
+	if needVault {
+		ids, err := vaultIdentities(hdr)
+		if err != nil {
+			return nil, nil, err
+		}
+		identities = append(identities, ids...)
+	}
+	if needToken {
+		ids, err := pkcs11Identities(hdr)
+		if err != nil {
+			return nil, nil, err
+		}
+		identities = append(identities, ids...)
+	}
+	if needPass {
+		id, err := passphraseIdentity()
+		if err != nil {
+			return nil, nil, err
+		}
+		identities = append(identities, id)
+	}
+	return identities, key, nil
 }
 
-func loadOrGenerateKey() ([]byte, error) {
-	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
-		return generateKeyFile()
+// loadKey returns ENCUTITL_KEY or key.bin. It never creates a key; that
+// is keygen's job.
+func loadKey() ([]byte, error) {
+	if key, err := envKey(); key != nil || err != nil {
+		return key, err
 	}
-	fmt.Print("Key exists. Use it? (y/n): ")
-	reader := bufio.NewReader(os.Stdin)
-	answer, _ := reader.ReadString('\n')
-	if strings.TrimSpace(strings.ToLower(answer)) != "y" {
-		return generateKeyFile()
+	path := keyFilePath()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("no key at %s, create one with: encutitl keygen (or set ENCUTITL_KEY)", path)
 	}
-	return os.ReadFile(keyFile)
+	return readKeyFile()
 }
 
-func generateKeyFile() ([]byte, error) {
-	key := make([]byte, keySize)
-	if _, err := rand.Read(key); err != nil {
-		return nil, err
+// encodeOutput is the text form of an encrypted result, as printed by
+// --to-stdout.
+func encodeOutput(result []byte) (string, error) {
+	switch *formatFlag {
+	case "age":
+		return armorAge(result)
+	case "jwe":
+		return string(result) + "\n", nil
+	case "sops":
+		return string(result), nil
 	}
-	err := os.WriteFile(keyFile, key, 0600)
-	return key, err
+	return encodeText(outputEncoding(), result) + "\n", nil
 }
 
 func outputEncoded(data []byte) {
@@ -212,3 +822,9 @@ func outputEncoded(data []byte) {
 	}
 }
 
+func writeOutput(path string, data []byte, perm os.FileMode) error {
+	if isRemoteURL(path) {
+		return uploadRemote(context.Background(), path, bytes.NewReader(data))
+	}
+	return writeDurable(path, data, perm)
+}
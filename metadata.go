@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// --metadata writes <output>.meta next to the encrypted file: a small
+// encutitl file holding only the name, tags and hashes. An indexing
+// service given the sidecars (and, with --meta-recipient, its own key)
+// can catalog holdings without ever seeing the content ciphertext.
+
+var (
+	metadataFlag   = flag.Bool("metadata", false, "Also write an encrypted <output>.meta sidecar with name, tags and hashes")
+	tagFlags       listFlag
+	metaRecipients listFlag
+)
+
+func init() {
+	flag.Var(&tagFlags, "tag", "Tag recorded in the --metadata sidecar, e.g. project=apollo (repeatable)")
+	flag.Var(&metaRecipients, "meta-recipient", "Encrypt the --metadata sidecar to this key instead of the file's recipients (repeatable)")
+}
+
+type fileMetadata struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`        // plaintext
+	ObjectSHA256 string    `json:"object_sha256"` // encrypted file, to find it in storage
+	Object       string    `json:"object"`
+	Tags         []string  `json:"tags,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// writeMetadata encrypts the sidecar for out to metaRecipients, or to
+// recipients when none are given.
+func writeMetadata(out, name string, plain, encrypted []byte, recipients []encutil.Recipient) error {
+	if len(metaRecipients) > 0 {
+		var err error
+		if recipients, err = parseRecipients(metaRecipients); err != nil {
+			return err
+		}
+	}
+	sum, objSum := sha256.Sum256(plain), sha256.Sum256(encrypted)
+	meta, err := json.Marshal(fileMetadata{
+		Name:         filepath.Base(name),
+		Size:         int64(len(plain)),
+		SHA256:       hex.EncodeToString(sum[:]),
+		ObjectSHA256: hex.EncodeToString(objSum[:]),
+		Object:       out,
+		Tags:         tagFlags,
+		Created:      time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	sealed, err := encutil.Encrypt(meta, recipients...)
+	if err != nil {
+		return err
+	}
+	return writeOutput(out+".meta", sealed, 0600)
+}
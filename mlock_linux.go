@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockMemory keeps the process's memory, including what it allocates
+// later, out of swap. With a finite RLIMIT_MEMLOCK the Go runtime would
+// fail to grow the heap once the limit is reached, so that is refused up
+// front rather than crashing later.
+func lockMemory() error {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &lim); err != nil {
+		return err
+	}
+	if lim.Cur != unix.RLIM_INFINITY && os.Geteuid() != 0 {
+		return errors.New("RLIMIT_MEMLOCK is limited, run under ulimit -l unlimited or LimitMEMLOCK=infinity")
+	}
+	return unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE)
+}
+
+// lockedCopy moves a secret out of the Go heap, where the collector may
+// copy it and freed memory is not cleared, into its own mapping that is
+// locked out of swap and left out of core dumps. b is zeroed. If even
+// mapping fails, b is returned as it is; past RLIMIT_MEMLOCK the copy is
+// made but stays unlocked.
+func lockedCopy(b []byte) []byte {
+	if len(b) == 0 {
+		return b
+	}
+	m, err := unix.Mmap(-1, 0, len(b), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return b
+	}
+	unix.Mlock(m)
+	unix.Madvise(m, unix.MADV_DONTDUMP)
+	copy(m, b)
+	clear(b)
+	return m
+}
+
+// releaseLocked zeroes a secret and unmaps it if lockedCopy mapped it.
+// Munmap refuses memory it did not map, so a heap fallback is only
+// cleared.
+func releaseLocked(b []byte) {
+	clear(b)
+	if len(b) > 0 {
+		unix.Munmap(b)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+func lockMemory() error {
+	return errors.New("memory locking is not supported on this platform")
+}
+
+// lockedCopy returns b: without a way to lock it, it stays on the heap.
+func lockedCopy(b []byte) []byte {
+	return b
+}
+
+// releaseLocked zeroes a secret from lockedCopy.
+func releaseLocked(b []byte) {
+	clear(b)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func lockMemory() error {
+	return errors.New("memory locking is not supported on this platform")
+}
+
+// lockedCopy is lockedCopy of mlock_linux.go with VirtualLock, which
+// keeps the pages in the working set.
+func lockedCopy(b []byte) []byte {
+	if len(b) == 0 {
+		return b
+	}
+	addr, err := windows.VirtualAlloc(0, uintptr(len(b)), windows.MEM_COMMIT|windows.MEM_RESERVE, windows.PAGE_READWRITE)
+	if err != nil {
+		return b
+	}
+	windows.VirtualLock(addr, uintptr(len(b)))
+	m := unsafe.Slice((*byte)(unsafe.Add(nil, addr)), len(b))
+	locked.Store(addr, true)
+	copy(m, b)
+	clear(b)
+	return m
+}
+
+// locked holds the addresses lockedCopy allocated, so releaseLocked only
+// frees those and leaves a heap fallback alone.
+var locked sync.Map
+
+// releaseLocked zeroes a secret and frees it if lockedCopy allocated it.
+func releaseLocked(b []byte) {
+	clear(b)
+	if len(b) == 0 {
+		return
+	}
+	addr := uintptr(unsafe.Pointer(&b[0]))
+	if _, ok := locked.LoadAndDelete(addr); ok {
+		windows.VirtualUnlock(addr, uintptr(len(b)))
+		windows.VirtualFree(addr, 0, windows.MEM_RELEASE)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// The 32-byte key is exactly the entropy of a 24-word BIP39 phrase (the
+// last word carries an 8-bit checksum), so it can be written on paper and
+// typed back in. No BIP39 seed derivation is involved: the words are the
+// key itself.
+
+func runKeyExport(args []string) {
+	fs := flag.NewFlagSet("key export", flag.ExitOnError)
+	mnemonic := fs.Bool("mnemonic", false, "Print the key as a 24-word BIP39 phrase")
+	qr := fs.String("qr", "", "Render the key as a QR code: term, or a .png file")
+	addKeyFileFlag(fs)
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if !*mnemonic && *qr == "" {
+		fail(exitUsage, tr("Error: key export needs --mnemonic or --qr"))
+		return
+	}
+
+	key, err := readKeyFile()
+	defer releaseLocked(key)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	if *qr != "" {
+		if err := writeQR(*qr, encodeKeyQR(key)); err != nil {
+			fail(exitIO, tr("QR error:"), err)
+			return
+		}
+		if *qr != "term" {
+			fmt.Printf(tr("Key %s QR code saved to: %s")+"\n", encutil.KeyID(key), *qr)
+		}
+		if !*mnemonic {
+			return
+		}
+	}
+	phrase, err := bip39.NewMnemonic(key)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	fmt.Printf(tr("Key %s as %d words, keep them offline:")+"\n\n", encutil.KeyID(key), len(strings.Fields(phrase)))
+	for i, w := range strings.Fields(phrase) {
+		if *a11yFlag {
+			fmt.Printf(tr("Word %d: %s")+"\n", i+1, w)
+			continue
+		}
+		fmt.Printf("%2d. %-10s", i+1, w)
+		if i%4 == 3 {
+			fmt.Println()
+		}
+	}
+}
+
+func runKeyImport(args []string) {
+	fs := flag.NewFlagSet("key import", flag.ExitOnError)
+	mnemonic := fs.Bool("mnemonic", false, "Read the key as a 24-word BIP39 phrase from stdin")
+	qr := fs.Bool("qr", false, "Read the key as a scanned key export --qr payload from stdin")
+	out := fs.String("o", "", "Where to write the imported key (default the key file, see --keyfile)")
+	addKeyFileFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *out == "" {
+		*out = keyFilePath()
+	}
+	if *mnemonic == *qr {
+		fail(exitUsage, tr("Error: key import needs one of --mnemonic or --qr"))
+		return
+	}
+	if _, err := os.Stat(*out); err == nil {
+		failf(exitUsage, tr("Error: %s already exists, move it away or use -o"), *out)
+		return
+	}
+
+	if *qr {
+		fmt.Println(tr("Paste the scanned payload:"))
+	} else {
+		fmt.Println(tr("Enter the 24 words:"))
+	}
+	text, err := io.ReadAll(bufio.NewReader(os.Stdin))
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	if *qr {
+		key, err := decodeKeyQR(string(text))
+		if err != nil {
+			fail(exitIO, tr("QR error:"), err)
+			return
+		}
+		saveImportedKey(*out, key)
+		return
+	}
+	// Accept the numbered layout export prints.
+	var words []string
+	for _, w := range strings.Fields(strings.ToLower(string(text))) {
+		if !strings.HasSuffix(w, ".") {
+			words = append(words, w)
+		}
+	}
+	if len(words) != 24 {
+		failf(exitKey, tr("Mnemonic error: got %d words, need 24"), len(words))
+		return
+	}
+	for i, w := range words {
+		if _, ok := bip39.GetWordIndex(w); !ok {
+			failf(exitKey, tr("Mnemonic error: word %d %q is not in the BIP39 list"), i+1, w)
+			return
+		}
+	}
+	key, err := bip39.EntropyFromMnemonic(strings.Join(words, " "))
+	if err != nil {
+		fail(exitKey, tr("Mnemonic error: checksum mismatch, check the word order"))
+		return
+	}
+	saveImportedKey(*out, key)
+}
+
+func saveImportedKey(out string, key []byte) {
+	if err := writePrivateKey(out, key); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Printf(tr("Imported key %s saved to: %s")+"\n", encutil.KeyID(key), out)
+}
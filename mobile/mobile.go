@@ -0,0 +1,195 @@
+// Package mobile is the encutil API in a shape gomobile can bind, for
+// iOS and Android companion apps: only byte slices, strings, numbers,
+// errors and pointers to structs of this package cross the boundary, so
+// lists go as newline-separated strings.
+//
+//	gomobile bind -target android -o encutitl.aar ./mobile
+//	gomobile bind -target ios -o Encutitl.xcframework ./mobile
+//
+// Keys come from key.bin as bytes, from a paper key's 24 words or from
+// the QR code key export --qr prints, and open files and vaults alike.
+package mobile
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+const (
+	keySize     = 32
+	qrKeyPrefix = "encutitl-key:"
+)
+
+// KeyFromMnemonic turns the 24 words of a paper key (key export
+// --mnemonic) back into the key. The numbers export prints may be left in.
+func KeyFromMnemonic(words string) ([]byte, error) {
+	var list []string
+	for _, w := range strings.Fields(strings.ToLower(words)) {
+		if !strings.HasSuffix(w, ".") {
+			list = append(list, w)
+		}
+	}
+	if len(list) != 24 {
+		return nil, fmt.Errorf("got %d words, need 24", len(list))
+	}
+	key, err := bip39.EntropyFromMnemonic(strings.Join(list, " "))
+	if err != nil {
+		return nil, errors.New("not a valid paper key, check the words and their order")
+	}
+	return key, nil
+}
+
+// KeyFromQR decodes what a scanner reads off a key export --qr code.
+func KeyFromQR(payload string) ([]byte, error) {
+	s, ok := strings.CutPrefix(strings.TrimSpace(payload), qrKeyPrefix)
+	if !ok {
+		return nil, errors.New("not an encutitl key QR payload")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key is %d bytes, want %d", len(key), keySize)
+	}
+	return key, nil
+}
+
+// Keys collects what a file may be opened with. Add to it, then Decrypt
+// or OpenVault.
+type Keys struct {
+	identities []encutil.Identity
+	legacyKey  []byte
+	// MaxSize limits what Decrypt returns, 0 for no limit.
+	MaxSize int64
+}
+
+func NewKeys() *Keys {
+	return &Keys{}
+}
+
+// AddKey adds a 32-byte symmetric key, as in key.bin.
+func (k *Keys) AddKey(key []byte) error {
+	r, err := encutil.NewKeyRecipient(bytes.Clone(key))
+	if err != nil {
+		return err
+	}
+	k.identities = append(k.identities, r)
+	if k.legacyKey == nil {
+		k.legacyKey = bytes.Clone(key) // legacy files name no key
+	}
+	return nil
+}
+
+// AddSSHKey adds an OpenSSH private key. passphrase is only used when the
+// key is encrypted.
+func (k *Keys) AddSSHKey(pem []byte, passphrase string) error {
+	id, err := encutil.ParseSSHIdentity(pem, func() ([]byte, error) {
+		if passphrase == "" {
+			return nil, errors.New("ssh key is encrypted, give its passphrase")
+		}
+		return []byte(passphrase), nil
+	})
+	if err != nil {
+		return err
+	}
+	k.identities = append(k.identities, id)
+	return nil
+}
+
+// AddHybridIdentities adds the mlkem768x25519 identities of an identity
+// file.
+func (k *Keys) AddHybridIdentities(text string) error {
+	ids, err := encutil.ParseHybridIdentities([]byte(text))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		k.identities = append(k.identities, id)
+	}
+	return nil
+}
+
+// AddPassphrase adds the passphrase of a --key-backend passphrase file.
+func (k *Keys) AddPassphrase(passphrase string) error {
+	params, _ := encutil.KDFPreset("interactive") // the file's own are used
+	p, err := encutil.NewPassphraseRecipient([]byte(passphrase), params)
+	if err != nil {
+		return err
+	}
+	k.identities = append(k.identities, p)
+	return nil
+}
+
+// Decrypt opens an encutitl, legacy or JWE file.
+func (k *Keys) Decrypt(data []byte) ([]byte, error) {
+	if encutil.IsJWE(string(data)) {
+		return encutil.DecryptJWE(k.legacyKey, string(data))
+	}
+	var buf bytes.Buffer
+	opts := encutil.DecryptOptions{LegacyKey: k.legacyKey, MaxSize: k.MaxSize}
+	if _, _, err := encutil.DecryptWith(&buf, data, opts, k.identities...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encrypt encrypts data to a symmetric key.
+func Encrypt(data, key []byte) ([]byte, error) {
+	r, err := encutil.NewKeyRecipient(key)
+	if err != nil {
+		return nil, err
+	}
+	return encutil.Encrypt(data, r)
+}
+
+// EncryptTo encrypts data to recipients, one ssh or encpq1 public key
+// per line.
+func EncryptTo(data []byte, recipients string) ([]byte, error) {
+	var list []encutil.Recipient
+	for _, line := range strings.Split(recipients, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r encutil.Recipient
+		var err error
+		if encutil.IsHybridRecipient(line) {
+			r, err = encutil.ParseHybridRecipient(line)
+		} else {
+			r, err = encutil.ParseSSHRecipient(line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	return encutil.Encrypt(data, list...)
+}
+
+// Recipients lists who a file is encrypted to, one per line, so an app
+// can tell which key to ask for before it asks.
+func Recipients(data []byte) (string, error) {
+	hdr, _, err := encutil.ParseHeader(data)
+	if err != nil {
+		return "", err
+	}
+	if hdr == nil {
+		return "legacy", nil
+	}
+	var lines []string
+	for _, s := range hdr.Recipients {
+		lines = append(lines, strings.TrimSpace(s.Type+" "+strings.Join(s.Args, " ")))
+	}
+	return strings.Join(lines, "\n"), nil
+}
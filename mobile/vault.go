@@ -0,0 +1,123 @@
+package mobile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A vault file, as vault add writes it, is "encutitl-vault\n" followed by
+// records of a u32-prefixed encrypted meta and a u64-prefixed encrypted
+// content; the latest record of a name wins and a removal has no content.
+// Apps read vaults; adding to them stays with the desktop tool, which
+// also handles sync.
+
+var vaultMagic = []byte("encutitl-vault\n")
+
+type vaultMeta struct {
+	Op      string    `json:"op"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime,omitempty"`
+	Added   time.Time `json:"added"`
+}
+
+// Vault is an opened vault file, with the metadata of its entries
+// decrypted and their contents still encrypted.
+type Vault struct {
+	keys    *Keys
+	entries map[string]vaultEntry
+	names   []string
+}
+
+type vaultEntry struct {
+	meta vaultMeta
+	data []byte
+}
+
+// OpenVault decrypts the entry list of a vault's contents.
+func OpenVault(data []byte, keys *Keys) (*Vault, error) {
+	if !bytes.HasPrefix(data, vaultMagic) {
+		return nil, errors.New("not a vault")
+	}
+	v := &Vault{keys: keys, entries: map[string]vaultEntry{}}
+	r := bytes.NewReader(data[len(vaultMagic):])
+	for r.Len() > 0 {
+		var metaLen uint32
+		if err := binary.Read(r, binary.BigEndian, &metaLen); err != nil || int64(metaLen) > int64(r.Len()) {
+			return nil, errors.New("truncated vault record")
+		}
+		sealed := make([]byte, metaLen)
+		io.ReadFull(r, sealed)
+		var dataLen uint64
+		if err := binary.Read(r, binary.BigEndian, &dataLen); err != nil || dataLen > uint64(r.Len()) {
+			return nil, errors.New("truncated vault record")
+		}
+		content := make([]byte, dataLen)
+		io.ReadFull(r, content)
+
+		plain, err := keys.Decrypt(sealed)
+		if err != nil {
+			return nil, err
+		}
+		var meta vaultMeta
+		if err := json.Unmarshal(plain, &meta); err != nil {
+			return nil, fmt.Errorf("bad vault record: %w", err)
+		}
+		if meta.Op == "remove" {
+			delete(v.entries, meta.Name)
+		} else {
+			v.entries[meta.Name] = vaultEntry{meta: meta, data: content}
+		}
+	}
+	for name := range v.entries {
+		v.names = append(v.names, name)
+	}
+	sort.Strings(v.names)
+	return v, nil
+}
+
+// Len is the number of entries.
+func (v *Vault) Len() int {
+	return len(v.names)
+}
+
+// Name is the name of entry i, in sorted order.
+func (v *Vault) Name(i int) string {
+	return v.names[i]
+}
+
+// Names lists the entries, one per line.
+func (v *Vault) Names() string {
+	return strings.Join(v.names, "\n")
+}
+
+// Size is the plaintext size of an entry, -1 if there is none of that
+// name.
+func (v *Vault) Size(name string) int64 {
+	e, ok := v.entries[name]
+	if !ok {
+		return -1
+	}
+	return e.meta.Size
+}
+
+// Modified is when the entry's file was last changed, in Unix seconds.
+func (v *Vault) Modified(name string) int64 {
+	return v.entries[name].meta.ModTime.Unix()
+}
+
+// Get decrypts an entry's content.
+func (v *Vault) Get(name string) ([]byte, error) {
+	e, ok := v.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("no entry %q", name)
+	}
+	return v.keys.Decrypt(e.data)
+}
@@ -0,0 +1,501 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// mount serves the plaintext of an encrypted file as a FUSE filesystem,
+// so programs can read it without a decrypted copy on disk.
+// A vault becomes a directory tree of its live entries, each decrypted
+// into memory when opened and forgotten when the last handle on it is
+// closed. A chunked file (--chunk-size) is one file whose chunks are
+// decrypted as reads reach them, so a file larger than memory can be
+// mounted; any other encrypted file is decrypted into memory once, at
+// mount time. Files are read-only, except that --writable lets a chunked
+// file be changed in place, see mountwrite.go. Keys are asked for before
+// mounting, and mount stays in the foreground until interrupted or
+// unmounted.
+//
+// statfs (df) counts plaintext: the files' sizes are used, and what a
+// writable file could still grow by, given the free space next to the
+// encrypted file and --quota, is available.
+
+func runMount(args []string) {
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	fs.Var(&identityFlags, "i", "Identity file used for decryption (repeatable)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.StringVar(reasonFlag, "reason", *reasonFlag, "Why a sensitive file is mounted, for the audit log")
+	allowOther := fs.Bool("allow-other", false, "Let users other than the one mounting read the files")
+	readAhead := fs.Int("read-ahead", encutil.DefaultReadAhead, "Chunks of a chunked file to decrypt ahead of sequential reads, 0 for none")
+	writable := fs.Bool("writable", false, "Let a chunked file be changed in place, journaling writes and re-encrypting it on close")
+	quota := fs.String("quota", "", "With --writable, the size the plaintext may grow to, e.g. 10G")
+	addLangFlag(fs)
+	fs.Parse(args)
+	var limit int64
+	if *quota != "" {
+		n, err := parseSize(*quota)
+		if err != nil || n <= 0 || !*writable {
+			fail(exitUsage, tr("Error: --quota takes a size, e.g. 10G, and needs --writable"))
+			return
+		}
+		limit = int64(n)
+	}
+	if fs.NArg() != 2 || *readAhead < 0 {
+		fail(exitUsage, "Usage: mount [-i KEY...] [--reason TEXT] [--allow-other] [--read-ahead N] [--writable [--quota SIZE]] FILE MOUNTPOINT")
+		return
+	}
+	encutil.DefaultReadAhead = *readAhead
+	path, dir := fs.Arg(0), fs.Arg(1)
+	root, err := mountRoot(path, *writable, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, encutil.ErrNoIdentityMatched):
+			fail(exitAuth, tr("Decryption error:"), err)
+		case errors.Is(err, encutil.ErrMalformed):
+			fail(exitAuth, tr("Decode input error:"), err)
+		default:
+			fail(exitIO, tr("Mount error:"), err)
+		}
+		return
+	}
+	defer root.close()
+
+	server, err := fusefs.Mount(dir, root, &fusefs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:      "encutitl",
+			Name:        "encutitl",
+			AllowOther:  *allowOther,
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		fail(exitIO, tr("Mount error:"), err)
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		if err := server.Unmount(); err != nil {
+			fmt.Fprintf(os.Stderr, tr("Unmount error: %v (is the mount still in use?)")+"\n", err)
+		}
+	}()
+	fmt.Fprintf(os.Stderr, tr("Mounted %s on %s (%s of plaintext in %s), interrupt or unmount to stop")+"\n", path, dir, formatBytes(root.used()), formatBytes(root.stored))
+	server.Wait()
+}
+
+// mountDir is the root and every directory of a mount.
+type mountDir struct {
+	fusefs.Inode
+	mtime   time.Time
+	root    *mountDir    // nil for the root
+	entries []*mountFile // all files, under their full paths, for the root
+	closers []io.Closer
+	stored  int64 // size of the encrypted file, for the root
+}
+
+var _ = (fusefs.NodeOnAdder)((*mountDir)(nil))
+var _ = (fusefs.NodeGetattrer)((*mountDir)(nil))
+var _ = (fusefs.NodeStatfser)((*mountDir)(nil))
+
+// mountRoot decrypts what is needed to list path. quota limits a
+// writable file, 0 for no limit.
+func mountRoot(path string, writable bool, quota int64) (*mountDir, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	root := &mountDir{mtime: info.ModTime(), stored: info.Size()}
+	start := make([]byte, len(vaultMagic))
+	io.ReadFull(f, start)
+	chunked := isChunkedFile(path)
+	if writable && !chunked {
+		return nil, errors.New("--writable needs a chunked file, encrypted with --chunk-size")
+	}
+	if bytes.Equal(start, vaultMagic) {
+		return root, root.addVault(path)
+	}
+	base := filepath.Base(strings.TrimSuffix(path, ".bin"))
+	if chunked {
+		return root, root.addChunked(path, base, writable, quota)
+	}
+	data, err := readFileRetry(path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := openData(path, data)
+	if err != nil {
+		return nil, err
+	}
+	content := &mountBytes{plain: plain}
+	root.closers = append(root.closers, content)
+	root.entries = append(root.entries, &mountFile{
+		name:  base,
+		size:  int64(len(plain)),
+		mode:  0o400,
+		mtime: info.ModTime(),
+		open:  func() (mountContent, error) { return sharedContent{content}, nil },
+	})
+	return root, nil
+}
+
+// addVault lists the live entries of a vault, to be decrypted on open.
+func (d *mountDir) addVault(path string) error {
+	v, err := openVault(path)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex // openStanza resolves identities on first use
+	entries := v.current()
+	for _, name := range sortedNames(entries) {
+		rec := entries[name]
+		mode := rec.meta.Mode.Perm() & 0o555
+		if mode == 0 {
+			mode = 0o400
+		}
+		d.entries = append(d.entries, &mountFile{
+			name:  name,
+			size:  rec.meta.Size,
+			mode:  mode,
+			mtime: rec.meta.ModTime,
+			open: func() (mountContent, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				plain, err := v.open(rec.data)
+				if err != nil {
+					return nil, err
+				}
+				return &mountBytes{plain: plain}, nil
+			},
+		})
+	}
+	return nil
+}
+
+// addChunked serves a chunked file through an encutil.ChunkReader, or a
+// journaledFile if it is writable.
+func (d *mountDir) addChunked(path, name string, writable bool, quota int64) error {
+	prefix, err := readHeaderPrefix(path)
+	if err != nil {
+		return err
+	}
+	if err := checkReason(path, prefix); err != nil {
+		return err
+	}
+	identities, key, err := decryptIdentities(prefix)
+	if err != nil {
+		return err
+	}
+	opts := encutil.DecryptOptions{LegacyKey: key, AAD: aadData, OnRepair: reportRepair, OnCanary: raiseCanary}
+	if writable {
+		jf, err := openJournaledFile(path, opts, identities)
+		if err != nil {
+			return err
+		}
+		jf.quota = quota
+		d.closers = append(d.closers, jf)
+		d.entries = append(d.entries, &mountFile{
+			name: name,
+			mode: 0o600,
+			rw:   jf,
+			open: func() (mountContent, error) { return committingContent{jf}, nil },
+		})
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	cr, err := encutil.NewChunkReader(f, info.Size(), opts, identities...)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	d.closers = append(d.closers, cr, f)
+	d.entries = append(d.entries, &mountFile{
+		name:  name,
+		size:  cr.Size(),
+		mode:  0o400,
+		mtime: info.ModTime(),
+		open:  func() (mountContent, error) { return sharedContent{cr}, nil },
+	})
+	return nil
+}
+
+// OnAdd builds the tree once the root is mounted.
+func (d *mountDir) OnAdd(ctx context.Context) {
+	for _, file := range d.entries {
+		dir, base := filepath.Split(file.name)
+		p := &d.Inode
+		for _, component := range strings.Split(dir, "/") {
+			if component == "" {
+				continue
+			}
+			ch := p.GetChild(component)
+			if ch == nil {
+				ch = p.NewPersistentInode(ctx, &mountDir{mtime: d.mtime, root: d}, fusefs.StableAttr{Mode: fuse.S_IFDIR})
+				p.AddChild(component, ch, true)
+			}
+			p = ch
+		}
+		p.AddChild(base, p.NewPersistentInode(ctx, file, fusefs.StableAttr{}), true)
+	}
+}
+
+func (d *mountDir) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0o500
+	out.SetTimes(nil, &d.mtime, &d.mtime)
+	return 0
+}
+
+// used is the plaintext size of the files.
+func (d *mountDir) used() int64 {
+	var n int64
+	for _, f := range d.entries {
+		if f.rw != nil {
+			n += f.rw.Size()
+		} else {
+			n += f.size
+		}
+	}
+	return n
+}
+
+func (d *mountDir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	if d.root != nil {
+		return d.root.Statfs(ctx, out)
+	}
+	var avail int64
+	for _, f := range d.entries {
+		if f.rw == nil {
+			continue
+		}
+		n, err := f.rw.Available()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", f.name, err)
+			return syscall.EIO
+		}
+		avail += n
+	}
+	const blockSize = 4096
+	out.Bsize, out.Frsize, out.NameLen = blockSize, blockSize, 255
+	out.Bfree = uint64(avail) / blockSize
+	out.Bavail = out.Bfree
+	out.Blocks = (uint64(d.used())+blockSize-1)/blockSize + out.Bfree
+	out.Files = uint64(len(d.entries))
+	return 0
+}
+
+func (d *mountDir) close() {
+	for _, c := range d.closers {
+		if err := c.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, tr("Unmount error:"), err)
+		}
+	}
+}
+
+// mountContent is the plaintext of an open file.
+type mountContent interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// mountBytes is plaintext held in memory, cleared on close.
+type mountBytes struct {
+	plain []byte
+}
+
+func (b *mountBytes) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(b.plain).ReadAt(p, off)
+}
+
+func (b *mountBytes) Close() error {
+	clear(b.plain)
+	return nil
+}
+
+// sharedContent is content that stays open for the whole mount.
+type sharedContent struct {
+	io.ReaderAt
+}
+
+func (sharedContent) Close() error { return nil }
+
+// committingContent is the content of a writable file, which stays open
+// for the whole mount; closing its last handle commits the changes.
+type committingContent struct {
+	*journaledFile
+}
+
+func (c committingContent) Close() error { return c.Commit() }
+
+// mountHandle is an open file; the node keeps what is open.
+type mountHandle struct{}
+
+// mountFile is one file of a mount.
+type mountFile struct {
+	fusefs.Inode
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	open  func() (mountContent, error)
+	rw    *journaledFile // for a writable file, whose size and mtime it has
+
+	mu      sync.Mutex
+	content mountContent
+	opened  int
+}
+
+var _ = (fusefs.NodeGetattrer)((*mountFile)(nil))
+var _ = (fusefs.NodeOpener)((*mountFile)(nil))
+var _ = (fusefs.NodeReader)((*mountFile)(nil))
+var _ = (fusefs.NodeReleaser)((*mountFile)(nil))
+var _ = (fusefs.NodeWriter)((*mountFile)(nil))
+var _ = (fusefs.NodeSetattrer)((*mountFile)(nil))
+var _ = (fusefs.NodeFsyncer)((*mountFile)(nil))
+
+func (f *mountFile) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	size, mtime := f.size, f.mtime
+	if f.rw != nil {
+		size, mtime = f.rw.Size(), f.rw.ModTime()
+	}
+	out.Mode = uint32(f.mode)
+	out.Nlink = 1
+	out.Size = uint64(size)
+	out.Blksize = 4096
+	out.Blocks = (out.Size + 511) / 512
+	out.SetTimes(nil, &mtime, &mtime)
+	return 0
+}
+
+// Open decrypts the file on the first open; later ones share it.
+func (f *mountFile) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if f.rw == nil && flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.content == nil {
+		content, err := f.open()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s %v\n", f.name, tr("Decryption error:"), err)
+			return nil, 0, syscall.EIO
+		}
+		f.content = content
+	}
+	if f.rw != nil && flags&syscall.O_TRUNC != 0 {
+		if err := f.rw.Truncate(0); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s %v\n", f.name, tr("Write error:"), err)
+			return nil, 0, syscall.EIO
+		}
+	}
+	f.opened++
+	// Without a handle go-fuse never calls Release.
+	return mountHandle{}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (f *mountFile) Write(ctx context.Context, fh fusefs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	if f.rw == nil {
+		return 0, syscall.EROFS
+	}
+	n, err := f.rw.WriteAt(data, off)
+	if errors.Is(err, syscall.ENOSPC) {
+		return uint32(n), syscall.ENOSPC
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s %v\n", f.name, tr("Write error:"), err)
+		return uint32(n), syscall.EIO
+	}
+	return uint32(n), 0
+}
+
+// Setattr changes the size of a writable file; other attributes are the
+// encrypted file's and stay as they are.
+func (f *mountFile) Setattr(ctx context.Context, fh fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		if f.rw == nil {
+			return syscall.EROFS
+		}
+		err := f.rw.Truncate(int64(size))
+		if errors.Is(err, syscall.ENOSPC) {
+			return syscall.ENOSPC
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s %v\n", f.name, tr("Write error:"), err)
+			return syscall.EIO
+		}
+	}
+	return f.Getattr(ctx, fh, out)
+}
+
+func (f *mountFile) Fsync(ctx context.Context, fh fusefs.FileHandle, flags uint32) syscall.Errno {
+	if f.rw == nil {
+		return 0
+	}
+	if err := f.rw.Sync(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s %v\n", f.name, tr("Write error:"), err)
+		return syscall.EIO
+	}
+	return 0
+}
+
+func (f *mountFile) Read(ctx context.Context, fh fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	content := f.content
+	f.mu.Unlock()
+	if content == nil {
+		return nil, syscall.EBADF
+	}
+	n, err := content.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "%s: %s %v\n", f.name, tr("Decryption error:"), err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// Release forgets the plaintext once the last handle is closed, and
+// commits a writable file's changes.
+func (f *mountFile) Release(ctx context.Context, fh fusefs.FileHandle) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.opened--; f.opened == 0 && f.content != nil {
+		if err := f.content.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, tr("%s: %s %v (kept in the journal)")+"\n", f.name, tr("Write error:"), err)
+		}
+		f.content = nil
+	}
+	return 0
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package main
+
+func runMount(args []string) {
+	fail(exitUsage, tr("Error: mount is not supported on this platform"))
+}
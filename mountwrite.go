@@ -0,0 +1,563 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// mount --writable lets a chunked file be changed in place. A chunk
+// cannot be sealed again under the nonce it was sealed with, so changing
+// the file means writing a new version of it, every chunk under a fresh
+// nonce prefix (see encutil.RewriteChunkState); doing that per write
+// would have an editor's many small writes each re-encrypt the file.
+// Instead, writes change chunks held in memory and are appended to
+// FILE.encutitl-journal first, each record sealed under a key derived
+// from the file key, so the journal is no more readable than the file.
+// The new version is written next to the file and renamed over it, with
+// the directory synced, when the last handle is closed, when
+// mountDirtyLimit has changed or been journaled, and at unmount; then the
+// journal is removed.
+//
+// fsync syncs the journal. After a crash, the next mount replays what
+// reached it onto the file and commits it at once, so the file is the
+// last version committed plus every write synced since; a record cut
+// short by the crash is dropped. The journal names the nonce prefix of
+// the version it changes: one left over by a crash after the rename
+// belongs to a version no longer there, and is already part of the file.
+
+const (
+	mountJournalSuffix = ".encutitl-journal"
+	mountDirtyLimit    = 64 << 20 // changed or journaled before committing without waiting for a close
+)
+
+var errQuota = fmt.Errorf("the file would grow past --quota: %w", syscall.ENOSPC)
+
+var mountJournalMagic = []byte("encutitl-journal\n")
+
+// Journal records, after the u32 length of the sealed record.
+const (
+	journalWrite    = 'w' // offset, then the data written there
+	journalTruncate = 't' // new size
+)
+
+// journaledFile is the plaintext of a chunked file mounted with
+// --writable: the version on disk, read through a ChunkReader, with the
+// chunks changed since it was committed on top.
+type journaledFile struct {
+	path string
+	opts encutil.DecryptOptions
+
+	mu    sync.Mutex
+	f     *os.File
+	cr    *encutil.ChunkReader
+	st    encutil.ChunkState // of the version on disk; holds the file key
+	size  int64
+	clean int64 // chunks not in dirty read through cr below this, zeros above
+	dirty map[int64][]byte
+	mtime time.Time
+	quota int64 // the size the plaintext may grow to, 0 for any
+
+	journal *os.File
+	jaead   cipher.AEAD
+	jhead   []byte // the journal's header, each record's associated data
+	jsize   int64
+	seq     uint64
+	jerr    error // a failed append, which may have left part of a record
+}
+
+// openJournaledFile opens path for writing, first committing whatever a
+// crash left in its journal.
+func openJournaledFile(path string, opts encutil.DecryptOptions, identities []encutil.Identity) (*journaledFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Mode().Perm()&0o200 == 0 {
+		err = fmt.Errorf("%s is read-only", path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st, err := encutil.RewriteChunkState(f, info.Size(), opts, identities...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st.FileKey = lockedCopy(st.FileKey)
+	cr, err := encutil.ReopenChunkReader(f, info.Size(), st, opts)
+	if err != nil {
+		f.Close()
+		releaseLocked(st.FileKey)
+		return nil, err
+	}
+	prefix := make([]byte, len(st.NoncePrefix))
+	if _, err := f.ReadAt(prefix, int64(len(st.Header))); err != nil {
+		cr.Close()
+		f.Close()
+		releaseLocked(st.FileKey)
+		return nil, err
+	}
+	st.NoncePrefix = prefix // the version on disk, for the journal to name
+	jf := &journaledFile{
+		path: path, opts: opts, f: f, cr: cr, st: st,
+		size: cr.Size(), clean: cr.Size(), dirty: map[int64][]byte{}, mtime: info.ModTime(),
+	}
+	if err := jf.recover(); err != nil {
+		jf.Close()
+		return nil, fmt.Errorf("%s: %w", path+mountJournalSuffix, err)
+	}
+	return jf, nil
+}
+
+// recover replays the journal a crash left and commits it.
+func (jf *journaledFile) recover() error {
+	data, err := os.ReadFile(jf.path + mountJournalSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	head := len(mountJournalMagic) + len(jf.st.NoncePrefix) + sha256.Size
+	if len(data) < head || !bytes.HasPrefix(data, mountJournalMagic) {
+		return errors.New("not a journal, move it away to mount")
+	}
+	if !bytes.Equal(data[len(mountJournalMagic):head-sha256.Size], jf.st.NoncePrefix) {
+		// Committed before the crash, only the removal was lost.
+		return os.Remove(jf.path + mountJournalSuffix)
+	}
+	aead, err := journalAEAD(jf.st.FileKey, data[head-sha256.Size:head])
+	if err != nil {
+		return err
+	}
+	records := 0
+	for rest, seq := data[head:], uint64(0); len(rest) >= 4; seq++ {
+		n := binary.BigEndian.Uint32(rest)
+		if uint64(n) > uint64(len(rest)-4) {
+			break
+		}
+		plain, err := aead.Open(nil, journalNonce(seq), rest[4:4+n], data[:head])
+		if err != nil || !jf.apply(plain) {
+			break
+		}
+		rest = rest[4+n:]
+		records++
+	}
+	if records > 0 {
+		fmt.Fprintf(os.Stderr, tr("Recovering %d writes to %s from its journal")+"\n", records, jf.path)
+		if err := jf.commit(); err != nil {
+			return err
+		}
+	}
+	return os.Remove(jf.path + mountJournalSuffix)
+}
+
+func journalAEAD(fileKey, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, salt, "encutitl mount journal", 32)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// journalNonce is the record's number. Every journal has its own salt,
+// so its key, and is never appended to after a crash.
+func journalNonce(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 4, 12), seq)
+}
+
+// apply makes the change of a journal record, reporting whether it was
+// one.
+func (jf *journaledFile) apply(record []byte) bool {
+	if len(record) < 9 {
+		return false
+	}
+	off := int64(binary.BigEndian.Uint64(record[1:9]))
+	if off < 0 {
+		return false
+	}
+	switch record[0] {
+	case journalWrite:
+		return jf.write(record[9:], off) == nil
+	case journalTruncate:
+		jf.truncate(off)
+	default:
+		return false
+	}
+	return true
+}
+
+// log appends a record to the journal, creating it for the first change
+// to this version.
+func (jf *journaledFile) log(op byte, off int64, data []byte) error {
+	if jf.jerr != nil {
+		return jf.jerr
+	}
+	if jf.journal == nil {
+		if err := jf.createJournal(); err != nil {
+			return err
+		}
+	}
+	record := binary.BigEndian.AppendUint64([]byte{op}, uint64(off))
+	record = append(record, data...)
+	sealed := jf.jaead.Seal(make([]byte, 4, 4+len(record)+jf.jaead.Overhead()), journalNonce(jf.seq), record, jf.jhead)
+	clear(record)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	jf.seq++
+	if _, err := jf.journal.Write(sealed); err != nil {
+		// Records after a torn one would not be replayed: nothing more
+		// is written until a commit starts a new journal.
+		jf.jerr = fmt.Errorf("journal: %w", err)
+		return jf.jerr
+	}
+	jf.jsize += int64(len(sealed))
+	return nil
+}
+
+func (jf *journaledFile) createJournal() error {
+	salt := make([]byte, sha256.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := journalAEAD(jf.st.FileKey, salt)
+	if err != nil {
+		return err
+	}
+	head := append(append(bytes.Clone(mountJournalMagic), jf.st.NoncePrefix...), salt...)
+	journal, err := os.OpenFile(jf.path+mountJournalSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = journal.Write(head); err == nil {
+		err = journal.Sync()
+	}
+	if err != nil {
+		journal.Close()
+		os.Remove(journal.Name())
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(jf.path)); err == nil {
+		dir.Sync() // so a synced record is not lost with the journal's name
+		dir.Close()
+	}
+	jf.journal, jf.jaead, jf.jhead, jf.jsize, jf.seq = journal, aead, head, int64(len(head)), 0
+	return nil
+}
+
+// WriteAt journals a write, then makes it.
+func (jf *journaledFile) WriteAt(p []byte, off int64) (int, error) {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	if err := jf.checkQuota(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	// Chunks that cannot be read are not written over blind.
+	if err := jf.load(p, off); err != nil {
+		return 0, err
+	}
+	if err := jf.log(journalWrite, off, p); err != nil {
+		return 0, err
+	}
+	if err := jf.write(p, off); err != nil {
+		return 0, err
+	}
+	return len(p), jf.commitIfLarge()
+}
+
+// Truncate journals a change of size, then makes it.
+func (jf *journaledFile) Truncate(size int64) error {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	if err := jf.checkQuota(size); err != nil {
+		return err
+	}
+	if err := jf.log(journalTruncate, size, nil); err != nil {
+		return err
+	}
+	jf.truncate(size)
+	return jf.commitIfLarge()
+}
+
+func (jf *journaledFile) write(p []byte, off int64) error {
+	if err := jf.load(p, off); err != nil {
+		return err
+	}
+	chunkSize := int64(jf.st.ChunkSize)
+	for n := 0; n < len(p); {
+		at := off + int64(n)
+		n += copy(jf.dirty[at/chunkSize][at%chunkSize:], p[n:])
+	}
+	jf.size = max(jf.size, off+int64(len(p)))
+	jf.mtime = time.Now()
+	return nil
+}
+
+// load reads in the chunks a write of p at off changes.
+func (jf *journaledFile) load(p []byte, off int64) error {
+	chunkSize := int64(jf.st.ChunkSize)
+	for i := off / chunkSize; len(p) > 0 && i*chunkSize < off+int64(len(p)); i++ {
+		if _, ok := jf.dirty[i]; ok {
+			continue
+		}
+		buf := make([]byte, chunkSize)
+		if err := jf.readClean(buf, i*chunkSize); err != nil {
+			return err
+		}
+		jf.dirty[i] = buf
+	}
+	return nil
+}
+
+func (jf *journaledFile) truncate(size int64) {
+	chunkSize := int64(jf.st.ChunkSize)
+	if size < jf.size {
+		for i, buf := range jf.dirty {
+			switch start := i * chunkSize; {
+			case start >= size:
+				clear(buf)
+				delete(jf.dirty, i)
+			case start+chunkSize > size:
+				clear(buf[size-start:])
+			}
+		}
+		jf.clean = min(jf.clean, size)
+	}
+	jf.size = size
+	jf.mtime = time.Now()
+}
+
+// readClean reads the version on disk where it is still current, leaving
+// the rest of p as it is.
+func (jf *journaledFile) readClean(p []byte, off int64) error {
+	if off >= jf.clean {
+		return nil
+	}
+	_, err := jf.cr.ReadAt(p[:min(int64(len(p)), jf.clean-off)], off)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (jf *journaledFile) ReadAt(p []byte, off int64) (int, error) {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	return jf.readAt(p, off)
+}
+
+func (jf *journaledFile) readAt(p []byte, off int64) (int, error) {
+	chunkSize := int64(jf.st.ChunkSize)
+	n := 0
+	for n < len(p) && off < jf.size {
+		i, within := off/chunkSize, off%chunkSize
+		want := min(int64(len(p)-n), chunkSize-within, jf.size-off)
+		dst := p[n : n+int(want)]
+		if buf, ok := jf.dirty[i]; ok {
+			copy(dst, buf[within:])
+		} else {
+			clear(dst)
+			if err := jf.readClean(dst, off); err != nil {
+				return n, err
+			}
+		}
+		n += int(want)
+		off += want
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size is the size of the plaintext, changes included.
+func (jf *journaledFile) Size() int64 {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	return jf.size
+}
+
+// ModTime is when the file was last changed.
+func (jf *journaledFile) ModTime() time.Time {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	return jf.mtime
+}
+
+// checkQuota refuses to grow the file to size past the quota. A file
+// already larger can still be changed.
+func (jf *journaledFile) checkQuota(size int64) error {
+	if jf.quota > 0 && size > jf.size && size > jf.quota {
+		return errQuota
+	}
+	return nil
+}
+
+// Available is how much the plaintext can still grow: within the quota,
+// and so that the free space next to the file holds the whole of it
+// encrypted, as a commit writes the new version before the old one goes.
+func (jf *journaledFile) Available() (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(jf.path), &st); err != nil {
+		return 0, err
+	}
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	free := int64(st.Bavail) * int64(st.Bsize)
+	avail := free/int64(jf.st.StoredChunkSize())*int64(jf.st.ChunkSize) - jf.size
+	if jf.quota > 0 {
+		avail = min(avail, jf.quota-jf.size)
+	}
+	return max(avail, 0), nil
+}
+
+// Sync makes the changes so far survive a crash.
+func (jf *journaledFile) Sync() error {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	if jf.journal == nil {
+		return nil
+	}
+	return jf.journal.Sync()
+}
+
+// Commit writes the changes into a new version of the file.
+func (jf *journaledFile) Commit() error {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	return jf.commit()
+}
+
+func (jf *journaledFile) commitIfLarge() error {
+	if int64(len(jf.dirty))*int64(jf.st.ChunkSize) < mountDirtyLimit && jf.jsize < mountDirtyLimit {
+		return nil
+	}
+	return jf.commit()
+}
+
+// commit writes the plaintext as a new version of the file, renames it
+// over the old one and starts on a new journal.
+func (jf *journaledFile) commit() error {
+	if jf.journal == nil && len(jf.dirty) == 0 && jf.size == jf.clean && jf.clean == jf.cr.Size() {
+		return nil
+	}
+	next, err := jf.st.Rewrite()
+	if err != nil {
+		return err
+	}
+	tmp := jf.path + partialSuffix
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // gone once renamed
+	err = jf.writeVersion(out, next)
+	if info, serr := jf.f.Stat(); err == nil && serr == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = renameSynced(tmp, jf.path)
+	}
+	if err != nil {
+		return fmt.Errorf("committing %s: %w", jf.path, err)
+	}
+
+	f, err := os.Open(jf.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	var cr *encutil.ChunkReader
+	if err == nil {
+		cr, err = encutil.ReopenChunkReader(f, info.Size(), next, jf.opts)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	jf.cr.Close()
+	jf.f.Close()
+	jf.f, jf.cr, jf.st = f, cr, next
+	jf.size, jf.clean = cr.Size(), cr.Size()
+	for i, buf := range jf.dirty {
+		clear(buf)
+		delete(jf.dirty, i)
+	}
+	if jf.journal != nil {
+		jf.journal.Close()
+		jf.journal, jf.jerr = nil, nil
+		os.Remove(jf.path + mountJournalSuffix)
+	}
+	return nil
+}
+
+// writeVersion writes the current plaintext to out as the version next
+// describes.
+func (jf *journaledFile) writeVersion(out *os.File, next encutil.ChunkState) error {
+	if _, err := out.Write(append(bytes.Clone(next.Header), next.NoncePrefix...)); err != nil {
+		return err
+	}
+	cw, err := encutil.ResumeChunkWriter(out, next)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, jf.st.ChunkSize)
+	defer clear(buf)
+	for off := int64(0); off < jf.size; {
+		n, err := jf.readAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := cw.Write(buf[:n]); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return cw.Close()
+}
+
+// Close commits what is left and closes the file.
+func (jf *journaledFile) Close() error {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+	err := jf.commit()
+	if jf.journal != nil {
+		jf.journal.Close() // kept for the next mount, as the commit failed
+	}
+	jf.cr.Close()
+	jf.f.Close()
+	releaseLocked(jf.st.FileKey)
+	jf.st.FileKey = nil // unmapped now, never to be touched again
+	return err
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// msg encrypts short messages to a group as single lines that paste into
+// a chat or a mail:
+//
+//	encutitl-msg:v1:GROUP:SENDER:SEQ:BASE64
+//
+// SEQ counts the messages SENDER sent to GROUP, kept in msg-counters.json
+// in the config dir. Group, sender and number are bound into the payload
+// as associated data, so a line whose number was edited does not
+// decrypt, and `msg verify-sequence` can trust the numbers of a
+// conversation to find messages that were dropped, replayed or
+// reordered. The sender name is only as trustworthy as the group: anyone
+// holding a group key can write as anyone.
+
+const (
+	msgPrefix       = "encutitl-msg:v1:"
+	msgCountersFile = "msg-counters.json"
+	msgMaxSize      = 1 << 20
+)
+
+// groupMessage is a parsed message line.
+type groupMessage struct {
+	group, sender string
+	seq           uint64
+	sealed        []byte
+}
+
+func (m *groupMessage) aad() []byte {
+	return fmt.Appendf(nil, "encutitl msg v1\x00%s\x00%s\x00%d", m.group, m.sender, m.seq)
+}
+
+func (m *groupMessage) stream() string { return m.group + "/" + m.sender }
+
+func (m *groupMessage) String() string {
+	return fmt.Sprintf("%s%s:%s:%d:%s", msgPrefix, m.group, m.sender, m.seq, base64.RawStdEncoding.EncodeToString(m.sealed))
+}
+
+func parseGroupMessage(line string) (*groupMessage, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), msgPrefix)
+	parts := strings.Split(rest, ":")
+	if !ok || len(parts) != 4 {
+		return nil, errors.New("not an encutitl message")
+	}
+	seq, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad sequence number %q", parts[2])
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	return &groupMessage{group: parts[0], sender: parts[1], seq: seq, sealed: sealed}, nil
+}
+
+func (m *groupMessage) open(identities []encutil.Identity) ([]byte, error) {
+	var buf bytes.Buffer
+	_, _, err := encutil.DecryptWith(&buf, m.sealed, encutil.DecryptOptions{MaxSize: msgMaxSize, AAD: m.aad()}, identities...)
+	return buf.Bytes(), err
+}
+
+func validMsgName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ": \t\r\n")
+}
+
+func runMsg(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "Usage: msg send|read|verify-sequence [flags]")
+		return
+	}
+	switch args[0] {
+	case "send":
+		runMsgSend(args[1:])
+	case "read":
+		runMsgRead(args[1:], false)
+	case "verify-sequence":
+		runMsgRead(args[1:], true)
+	default:
+		fail(exitUsage, tr("Error: unknown msg command"), args[0])
+	}
+}
+
+func runMsgSend(args []string) {
+	fs := flag.NewFlagSet("msg send", flag.ExitOnError)
+	group := fs.String("g", "", "Group the message is for")
+	from := fs.String("from", "", "Sender name (default the user name)")
+	fs.Var(&recipientFlags, "recipient", "Group member's key (repeatable)")
+	fs.Var(&recipientFlags, "r", "Short for --recipient")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *from == "" {
+		if u, err := user.Current(); err == nil {
+			*from = u.Username
+		}
+	}
+	if !validMsgName(*group) || !validMsgName(*from) || len(recipientFlags) == 0 {
+		fail(exitUsage, "Usage: msg send -g GROUP [--from NAME] -r KEY... [TEXT...] (names without spaces or colons)")
+		return
+	}
+	text := []byte(strings.Join(fs.Args(), " "))
+	if fs.NArg() == 0 {
+		var err error
+		if text, err = io.ReadAll(io.LimitReader(os.Stdin, msgMaxSize+1)); err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			return
+		}
+	}
+	if len(text) > msgMaxSize {
+		failf(exitUsage, tr("Error: messages are limited to %s"), formatBytes(msgMaxSize))
+		return
+	}
+	recipients, err := parseRecipients(recipientFlags)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	m := &groupMessage{group: *group, sender: *from}
+	if m.seq, err = nextMsgSeq(m.stream()); err != nil {
+		fail(exitIO, tr("Counter error:"), err)
+		return
+	}
+	m.sealed, err = encutil.EncryptWith(text, encutil.EncryptOptions{Compression: encutil.CompressionNone, AAD: m.aad()}, recipients...)
+	if err != nil {
+		fail(exitError, tr("Encryption error:"), err)
+		return
+	}
+	fmt.Println(m)
+}
+
+// nextMsgSeq returns the number of the next message of a stream, counting
+// from 1, and saves it.
+func nextMsgSeq(stream string) (uint64, error) {
+	dir, err := configDir()
+	if err != nil {
+		return 0, err
+	}
+	path := filepath.Join(dir, msgCountersFile)
+	counters := map[string]uint64{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &counters)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	counters[stream]++
+	if data, err = json.MarshalIndent(counters, "", "  "); err != nil {
+		return 0, err
+	}
+	// Saved before the message exists: a number skipped after a failed
+	// send is harmless, one used twice would look like a replay.
+	return counters[stream], os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// msgStream tracks the numbers seen from one sender to one group.
+type msgStream struct {
+	first, last uint64
+	seen        map[uint64]bool
+	problems    int
+}
+
+// runMsgRead decrypts message lines from the files (or stdin) in order,
+// printing them, or with verify reporting only the breaks in each
+// sender's numbering.
+func runMsgRead(args []string, verify bool) {
+	name := "msg read"
+	if verify {
+		name = "msg verify-sequence"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Var(&identityFlags, "i", "Identity file used for decryption (repeatable)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	identities, err := sshIdentities()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+
+	var inputs []io.Reader
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fail(exitIO, tr("Input read error:"), err)
+			return
+		}
+		defer f.Close()
+		inputs = append(inputs, f)
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, os.Stdin)
+	}
+	sc := bufio.NewScanner(io.MultiReader(inputs...))
+	sc.Buffer(nil, 2*msgMaxSize)
+	streams := map[string]*msgStream{}
+	bad := 0
+	for sc.Scan() {
+		if !strings.Contains(sc.Text(), msgPrefix) {
+			continue // chat chatter around the messages
+		}
+		m, err := parseGroupMessage(sc.Text()[strings.Index(sc.Text(), msgPrefix):])
+		var text []byte
+		if err == nil {
+			text, err = m.open(identities)
+		}
+		if err != nil {
+			bad++
+			fail(exitAuth, tr("Decryption error:"), err)
+			continue
+		}
+		if !verify {
+			fmt.Printf("%s #%d: %s\n", m.stream(), m.seq, strings.TrimRight(string(text), "\n"))
+			continue
+		}
+		s := streams[m.stream()]
+		if s == nil {
+			s = &msgStream{first: m.seq, last: m.seq - 1, seen: map[uint64]bool{}}
+			streams[m.stream()] = s
+		}
+		switch {
+		case s.seen[m.seq]:
+			fmt.Printf(tr("%s: #%d REPLAYED")+"\n", m.stream(), m.seq)
+			s.problems++
+		case m.seq < s.last:
+			fmt.Printf(tr("%s: #%d arrived after #%d")+"\n", m.stream(), m.seq, s.last)
+			s.problems++
+		case m.seq > s.last+1:
+			missing := fmt.Sprintf("#%d", s.last+1)
+			if m.seq-1 > s.last+1 {
+				missing += fmt.Sprintf("-%d", m.seq-1)
+			}
+			fmt.Printf(tr("%s: %s MISSING")+"\n", m.stream(), missing)
+			s.problems++
+		}
+		s.seen[m.seq] = true
+		s.last = max(s.last, m.seq)
+	}
+	if err := sc.Err(); err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	if !verify {
+		return
+	}
+	names := make([]string, 0, len(streams))
+	for name := range streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	problems := bad
+	for _, name := range names {
+		s := streams[name]
+		status := "OK"
+		if s.problems > 0 {
+			status = fmt.Sprintf("%d problems", s.problems)
+		}
+		fmt.Printf(tr("%s: #%d to #%d, %d messages, %s")+"\n", name, s.first, s.last, len(s.seen), status)
+		problems += s.problems
+	}
+	if problems > 0 && exitCode == 0 {
+		exitCode = exitError
+	}
+}
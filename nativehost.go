@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// native-host lets a browser extension fill in passwords from a vault.
+// Chrome and Firefox start it with the extension's origin as argument and
+// talk to it over stdin and stdout, each message being JSON preceded by
+// its length as a native-endian u32:
+//
+//	{"type": "status"}                   {"ok": true, "locked": true}
+//	{"type": "unlock"}                   {"ok": true, "locked": false}
+//	{"type": "list", "site": "example.com"}
+//	                                     {"ok": true, "entries": ["example.com/alice"]}
+//	{"type": "get", "site": "example.com", "name": "example.com/alice"}
+//	                                     {"ok": true, "entry": "...", "login": "alice", "password": "...", "fields": {...}}
+//	{"type": "lock"}
+//
+// Failures are {"ok": false, "code": ..., "error": ...} with the codes of
+// the HTTP APIs plus LOCKED and DENIED. The vault stays locked, holding no
+// keys, until the extension asks to unlock it; a passphrase is asked for
+// in a dialog. Entries match a site when a path element is the site's
+// domain or a parent of it, and hold a password on the first line and
+// "key: value" fields after it, as with pass. The first get for a site
+// in an unlocked session asks the user in a dialog whether the extension
+// may have it.
+//
+// native-host install writes the browser's host manifest and a launcher
+// script, and records which vault to serve.
+
+const (
+	nativeHostName   = "com.encutitl.vault"
+	nativeHostConfig = "native-host.json"
+	nativeMaxMessage = 1 << 20 // what Chrome accepts from a host
+
+	codeLocked = "LOCKED"
+	codeDenied = "DENIED"
+)
+
+type nativeRequest struct {
+	Type string `json:"type"`
+	Site string `json:"site"`
+	Name string `json:"name"`
+}
+
+type nativeResponse struct {
+	OK       bool              `json:"ok"`
+	Code     string            `json:"code,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Locked   *bool             `json:"locked,omitempty"`
+	Entries  []string          `json:"entries,omitempty"`
+	Entry    string            `json:"entry,omitempty"`
+	Login    string            `json:"login,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+type nativeHost struct {
+	vaultPath string
+	origin    string
+	vault     *vaultFile      // nil while locked
+	approved  map[string]bool // sites approved since unlocking
+}
+
+func runNativeHost(args []string) {
+	if len(args) > 0 && args[0] == "install" {
+		runNativeHostInstall(args[1:])
+		return
+	}
+	cfg, err := loadNativeHostConfig()
+	if err != nil {
+		failf(exitUsage, tr("Error: %v (run native-host install)"), err)
+		return
+	}
+	h := &nativeHost{vaultPath: cfg.Vault, approved: map[string]bool{}}
+	if len(args) > 0 {
+		h.origin = args[len(args)-1] // Firefox passes the manifest path first
+	}
+	// stdout is the browser's; anything printed along the way goes to its
+	// log instead.
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	promptSecret = dialogSecret
+	in := bufio.NewReader(os.Stdin)
+	for {
+		var req nativeRequest
+		err := readNativeMessage(in, &req)
+		if errors.Is(err, io.EOF) {
+			return // the extension disconnected
+		}
+		var resp *nativeResponse
+		if err != nil {
+			resp = nativeError(codeBadRequest, err)
+		} else {
+			resp = h.handle(&req)
+		}
+		if err := writeNativeMessage(out, resp); err != nil {
+			fail(exitIO, tr("Native host error:"), err)
+			return
+		}
+	}
+}
+
+func (h *nativeHost) handle(req *nativeRequest) *nativeResponse {
+	switch req.Type {
+	case "status":
+		return h.status()
+	case "unlock":
+		if h.vault == nil {
+			v, err := openVault(h.vaultPath)
+			if err != nil {
+				return nativeError(errorCode(err), err)
+			}
+			h.vault = v
+		}
+		return h.status()
+	case "lock":
+		h.vault = nil
+		loadedSSHIdentities = nil // drop the decrypted keys too
+		h.approved = map[string]bool{}
+		return h.status()
+	case "list", "get":
+	default:
+		return nativeError(codeBadRequest, fmt.Errorf("unknown request type %q", req.Type))
+	}
+
+	if h.vault == nil {
+		return nativeError(codeLocked, errors.New("the vault is locked"))
+	}
+	site := strings.TrimPrefix(strings.ToLower(req.Site), "www.")
+	if site == "" {
+		return nativeError(codeBadRequest, errors.New("no site given"))
+	}
+	entries := h.vault.current()
+	var matches []string
+	for _, name := range sortedNames(entries) {
+		if entryMatchesSite(name, site) {
+			matches = append(matches, name)
+		}
+	}
+	if req.Type == "list" {
+		return &nativeResponse{OK: true, Entries: matches}
+	}
+
+	name := req.Name
+	if name == "" && len(matches) == 1 {
+		name = matches[0]
+	}
+	if name == "" || !entryMatchesSite(name, site) {
+		// Never hand out another site's entry, whatever the extension
+		// asks for.
+		return nativeError(codeNotFound, fmt.Errorf("no single entry for %s", site))
+	}
+	rec, ok := entries[name]
+	if !ok {
+		return nativeError(codeNotFound, fmt.Errorf("no entry %s", name))
+	}
+	if !h.approved[site] {
+		ok, err := askApproval(fmt.Sprintf("Allow %s to fill in %s on %s?", h.extensionName(), name, site))
+		if err != nil {
+			return nativeError(codeUnavailable, err)
+		}
+		if !ok {
+			return nativeError(codeDenied, errors.New("the user declined"))
+		}
+		h.approved[site] = true
+	}
+	content, err := h.vault.open(rec.data)
+	if err != nil {
+		return nativeError(errorCode(err), err)
+	}
+	resp := parseCredential(name, content)
+	resp.OK = true
+	resp.Entry = name
+	return resp
+}
+
+func (h *nativeHost) status() *nativeResponse {
+	locked := h.vault == nil
+	return &nativeResponse{OK: true, Locked: &locked}
+}
+
+func (h *nativeHost) extensionName() string {
+	if h.origin == "" {
+		return "the browser extension"
+	}
+	return h.origin
+}
+
+func nativeError(code string, err error) *nativeResponse {
+	return &nativeResponse{Code: code, Error: err.Error()}
+}
+
+// entryMatchesSite reports whether a path element of name is site or one
+// of its parent domains, so example.com entries serve login.example.com.
+func entryMatchesSite(name, site string) bool {
+	for _, elem := range strings.Split(strings.ToLower(name), "/") {
+		if strings.Contains(elem, ".") && (site == elem || strings.HasSuffix(site, "."+elem)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCredential reads a pass-style entry: the password, then fields.
+// Without a login field the last path element is the login, unless it
+// is the domain.
+func parseCredential(name string, content []byte) *nativeResponse {
+	first, rest, _ := strings.Cut(string(content), "\n")
+	resp := &nativeResponse{Password: strings.TrimSuffix(first, "\r"), Fields: map[string]string{}}
+	for _, line := range strings.Split(rest, "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			resp.Fields[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	for _, k := range []string{"login", "username", "user", "email"} {
+		if v := resp.Fields[k]; v != "" {
+			resp.Login = v
+			break
+		}
+	}
+	if last := name[strings.LastIndex(name, "/")+1:]; resp.Login == "" && !strings.Contains(last, ".") {
+		resp.Login = last
+	}
+	if len(resp.Fields) == 0 {
+		resp.Fields = nil
+	}
+	return resp
+}
+
+func readNativeMessage(r io.Reader, v any) error {
+	var n uint32
+	if err := binary.Read(r, binary.NativeEndian, &n); err != nil {
+		return err
+	}
+	if n > nativeMaxMessage {
+		return fmt.Errorf("message of %d bytes is too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeNativeMessage(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > nativeMaxMessage {
+		data, _ = json.Marshal(nativeError(codePayloadTooLarge, errors.New("entry too large for the browser")))
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.NativeEndian, uint32(len(data)))
+	buf.Write(data)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// askApproval asks a yes/no question in a desktop dialog.
+func askApproval(question string) (bool, error) {
+	if runtime.GOOS == "darwin" {
+		out, err := exec.Command("osascript", "-e", fmt.Sprintf(`display dialog %q buttons {"Deny", "Allow"} default button "Deny" with title "encutitl"`, question)).Output()
+		// Deny and closing the dialog both exit non-zero.
+		return err == nil && strings.Contains(string(out), "Allow"), nil
+	}
+	name, args, err := linuxDialog("--question", question)
+	if err != nil {
+		return false, err
+	}
+	err = exec.Command(name, args...).Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// dialogSecret is promptSecret for the native host.
+func dialogSecret(prompt string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf(`text returned of (display dialog %q default answer "" with hidden answer with title "encutitl")`, prompt))
+	} else {
+		name, args, err := linuxDialog("--password", prompt)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(name, args...)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("passphrase dialog cancelled")
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// linuxDialog picks zenity or kdialog for a --question or --password
+// dialog.
+func linuxDialog(kind, text string) (string, []string, error) {
+	if _, err := exec.LookPath("zenity"); err == nil {
+		if kind == "--password" {
+			return "zenity", []string{"--password", "--title", text}, nil
+		}
+		return "zenity", []string{kind, "--title", "encutitl", "--text", text}, nil
+	}
+	if _, err := exec.LookPath("kdialog"); err == nil {
+		if kind == "--question" {
+			kind = "--yesno"
+		}
+		return "kdialog", []string{"--title", "encutitl", kind, text}, nil
+	}
+	return "", nil, errors.New("no dialog program found, install zenity or kdialog")
+}
+
+type nativeHostSettings struct {
+	Vault string `json:"vault"`
+}
+
+func loadNativeHostConfig() (*nativeHostSettings, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, nativeHostConfig))
+	if err != nil {
+		return nil, err
+	}
+	var cfg nativeHostSettings
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", nativeHostConfig, err)
+	}
+	if cfg.Vault == "" {
+		return nil, fmt.Errorf("%s: no vault", nativeHostConfig)
+	}
+	return &cfg, nil
+}
+
+func runNativeHostInstall(args []string) {
+	fs := flag.NewFlagSet("native-host install", flag.ExitOnError)
+	browser := fs.String("browser", "chrome", "chrome, chromium or firefox")
+	extension := fs.String("extension", "", "ID of the extension allowed to connect")
+	vaultPath := fs.String("vault", "", "Vault to serve")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *extension == "" || *vaultPath == "" || fs.NArg() != 0 {
+		fail(exitUsage, "Usage: native-host install [--browser chrome|chromium|firefox] --extension ID --vault VAULT")
+		return
+	}
+	manifestDir, err := nativeManifestDir(*browser)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	vault, err := filepath.Abs(*vaultPath)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.Abs(exe)
+	}
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+	dir, err := configDir()
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+
+	// Browsers start the manifest's path with no arguments of ours, so it
+	// points at a launcher that adds the subcommand.
+	launcher := filepath.Join(dir, "native-host")
+	script := fmt.Sprintf("#!/bin/sh\nexec %q native-host \"$@\"\n", exe)
+	if runtime.GOOS == "windows" {
+		launcher += ".bat"
+		script = fmt.Sprintf("@echo off\r\n\"%s\" native-host %%*\r\n", exe)
+	}
+	settings, _ := json.MarshalIndent(nativeHostSettings{Vault: vault}, "", "  ")
+	manifest := map[string]any{
+		"name":        nativeHostName,
+		"description": "encutitl vault",
+		"path":        launcher,
+		"type":        "stdio",
+	}
+	if *browser == "firefox" {
+		manifest["allowed_extensions"] = []string{*extension}
+	} else {
+		manifest["allowed_origins"] = []string{"chrome-extension://" + *extension + "/"}
+	}
+	manifestJSON, _ := json.MarshalIndent(manifest, "", "  ")
+	manifestPath := filepath.Join(manifestDir, nativeHostName+".json")
+
+	for _, f := range []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{
+		{launcher, []byte(script), 0700},
+		{filepath.Join(dir, nativeHostConfig), settings, 0600},
+		{manifestPath, manifestJSON, 0644},
+	} {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+		if err := os.WriteFile(f.path, f.data, f.perm); err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+	}
+	fmt.Println(tr("Native messaging host manifest saved to:"), manifestPath)
+	if runtime.GOOS == "windows" {
+		fmt.Printf(tr("Register it under HKCU\\Software\\%s\\NativeMessagingHosts\\%s")+"\n", nativeRegistryVendor(*browser), nativeHostName)
+	}
+}
+
+// nativeManifestDir is where the browser looks for host manifests of the
+// current user. Windows has them in the registry instead, so they are
+// kept next to the config there.
+func nativeManifestDir(browser string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dirs := map[string]map[string]string{
+		"linux": {
+			"chrome":   ".config/google-chrome/NativeMessagingHosts",
+			"chromium": ".config/chromium/NativeMessagingHosts",
+			"firefox":  ".mozilla/native-messaging-hosts",
+		},
+		"darwin": {
+			"chrome":   "Library/Application Support/Google/Chrome/NativeMessagingHosts",
+			"chromium": "Library/Application Support/Chromium/NativeMessagingHosts",
+			"firefox":  "Library/Application Support/Mozilla/NativeMessagingHosts",
+		},
+	}
+	if runtime.GOOS == "windows" {
+		if nativeRegistryVendor(browser) == "" {
+			return "", fmt.Errorf("unknown browser %q", browser)
+		}
+		return configDir()
+	}
+	byBrowser, ok := dirs[runtime.GOOS]
+	if !ok {
+		byBrowser = dirs["linux"]
+	}
+	dir, ok := byBrowser[browser]
+	if !ok {
+		names := make([]string, 0, len(byBrowser))
+		for name := range byBrowser {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown browser %q, use one of %s", browser, strings.Join(names, ", "))
+	}
+	return filepath.Join(home, filepath.FromSlash(dir)), nil
+}
+
+func nativeRegistryVendor(browser string) string {
+	return map[string]string{
+		"chrome":   `Google\Chrome`,
+		"chromium": "Chromium",
+		"firefox":  "Mozilla",
+	}[browser]
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Every outgoing connection goes through dial or httpClient so --proxy
+// (and the usual HTTPS_PROXY / ALL_PROXY variables) apply everywhere.
+// socks5 proxies get the hostname, not a resolved address, so DNS also
+// goes through Tor.
+
+var proxyFlag = flag.String("proxy", "", "Proxy for all network traffic: socks5://host:port or http(s)://host:port")
+
+func proxyURL() (*url.URL, error) {
+	if *proxyFlag == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(*proxyFlag)
+	if err != nil {
+		return nil, fmt.Errorf("bad --proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+		return u, nil
+	}
+	return nil, fmt.Errorf("bad --proxy: unsupported scheme %q", u.Scheme)
+}
+
+func dialer() (proxy.ContextDialer, error) {
+	direct := &net.Dialer{Timeout: 30 * time.Second}
+	u, err := proxyURL()
+	if err != nil {
+		return nil, err
+	}
+	var d proxy.Dialer
+	switch {
+	case u == nil:
+		d = proxy.FromEnvironmentUsing(direct)
+	case u.Scheme == "socks5" || u.Scheme == "socks5h":
+		d, err = proxy.FromURL(u, direct)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("--proxy %s only applies to HTTP requests, use a socks5 proxy for raw connections", u.Scheme)
+	}
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd, nil
+	}
+	return contextDialer{d}, nil
+}
+
+type contextDialer struct{ proxy.Dialer }
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.Dial(network, addr)
+}
+
+func dial(network, addr string) (net.Conn, error) {
+	if network == "unix" {
+		return net.Dial(network, addr)
+	}
+	d, err := dialer()
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func httpClient() (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if err := configureTransport(tr); err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: tr, Timeout: 60 * time.Second}, nil
+}
+
+// configureTransport applies the proxy settings to tr, for SDKs that
+// build their own transports.
+func configureTransport(tr *http.Transport) error {
+	u, err := proxyURL()
+	if err != nil {
+		return err
+	}
+	switch {
+	case u == nil:
+		tr.Proxy = http.ProxyFromEnvironment
+	case u.Scheme == "http" || u.Scheme == "https":
+		tr.Proxy = http.ProxyURL(u)
+	default:
+		d, err := dialer()
+		if err != nil {
+			return err
+		}
+		tr.Proxy = nil
+		tr.DialContext = d.DialContext
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// --pad rounds the payload up so the size of an encrypted file says
+// little about the secret in it: padme costs at most 12%, block:N makes
+// every file under N bytes the same size. The scheme is recorded in the
+// header, decryption needs no flag.
+
+var padFlag = flag.String("pad", "", "Pad the payload to hide its length: padme or block:N (encutitl format)")
+
+func checkPad() error {
+	if *padFlag != "" && *formatFlag != "encutitl" {
+		return errors.New("--pad needs the encutitl format")
+	}
+	return encutil.CheckPadding(*padFlag)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// known_peers pins the public key a network peer presented the first time
+// we talked to it, the same trust-on-first-use model as ssh known_hosts.
+// One "host key" pair per line, key in base64.
+const knownPeersFile = "known_peers"
+
+type peerKeyMismatchError struct {
+	host      string
+	pinned    []byte
+	presented []byte
+}
+
+func (e *peerKeyMismatchError) Error() string {
+	return fmt.Sprintf("PEER KEY MISMATCH for %s: pinned %s, presented %s (possible man-in-the-middle; run `encutitl peers forget %s` if the peer really changed keys)",
+		e.host, displayFingerprint(e.pinned), displayFingerprint(e.presented), e.host)
+}
+
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "encutitl")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func knownPeersPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, knownPeersFile), nil
+}
+
+func loadKnownPeers() (map[string][]byte, error) {
+	path, err := knownPeersPath()
+	if err != nil {
+		return nil, err
+	}
+	peers := map[string][]byte{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return peers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad key for %s", path, fields[0])
+		}
+		peers[fields[0]] = key
+	}
+	return peers, sc.Err()
+}
+
+func saveKnownPeers(peers map[string][]byte) error {
+	path, err := knownPeersPath()
+	if err != nil {
+		return err
+	}
+	hosts := make([]string, 0, len(peers))
+	for h := range peers {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	var buf bytes.Buffer
+	for _, h := range hosts {
+		fmt.Fprintf(&buf, "%s %s\n", h, base64.StdEncoding.EncodeToString(peers[h]))
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// checkPeerKey pins key for host on first contact and fails with a
+// *peerKeyMismatchError if a different key was pinned before.
+func checkPeerKey(host string, key []byte) error {
+	peers, err := loadKnownPeers()
+	if err != nil {
+		return err
+	}
+	pinned, ok := peers[host]
+	if ok {
+		if !bytes.Equal(pinned, key) {
+			return &peerKeyMismatchError{host: host, pinned: pinned, presented: key}
+		}
+		return nil
+	}
+	peers[host] = key
+	if err := saveKnownPeers(peers); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, tr("Pinned new peer %s with key %s")+"\n", host, displayFingerprint(key))
+	return nil
+}
+
+func runPeers(args []string) {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: encutitl peers list | forget <host>")
+	}
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+
+	peers, err := loadKnownPeers()
+	if err != nil {
+		fail(exitIO, tr("Known peers error:"), err)
+		return
+	}
+	switch fs.Arg(0) {
+	case "", "list":
+		hosts := make([]string, 0, len(peers))
+		for h := range peers {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		for _, h := range hosts {
+			if *a11yFlag {
+				fmt.Printf(tr("Peer %s, key %s.")+"\n", h, displayFingerprint(peers[h]))
+				continue
+			}
+			fmt.Println(h, keyFingerprint(peers[h]))
+		}
+	case "forget":
+		host := fs.Arg(1)
+		if _, ok := peers[host]; !ok {
+			fail(exitUsage, tr("Error: no pinned key for"), host)
+			return
+		}
+		delete(peers, host)
+		if err := saveKnownPeers(peers); err != nil {
+			fail(exitIO, tr("Known peers error:"), err)
+			return
+		}
+		fmt.Println(tr("Forgot"), host)
+	default:
+		fs.Usage()
+	}
+}
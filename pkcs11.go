@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// With --key-backend pkcs11 the file key is wrapped by a key that lives on
+// a PKCS#11 token (YubiKey via ykcs11, a smart card, an HSM or SoftHSM):
+//
+//	RSA key pair  wrapped with RSA-OAEP/SHA-256, unwrapped on the token
+//	AES key       wrapped and unwrapped on the token with AES-GCM
+//
+// Only the file key ever crosses into the process. The stanza records the
+// key label and mechanism; the module path is local and given again when
+// decrypting.
+
+const pkcs11Stanza = "pkcs11"
+
+var pkcs11Module = flag.String("pkcs11-module", "", "PKCS#11 module for --key-backend pkcs11, e.g. /usr/lib/libykcs11.so")
+
+// tokenKey is a key on a token that can both wrap and unwrap file keys.
+type tokenKey interface {
+	encutil.Recipient
+	encutil.Identity
+}
+
+func newPKCS11Recipient(label string) (tokenKey, error) {
+	if *pkcs11Module == "" {
+		return nil, errors.New("pkcs11: --pkcs11-module is required")
+	}
+	if label == "" {
+		return nil, errors.New("pkcs11: --key-name is required")
+	}
+	return openPKCS11Key(*pkcs11Module, label)
+}
+
+// pkcs11Identities opens the token keys named in the header.
+func pkcs11Identities(hdr *encutil.Header) ([]encutil.Identity, error) {
+	var out []encutil.Identity
+	seen := map[string]bool{}
+	for _, s := range hdr.Recipients {
+		if s.Type != pkcs11Stanza || len(s.Args) != 2 || seen[s.Args[0]] {
+			continue
+		}
+		seen[s.Args[0]] = true
+		if *pkcs11Module == "" {
+			return nil, fmt.Errorf("file is wrapped by PKCS#11 key %q, pass --pkcs11-module", s.Args[0])
+		}
+		k, err := openPKCS11Key(*pkcs11Module, s.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, nil
+}
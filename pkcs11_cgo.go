@@ -0,0 +1,212 @@
+//go:build cgo
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+type p11Key struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	token   pkcs11.TokenInfo
+	label   string
+	mech    string // "rsa-oaep" or "aes-gcm"
+	handle  pkcs11.ObjectHandle
+	private bool // handle is usable for unwrapping
+	pub     *rsa.PublicKey
+}
+
+// openPKCS11Key finds the first token holding a key labelled label.
+func openPKCS11Key(module, label string) (tokenKey, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11: cannot load %s", module)
+	}
+	if err := ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	for _, slot := range slots {
+		k, err := findTokenKey(ctx, slot, label)
+		if err != nil {
+			ctx.Finalize()
+			ctx.Destroy()
+			return nil, err
+		}
+		if k != nil {
+			return k, nil
+		}
+	}
+	ctx.Finalize()
+	ctx.Destroy()
+	return nil, fmt.Errorf("pkcs11: no key labelled %q on any token", label)
+}
+
+func findTokenKey(ctx *pkcs11.Ctx, slot uint, label string) (*p11Key, error) {
+	info, err := ctx.GetTokenInfo(slot)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	sh, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	k := &p11Key{ctx: ctx, session: sh, token: info, label: label}
+
+	// An RSA public key is usually readable without a PIN, which is all
+	// wrapping needs. Private and secret keys only show up after login.
+	found, err := k.find()
+	if err == nil && !found && info.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0 {
+		if err = k.login(); err == nil {
+			found, err = k.find()
+		}
+	}
+	if err != nil || !found {
+		ctx.CloseSession(sh)
+		if err != nil {
+			return nil, fmt.Errorf("pkcs11: %s: %w", info.Label, err)
+		}
+		return nil, nil
+	}
+	return k, nil
+}
+
+func (k *p11Key) login() error {
+	if err := batchPrompt("PIN for token "+k.token.Label, "token PINs can only be typed in"); err != nil {
+		return err
+	}
+	pin, err := promptSecret(fmt.Sprintf("PIN for token %s: ", k.token.Label))
+	if err != nil {
+		return err
+	}
+	err = k.ctx.Login(k.session, pkcs11.CKU_USER, string(pin))
+	if errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return nil
+	}
+	return err
+}
+
+// find looks for a secret AES key, then an RSA private or public key with
+// the label.
+func (k *p11Key) find() (bool, error) {
+	if h, ok, err := k.findObject(pkcs11.CKO_SECRET_KEY); err != nil || ok {
+		k.handle, k.private, k.mech = h, ok, "aes-gcm"
+		return ok, err
+	}
+	h, ok, err := k.findObject(pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return false, err
+	}
+	k.handle, k.private, k.mech = h, ok, "rsa-oaep"
+	pubObj := h
+	if ph, pubOK, err := k.findObject(pkcs11.CKO_PUBLIC_KEY); err == nil && pubOK {
+		pubObj, ok = ph, true
+	}
+	if !ok {
+		return false, nil
+	}
+	attrs, err := k.ctx.GetAttributeValue(k.session, pubObj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return false, err
+	}
+	k.pub = &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[0].Value),
+		E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+	}
+	return true, nil
+}
+
+func (k *p11Key) findObject(class uint) (pkcs11.ObjectHandle, bool, error) {
+	if err := k.ctx.FindObjectsInit(k.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.label),
+	}); err != nil {
+		return 0, false, err
+	}
+	objs, _, err := k.ctx.FindObjects(k.session, 1)
+	k.ctx.FindObjectsFinal(k.session)
+	if err != nil || len(objs) == 0 {
+		return 0, false, err
+	}
+	return objs[0], true, nil
+}
+
+func (k *p11Key) Wrap(fileKey []byte) (*encutil.Stanza, error) {
+	var body []byte
+	var err error
+	switch k.mech {
+	case "rsa-oaep":
+		body, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, k.pub, fileKey, nil)
+	case "aes-gcm":
+		iv := make([]byte, 12)
+		if _, err := rand.Read(iv); err != nil {
+			return nil, err
+		}
+		params := pkcs11.NewGCMParams(iv, []byte(pkcs11Stanza+"/"+k.label), 128)
+		defer params.Free()
+		if err = k.ctx.EncryptInit(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}, k.handle); err == nil {
+			var ct []byte
+			ct, err = k.ctx.Encrypt(k.session, fileKey)
+			body = append(iv, ct...)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 wrap with %q: %w", k.label, err)
+	}
+	return &encutil.Stanza{Type: pkcs11Stanza, Args: []string{k.label, k.mech}, Body: body}, nil
+}
+
+func (k *p11Key) Unwrap(s *encutil.Stanza) ([]byte, error) {
+	if s.Type != pkcs11Stanza || len(s.Args) != 2 || s.Args[0] != k.label || s.Args[1] != k.mech {
+		return nil, encutil.ErrIncorrectIdentity
+	}
+	if !k.private {
+		if err := k.login(); err != nil {
+			return nil, fmt.Errorf("pkcs11: %s: %w", k.token.Label, err)
+		}
+		if _, err := k.find(); err != nil || !k.private {
+			return nil, fmt.Errorf("pkcs11: no private key labelled %q on %s", k.label, k.token.Label)
+		}
+	}
+	var mech *pkcs11.Mechanism
+	body := s.Body
+	switch k.mech {
+	case "rsa-oaep":
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP,
+			pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil))
+	case "aes-gcm":
+		if len(body) < 12 {
+			return nil, errors.New("pkcs11: short stanza body")
+		}
+		params := pkcs11.NewGCMParams(body[:12], []byte(pkcs11Stanza+"/"+k.label), 128)
+		defer params.Free()
+		mech = pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)
+		body = body[12:]
+	}
+	if err := k.ctx.DecryptInit(k.session, []*pkcs11.Mechanism{mech}, k.handle); err != nil {
+		return nil, fmt.Errorf("pkcs11 unwrap with %q: %w", k.label, err)
+	}
+	fileKey, err := k.ctx.Decrypt(k.session, body)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 unwrap with %q: %w", k.label, err)
+	}
+	return fileKey, nil
+}
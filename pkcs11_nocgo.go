@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package main
+
+import "errors"
+
+func openPKCS11Key(module, label string) (tokenKey, error) {
+	return nil, errors.New("pkcs11: this build has no cgo, PKCS#11 tokens are not available")
+}
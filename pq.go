@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// key pq-generate creates a hybrid ML-KEM-768 + X25519 key pair for
+// archives that have to stay confidential for decades: pq.key is the
+// identity, found on decryption like the default SSH keys, and pq.pub the
+// encpq1 recipient to hand out for --recipient. Both live in the config
+// directory, like key.bin, with the same fallback to the working
+// directory.
+
+const (
+	pqKeyFile = "pq.key"
+	pqPubFile = "pq.pub"
+)
+
+func runKeyPQGenerate(args []string) {
+	fs := flag.NewFlagSet("key pq-generate", flag.ExitOnError)
+	out := fs.String("o", "", "Where to write the private key; the public key goes to <o>.pub (default pq.key and pq.pub in the config directory)")
+	addLangFlag(fs)
+	fs.Parse(args)
+	pubPath := *out + ".pub"
+	if *out == "" {
+		*out, pubPath = pqKeyPath(), pqPubPath()
+	}
+
+	if _, err := os.Stat(*out); err == nil {
+		failf(exitUsage, tr("Error: %s already exists, move it away or use -o"), *out)
+		return
+	}
+	id, err := encutil.GenerateHybridIdentity()
+	if err != nil {
+		fail(exitError, tr("Key error:"), err)
+		return
+	}
+	pub := id.Recipient().String()
+	priv := fmt.Sprintf("# encutitl hybrid ML-KEM-768 + X25519 identity\n# public key: %s\n%s\n", pub, id)
+	if err := writePrivateKey(*out, []byte(priv)); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	if err := os.WriteFile(pubPath, []byte(pub+"\n"), 0644); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Println(tr("Private key saved to:"), *out)
+	fmt.Println(tr("Public key saved to:"), pubPath)
+}
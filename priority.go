@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// --nice, --ionice, --cpus and --numa-node keep a scheduled job from
+// crowding out the rest of a shared server: they lower the CPU and I/O
+// priority of the run and pin it to some cores, with GOMAXPROCS cut to
+// match so the workers do not fight over them. Like any flag they can be
+// set in a profile, so every job of that profile runs that way; watch
+// takes them too. Only Linux supports them; --ionice only has an effect
+// with the bfq I/O scheduler.
+//
+//	--nice 10                  CPU niceness, 1 to 19 (negative needs root)
+//	--ionice idle              I/O only when the disk is otherwise idle
+//	--ionice best-effort:7     the default class, levels 0 (high) to 7
+//	--cpus 0-3,8               run on these CPUs
+//	--numa-node 1              run on the CPUs of NUMA node 1
+
+var (
+	niceFlag     = flag.Int("nice", 0, "CPU niceness of the run, -20 to 19 (0 leaves it)")
+	ioniceFlag   = flag.String("ionice", "", "I/O priority: idle, best-effort[:0-7] or realtime[:0-7]")
+	cpusFlag     = flag.String("cpus", "", "Run on these CPUs, as a list like 0-3,8")
+	numaNodeFlag = flag.Int("numa-node", -1, "Run on the CPUs of this NUMA node")
+)
+
+// I/O priority classes, as ioprio_set(2) numbers them.
+var ioClasses = map[string]int{"realtime": 1, "best-effort": 2, "idle": 3}
+
+// applyPriority applies the priority and affinity flags to the process.
+func applyPriority() error {
+	if *niceFlag < -20 || *niceFlag > 19 {
+		return fmt.Errorf("--nice %d, expected -20 to 19", *niceFlag)
+	}
+	class, level, err := parseIONice(*ioniceFlag)
+	if err != nil {
+		return err
+	}
+	if *cpusFlag != "" && *numaNodeFlag >= 0 {
+		return fmt.Errorf("use one of --cpus and --numa-node")
+	}
+	list := *cpusFlag
+	if *numaNodeFlag >= 0 {
+		data, err := os.ReadFile(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", *numaNodeFlag))
+		if err != nil {
+			return fmt.Errorf("--numa-node %d: %w", *numaNodeFlag, err)
+		}
+		list = strings.TrimSpace(string(data))
+	}
+	var cpus []int
+	if list != "" {
+		if cpus, err = parseCPUList(list); err != nil {
+			return err
+		}
+	}
+	if *niceFlag == 0 && class == 0 && cpus == nil {
+		return nil
+	}
+	if err := setPriority(*niceFlag, class, level, cpus); err != nil {
+		return err
+	}
+	if cpus != nil {
+		runtime.GOMAXPROCS(len(cpus))
+	}
+	return nil
+}
+
+// parseIONice parses --ionice into an ioClasses class and a level.
+func parseIONice(s string) (class, level int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	name, lvl, hasLevel := strings.Cut(s, ":")
+	class, ok := ioClasses[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown --ionice class %q, use idle, best-effort or realtime", name)
+	}
+	level = 4 // the kernel's default within a class
+	if hasLevel {
+		level, err = strconv.Atoi(lvl)
+		if err != nil || level < 0 || level > 7 || name == "idle" {
+			return 0, 0, fmt.Errorf("bad --ionice %q, levels are 0 to 7 and idle has none", s)
+		}
+	}
+	return class, level, nil
+}
+
+// parseCPUList parses a CPU list in the kernel's format, like 0-3,8.
+func parseCPUList(s string) ([]int, error) {
+	seen := map[int]bool{}
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err1 := strconv.Atoi(lo)
+		last, err2 := first, error(nil)
+		if isRange {
+			last, err2 = strconv.Atoi(hi)
+		}
+		if err1 != nil || err2 != nil || first < 0 || last < first || last >= 1<<16 {
+			return nil, fmt.Errorf("bad CPU list %q, expected something like 0-3,8", s)
+		}
+		for c := first; c <= last; c++ {
+			if !seen[c] {
+				seen[c] = true
+				cpus = append(cpus, c)
+			}
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// setPriority applies niceness, I/O priority and affinity. On Linux all
+// three belong to threads, not the process, so they are set on every
+// thread the runtime has started; threads started later inherit them.
+// A thread started while going through the list is caught by going
+// through it again.
+func setPriority(nice, ioClass, ioLevel int, cpus []int) error {
+	var set unix.CPUSet
+	for _, c := range cpus {
+		set.Set(c)
+	}
+	done := map[int]bool{}
+	for {
+		tasks, err := os.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		fresh := false
+		for _, t := range tasks {
+			tid, err := strconv.Atoi(t.Name())
+			if err != nil || done[tid] {
+				continue
+			}
+			fresh = true
+			if err := setThreadPriority(tid, nice, ioClass, ioLevel, cpus, &set); err != nil {
+				return err
+			}
+			done[tid] = true
+		}
+		if !fresh {
+			return nil
+		}
+	}
+}
+
+func setThreadPriority(tid, nice, ioClass, ioLevel int, cpus []int, set *unix.CPUSet) error {
+	if nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil {
+			return fmt.Errorf("--nice: %w", err)
+		}
+	}
+	if ioClass != 0 {
+		const whoProcess, classShift = 1, 13
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, whoProcess, uintptr(tid), uintptr(ioClass<<classShift|ioLevel)); errno != 0 {
+			return fmt.Errorf("--ionice: %w", errno)
+		}
+	}
+	if cpus != nil {
+		if err := unix.SchedSetaffinity(tid, set); err != nil {
+			return fmt.Errorf("--cpus: %w", err)
+		}
+	}
+	return nil
+}
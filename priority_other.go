@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func setPriority(nice, ioClass, ioLevel int, cpus []int) error {
+	return errors.New("--nice, --ionice, --cpus and --numa-node are only supported on Linux")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Profiles in <config dir>/config.toml preset flags by their command line
+// names. Flags given on the command line win over the profile; a profile
+// named default applies when --profile is not given.
+//
+//	[profiles.work]
+//	key-backend = "vault"
+//	key-name = "backups"
+//	recipient = ["github:alice", "~/.ssh/bob.pub"]
+//	output-as-hex = true
+
+const configFile = "config.toml"
+
+var profileFlag = flag.String("profile", os.Getenv("ENCUTITL_PROFILE"), "Apply flags from this profile in config.toml")
+
+type configToml struct {
+	Profiles map[string]map[string]any `toml:"profiles"`
+}
+
+// applyProfile sets the flags of the selected profile that were not given
+// on the command line. Call it right after flag.Parse.
+func applyProfile() error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	var cfg configToml
+	if _, err := toml.DecodeFile(filepath.Join(dir, configFile), &cfg); err != nil {
+		if errors.Is(err, os.ErrNotExist) && *profileFlag == "" {
+			return nil
+		}
+		return err
+	}
+	name := *profileFlag
+	if name == "" {
+		name = "default"
+	}
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		if *profileFlag == "" {
+			return nil
+		}
+		return fmt.Errorf("no profile %q in %s", name, filepath.Join(dir, configFile))
+	}
+
+	// Aliases such as -r and --recipient share a Value, so a flag given
+	// under any of its names keeps the profile off all of them.
+	set := map[flag.Value]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Value] = true })
+	for key, v := range profile {
+		f := flag.Lookup(key)
+		if f == nil || key == "profile" {
+			return fmt.Errorf("profile %s: unknown flag %q", name, key)
+		}
+		if set[f.Value] {
+			continue
+		}
+		values, ok := v.([]any)
+		if !ok {
+			values = []any{v}
+		}
+		for _, v := range values {
+			if err := flag.Set(key, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("profile %s: %s: %w", name, key, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// A proof ties a recipient key to an account the key's owner controls, as
+// Keybase did: a web page (their site, a gist, a profile) or a DNS TXT
+// record at _encutitl.<domain> carrying a statement signed by the key,
+// made with `proof create`:
+//
+//	encutitl-proof=v1;key=SHA256:...;sig=...
+//
+// The signature covers the location too, so a statement copied elsewhere
+// proves nothing. Someone who swapped a key in a recipients file would
+// also have to control the accounts its proofs point at.
+//
+// SSH key lines name their proofs with an option, repeatable:
+//
+//	proof="https://alice.example/keys.html",proof="dns:alice.example" ssh-ed25519 AAAA... alice
+//
+// Every proof of a key is checked before the key is first encrypted to and
+// the key is then remembered in proofs.json in the config dir, so later
+// runs neither wait on the network nor fail when a page moves. With
+// --require-proofs, keys without a verified proof are refused.
+
+const (
+	proofsFile    = "proofs.json"
+	proofVersion  = "v1"
+	proofDNSLabel = "_encutitl."
+)
+
+var requireProofs = flag.Bool("require-proofs", false, "Refuse recipient keys without a verified proof")
+
+var proofPattern = regexp.MustCompile(`encutitl-proof=v1;key=(SHA256:[A-Za-z0-9+/]+);sig=([A-Za-z0-9+/=]+)`)
+
+// verifiedProof is a key's entry in proofs.json.
+type verifiedProof struct {
+	Locations []string  `json:"locations"`
+	Verified  time.Time `json:"verified"`
+}
+
+// proofMessage is what a proof's signature covers.
+func proofMessage(location, fingerprint string) []byte {
+	return []byte("encutitl-proof " + proofVersion + "\n" + location + "\n" + fingerprint)
+}
+
+// checkProof verifies the proofs a recipient key line names, unless they
+// were verified before.
+func checkProof(line string) error {
+	pub, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		if *requireProofs {
+			return errors.New("--require-proofs: only SSH keys can carry proofs")
+		}
+		return nil
+	}
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+	var locations []string
+	for _, opt := range options {
+		if v, ok := strings.CutPrefix(opt, "proof="); ok {
+			locations = append(locations, strings.Trim(v, `"`))
+		}
+	}
+	fp := ssh.FingerprintSHA256(pub)
+	path, known, err := loadProofs()
+	if err != nil {
+		return err
+	}
+	if v, ok := known[fp]; ok && (len(locations) == 0 || containsAll(v.Locations, locations)) {
+		return nil
+	}
+	if len(locations) == 0 {
+		if *requireProofs {
+			return fmt.Errorf("--require-proofs: key %s has no proof", fp)
+		}
+		return nil
+	}
+	for _, loc := range locations {
+		if err := verifyProof(loc, pub); err != nil {
+			return fmt.Errorf("proof %s for %s: %w", loc, fp, err)
+		}
+		fmt.Fprintf(os.Stderr, tr("Verified proof of %s at %s")+"\n", fp, loc)
+	}
+	known[fp] = verifiedProof{Locations: locations, Verified: time.Now().UTC()}
+	return saveProofs(path, known)
+}
+
+func containsAll(have, want []string) bool {
+	for _, w := range want {
+		if !slices.Contains(have, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyProof looks for a statement by pub at location.
+func verifyProof(location string, pub ssh.PublicKey) error {
+	texts, err := fetchProofTexts(location)
+	if err != nil {
+		return err
+	}
+	fp := ssh.FingerprintSHA256(pub)
+	found := false
+	for _, text := range texts {
+		for _, m := range proofPattern.FindAllStringSubmatch(text, -1) {
+			if m[1] != fp {
+				continue
+			}
+			found = true
+			blob, err := base64.StdEncoding.DecodeString(m[2])
+			if err != nil {
+				continue
+			}
+			sig := new(ssh.Signature)
+			if ssh.Unmarshal(blob, sig) != nil {
+				continue
+			}
+			if pub.Verify(proofMessage(location, fp), sig) == nil {
+				return nil
+			}
+		}
+	}
+	if found {
+		return errors.New("signature INVALID")
+	}
+	return errors.New("no statement for this key found")
+}
+
+// fetchProofTexts returns the page, or the TXT records, at location.
+func fetchProofTexts(location string) ([]string, error) {
+	if domain, ok := strings.CutPrefix(location, "dns:"); ok {
+		return net.LookupTXT(proofDNSLabel + domain)
+	}
+	if !strings.HasPrefix(location, "https://") {
+		return nil, errors.New("proofs are https:// pages or dns:domain records")
+	}
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(data)}, nil
+}
+
+func loadProofs() (string, map[string]verifiedProof, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(dir, proofsFile)
+	known := map[string]verifiedProof{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return path, known, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &known)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return path, known, nil
+}
+
+func saveProofs(path string, known map[string]verifiedProof) error {
+	data, err := json.MarshalIndent(known, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+func runProof(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "Usage: proof create|forget [flags]")
+		return
+	}
+	switch args[0] {
+	case "create":
+		runProofCreate(args[1:])
+	case "forget":
+		runProofForget(args[1:])
+	default:
+		fail(exitUsage, tr("Error: unknown proof command"), args[0])
+	}
+}
+
+// runProofCreate prints the statement to post at a location, signed with
+// an SSH private key.
+func runProofCreate(args []string) {
+	fs := flag.NewFlagSet("proof create", flag.ExitOnError)
+	keyPath := fs.String("i", "", "SSH private key to sign with")
+	addKeyPermsFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *keyPath == "" || fs.NArg() != 1 {
+		fail(exitUsage, "Usage: proof create -i KEY https://URL|dns:DOMAIN")
+		return
+	}
+	location := fs.Arg(0)
+	if !strings.HasPrefix(location, "https://") && !strings.HasPrefix(location, "dns:") {
+		fail(exitUsage, tr("Error: proofs are https:// pages or dns:domain records"))
+		return
+	}
+	data, err := readPrivateKey(*keyPath)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	id, err := encutil.ParseSSHIdentity(data, passphrasePrompt(*keyPath))
+	var signer ssh.Signer
+	if err == nil {
+		signer, err = id.Signer()
+	}
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	fp := ssh.FingerprintSHA256(signer.PublicKey())
+	var sig *ssh.Signature
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, proofMessage(location, fp), ssh.KeyAlgoRSASHA256) // not SHA-1
+	} else {
+		sig, err = signer.Sign(rand.Reader, proofMessage(location, fp))
+	}
+	if err != nil {
+		fail(exitKey, tr("Signing error:"), err)
+		return
+	}
+	statement := fmt.Sprintf("encutitl-proof=%s;key=%s;sig=%s", proofVersion, fp, base64.StdEncoding.EncodeToString(ssh.Marshal(sig)))
+	if domain, ok := strings.CutPrefix(location, "dns:"); ok {
+		fmt.Fprintf(os.Stderr, tr("Add a TXT record at %s%s with:")+"\n", proofDNSLabel, domain)
+	} else {
+		fmt.Fprintf(os.Stderr, tr("Publish at %s:")+"\n", location)
+	}
+	fmt.Println(statement)
+	fmt.Fprintf(os.Stderr, tr("and give the key to others as:")+"\nproof=%q %s", location, ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+// runProofForget drops a key from proofs.json so its proofs are checked
+// again on next use.
+func runProofForget(args []string) {
+	fs := flag.NewFlagSet("proof forget", flag.ExitOnError)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(exitUsage, "Usage: proof forget SHA256:FINGERPRINT")
+		return
+	}
+	path, known, err := loadProofs()
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+	if _, ok := known[fs.Arg(0)]; !ok {
+		fmt.Println(tr("No verified proof for"), fs.Arg(0))
+		return
+	}
+	delete(known, fs.Arg(0))
+	if err := saveProofs(path, known); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Println(tr("Forgot the proofs of"), fs.Arg(0))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// --qr renders the text form of a ciphertext (what --to-stdout prints) or,
+// with key export, the key as a QR code, either in the terminal or as a
+// PNG, for carrying across an air gap to a phone or onto paper. Whatever a
+// scanner decodes goes straight back in: -d -s <payload> for ciphertexts,
+// key import --qr on stdin for keys.
+
+const qrKeyPrefix = "encutitl-key:"
+
+var qrFlag = flag.String("qr", "", "Also render the output as a QR code: term, or a .png file")
+
+// writeQR renders payload to dest, "term" for the terminal or a PNG path.
+func writeQR(dest, payload string) error {
+	q, err := qrcode.New(payload, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("%d bytes do not fit in a QR code: %w", len(payload), err)
+	}
+	if dest == "term" {
+		fmt.Print(q.ToSmallString(false))
+		return nil
+	}
+	if !strings.HasSuffix(strings.ToLower(dest), ".png") {
+		return fmt.Errorf("--qr %q: want term or a .png file", dest)
+	}
+	return q.WriteFile(512, dest)
+}
+
+func encodeKeyQR(key []byte) string {
+	return qrKeyPrefix + base64.RawURLEncoding.EncodeToString(key)
+}
+
+func decodeKeyQR(payload string) ([]byte, error) {
+	s, ok := strings.CutPrefix(strings.TrimSpace(payload), qrKeyPrefix)
+	if !ok {
+		return nil, errors.New("not an encutitl key QR payload")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key is %d bytes, want %d", len(key), keySize)
+	}
+	return key, nil
+}
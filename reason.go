@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// -e --sensitive marks a file in its header, which is authenticated, so
+// the mark cannot be removed without breaking the file. Every decryption
+// of a sensitive file, by -d or by cat, grep, inspect --open, mount, edit
+// or rekey, goes into the audit log. With the policy
+//
+//	[policy]
+//	require_reason = true
+//
+// in config.toml, decrypting one also needs --reason, such as the ticket
+// the access is for, which is logged with it; without one the file is
+// refused before any key is loaded.
+
+var (
+	sensitiveFlag = flag.Bool("sensitive", false, "Mark the encrypted file sensitive: decrypting it is audited, with --reason if the policy requires one")
+	reasonFlag    = flag.String("reason", "", "Why a sensitive file is being decrypted, e.g. a ticket number, for the audit log")
+)
+
+type policyConfig struct {
+	RequireReason bool `toml:"require_reason"`
+}
+
+func loadPolicy() (policyConfig, error) {
+	var file struct {
+		Policy policyConfig `toml:"policy"`
+	}
+	dir, err := configDir()
+	if err != nil {
+		return file.Policy, err
+	}
+	if _, err := toml.DecodeFile(filepath.Join(dir, configFile), &file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return file.Policy, err
+	}
+	return file.Policy, nil
+}
+
+// checkReason applies the policy to decrypting data, an encrypted file
+// or just its header, and logs the access if it is sensitive.
+func checkReason(name string, data []byte) error {
+	if !encutil.IsEncutitl(data) {
+		return nil
+	}
+	hdr, _, err := encutil.ParseHeader(data)
+	if err != nil || hdr == nil || !hdr.Sensitive {
+		return err
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	reason := strings.TrimSpace(*reasonFlag)
+	if policy.RequireReason && reason == "" {
+		return errors.New("marked sensitive, give --reason for decrypting it")
+	}
+	if abs, err := filepath.Abs(name); err == nil && !isRemoteURL(name) {
+		name = abs
+	}
+	if err := writeAudit(auditEvent{File: name, Reason: reason}); err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"golang.org/x/term"
+)
+
+// listFlag collects a repeatable string flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var (
+	recipientFlags listFlag
+	identityFlags  listFlag
+)
+
+func init() {
+	flag.Var(&recipientFlags, "recipient", "Encrypt to an ssh-ed25519/ssh-rsa public key, an encpq1 hybrid post-quantum key, an age1 key (--format age), a .pub file, github:<user> or user@domain from the domain's key directory (repeatable)")
+	flag.Var(&recipientFlags, "r", "Short for --recipient")
+	flag.Var(&identityFlags, "i", "SSH private key, pq.key or age identity file used for decryption (repeatable, default ~/.ssh/id_ed25519, ~/.ssh/id_rsa and pq.key in the config directory)")
+}
+
+func parseRecipients(specs []string) ([]encutil.Recipient, error) {
+	var out []encutil.Recipient
+	err := parseRecipientSpecs(specs, func(line string) error {
+		r, err := parseRecipientLine(line)
+		if err == nil {
+			out = append(out, r)
+		}
+		return err
+	})
+	return out, err
+}
+
+// parseRecipientLine parses one public key line for the encutitl format.
+func parseRecipientLine(line string) (encutil.Recipient, error) {
+	if strings.HasPrefix(line, "age1") {
+		return nil, errors.New("age recipients need --format age or sops")
+	}
+	if encutil.IsHybridRecipient(line) {
+		return encutil.ParseHybridRecipient(line)
+	}
+	return encutil.ParseSSHRecipient(line)
+}
+
+// parseRecipientSpecs expands every --recipient value (a key, a file of
+// keys, github:<user> or an address) and hands each public key line to
+// parse, after checking its proofs, its expiry and the revocation list.
+func parseRecipientSpecs(specs []string, parse func(line string) error) error {
+	for _, spec := range specs {
+		lines, err := expandRecipientSpec(spec)
+		if err != nil {
+			return err
+		}
+		found := 0
+		for _, line := range lines {
+			err := checkProof(line)
+			if err == nil {
+				line, err = checkExpiry(line)
+			}
+			if err == nil {
+				err = checkRevoked(line)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", spec, err)
+			}
+			if err := parse(line); err != nil {
+				if strings.HasPrefix(spec, "github:") {
+					continue // skip ecdsa and other key types
+				}
+				return fmt.Errorf("%s: %w", spec, err)
+			}
+			found++
+		}
+		if found == 0 {
+			return fmt.Errorf("%s: no usable public keys found", spec)
+		}
+	}
+	return nil
+}
+
+// expandRecipientSpec returns the public key lines of one --recipient
+// value, without blank lines and comments.
+func expandRecipientSpec(spec string) ([]string, error) {
+	var lines []string
+	switch {
+	case strings.HasPrefix(spec, "github:"):
+		keys, err := fetchGitHubKeys(strings.TrimPrefix(spec, "github:"))
+		if err != nil {
+			return nil, err
+		}
+		lines = keys
+	case strings.HasPrefix(spec, "ssh-"), strings.HasPrefix(spec, "age1"), encutil.IsHybridRecipient(spec):
+		lines = []string{spec}
+	case isDirectoryAddress(spec):
+		keys, err := lookupDirectory(spec)
+		if err != nil {
+			return nil, err
+		}
+		lines = keys
+	default:
+		data, err := os.ReadFile(expandHome(spec))
+		if err != nil {
+			return nil, err
+		}
+		lines = strings.Split(string(data), "\n")
+	}
+	var out []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			out = append(out, line)
+		}
+	}
+	return out, nil
+}
+
+// expandHome resolves a leading ~/ in a recipient path, for specs that
+// come from a profile rather than through the shell.
+func expandHome(path string) string {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, rest)
+}
+
+func fetchGitHubKeys(user string) ([]string, error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get("https://api.github.com/users/" + user + "/keys")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("github:%s: %s", user, resp.Status)
+	}
+	var keys []struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("github:%s: %w", user, err)
+	}
+	var out []string
+	for _, k := range keys {
+		out = append(out, k.Key)
+	}
+	return out, nil
+}
+
+// identityFiles returns the -i paths, or the default SSH keys, pq.key and
+// the imported identities that exist.
+func identityFiles() ([]string, error) {
+	if len(identityFlags) > 0 {
+		return identityFlags, nil
+	}
+	var out []string
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range []string{"id_ed25519", "id_rsa"} {
+			path := filepath.Join(home, ".ssh", name)
+			if _, err := os.Stat(path); err == nil {
+				out = append(out, path)
+			}
+		}
+	}
+	pq := pqKeyPath()
+	if _, err := os.Stat(pq); err == nil {
+		out = append(out, pq)
+	}
+	imported, err := importedIdentities()
+	if err != nil {
+		return nil, err
+	}
+	return append(out, imported...), nil
+}
+
+// loadedSSHIdentities keeps the keys of a run that opens several files,
+// so each passphrase is asked for once.
+var loadedSSHIdentities []encutil.Identity
+
+func sshIdentities() ([]encutil.Identity, error) {
+	if loadedSSHIdentities != nil {
+		return loadedSSHIdentities, nil
+	}
+	if len(identityFlags) == 0 && os.Getenv(agentSockEnv) != "" {
+		client, err := dialAgent()
+		if err != nil {
+			return nil, err
+		}
+		return []encutil.Identity{&agentIdentity{client: client}}, nil
+	}
+	paths, err := identityFiles()
+	if err != nil {
+		return nil, err
+	}
+	var out []encutil.Identity
+	for _, path := range paths {
+		data, err := readPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if isAgeIdentityFile(data) || isAge(data) || isAgeArmor(string(data)) {
+			continue // age only
+		}
+		if encutil.IsHybridIdentity(data) {
+			ids, err := encutil.ParseHybridIdentities(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			for _, id := range ids {
+				out = append(out, id)
+			}
+			continue
+		}
+		id, err := encutil.ParseSSHIdentity(data, passphrasePrompt(path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		out = append(out, id)
+	}
+	loadedSSHIdentities = out
+	return out, nil
+}
+
+func passphrasePrompt(path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if pass, err := configuredPassphrase(); pass != nil || err != nil {
+			return pass, err
+		}
+		return promptSecret(fmt.Sprintf(tr("Passphrase for %s: "), path))
+	}
+}
+
+// promptSecret asks for passphrases and PINs. The native messaging host,
+// whose stdin belongs to the browser, replaces it with a dialog.
+var promptSecret = readSecret
+
+// readSecret prompts on stderr, so the prompt never ends up in piped or
+// --to-stdout output, and reads a line without echo when stdin is a
+// terminal.
+func readSecret(prompt string) ([]byte, error) {
+	if err := batchPrompt(strings.TrimSuffix(strings.TrimSpace(prompt), ":"), "passphrases can come from --passphrase-fd, --passphrase-file or ENCUTITL_PASSPHRASE"); err != nil {
+		return nil, err
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return pass, err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return []byte(strings.TrimRight(line, "\r\n")), err
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// rekey re-encrypts encutitl files in place to the recipients given with
+// --recipient (or the defaults, as -e), for rotating keys or adding and
+// removing a reader; directories are searched for encutitl files. It
+// first prints the plan: every file that would change, with its size and
+// the stanzas it is encrypted to now, the recipients it would be encrypted
+// to, and the total. Files already encrypted to exactly those recipients
+// are left alone. --dry-run stops after the plan.
+//
+// A run over --confirm-above in total (default 1G) only goes ahead with
+// --confirm and the token the plan prints. The token is a hash of the
+// plan, so one copied from a dry run stops working as soon as the files
+// or the recipients are not the ones it showed.
+//
+// Chunked files are skipped, as they would have to be streamed; decrypt
+// and encrypt them again with --chunk-size.
+
+const rekeyConfirmDefault = 1 << 30
+
+type rekeyEntry struct {
+	path      string
+	size      int64
+	stanzas   []string
+	hdr       *encutil.Header
+	unchanged bool
+}
+
+func runRekey(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	fs.Var(&recipientFlags, "recipient", "Recipient to encrypt to (repeatable, default key.bin)")
+	fs.Var(&identityFlags, "i", "Identity file used for decryption (repeatable)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.StringVar(aadFlag, "aad", *aadFlag, "Associated data the files were encrypted with")
+	fs.StringVar(reasonFlag, "reason", *reasonFlag, "Why sensitive files are re-encrypted, for the audit log")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be re-encrypted")
+	confirm := fs.String("confirm", "", "Token from the plan, to go ahead with a run over --confirm-above")
+	confirmAbove := sizeFlag(rekeyConfirmDefault)
+	fs.Var(&confirmAbove, "confirm-above", "Total size above which --confirm is needed (default 1G)")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fail(exitUsage, "Usage: rekey [--recipient KEY...] [-i KEY...] [--aad DATA] [--reason TEXT] [--dry-run] [--confirm TOKEN] [--confirm-above SIZE] FILE|DIR...")
+		return
+	}
+	if err := loadAAD(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	recipients, err := encryptRecipients()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	files, err := rekeyPlan(fs.Args(), recipients)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+
+	var targets []string
+	for _, r := range recipients {
+		s, err := r.Wrap(make([]byte, 32))
+		if err != nil {
+			fail(exitKey, tr("Key error:"), err)
+			return
+		}
+		targets = append(targets, stanzaID(s))
+	}
+	plan := sha256.New()
+	fmt.Println(tr("Recipients:"), strings.Join(targets, ", "))
+	fmt.Fprintln(plan, targets)
+	var total int64
+	var n int
+	for _, f := range files {
+		if f.unchanged {
+			continue
+		}
+		fmt.Printf(tr("  %s  %s  from %s")+"\n", f.path, formatBytes(f.size), strings.Join(f.stanzas, ", "))
+		fmt.Fprintln(plan, f.path, f.size, f.stanzas)
+		total += f.size
+		n++
+	}
+	token := hex.EncodeToString(plan.Sum(nil))[:12]
+	fmt.Printf(tr("%d files, %s to re-encrypt, %d already to these recipients")+"\n", n, formatBytes(total), len(files)-n)
+	if *dryRun || n == 0 {
+		if total > int64(confirmAbove) {
+			fmt.Println(tr("Confirmation token:"), token)
+		}
+		return
+	}
+	if total > int64(confirmAbove) && *confirm != token {
+		if *confirm != "" {
+			fmt.Fprintln(os.Stderr, tr("The files or recipients changed since the token was printed"))
+		}
+		failf(exitUsage, tr("Error: this is over %s, run again with --confirm %s to go ahead"), formatBytes(int64(confirmAbove)), token)
+		return
+	}
+
+	var ids []encutil.Identity
+	var key []byte
+	done := 0
+	for _, f := range files {
+		if f.unchanged {
+			continue
+		}
+		if rekeyOne(f, recipients, &ids, &key) {
+			done++
+		}
+	}
+	fmt.Printf(tr("Re-encrypted %d of %d files")+"\n", done, n)
+}
+
+// rekeyPlan finds the encutitl files under paths and reads their headers.
+func rekeyPlan(paths []string, recipients []encutil.Recipient) ([]rekeyEntry, error) {
+	var files []rekeyEntry
+	add := func(path string, explicit bool) error {
+		prefix, err := readHeaderPrefix(path)
+		if err != nil {
+			if explicit {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			return nil // not an encutitl file
+		}
+		hdr, _, err := encutil.ParseHeader(prefix)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if hdr.ChunkSize > 0 {
+			fmt.Fprintf(os.Stderr, tr("Skipping %s: chunked files are not rekeyed")+"\n", path)
+			return nil
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		f := rekeyEntry{path: path, size: info.Size(), hdr: hdr}
+		for _, s := range hdr.Recipients {
+			f.stanzas = append(f.stanzas, stanzaID(s))
+		}
+		f.unchanged = checkSameRecipients(hdr, recipients) == nil
+		files = append(files, f)
+		return nil
+	}
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if err := add(root, true); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			return add(path, false)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// rekeyOne re-encrypts one file, reusing the identities of the first
+// file for the rest unless they do not open it.
+func rekeyOne(f rekeyEntry, recipients []encutil.Recipient, ids *[]encutil.Identity, key *[]byte) bool {
+	data, err := readFileRetry(f.path)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return false
+	}
+	if f.hdr.AAD && aadData == nil {
+		failf(exitUsage, tr("Error: %s was encrypted with --aad, give it"), f.path)
+		return false
+	}
+	if err := checkReason(f.path, data); err != nil {
+		fail(exitUsage, tr("Error:"), fmt.Errorf("%s: %w", f.path, err))
+		return false
+	}
+	if *ids == nil && *key == nil {
+		if *ids, *key, err = decryptIdentities(data); err != nil {
+			fail(exitKey, tr("Key error:"), err)
+			return false
+		}
+	}
+	// A decoy keeps its canary, which only fires when the new version
+	// is decrypted.
+	var plain bytes.Buffer
+	var canary *encutil.Canary
+	keep := func(c *encutil.Canary) { canary = c }
+	_, _, err = decryptCanary(&plain, data, *key, *ids, keep)
+	if errors.Is(err, encutil.ErrNoIdentityMatched) {
+		// Encrypted to other kinds of keys than the first file.
+		var more []encutil.Identity
+		var k []byte
+		if more, k, err = decryptIdentities(data); err == nil {
+			plain.Reset()
+			_, _, err = decryptCanary(&plain, data, k, more, keep)
+		}
+	}
+	if err != nil {
+		fail(exitAuth, tr("Decryption error:"), fmt.Errorf("%s: %w", f.path, err))
+		return false
+	}
+	defer clear(plain.Bytes())
+	compression, err := payloadCompression(plain.Bytes())
+	if err != nil {
+		fail(exitError, tr("Encryption error:"), err)
+		return false
+	}
+	out, err := encutil.EncryptWith(plain.Bytes(), encutil.EncryptOptions{Compression: compression, AAD: aadData, Padding: f.hdr.Padding, Sensitive: f.hdr.Sensitive, Canary: canary}, recipients...)
+	if err != nil {
+		fail(exitError, tr("Encryption error:"), err)
+		return false
+	}
+	if err := replaceFile(f.path, out); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return false
+	}
+	fmt.Println(tr("Re-encrypted"), f.path)
+	return true
+}
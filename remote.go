@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// -f and -o take object storage and web URLs besides local paths:
+//
+//	s3://bucket/key     Amazon S3 and compatibles, see s3.go
+//	gs://bucket/object  Google Cloud Storage
+//	https://...         GET to read, PUT to write, e.g. presigned URLs
+//	sftp://host/path    SSH servers, see sftp.go
+//
+// Outputs are streamed up as they are written, with no local copy beyond
+// what decryption already stages. GCS credentials come from Google's
+// application default chain (GOOGLE_APPLICATION_CREDENTIALS, gcloud's
+// login, the metadata server), and STORAGE_EMULATOR_HOST points gs:// at
+// an emulator as it does for the SDKs. Uploads go in --part-size chunks
+// through a resumable session and are checked against the CRC32C GCS
+// computes; downloads against the one it sends.
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func isRemoteURL(s string) bool {
+	return isS3URL(s) || isGCSURL(s) || isHTTPSURL(s) || isSFTPURL(s)
+}
+
+func isGCSURL(s string) bool {
+	return strings.HasPrefix(s, "gs://")
+}
+
+func isHTTPSURL(s string) bool {
+	return strings.HasPrefix(s, "https://")
+}
+
+// remoteBase is the last path element of a remote URL, without the query
+// a presigned URL carries.
+func remoteBase(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(s)
+}
+
+func downloadRemote(ctx context.Context, src string) ([]byte, error) {
+	switch {
+	case isS3URL(src):
+		return downloadS3(ctx, src)
+	case isGCSURL(src):
+		return downloadGCS(ctx, src)
+	case isSFTPURL(src):
+		return downloadSFTP(ctx, src)
+	}
+	return downloadHTTPS(ctx, src)
+}
+
+func uploadRemote(ctx context.Context, dest string, r io.Reader) error {
+	switch {
+	case isS3URL(dest):
+		return uploadS3(ctx, dest, r)
+	case isGCSURL(dest):
+		return uploadGCS(ctx, dest, r)
+	case isSFTPURL(dest):
+		return uploadSFTP(ctx, dest, r)
+	}
+	return uploadHTTPS(ctx, dest, r)
+}
+
+// remoteClient is httpClient without its overall timeout, which a large
+// transfer would run into; the context bounds it instead.
+func remoteClient() (*http.Client, error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = 0
+	return client, nil
+}
+
+func downloadHTTPS(ctx context.Context, src string) ([]byte, error) {
+	client, err := remoteClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", redactURL(src), resp.Status)
+	}
+	return readLimited(resp.Body)
+}
+
+// uploadHTTPS PUTs r to dest. Files and buffers are sent with their length,
+// which presigned URLs insist on; other readers go chunked.
+func uploadHTTPS(ctx context.Context, dest string, r io.Reader) error {
+	client, err := remoteClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, dest, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if f, ok := r.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		req.ContentLength = info.Size()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("PUT %s: %s %s", redactURL(dest), resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// redactURL drops the query, where presigned URLs keep their signature,
+// from a URL going into an error message.
+func redactURL(s string) string {
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		return s[:i] + "?..."
+	}
+	return s
+}
+
+func parseGCSURL(s string) (bucket, object string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	bucket, object = u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" || strings.HasSuffix(object, "/") {
+		return "", "", fmt.Errorf("%s: expected gs://bucket/object", s)
+	}
+	return bucket, object, nil
+}
+
+// gcsClient returns the API base URL and a client that authenticates its
+// requests.
+func gcsClient(ctx context.Context) (string, *http.Client, error) {
+	client, err := remoteClient()
+	if err != nil {
+		return "", nil, err
+	}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return strings.TrimSuffix(host, "/"), client, nil
+	}
+	ts, err := google.DefaultTokenSource(context.WithValue(ctx, oauth2.HTTPClient, client), gcsScope)
+	if err != nil {
+		return "", nil, err
+	}
+	client.Transport = &oauth2.Transport{Source: ts, Base: client.Transport}
+	return "https://storage.googleapis.com", client, nil
+}
+
+func downloadGCS(ctx context.Context, src string) ([]byte, error) {
+	bucket, object, err := parseGCSURL(src)
+	if err != nil {
+		return nil, err
+	}
+	base, client, err := gcsClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", base, url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, gcsError(src, resp)
+	}
+	data, err := readLimited(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range resp.Header.Values("X-Goog-Hash") {
+		for _, sum := range strings.Split(h, ",") {
+			if want, ok := strings.CutPrefix(strings.TrimSpace(sum), "crc32c="); ok && want != crc32cBase64(data) {
+				return nil, fmt.Errorf("%s: CRC32C mismatch, the download is corrupt", src)
+			}
+		}
+	}
+	return data, nil
+}
+
+// uploadGCS streams r into a resumable upload session, one --part-size
+// chunk at a time. A session that fails midway is left to expire.
+func uploadGCS(ctx context.Context, dest string, r io.Reader) error {
+	bucket, object, err := parseGCSURL(dest)
+	if err != nil {
+		return err
+	}
+	chunkSize := int64(*partSizeMiB) << 20
+	if chunkSize < minPartSize {
+		return fmt.Errorf("--part-size must be at least %d MiB", minPartSize>>20)
+	}
+	base, client, err := gcsClient(ctx)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s", base, url.PathEscape(bucket), url.QueryEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader("{}"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusOK || session == "" {
+		return gcsError(dest, resp)
+	}
+
+	crc := crc32.New(castagnoli)
+	buf := make([]byte, chunkSize)
+	var off int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		crc.Write(buf[:n])
+		total := "*"
+		if last {
+			total = strconv.FormatInt(off+int64(n), 10)
+		}
+		rangeHdr := fmt.Sprintf("bytes %d-%d/%s", off, off+int64(n)-1, total)
+		if n == 0 {
+			rangeHdr = "bytes */" + total
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, bytes.NewReader(buf[:n]))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Range", rangeHdr)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		if !last {
+			if resp.StatusCode != http.StatusPermanentRedirect {
+				defer resp.Body.Close()
+				return gcsError(dest, resp)
+			}
+			resp.Body.Close()
+			off += int64(n)
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			return gcsError(dest, resp)
+		}
+		var obj struct {
+			CRC32C string `json:"crc32c"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+			return fmt.Errorf("%s: %w", dest, err)
+		}
+		sum := binary.BigEndian.AppendUint32(nil, crc.Sum32())
+		if obj.CRC32C != "" && obj.CRC32C != base64.StdEncoding.EncodeToString(sum) {
+			return fmt.Errorf("%s: CRC32C mismatch, the upload is corrupt", dest)
+		}
+		return nil
+	}
+}
+
+func crc32cBase64(data []byte) string {
+	sum := binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, castagnoli))
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// gcsError turns a failed JSON API response into an error, with the
+// message from its body when there is one.
+func gcsError(name string, resp *http.Response) error {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil && body.Error.Message != "" {
+		return fmt.Errorf("%s: %s: %s", name, resp.Status, body.Error.Message)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return errors.New(name + ": " + resp.Status)
+}
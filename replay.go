@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// With --replay-window, serve and serve-grpc decrypt a file only once
+// within the window, for callers that hand out encrypted tokens as
+// one-time credentials. Files are told apart by a hash of their payload,
+// the part sealed under the file key with its nonce, so rewrapping or
+// dropping recipient stanzas does not make a copy look new. A second
+// request is refused with REPLAYED while the first is still running too.
+//
+// The record lives in memory and is lost on restart, so a token must not
+// outlive the window by more than a restart can cost; give tokens an
+// expiry of their own where that matters.
+
+var errReplayed = errors.New("already decrypted within the replay window")
+
+type replayGuard struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[[sha256.Size]byte]replaySeen
+	swept  time.Time
+}
+
+// replaySeen is when a payload was first decrypted and the key that opened
+// it, empty while that decryption is running.
+type replaySeen struct {
+	at  time.Time
+	key string
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	if window <= 0 {
+		return nil
+	}
+	return &replayGuard{window: window, seen: map[[sha256.Size]byte]replaySeen{}}
+}
+
+// replayID hashes the part of a file that stays the same however its
+// recipients are wrapped.
+func replayID(data []byte) [sha256.Size]byte {
+	switch {
+	case encutil.IsJWE(string(data)):
+		// The IV and ciphertext of header.key.iv.ciphertext.tag.
+		parts := strings.Split(strings.TrimSpace(string(data)), ".")
+		return sha256.Sum256([]byte(parts[2] + "." + parts[3]))
+	case isAge(data):
+		if i := bytes.Index(data, []byte("\n--- ")); i >= 0 {
+			if j := bytes.IndexByte(data[i+1:], '\n'); j >= 0 {
+				return sha256.Sum256(data[i+1+j+1:])
+			}
+		}
+	default:
+		if _, raw, err := encutil.ParseHeader(data); err == nil && raw != nil {
+			return sha256.Sum256(data[len(raw):])
+		}
+	}
+	return sha256.Sum256(data)
+}
+
+// claim reserves data for decryption, failing if it was decrypted within
+// the window or is being decrypted now. A nil guard allows everything.
+func (g *replayGuard) claim(data []byte) ([sha256.Size]byte, error) {
+	id := replayID(data)
+	if g == nil {
+		return id, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Sub(g.swept) > g.window/4 {
+		for k, s := range g.seen {
+			if now.Sub(s.at) > g.window {
+				delete(g.seen, k)
+			}
+		}
+		g.swept = now
+	}
+	if s, ok := g.seen[id]; ok && now.Sub(s.at) <= g.window {
+		if s.key == "" {
+			return id, fmt.Errorf("%w (still in progress)", errReplayed)
+		}
+		return id, fmt.Errorf("%w (key %s, %s ago)", errReplayed, s.key, now.Sub(s.at).Round(time.Second))
+	}
+	g.seen[id] = replaySeen{at: now}
+	return id, nil
+}
+
+// finish records the outcome of a claimed decryption. A failed one is
+// forgotten, so a request that was cut short can be sent again.
+func (g *replayGuard) finish(id [sha256.Size]byte, stanza *encutil.Stanza, data []byte, err error) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err != nil {
+		delete(g.seen, id)
+		return
+	}
+	s := g.seen[id]
+	s.key = stanzaKeyID(stanza, data)
+	g.seen[id] = s
+}
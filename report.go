@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// --report writes a record of what a decrypt or extract restored: every
+// file written, the sha256 of what was written, the encrypted source it
+// came from (with its own sha256, so the exact snapshot can be found
+// again) and the key that opened it. The report is signed with sign.key
+// like any other file, so `encutitl verify -f REPORT` checks it and the
+// pair can be attached to a ticket as is.
+
+var reportFlag = flag.String("report", "", "Write a signed JSON report of restored files to this path (signature in <path>.sig)")
+
+type restoredFile struct {
+	Path         string `json:"path"`
+	Size         int    `json:"size"`
+	SHA256       string `json:"sha256"`
+	Source       string `json:"source"`
+	SourceSHA256 string `json:"source_sha256"`
+	Key          string `json:"key"`
+}
+
+type restoreReport struct {
+	Created time.Time      `json:"created"`
+	Host    string         `json:"host"`
+	User    string         `json:"user"`
+	Command []string       `json:"command"`
+	Signer  string         `json:"signer"`
+	Files   []restoredFile `json:"files"`
+}
+
+// restoreSource is where restored files come from. Set once the encrypted
+// input has been read and opened.
+type restoreSource struct {
+	name string
+	sum  string
+	key  string
+}
+
+var restored []restoredFile
+
+func newRestoreSource(name string, sealed []byte, stanza *encutil.Stanza) restoreSource {
+	sum := sha256.Sum256(sealed)
+	if abs, err := filepath.Abs(name); err == nil && !isRemoteURL(name) {
+		name = abs
+	}
+	return restoreSource{name: name, sum: hex.EncodeToString(sum[:]), key: stanzaKeyID(stanza, sealed)}
+}
+
+// record notes one written file. Paths are made absolute so the report
+// stands on its own.
+func (src restoreSource) record(path string, data []byte) {
+	sum := sha256.Sum256(data)
+	src.recordSum(path, len(data), sum[:])
+}
+
+func (src restoreSource) recordSum(path string, size int, sum []byte) {
+	if *reportFlag == "" {
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil && !isRemoteURL(path) {
+		path = abs
+	}
+	restored = append(restored, restoredFile{
+		Path:         path,
+		Size:         size,
+		SHA256:       hex.EncodeToString(sum),
+		Source:       src.name,
+		SourceSHA256: src.sum,
+		Key:          src.key,
+	})
+}
+
+// stanzaKeyID names the key that unwrapped the file key: the stanza type
+// and its key identifying arguments. Ephemeral shares are left out, they
+// say nothing about the key.
+func stanzaKeyID(s *encutil.Stanza, sealed []byte) string {
+	switch {
+	case s == nil && encutil.IsJWE(string(sealed)):
+		return "jwe"
+	case s == nil && isAge(sealed):
+		return "age"
+	case s == nil:
+		// Legacy files are keyed by key.bin directly.
+		if key, err := readKeyFile(); err == nil && len(key) == keySize {
+			return "legacy " + encutil.KeyID(key)
+		}
+		return "legacy"
+	case (s.Type == ssh.KeyAlgoED25519 || s.Type == encutil.HybridStanza) && len(s.Args) > 0:
+		return s.Type + " " + s.Args[0]
+	case s.Type == encutil.PassphraseStanza:
+		return s.Type + " (passphrase)"
+	}
+	return strings.TrimSpace(s.Type + " " + strings.Join(s.Args, " "))
+}
+
+// writeReport writes and signs the report, if one was asked for. Called
+// once the command is done, so partial restores are reported too.
+func writeReport() error {
+	if *reportFlag == "" {
+		return nil
+	}
+	priv, err := loadOrGenerateSigningKey()
+	if err != nil {
+		return err
+	}
+	who := "unknown"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+	host, _ := os.Hostname()
+	rep := restoreReport{
+		Created: time.Now().UTC(),
+		Host:    host,
+		User:    who,
+		Command: os.Args[1:],
+		Signer:  base64.RawURLEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+		Files:   restored,
+	}
+	if rep.Files == nil {
+		rep.Files = []restoredFile{}
+	}
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := os.WriteFile(*reportFlag, data, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*reportFlag+".sig", ed25519.Sign(priv, data), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, tr("Restore report saved to: %s (%d files)")+"\n", *reportFlag, len(rep.Files))
+	return nil
+}
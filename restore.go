@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// Objects in GLACIER, DEEP_ARCHIVE or the Intelligent-Tiering archive
+// tiers have to be restored before they can be read, which takes minutes
+// to days. restore plan shows what is cold, restore initiate requests all
+// of it in one go and restore status (--wait) polls until everything can
+// be decrypted with -d -f s3://..., or with --decrypt downloads and
+// decrypts it all into a local directory once it can.
+
+type coldObject struct {
+	key      string
+	size     int64
+	class    string
+	archived bool   // Intelligent-Tiering archive tier
+	restore  string // "", "ongoing" or "available"
+	expiry   string
+}
+
+func (o coldObject) cold() bool {
+	return o.archived || o.class == string(types.StorageClassGlacier) || o.class == string(types.StorageClassDeepArchive)
+}
+
+func runRestore(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "Usage: restore plan|initiate|status [flags] s3://bucket/key-or-prefix/")
+		return
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("restore "+cmd, flag.ExitOnError)
+	tier := fs.String("tier", "Standard", "Retrieval tier: Expedited, Standard or Bulk")
+	days := fs.Int("days", 7, "Days to keep the restored copy")
+	wait := fs.Bool("wait", false, "status: poll until every object is available")
+	interval := fs.Duration("interval", 15*time.Minute, "status --wait: time between polls")
+	decrypt := fs.Bool("decrypt", false, "status: decrypt every object once all are available")
+	outDir := fs.String("o", ".", "status --decrypt: directory to write the decrypted files to")
+	fs.StringVar(proxyFlag, "proxy", "", "Proxy for S3 requests")
+	fs.Var(&identityFlags, "i", "status --decrypt: identity file used for decryption (repeatable)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		failf(exitUsage, tr("Error: restore %s needs one s3://bucket/key or s3://bucket/prefix/"), cmd)
+		return
+	}
+	if !slices.Contains(types.Tier("").Values(), types.Tier(*tier)) {
+		fail(exitUsage, tr("Error: unknown --tier"), *tier)
+		return
+	}
+
+	ctx := context.Background()
+	client, err := s3Client(ctx)
+	if err != nil {
+		fail(exitIO, tr("S3 error:"), err)
+		return
+	}
+	bucket, prefix, single, err := parseS3Location(fs.Arg(0))
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	objs, err := listColdObjects(ctx, client, bucket, prefix, single)
+	if err != nil {
+		fail(exitIO, tr("S3 error:"), err)
+		return
+	}
+
+	switch cmd {
+	case "plan":
+		printRestorePlan(objs, *tier)
+	case "initiate":
+		initiateRestores(ctx, client, bucket, objs, types.Tier(*tier), int32(*days))
+	case "status":
+		var pending, missing int
+		for {
+			pending, missing = printRestoreStatus(objs)
+			if pending == 0 || !*wait {
+				break
+			}
+			time.Sleep(*interval)
+			if objs, err = listColdObjects(ctx, client, bucket, prefix, single); err != nil {
+				fail(exitIO, tr("S3 error:"), err)
+				return
+			}
+		}
+		switch {
+		case !*decrypt:
+		case missing > 0:
+			failf(exitUsage, tr("Error: run restore initiate first, %d objects were not requested"), missing)
+		case pending > 0:
+			failf(exitUsage, tr("Error: %d objects are still being restored, use --wait"), pending)
+		default:
+			decryptRestored(ctx, bucket, prefix, single, objs, *outDir)
+		}
+	default:
+		fail(exitUsage, tr("Error: unknown restore command"), cmd)
+	}
+}
+
+// parseS3Location accepts s3://bucket/key for one object and
+// s3://bucket/prefix/ or s3://bucket for everything below it.
+func parseS3Location(s string) (bucket, prefix string, single bool, err error) {
+	if !isS3URL(s) {
+		return "", "", false, fmt.Errorf("%s: expected s3://bucket/key or s3://bucket/prefix/", s)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", false, err
+	}
+	prefix = strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" {
+		return "", "", false, fmt.Errorf("%s: missing bucket", s)
+	}
+	return u.Host, prefix, prefix != "" && !strings.HasSuffix(prefix, "/"), nil
+}
+
+func listColdObjects(ctx context.Context, client *s3.Client, bucket, prefix string, single bool) ([]coldObject, error) {
+	keys := []string{prefix}
+	if !single {
+		keys = nil
+		p := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)})
+		for p.HasMorePages() {
+			page, err := p.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, o := range page.Contents {
+				keys = append(keys, aws.ToString(o.Key))
+			}
+		}
+	}
+
+	var out []coldObject
+	for _, key := range keys {
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		o := coldObject{
+			key:      key,
+			size:     aws.ToInt64(head.ContentLength),
+			class:    string(head.StorageClass),
+			archived: head.ArchiveStatus != "",
+		}
+		if o.class == "" {
+			o.class = string(types.StorageClassStandard)
+		}
+		o.restore, o.expiry = parseRestoreHeader(aws.ToString(head.Restore))
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// parseRestoreHeader reads x-amz-restore, e.g.
+// ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+func parseRestoreHeader(h string) (state, expiry string) {
+	switch {
+	case h == "":
+		return "", ""
+	case strings.Contains(h, `ongoing-request="true"`):
+		return "ongoing", ""
+	}
+	if _, e, ok := strings.Cut(h, `expiry-date="`); ok {
+		expiry, _, _ = strings.Cut(e, `"`)
+	}
+	return "available", expiry
+}
+
+// restoreEstimate is the documented typical retrieval time per tier.
+func restoreEstimate(class, tier string) string {
+	if class == string(types.StorageClassDeepArchive) {
+		if tier == "Bulk" {
+			return "within 48 hours"
+		}
+		return "within 12 hours"
+	}
+	switch tier {
+	case "Expedited":
+		return "takes 1-5 minutes"
+	case "Bulk":
+		return "takes 5-12 hours"
+	}
+	return "takes 3-5 hours"
+}
+
+func printRestorePlan(objs []coldObject, tier string) {
+	var need, needBytes, done int
+	byClass := map[string]int{}
+	for _, o := range objs {
+		if !o.cold() {
+			continue
+		}
+		if o.restore != "" {
+			done++
+			continue
+		}
+		need++
+		needBytes += int(o.size)
+		byClass[o.class]++
+		if *a11yFlag {
+			fmt.Printf(tr("%s needs restoring, %s, %d bytes.")+"\n", o.key, o.class, o.size)
+		} else {
+			fmt.Printf("  %-14s %12d  %s\n", o.class, o.size, o.key)
+		}
+	}
+	fmt.Printf(tr("%d objects, %d need restoring (%d bytes), %d already restored or in progress")+"\n", len(objs), need, needBytes, done)
+	for class, n := range byClass {
+		fmt.Printf(tr("%s: %d objects, %s retrieval typically %s")+"\n", class, n, tier, restoreEstimate(class, tier))
+	}
+	if need > 0 {
+		fmt.Println(tr("Run restore initiate to request them."))
+	}
+}
+
+func initiateRestores(ctx context.Context, client *s3.Client, bucket string, objs []coldObject, tier types.Tier, days int32) {
+	var requested, skipped, failed int
+	for _, o := range objs {
+		if !o.cold() || o.restore != "" {
+			skipped++
+			continue
+		}
+		req := &types.RestoreRequest{GlacierJobParameters: &types.GlacierJobParameters{Tier: tier}}
+		if !o.archived {
+			// Intelligent-Tiering restores move the object back to the
+			// frequent access tier and take no expiry.
+			req.Days = aws.Int32(days)
+		}
+		_, err := client.RestoreObject(ctx, &s3.RestoreObjectInput{
+			Bucket:         aws.String(bucket),
+			Key:            aws.String(o.key),
+			RestoreRequest: req,
+		})
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress" {
+			skipped++
+			continue
+		}
+		if err != nil {
+			failf(exitIO, "  %s: %v", o.key, err)
+			failed++
+			continue
+		}
+		requested++
+	}
+	fmt.Printf(tr("Requested %d restores (%s tier), %d skipped, %d failed")+"\n", requested, tier, skipped, failed)
+}
+
+func printRestoreStatus(objs []coldObject) (pending, missing int) {
+	var available int
+	for _, o := range objs {
+		if !o.cold() {
+			continue
+		}
+		switch o.restore {
+		case "ongoing":
+			pending++
+		case "available":
+			available++
+			fmt.Printf(tr("  available until %s  %s")+"\n", o.expiry, o.key)
+		default:
+			missing++
+			fmt.Printf(tr("  not requested  %s")+"\n", o.key)
+		}
+	}
+	fmt.Printf(tr("%s: %d available, %d in progress, %d not requested")+"\n", time.Now().Format(time.RFC3339), available, pending, missing)
+	return pending, missing
+}
+
+// decryptRestored downloads and decrypts every object into dir, as -d -f
+// s3://... would one at a time.
+func decryptRestored(ctx context.Context, bucket, prefix string, single bool, objs []coldObject, dir string) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	var done, failed int
+	for _, o := range objs {
+		if !decryptRestoredObject(ctx, bucket, prefix, single, o, dir) {
+			failed++
+			continue
+		}
+		done++
+	}
+	fmt.Printf(tr("Decrypted %d objects into %s, %d failed")+"\n", done, dir, failed)
+}
+
+// decryptRestoredObject decrypts o to its key's path below prefix in dir,
+// reporting errors itself.
+func decryptRestoredObject(ctx context.Context, bucket, prefix string, single bool, o coldObject, dir string) bool {
+	rel := strings.TrimPrefix(o.key, prefix)
+	if single {
+		rel = path.Base(o.key)
+	}
+	rel = filepath.FromSlash(decryptedBase(rel))
+	if !filepath.IsLocal(rel) {
+		fail(exitIO, tr("Write error:"), fmt.Errorf("%s: refusing to write outside %s", o.key, dir))
+		return false
+	}
+	src := "s3://" + bucket + "/" + o.key
+	data, err := downloadS3(ctx, src)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), o.key+":", err)
+		return false
+	}
+	plain, err := openData(src, data)
+	defer clear(plain)
+	var ke keyError
+	switch {
+	case errors.As(err, &ke):
+		fail(exitKey, tr("Key error:"), o.key+":", ke.error)
+		return false
+	case errors.Is(err, encutil.ErrMalformed):
+		fail(exitAuth, tr("Decode input error:"), o.key+":", err)
+		return false
+	case err != nil:
+		fail(exitAuth, tr("Decryption error:"), o.key+":", err)
+		return false
+	}
+	out := filepath.Join(dir, rel)
+	err = os.MkdirAll(filepath.Dir(out), 0700)
+	if err == nil {
+		err = writeOutput(out, plain, 0600)
+	}
+	if err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return false
+	}
+	fmt.Printf("  %s -> %s\n", o.key, out)
+	return true
+}
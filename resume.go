@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// --chunk-size encrypts a local file into the chunked format (see
+// encutil/chunked.go), streaming it rather than reading it whole, which
+// is what files too large for memory need. Decrypting a chunked file from
+// a local -f streams too.
+//
+// --resume makes such a run resumable: the output is written to
+// OUT.encutitl-partial, and OUT.encutitl-resume keeps the file key and an
+// index of the SHA-256 of every chunk's plaintext, appended each time the
+// chunks written so far have been synced. Running the same command again
+// after an interruption checks that the input has the size and mtime it
+// had, that the last indexed chunk still decrypts and matches the input,
+// cuts the partial file back to it and carries on from there. Both files
+// are removed once OUT is complete. The journal is 0600, but holds the key
+// to the partial file: keep it no further from others than the input.
+
+const (
+	chunkSizeDefault = 1 << 20
+	resumeCommit     = 64 << 20 // plaintext between syncs of the index
+	partialSuffix    = ".encutitl-partial"
+	journalSuffix    = ".encutitl-resume"
+)
+
+var (
+	chunkSizeFlag sizeFlag
+	resumeFlag    = flag.Bool("resume", false, "Keep an index while encrypting with --chunk-size, and carry on from it after an interruption")
+	fecFlag       = flag.String("fec", "", "Add Reed-Solomon parity of this much of the data to each chunk, e.g. 10%, to survive damaged media")
+)
+
+func init() {
+	flag.Var(&chunkSizeFlag, "chunk-size", "Encrypt a large file in chunks of this size, e.g. 1M, streaming it instead of reading it whole")
+}
+
+// resumeMeta is the first line of a journal. Every line after it is the
+// hex SHA-256 of one chunk's plaintext.
+type resumeMeta struct {
+	Input       string    `json:"input"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	ChunkSize   int       `json:"chunk_size"`
+	FileKey     []byte    `json:"file_key"`
+	Header      []byte    `json:"header"`
+	NoncePrefix []byte    `json:"nonce_prefix"`
+	AAD         []byte    `json:"aad,omitempty"`
+}
+
+func chunkedRun() bool {
+	return chunkSizeFlag > 0 || *resumeFlag || *fecFlag != ""
+}
+
+// fecHeader turns --fec into the header's value.
+func fecHeader() (string, error) {
+	if *fecFlag == "" {
+		return "", nil
+	}
+	pct, err := strconv.Atoi(strings.TrimSuffix(*fecFlag, "%"))
+	if err != nil {
+		return "", fmt.Errorf("bad --fec %q, expected a percentage like 10%%", *fecFlag)
+	}
+	return encutil.FECPercent(pct)
+}
+
+// checkChunked refuses what a streamed encryption cannot do.
+func checkChunked() error {
+	switch {
+	case *directIOFlag && !chunkedRun():
+		return errors.New("--direct-io needs --chunk-size when encrypting")
+	case !chunkedRun():
+		return nil
+	case *fileFlag == "" || *fileFlag == "-" || isRemoteURL(*fileFlag) || *pasteFlag || *snapshotFlag != "":
+		return errors.New("--chunk-size, --resume and --fec need a local -f file")
+	case isRemoteURL(*outputFlag) || *toStdout || *copyFlag || *qrFlag != "":
+		return errors.New("--chunk-size, --resume and --fec need a local output file")
+	case *formatFlag != "encutitl":
+		return errors.New("--chunk-size, --resume and --fec need the encutitl format")
+	case *archiveFlag || *recompressFlag || *recurseFlag != "" || *inPlaceFlag:
+		return errors.New("--chunk-size, --resume and --fec cannot be combined with --archive, --recompress, -R or --in-place")
+	case *padFlag != "" || *deterministicFlag || *compressionFlag == encutil.CompressionDeflate:
+		return errors.New("chunked files cannot be padded, deterministic or compressed")
+	case *signOutput || *metadataFlag || *canaryFlag:
+		return errors.New("--chunk-size, --resume and --fec cannot be combined with --sign, --metadata or --canary")
+	case chunkSizeFlag > 0 && (chunkSizeFlag < encutil.MinChunkSize || chunkSizeFlag > encutil.MaxChunkSize):
+		return fmt.Errorf("--chunk-size must be between %s and %s", formatBytes(encutil.MinChunkSize), formatBytes(encutil.MaxChunkSize))
+	}
+	_, err := fecHeader()
+	return err
+}
+
+// encryptChunked encrypts -f in chunks, resuming an interrupted run with
+// --resume.
+func encryptChunked() {
+	in := *fileFlag
+	out := *outputFlag
+	if out == "" {
+		out = encryptedName(in)
+	}
+	src, err := os.Open(in)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("%s is not a regular file", in)
+	}
+	if err == nil {
+		err = checkInputSize(info.Size())
+	}
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	startJob(jobBytes, info.Size(), "--resume")
+
+	var st *encutil.ChunkState
+	var dst, journal *os.File
+	if *resumeFlag {
+		st, dst, journal, err = resumeChunked(src, info, out)
+		if err != nil {
+			fail(exitIO, tr("Resume error:"), err)
+			return
+		}
+		if journal != nil {
+			defer journal.Close()
+		}
+	}
+	var recipients []encutil.Recipient
+	if st == nil {
+		if recipients, err = encryptRecipients(); err != nil {
+			fail(exitKey, tr("Key error:"), err)
+			return
+		}
+		os.Remove(out + journalSuffix) // left by a run without --resume
+		if dst, err = os.OpenFile(out+partialSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+	}
+	defer dst.Close()
+
+	var r io.Reader = src
+	var w syncWriter = dst
+	if *directIOFlag {
+		if r, err = newUncachedReader(src); err == nil {
+			w, err = newUncachedWriter(dst)
+		}
+		if err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+	}
+	var cw *encutil.ChunkWriter
+	if st != nil {
+		cw, err = encutil.ResumeChunkWriter(w, *st)
+	} else {
+		size := int(chunkSizeFlag)
+		if size == 0 {
+			size = chunkSizeDefault
+		}
+		fec, _ := fecHeader() // checked before
+		if cw, err = encutil.NewChunkWriter(w, size, encutil.EncryptOptions{Compression: encutil.CompressionNone, AAD: aadData, FEC: fec, Sensitive: *sensitiveFlag}, recipients...); err == nil && *resumeFlag {
+			journal, err = createJournal(out, in, info, cw.State())
+			if journal != nil {
+				defer journal.Close()
+			}
+		}
+	}
+	if err != nil {
+		fail(exitError, tr("Encryption error:"), err)
+		return
+	}
+
+	if off, err := src.Seek(0, io.SeekCurrent); err == nil {
+		jobProgressAt(off) // where a resumed run starts
+	}
+	if err := copyChunks(cw, jobReader(r), w, journal); err != nil {
+		fail(exitIO, tr("Encryption error:"), err)
+		return
+	}
+	if err := flushUncached(w); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	level := durability()
+	if err = syncDurable(dst, level); err == nil {
+		err = dst.Close()
+	}
+	if err == nil {
+		err = renameDurable(out+partialSuffix, out, level)
+	}
+	if err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	if journal != nil {
+		os.Remove(out + journalSuffix)
+	}
+	fmt.Println(tr("Encrypted file saved to:"), out)
+}
+
+// copyChunks feeds the rest of src to cw a chunk at a time. With a
+// journal, the chunks are synced to dst and indexed every resumeCommit
+// bytes, so a later --resume only repeats what came after.
+func copyChunks(cw *encutil.ChunkWriter, src io.Reader, dst syncWriter, journal *os.File) error {
+	st := cw.State()
+	buf := make([]byte, st.ChunkSize)
+	every := uint32(max(resumeCommit/st.ChunkSize, 1))
+	var sums []string // chunks read but not yet indexed, from st.Chunks on
+	indexed := st.Chunks
+	for {
+		n, err := io.ReadFull(src, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if _, err := cw.Write(buf[:n]); err != nil {
+			return err
+		}
+		if n < len(buf) {
+			break
+		}
+		if journal == nil {
+			continue
+		}
+		sum := sha256.Sum256(buf[:n])
+		sums = append(sums, hex.EncodeToString(sum[:]))
+		// The chunk just written stays buffered until the next one
+		// shows it was not the last, so only those before it are sealed.
+		if sealed := cw.State().Chunks; sealed-indexed >= every {
+			if err := dst.Sync(); err != nil {
+				return err
+			}
+			k := sealed - indexed
+			if _, err := io.WriteString(journal, strings.Join(sums[:k], "\n")+"\n"); err != nil {
+				return err
+			}
+			if err := journal.Sync(); err != nil {
+				return err
+			}
+			sums, indexed = sums[k:], sealed
+		}
+	}
+	return cw.Close()
+}
+
+func createJournal(out, in string, info os.FileInfo, st encutil.ChunkState) (*os.File, error) {
+	meta, err := json.Marshal(resumeMeta{
+		Input: in, Size: info.Size(), ModTime: info.ModTime(), ChunkSize: st.ChunkSize,
+		FileKey: st.FileKey, Header: st.Header, NoncePrefix: st.NoncePrefix, AAD: st.AAD,
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(out+journalSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(append(meta, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// resumeChunked picks up the run recorded in out's journal, returning its
+// state with the partial output and the input positioned after the last
+// indexed chunk. Without a journal it returns a nil state, for a fresh
+// start.
+func resumeChunked(src *os.File, info os.FileInfo, out string) (*encutil.ChunkState, *os.File, *os.File, error) {
+	data, err := os.ReadFile(out + journalSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	// The last line is empty, or one cut short by the interruption.
+	lines = lines[:len(lines)-1]
+	var meta resumeMeta
+	if len(lines) == 0 || json.Unmarshal([]byte(lines[0]), &meta) != nil {
+		return nil, nil, nil, fmt.Errorf("%s is damaged, remove it and %s to start over", out+journalSuffix, out+partialSuffix)
+	}
+	sums := lines[1:]
+	switch {
+	case meta.Size != info.Size() || !meta.ModTime.Equal(info.ModTime()):
+		return nil, nil, nil, fmt.Errorf("%s changed since the interrupted run, remove %s to start over", src.Name(), out+journalSuffix)
+	case chunkSizeFlag > 0 && int(chunkSizeFlag) != meta.ChunkSize:
+		return nil, nil, nil, fmt.Errorf("the interrupted run used --chunk-size %s", formatBytes(int64(meta.ChunkSize)))
+	case !bytes.Equal(meta.AAD, aadData):
+		return nil, nil, nil, errors.New("the interrupted run used different --aad")
+	}
+	hdr, _, err := encutil.ParseHeader(meta.Header)
+	if err != nil || hdr == nil {
+		return nil, nil, nil, fmt.Errorf("%s is damaged, remove it and %s to start over", out+journalSuffix, out+partialSuffix)
+	}
+	if fec, _ := fecHeader(); *fecFlag != "" && fec != hdr.FEC {
+		return nil, nil, nil, errors.New("the interrupted run used a different --fec")
+	}
+	st := encutil.ChunkState{
+		FileKey: meta.FileKey, Header: meta.Header, NoncePrefix: meta.NoncePrefix, AAD: meta.AAD,
+		ChunkSize: meta.ChunkSize, FEC: hdr.FEC, Chunks: uint32(len(sums)),
+	}
+
+	dst, err := os.OpenFile(out+partialSuffix, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkPartial(dst, src, st, sums); err != nil {
+		dst.Close()
+		return nil, nil, nil, err
+	}
+	err = dst.Truncate(st.Offset())
+	if err == nil {
+		_, err = dst.Seek(st.Offset(), io.SeekStart)
+	}
+	if err == nil {
+		_, err = src.Seek(int64(st.Chunks)*int64(st.ChunkSize), io.SeekStart)
+	}
+	var journal *os.File
+	if err == nil {
+		// Drop a line cut short, then append after the rest.
+		keep := len(strings.Join(lines, "\n")) + 1
+		journal, err = os.OpenFile(out+journalSuffix, os.O_WRONLY, 0)
+		if err == nil {
+			err = journal.Truncate(int64(keep))
+		}
+		if err == nil {
+			_, err = journal.Seek(int64(keep), io.SeekStart)
+		}
+	}
+	if err != nil {
+		dst.Close()
+		if journal != nil {
+			journal.Close()
+		}
+		return nil, nil, nil, err
+	}
+	fmt.Fprintf(os.Stderr, tr("Resuming %s after %s")+"\n", src.Name(), formatBytes(int64(st.Chunks)*int64(st.ChunkSize)))
+	return &st, dst, journal, nil
+}
+
+// checkPartial checks that the partial file starts with the journal's
+// header and that its last indexed chunk decrypts to what the input holds
+// there. The chunks before it were synced before being indexed.
+func checkPartial(dst, src *os.File, st encutil.ChunkState, sums []string) error {
+	info, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < st.Offset() {
+		return fmt.Errorf("%s is shorter than its index, remove it and the journal to start over", dst.Name())
+	}
+	start := make([]byte, len(st.Header)+len(st.NoncePrefix))
+	if _, err := dst.ReadAt(start, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(start, append(st.Header[:len(st.Header):len(st.Header)], st.NoncePrefix...)) {
+		return fmt.Errorf("%s does not belong to its journal", dst.Name())
+	}
+	if st.Chunks == 0 {
+		return nil
+	}
+	last := st.Chunks - 1
+	stored := make([]byte, st.StoredChunkSize())
+	if _, err := dst.ReadAt(stored, st.Offset()-int64(len(stored))); err != nil {
+		return err
+	}
+	plain, err := st.OpenChunk(last, stored)
+	if err != nil {
+		return fmt.Errorf("%s: chunk %d does not decrypt: %w", dst.Name(), last, err)
+	}
+	input := make([]byte, st.ChunkSize)
+	if _, err := src.ReadAt(input, int64(last)*int64(st.ChunkSize)); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(plain)
+	if hex.EncodeToString(sum[:]) != sums[last] || !bytes.Equal(plain, input) {
+		return fmt.Errorf("chunk %d no longer matches %s, remove the journal to start over", last, src.Name())
+	}
+	return nil
+}
+
+// isChunkedFile reports whether path is a local chunked file, which -d
+// streams.
+func isChunkedFile(path string) bool {
+	if path == "" || path == "-" || isRemoteURL(path) {
+		return false
+	}
+	prefix, err := readHeaderPrefix(path)
+	if err != nil {
+		return false
+	}
+	hdr, _, err := encutil.ParseHeader(prefix)
+	return err == nil && hdr != nil && hdr.ChunkSize > 0
+}
+
+// readHeaderPrefix reads the raw encutitl header at the start of path.
+func readHeaderPrefix(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	start, err := r.Peek(len(encutil.Magic) + 5)
+	if err != nil || !encutil.IsEncutitl(start) {
+		return nil, errors.New("not an encutitl file")
+	}
+	n := binary.BigEndian.Uint32(start[len(encutil.Magic)+1:])
+	if n > 1<<20 {
+		return nil, fmt.Errorf("%w: header claims %d bytes", encutil.ErrMalformed, n)
+	}
+	prefix := make([]byte, len(start)+int(n))
+	_, err = io.ReadFull(r, prefix)
+	return prefix, err
+}
+
+// decryptChunked streams a chunked -f file to stdout or its output file.
+func decryptChunked(path string) {
+	if err := checkInputFile(path); err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		startJob(jobBytes, info.Size())
+	}
+	prefix, err := readHeaderPrefix(path)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	if _, _, err := encutil.ParseHeader(prefix); err != nil {
+		fail(exitAuth, tr("Decode input error:"), err)
+		return
+	}
+	if err := checkReason(path, prefix); err != nil {
+		fail(exitUsage, tr("Error:"), fmt.Errorf("%s: %w", path, err))
+		return
+	}
+	identities, key, err := decryptIdentities(prefix)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	opts := encutil.DecryptOptions{LegacyKey: key, MaxSize: int64(maxOutputSize), AAD: aadData, OnRepair: reportRepair, OnCanary: raiseCanary}
+	decrypt := func(w io.Writer) (int64, restoreSource, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, restoreSource{}, err
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if *directIOFlag {
+			if r, err = newUncachedReader(f); err != nil {
+				return 0, restoreSource{}, err
+			}
+		}
+		h := sha256.New()
+		n, stanza, err := encutil.DecryptStream(w, io.TeeReader(jobReader(r), h), opts, identities...)
+		src := newRestoreSource(path, prefix, stanza)
+		src.sum = hex.EncodeToString(h.Sum(nil))
+		return n, src, err
+	}
+	if *toStdout {
+		if _, _, err := decrypt(os.Stdout); err != nil {
+			fail(exitAuth, tr("Decryption error:"), err)
+		}
+		return
+	}
+	out := decryptedName(path)
+	if *inPlaceFlag {
+		out = path
+	}
+	decryptIntoFile(out, decrypt)
+}
+
+// reportRepair warns that --fec parity was needed: the file decrypted,
+// but its medium is failing.
+func reportRepair(chunk uint32, damaged int) {
+	fmt.Fprintf(os.Stderr, tr("Warning: chunk %d was damaged (%d shards) and repaired from its parity, copy the file to new media")+"\n", chunk, damaged)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A revocation list names recipient keys that must no longer be encrypted
+// to, say a team member's key after their laptop was stolen. It is a JSON
+// file signed with an encutitl signing key; whoever administers the team
+// keeps it with `revocations add/remove` and publishes it, and everyone
+// points --revocations at it (a file or an https URL, usually from a
+// profile) with the administrator's sign.pub as --revocations-pub.
+//
+// Every public key --recipient expands to is looked up, however it was
+// given (a key, a file, github:user), and a revoked one fails the run, or
+// only prints a warning with --revoked warn. A list that does not verify
+// fails the run either way. A fetched list is cached, and used with a
+// warning while the URL is unreachable; a list older than the cached one
+// is refused, so an old copy cannot be replayed to unrevoke a key.
+
+const (
+	revocationsFile      = "revocations.json"
+	revocationsCacheFile = "revocations-cache.json"
+)
+
+var (
+	revocationsFlag    = flag.String("revocations", "", "Signed revocation list, a file or https URL (default revocations.json in the config dir, if there is one)")
+	revocationsPubFlag = flag.String("revocations-pub", "", "Public key the revocation list must be signed with (default sign.pub in the config directory)")
+	revokedFlag        = flag.String("revoked", "refuse", "What to do when a recipient is on the revocation list: refuse or warn")
+)
+
+type revocationList struct {
+	Issued    time.Time    `json:"issued"`
+	Revoked   []revocation `json:"revoked"`
+	Signer    []byte       `json:"signer"`
+	Signature []byte       `json:"signature,omitempty"`
+}
+
+type revocation struct {
+	Key     string    `json:"key"`
+	Reason  string    `json:"reason,omitempty"`
+	Revoked time.Time `json:"revoked"`
+}
+
+// signedBytes is what the signature covers: the list without it.
+func (l revocationList) signedBytes() ([]byte, error) {
+	l.Signature = nil
+	return json.Marshal(l)
+}
+
+func (l *revocationList) verify(pub ed25519.PublicKey) error {
+	if !bytes.Equal(pub, l.Signer) {
+		return errors.New("revocation list is signed by a different key")
+	}
+	msg, err := l.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, msg, l.Signature) {
+		return errors.New("revocation list signature INVALID")
+	}
+	return nil
+}
+
+func (l *revocationList) find(key string) *revocation {
+	for i := range l.Revoked {
+		if l.Revoked[i].Key == key {
+			return &l.Revoked[i]
+		}
+	}
+	return nil
+}
+
+// revocationKey is how a public key line is listed: type and key for SSH
+// keys, without options and comment and the certified key for
+// certificates, and the key itself for the others.
+func revocationKey(line string) string {
+	if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			pub = cert.Key
+		}
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// revokedKeyName is a short name for a listed key.
+func revokedKeyName(key string) string {
+	if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err == nil {
+		return ssh.FingerprintSHA256(pub)
+	}
+	if len(key) > 24 {
+		return key[:12] + "..." + keyFingerprint([]byte(key))[7:19]
+	}
+	return key
+}
+
+var (
+	revocations       *revocationList
+	revocationsLoaded bool
+)
+
+// checkRevoked fails for a recipient key on the revocation list, or warns
+// with --revoked warn.
+func checkRevoked(line string) error {
+	if !revocationsLoaded {
+		l, err := loadRevocations()
+		if err != nil {
+			return err
+		}
+		revocations, revocationsLoaded = l, true
+	}
+	if revocations == nil {
+		return nil
+	}
+	r := revocations.find(revocationKey(line))
+	if r == nil {
+		return nil
+	}
+	msg := fmt.Sprintf("recipient %s was revoked on %s", revokedKeyName(r.Key), r.Revoked.Format(time.DateOnly))
+	if r.Reason != "" {
+		msg += " (" + r.Reason + ")"
+	}
+	if *revokedFlag == "warn" {
+		fmt.Fprintln(os.Stderr, tr("Warning:"), msg)
+		return nil
+	}
+	return errors.New(msg)
+}
+
+// revocationsPub is the public key revocation lists are checked with.
+func revocationsPub() string {
+	if *revocationsPubFlag != "" {
+		return *revocationsPubFlag
+	}
+	return signPubPath()
+}
+
+// loadRevocations returns the verified list, or nil when none is
+// configured.
+func loadRevocations() (*revocationList, error) {
+	if *revokedFlag != "refuse" && *revokedFlag != "warn" {
+		return nil, fmt.Errorf("--revoked must be refuse or warn, not %q", *revokedFlag)
+	}
+	src := *revocationsFlag
+	if src == "" {
+		dir, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		src = filepath.Join(dir, revocationsFile)
+		if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	}
+	pub, err := readPublicKey(revocationsPub())
+	if err != nil {
+		return nil, fmt.Errorf("revocation list signer: %w", err)
+	}
+	if strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://") {
+		return fetchRevocations(src, pub)
+	}
+	l, err := readRevocations(src)
+	if err == nil {
+		err = l.verify(pub)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	return l, nil
+}
+
+func readRevocations(path string) (*revocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := new(revocationList)
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// fetchRevocations downloads the list, falling back to the cached copy
+// when that fails.
+func fetchRevocations(url string, pub ed25519.PublicKey) (*revocationList, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	cachePath := filepath.Join(dir, revocationsCacheFile)
+	cached, err := readRevocations(cachePath)
+	if err == nil && cached.verify(pub) != nil {
+		cached = nil // signed by a key no longer configured
+	}
+
+	l, err := downloadRevocations(url)
+	if err == nil {
+		err = l.verify(pub)
+	}
+	if err != nil {
+		if cached == nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+		fmt.Fprintf(os.Stderr, tr("Warning: %s: %v, using the cached revocation list of %s")+"\n", url, err, cached.Issued.Format(time.DateTime))
+		return cached, nil
+	}
+	if cached != nil && l.Issued.Before(cached.Issued) {
+		return nil, fmt.Errorf("%s: revocation list issued %s is older than the cached one of %s", url, l.Issued.Format(time.DateTime), cached.Issued.Format(time.DateTime))
+	}
+	if data, err := json.Marshal(l); err == nil {
+		os.WriteFile(cachePath, data, 0600) // best effort, the list is verified either way
+	}
+	return l, nil
+}
+
+func downloadRevocations(url string) (*revocationList, error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	l := new(revocationList)
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func runRevocations(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "Usage: revocations add|remove|list [flags]")
+		return
+	}
+	switch args[0] {
+	case "add", "remove":
+		runRevocationsEdit(args[0], args[1:])
+	case "list":
+		runRevocationsList(args[1:])
+	default:
+		fail(exitUsage, tr("Error: unknown revocations command"), args[0])
+	}
+}
+
+// runRevocationsEdit adds or removes keys and signs the list again with
+// sign.key. An existing list has to be signed by that key already.
+func runRevocationsEdit(cmd string, args []string) {
+	fs := flag.NewFlagSet("revocations "+cmd, flag.ExitOnError)
+	path := fs.String("l", revocationsFile, "Revocation list to change, published from there")
+	reason := fs.String("reason", "", "Why the keys are revoked")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		failf(exitUsage, "Usage: revocations %s [-l FILE] [--reason TEXT] KEY...", cmd)
+		return
+	}
+	priv, err := loadOrGenerateSigningKey()
+	if err != nil {
+		fail(exitKey, tr("Signing key error:"), err)
+		return
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	l, err := readRevocations(*path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		l, err = &revocationList{}, nil
+	case err == nil:
+		err = l.verify(pub)
+	}
+	if err != nil {
+		fail(exitAuth, tr("Revocation list error:"), fmt.Errorf("%s: %w", *path, err))
+		return
+	}
+
+	var keys []string
+	for _, spec := range fs.Args() {
+		lines, err := expandRecipientSpec(spec)
+		if err != nil {
+			fail(exitKey, tr("Key error:"), err)
+			return
+		}
+		for _, line := range lines {
+			keys = append(keys, revocationKey(line))
+		}
+	}
+	now := time.Now().UTC()
+	for _, key := range keys {
+		if cmd == "add" {
+			if l.find(key) == nil {
+				l.Revoked = append(l.Revoked, revocation{Key: key, Reason: *reason, Revoked: now})
+				fmt.Println(tr("Revoked"), revokedKeyName(key))
+			}
+			continue
+		}
+		kept := l.Revoked[:0]
+		for _, r := range l.Revoked {
+			if r.Key != key {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) < len(l.Revoked) {
+			fmt.Println(tr("Reinstated"), revokedKeyName(key))
+		}
+		l.Revoked = kept
+	}
+
+	l.Issued, l.Signer = now, pub
+	msg, err := l.signedBytes()
+	if err != nil {
+		fail(exitError, tr("Error:"), err)
+		return
+	}
+	l.Signature = ed25519.Sign(priv, msg)
+	out, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		fail(exitError, tr("Error:"), err)
+		return
+	}
+	out = append(out, '\n')
+	if _, err := os.Stat(*path); err == nil {
+		err = replaceFile(*path, out)
+	} else {
+		err = os.WriteFile(*path, out, 0644)
+	}
+	if err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Println(tr("Revocation list saved to:"), *path)
+}
+
+func runRevocationsList(args []string) {
+	fs := flag.NewFlagSet("revocations list", flag.ExitOnError)
+	fs.StringVar(revocationsFlag, "l", "", "Revocation list, a file or https URL (default as for encryption)")
+	fs.StringVar(revocationsPubFlag, "pub", "", "Public key the list must be signed with (default sign.pub in the config directory)")
+	addLangFlag(fs)
+	fs.Parse(args)
+	l, err := loadRevocations()
+	if err != nil {
+		fail(exitAuth, tr("Revocation list error:"), err)
+		return
+	}
+	if l == nil {
+		fmt.Println(tr("No revocation list"))
+		return
+	}
+	fmt.Println(tr("Issued:"), l.Issued.Format(time.DateTime), "UTC")
+	for _, r := range l.Revoked {
+		line := fmt.Sprintf("%s  %s", r.Revoked.Format(time.DateOnly), revokedKeyName(r.Key))
+		if r.Reason != "" {
+			line += "  " + r.Reason
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Outputs given as s3://bucket/key are uploaded directly. Anything larger
+// than one part goes through a multipart upload with --upload-concurrency
+// parts in flight; every part carries a SHA-256 checksum that S3 verifies
+// on receipt and again when the upload is completed. Credentials, region
+// and endpoint (AWS_ENDPOINT_URL_S3 for MinIO and friends) come from the
+// standard SDK chain.
+
+const (
+	minPartSize = 5 << 20 // S3 minimum for all but the last part
+	maxParts    = 10000   // S3 maximum parts per upload
+)
+
+var (
+	partSizeMiB       = flag.Int("part-size", 16, "Multipart upload part size in MiB for s3:// and gs:// outputs")
+	uploadConcurrency = flag.Int("upload-concurrency", 4, "Parts uploaded in parallel for s3:// outputs")
+	storageClass      = flag.String("storage-class", "", "Storage class for s3:// outputs, e.g. STANDARD_IA, GLACIER_IR, DEEP_ARCHIVE")
+	objectLockMode    = flag.String("object-lock", "", "Object lock mode for s3:// outputs: governance or compliance (needs --retain)")
+	retainFlag        = flag.String("retain", "", "Object lock retention: a duration like 90d or 1y, or an RFC 3339 date")
+	legalHold         = flag.Bool("legal-hold", false, "Place a legal hold on s3:// outputs")
+)
+
+// objectOptions are the per-upload settings that make backups immutable
+// (object lock, legal hold) and pick their price tier (storage class).
+// Object lock only works on buckets created with it enabled.
+type objectOptions struct {
+	storageClass types.StorageClass
+	lockMode     types.ObjectLockMode
+	retainUntil  *time.Time
+	legalHold    types.ObjectLockLegalHoldStatus
+}
+
+func objectOptionsFromFlags(now time.Time) (*objectOptions, error) {
+	o := &objectOptions{storageClass: types.StorageClass(strings.ToUpper(*storageClass))}
+	if o.storageClass != "" && !slices.Contains(o.storageClass.Values(), o.storageClass) {
+		return nil, fmt.Errorf("unknown --storage-class %q", *storageClass)
+	}
+	switch strings.ToLower(*objectLockMode) {
+	case "":
+		if *retainFlag != "" {
+			return nil, errors.New("--retain needs --object-lock governance|compliance")
+		}
+	case "governance", "compliance":
+		o.lockMode = types.ObjectLockMode(strings.ToUpper(*objectLockMode))
+		if *retainFlag == "" {
+			return nil, errors.New("--object-lock needs --retain")
+		}
+		until, err := parseRetention(*retainFlag, now)
+		if err != nil {
+			return nil, err
+		}
+		o.retainUntil = &until
+	default:
+		return nil, fmt.Errorf("unknown --object-lock mode %q", *objectLockMode)
+	}
+	if *legalHold {
+		o.legalHold = types.ObjectLockLegalHoldStatusOn
+	}
+	return o, nil
+}
+
+// parseRetention accepts an absolute RFC 3339 time or date, or a duration
+// counted from now in days (d), years (y) or anything time.ParseDuration
+// understands.
+func parseRetention(s string, now time.Time) (time.Time, error) {
+	var until time.Time
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		until = t
+	} else if t, err := time.Parse("2006-01-02", s); err == nil {
+		until = t
+	} else if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") {
+		until = now.AddDate(0, 0, n)
+	} else if n, err := strconv.Atoi(strings.TrimSuffix(s, "y")); err == nil && strings.HasSuffix(s, "y") {
+		until = now.AddDate(n, 0, 0)
+	} else if d, err := time.ParseDuration(s); err == nil {
+		until = now.Add(d)
+	} else {
+		return time.Time{}, fmt.Errorf("bad --retain %q", s)
+	}
+	if !until.After(now) {
+		return time.Time{}, fmt.Errorf("--retain %q is not in the future", s)
+	}
+	return until, nil
+}
+
+func isS3URL(s string) bool {
+	return strings.HasPrefix(s, "s3://")
+}
+
+func parseS3URL(s string) (bucket, key string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	bucket, key = u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return "", "", fmt.Errorf("%s: expected s3://bucket/key", s)
+	}
+	return bucket, key, nil
+}
+
+func s3Client(ctx context.Context) (*s3.Client, error) {
+	if _, err := proxyURL(); err != nil {
+		return nil, err
+	}
+	hc := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		configureTransport(tr)
+	})
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithHTTPClient(hc))
+	if err != nil {
+		return nil, err
+	}
+	customEndpoint := os.Getenv("AWS_ENDPOINT_URL_S3") != "" || os.Getenv("AWS_ENDPOINT_URL") != ""
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = customEndpoint
+		o.DisableLogOutputChecksumValidationSkipped = true
+	}), nil
+}
+
+func uploadS3(ctx context.Context, dest string, r io.Reader) error {
+	bucket, key, err := parseS3URL(dest)
+	if err != nil {
+		return err
+	}
+	partSize := int64(*partSizeMiB) << 20
+	if partSize < minPartSize {
+		return fmt.Errorf("--part-size must be at least %d MiB", minPartSize>>20)
+	}
+	if *uploadConcurrency < 1 {
+		return errors.New("--upload-concurrency must be at least 1")
+	}
+	if size := readerSize(r); size > partSize*maxParts {
+		// Grow the parts to fit, in whole MiB.
+		partSize = ((size+maxParts-1)/maxParts + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	opts, err := objectOptionsFromFlags(time.Now())
+	if err != nil {
+		return err
+	}
+	client, err := s3Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	first := make([]byte, partSize)
+	n, err := io.ReadFull(r, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Fits in one part, a plain PUT is enough.
+		_, err = client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			Body:              bytes.NewReader(first[:n]),
+			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			ChecksumSHA256:    aws.String(sha256Base64(first[:n])),
+
+			StorageClass:              opts.storageClass,
+			ObjectLockMode:            opts.lockMode,
+			ObjectLockRetainUntilDate: opts.retainUntil,
+			ObjectLockLegalHoldStatus: opts.legalHold,
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	created, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+
+		StorageClass:              opts.storageClass,
+		ObjectLockMode:            opts.lockMode,
+		ObjectLockRetainUntilDate: opts.retainUntil,
+		ObjectLockLegalHoldStatus: opts.legalHold,
+	})
+	if err != nil {
+		return err
+	}
+	up := &s3.UploadPartInput{Bucket: aws.String(bucket), Key: aws.String(key), UploadId: created.UploadId}
+	parts, err := uploadParts(ctx, client, up, io.MultiReader(bytes.NewReader(first), r), partSize)
+	if err != nil {
+		client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   up.Bucket,
+			Key:      up.Key,
+			UploadId: up.UploadId,
+		})
+		return err
+	}
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          up.Bucket,
+		Key:             up.Key,
+		UploadId:        up.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// uploadParts reads r in partSize pieces and uploads them with a bounded
+// number of workers, so memory use stays at concurrency * partSize.
+func uploadParts(ctx context.Context, client *s3.Client, up *s3.UploadPartInput, r io.Reader, partSize int64) ([]types.CompletedPart, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		num  int32
+		data []byte
+	}
+	jobs := make(chan job)
+	var (
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	for i := 0; i < *uploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sum := sha256Base64(j.data)
+				out, err := client.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:            up.Bucket,
+					Key:               up.Key,
+					UploadId:          up.UploadId,
+					PartNumber:        aws.Int32(j.num),
+					Body:              bytes.NewReader(j.data),
+					ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+					ChecksumSHA256:    aws.String(sum),
+				})
+				if err != nil {
+					fail(fmt.Errorf("part %d: %w", j.num, err))
+					continue
+				}
+				mu.Lock()
+				parts = append(parts, types.CompletedPart{
+					ETag:           out.ETag,
+					PartNumber:     aws.Int32(j.num),
+					ChecksumSHA256: aws.String(sum),
+				})
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var readErr error
+	for num := int32(1); ctx.Err() == nil; num++ {
+		buf := make([]byte, partSize)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && num > maxParts {
+			readErr = fmt.Errorf("upload is over %d parts of %d MiB, raise --part-size", maxParts, partSize>>20)
+			break
+		}
+		if n > 0 {
+			select {
+			case jobs <- job{num: num, data: buf[:n]}:
+			case <-ctx.Done():
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if readErr != nil {
+		return nil, readErr
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	return parts, nil
+}
+
+// readerSize is how much r holds if it can tell, else -1.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+// downloadS3 reads a whole object, up to --max-input-size. Objects still in an archive tier are
+// reported with a pointer to restore instead of the bare API error.
+func downloadS3(ctx context.Context, src string) ([]byte, error) {
+	bucket, key, err := parseS3URL(src)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	var cold *types.InvalidObjectState
+	if errors.As(err, &cold) {
+		return nil, fmt.Errorf("%s is in %s, run restore plan/initiate first", src, cold.StorageClass)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return readLimited(out.Body)
+}
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// Once flags are parsed, a local encrypt or decrypt confines itself to
+// what that run needs: Landlock and seccomp on Linux, unveil and pledge
+// on OpenBSD. Files can be read only under the paths the flags name plus
+// the system directories the runtime touches, and written only where the
+// outputs, keys and config live. No programs can be run but the --isolate
+// worker, and the network is off unless a recipient, revocation list, key
+// directory, canary webhook or backend needs it. A parser bug exploited
+// by a malicious ciphertext is then stuck inside that box. Runs that
+// shell out or talk to S3, Vault or a PKCS#11 module are left unconfined.
+
+var sandboxFlag = flag.String("sandbox", "auto", "Confine local encrypt/decrypt runs: auto (where supported), require (fail if not possible) or off")
+
+var errSandboxUnsupported = errors.New("not supported on this platform")
+
+type sandboxPolicy struct {
+	read    []string // read only, files or directories
+	write   []string // read and write, directories
+	exec    []string // programs that may be run
+	network bool
+}
+
+// enterSandbox applies the sandbox for the main encrypt/decrypt flow.
+func enterSandbox() error {
+	switch *sandboxFlag {
+	case "off":
+		return nil
+	case "auto", "require":
+	default:
+		return fmt.Errorf("unknown --sandbox %q", *sandboxFlag)
+	}
+	p, why := mainSandboxPolicy()
+	if p == nil {
+		if *sandboxFlag == "require" {
+			return fmt.Errorf("--sandbox require: %s", why)
+		}
+		return nil
+	}
+	err := applySandbox(p)
+	if err != nil && *sandboxFlag == "require" {
+		return fmt.Errorf("--sandbox require: %w", err)
+	}
+	return nil
+}
+
+// mainSandboxPolicy works out the paths this run touches from its flags,
+// or returns nil and the reason it cannot be confined.
+func mainSandboxPolicy() (*sandboxPolicy, string) {
+	switch {
+	case isRemoteURL(*fileFlag) || isRemoteURL(*outputFlag):
+		return nil, "remote input or output"
+	case *keyBackend != "local":
+		return nil, "--key-backend " + *keyBackend
+	case *snapshotFlag != "":
+		return nil, "--snapshot runs external tools"
+	case *copyFlag || *pasteFlag:
+		return nil, "--copy and --paste run the clipboard tools"
+	}
+	p := &sandboxPolicy{}
+	for _, spec := range recipientFlags {
+		if strings.HasPrefix(spec, "github:") || isDirectoryAddress(spec) {
+			p.network = true
+		} else if !strings.HasPrefix(spec, "ssh-") && !strings.HasPrefix(spec, "age1") && !encutil.IsHybridRecipient(spec) {
+			p.read = append(p.read, expandHome(spec))
+			// Keys with proofs not verified yet need fetching them.
+			if data, err := os.ReadFile(expandHome(spec)); err == nil && bytes.Contains(data, []byte("proof=")) {
+				p.network = true
+			}
+		} else if strings.Contains(spec, "proof=") {
+			p.network = true
+		}
+	}
+	p.read = append(p.read, metaRecipients...)
+	if strings.HasPrefix(*revocationsFlag, "https://") || strings.HasPrefix(*revocationsFlag, "http://") {
+		p.network = true
+	} else if *revocationsFlag != "" {
+		p.read = append(p.read, *revocationsFlag)
+	}
+	p.read = append(p.read, revocationsPub())
+	p.network = p.network || *keyDirectoryFlag != ""
+	// A decoy's own webhook is only known once it has decrypted, too
+	// late to allow the network; a confined run reaches --canary-webhook
+	// and otherwise only logs the alert.
+	p.network = p.network || *decrypt && *canaryWebhook != ""
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err.Error()
+	}
+	// key.bin, sign.key and relative outputs.
+	p.write = append(p.write, cwd, os.TempDir())
+	if dir, err := configDir(); err == nil {
+		p.write = append(p.write, dir)
+	}
+	for _, in := range []string{*fileFlag, *recurseFlag} {
+		if in != "" {
+			// Outputs default to next to the input.
+			p.write = append(p.write, filepath.Dir(filepath.Clean(in)))
+		}
+	}
+	for _, out := range []string{*outputFlag, *reportFlag} {
+		if out != "" {
+			p.write = append(p.write, filepath.Dir(filepath.Clean(out)))
+		}
+	}
+	if *outputFlag != "" {
+		p.write = append(p.write, *outputFlag) // -R and --archive output directories
+	}
+	if ids, err := identityFiles(); err == nil {
+		p.read = append(p.read, ids...)
+	}
+	if *isolateFlag {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err.Error()
+		}
+		p.exec = append(p.exec, exe)
+	}
+	if strings.HasPrefix(*aadFlag, "@") {
+		p.read = append(p.read, strings.TrimPrefix(*aadFlag, "@"))
+	}
+	if *passphraseFile != "" {
+		p.read = append(p.read, *passphraseFile)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		p.read = append(p.read, filepath.Join(home, ".ssh"))
+	}
+	// Terminals, TPM, resolver and CA files, time zones, and NSS modules
+	// user lookups may load.
+	p.write = append(p.write, "/dev")
+	p.read = append(p.read, "/etc", "/proc", "/usr/share/zoneinfo", "/usr/lib", "/lib", "/lib64")
+	return p, ""
+}
+
+// nearestExisting returns path, or the closest ancestor of it that
+// exists, since rules can only be attached to existing files.
+func nearestExisting(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return ""
+		}
+		path = parent
+	}
+}
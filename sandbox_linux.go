@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	seccomp "github.com/elastic/go-seccomp-bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Filesystem access rights by the Landlock ABI version that introduced
+// them. Rights the kernel does not know are left out of the ruleset.
+var landlockFSAccess = []uint64{
+	1: unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM,
+	2: unix.LANDLOCK_ACCESS_FS_REFER,
+	3: unix.LANDLOCK_ACCESS_FS_TRUNCATE,
+	5: unix.LANDLOCK_ACCESS_FS_IOCTL_DEV,
+}
+
+const (
+	landlockRead = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	// Rights that apply to a file rather than a directory.
+	landlockFileRights = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+)
+
+// Syscalls nothing in encutitl uses, denied with EPERM. exec is allowed
+// again for policies that run the --isolate worker.
+var deniedSyscalls = []string{
+	"execve", "execveat", "ptrace", "process_vm_readv", "process_vm_writev",
+	"mount", "umount2", "pivot_root", "chroot", "unshare", "setns",
+	"kexec_load", "init_module", "finit_module", "delete_module",
+	"bpf", "perf_event_open", "userfaultfd", "personality",
+	"keyctl", "add_key", "request_key",
+}
+
+func applySandbox(p *sandboxPolicy) error {
+	// seccomp goes first: with TSYNC it also sets no_new_privs on every
+	// thread, which Landlock requires.
+	if err := applySeccomp(p); err != nil {
+		return fmt.Errorf("seccomp: %w", err)
+	}
+	if err := applyLandlock(p); err != nil {
+		return fmt.Errorf("landlock: %w", err)
+	}
+	return nil
+}
+
+func applySeccomp(p *sandboxPolicy) error {
+	if !seccomp.Supported() {
+		return errSandboxUnsupported
+	}
+	denied := deniedSyscalls
+	if len(p.exec) > 0 {
+		denied = slices.DeleteFunc(slices.Clone(denied), func(name string) bool {
+			return name == "execve" || name == "execveat"
+		})
+	}
+	groups := []seccomp.SyscallGroup{{Action: seccomp.ActionErrno, Names: denied}}
+	if !p.network {
+		// Unix sockets stay, NSS lookups may use them.
+		groups = append(groups, seccomp.SyscallGroup{
+			Action: seccomp.ActionErrno,
+			NamesWithCondtions: []seccomp.NameWithConditions{
+				{Name: "socket", Conditions: []seccomp.Condition{{Argument: 0, Operation: seccomp.Equal, Value: unix.AF_INET}}},
+				{Name: "socket", Conditions: []seccomp.Condition{{Argument: 0, Operation: seccomp.Equal, Value: unix.AF_INET6}}},
+			},
+		})
+	}
+	return seccomp.LoadFilter(seccomp.Filter{
+		NoNewPrivs: true,
+		Flag:       seccomp.FilterFlagTSync,
+		Policy:     seccomp.Policy{DefaultAction: seccomp.ActionAllow, Syscalls: groups},
+	})
+}
+
+func applyLandlock(p *sandboxPolicy) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return errSandboxUnsupported
+	}
+	var handled uint64
+	for v, access := range landlockFSAccess {
+		if v <= int(abi) {
+			handled |= access
+		}
+	}
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	if abi >= 4 && !p.network {
+		attr.Access_net = unix.LANDLOCK_ACCESS_NET_BIND_TCP | unix.LANDLOCK_ACCESS_NET_CONNECT_TCP
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	writeAccess := handled &^ unix.LANDLOCK_ACCESS_FS_EXECUTE
+	for _, path := range p.write {
+		if err := landlockAllow(ruleset, path, writeAccess); err != nil {
+			return err
+		}
+	}
+	for _, path := range p.read {
+		if err := landlockAllow(ruleset, path, handled&landlockRead); err != nil {
+			return err
+		}
+	}
+	for _, path := range p.exec {
+		if err := landlockAllow(ruleset, path, handled&(landlockRead|unix.LANDLOCK_ACCESS_FS_EXECUTE)); err != nil {
+			return err
+		}
+	}
+
+	// Every thread has to be restricted, not just this one. The Go
+	// runtime can only do that in binaries built without cgo.
+	_, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0)
+	if errno == syscall.ENOTSUP {
+		return errors.New("needs a binary built with CGO_ENABLED=0")
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func landlockAllow(ruleset int, path string, access uint64) error {
+	if path = nearestExisting(path); path == "" {
+		return nil
+	}
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil // vanished or unreadable, nothing to allow
+	}
+	defer unix.Close(fd)
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		access &= landlockFileRights
+	}
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("%s: %w", path, errno)
+	}
+	return nil
+}
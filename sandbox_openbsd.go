@@ -0,0 +1,40 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+func applySandbox(p *sandboxPolicy) error {
+	for _, path := range p.write {
+		if path = nearestExisting(path); path != "" {
+			if err := unix.Unveil(path, "rwc"); err != nil {
+				return err
+			}
+		}
+	}
+	for _, path := range p.read {
+		if path = nearestExisting(path); path != "" {
+			if err := unix.Unveil(path, "r"); err != nil {
+				return err
+			}
+		}
+	}
+	for _, path := range p.exec {
+		if err := unix.Unveil(path, "rx"); err != nil {
+			return err
+		}
+	}
+	if err := unix.UnveilBlock(); err != nil {
+		return err
+	}
+	promises := "stdio"
+	if len(p.read)+len(p.write) > 0 {
+		promises += " rpath wpath cpath fattr flock tty"
+	}
+	if p.network {
+		promises += " inet dns"
+	}
+	if len(p.exec) > 0 {
+		// The --isolate worker pledges for itself once running.
+		promises += " proc exec"
+	}
+	return unix.Pledge(promises, "")
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !openbsd
+
+package main
+
+func applySandbox(p *sandboxPolicy) error {
+	return errSandboxUnsupported
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// scan looks for secrets about to be committed in plaintext. As a git
+// pre-commit hook
+//
+//	exec encutitl scan --staged
+//
+// it checks the staged version of every added or modified file and fails
+// the commit on a finding. Files are flagged when
+//
+//   - their path matches a must_encrypt pattern and they are not encrypted
+//   - they hold a private key, a key.bin or a cloud access key
+//   - a line holds a long token random enough to be a key (entropy above
+//     entropy bits per character), unless the file is encrypted
+//
+// Patterns come from the [scan] table of .encutitl.toml at the top of the
+// repository, or else of config.toml. A pattern without a slash matches
+// the file name, one with a slash the path from the top; "dir/" matches
+// everything under dir. Paths matching allow are never flagged, nor are
+// lock files, whose checksums look random.
+//
+//	[scan]
+//	must_encrypt = ["secrets/", "*.pem", ".env"]
+//	allow = ["testdata/"]
+//	entropy = 4.5
+
+const scanRepoConfig = ".encutitl.toml"
+
+type scanConfig struct {
+	MustEncrypt []string `toml:"must_encrypt"`
+	Allow       []string `toml:"allow"`
+	Entropy     float64  `toml:"entropy"`
+}
+
+const scanEntropy = 4.5 // bits per character
+
+var scanAllowDefault = []string{"go.sum", "package-lock.json", "yarn.lock", "pnpm-lock.yaml", "Cargo.lock", "poetry.lock", "Gemfile.lock", "composer.lock"}
+
+var (
+	scanKeyPatterns = []struct {
+		re   *regexp.Regexp
+		what string
+	}{
+		{regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`), "private key"},
+		{regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`), "AWS access key"},
+		{regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`), "GitHub token"},
+		{regexp.MustCompile(`\bxox[baprs]-[A-Za-z0-9-]{10,}`), "Slack token"},
+	}
+	// Tokens of 32 or more base64 or hex characters are checked for
+	// entropy, except in public keys.
+	scanToken     = regexp.MustCompile(`[A-Za-z0-9+/=_-]{32,}`)
+	scanPublicKey = regexp.MustCompile(`^\s*(ssh-(rsa|dss|ed25519)|ecdsa-sha2-\S+|sk-\S+|age1[a-z0-9]+)\b`)
+)
+
+type scanFinding struct {
+	path, reason string
+	line         int
+}
+
+func runScan(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	staged := fs.Bool("staged", false, "Scan the files staged for commit in the current git repository")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *staged == (fs.NArg() > 0) {
+		fail(exitUsage, "Usage: scan --staged | scan FILE|DIR...")
+		return
+	}
+	top := "."
+	if *staged {
+		out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+		if err != nil {
+			fail(exitUsage, tr("Error: not in a git repository:"), gitError(err))
+			return
+		}
+		top = strings.TrimSpace(string(out))
+	}
+	cfg, err := loadScanConfig(top)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+
+	var findings []scanFinding
+	check := func(name string, data []byte) {
+		findings = append(findings, cfg.scan(name, data)...)
+	}
+	if *staged {
+		err = scanStaged(top, check)
+	} else {
+		err = scanPaths(fs.Args(), check)
+	}
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	for _, f := range findings {
+		if f.line > 0 {
+			fmt.Printf("%s:%d: %s\n", f.path, f.line, f.reason)
+		} else {
+			fmt.Printf("%s: %s\n", f.path, f.reason)
+		}
+	}
+	if len(findings) > 0 {
+		failf(exitError, tr("Error: %d findings, encrypt the files (or add them to allow in [scan]) before committing"), len(findings))
+	}
+}
+
+func gitError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
+
+// loadScanConfig reads [scan] from the repository's .encutitl.toml, or
+// else config.toml.
+func loadScanConfig(top string) (*scanConfig, error) {
+	var file struct {
+		Scan scanConfig `toml:"scan"`
+	}
+	paths := []string{filepath.Join(top, scanRepoConfig)}
+	if dir, err := configDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, configFile))
+	}
+	for _, p := range paths {
+		md, err := toml.DecodeFile(p, &file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if md.IsDefined("scan") {
+			break
+		}
+	}
+	cfg := file.Scan
+	cfg.Allow = append(cfg.Allow, scanAllowDefault...)
+	if cfg.Entropy == 0 {
+		cfg.Entropy = scanEntropy
+	}
+	return &cfg, nil
+}
+
+// scanStaged passes check the index version of every staged file.
+func scanStaged(top string, check func(name string, data []byte)) error {
+	cmd := exec.Command("git", "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z")
+	cmd.Dir = top
+	out, err := cmd.Output()
+	if err != nil {
+		return gitError(err)
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(out), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		show := exec.Command("git", "show", ":"+name)
+		show.Dir = top
+		data, err := show.Output()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, gitError(err))
+		}
+		check(name, data)
+	}
+	return nil
+}
+
+func scanPaths(paths []string, check func(name string, data []byte)) error {
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			data, err := readFileRetry(p)
+			if err != nil {
+				return err
+			}
+			check(filepath.ToSlash(p), data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan returns what is wrong with committing data as name.
+func (cfg *scanConfig) scan(name string, data []byte) []scanFinding {
+	if matchAny(cfg.Allow, name) || isEncryptedData(data) {
+		return nil
+	}
+	var findings []scanFinding
+	if matchAny(cfg.MustEncrypt, name) {
+		findings = append(findings, scanFinding{path: name, reason: "must be encrypted (must_encrypt)"})
+	}
+	if path.Base(name) == keyFileName && len(data) == keySize {
+		findings = append(findings, scanFinding{path: name, reason: "encutitl key file"})
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return findings // binary, the patterns below are for text
+	}
+	keyFound := false // the rest of a key is not worth reporting
+	for i, line := range strings.Split(string(data), "\n") {
+		for _, p := range scanKeyPatterns {
+			if p.re.MatchString(line) {
+				findings = append(findings, scanFinding{path: name, line: i + 1, reason: p.what})
+				keyFound = true
+			}
+		}
+		if keyFound || scanPublicKey.MatchString(line) {
+			continue
+		}
+		for _, tok := range scanToken.FindAllString(line, -1) {
+			if e := entropy(tok); e > cfg.Entropy {
+				findings = append(findings, scanFinding{path: name, line: i + 1, reason: fmt.Sprintf("random-looking %d character token (%.1f bits per character)", len(tok), e)})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// isEncryptedData reports whether data is encrypted output, binary or in
+// text form.
+func isEncryptedData(data []byte) bool {
+	if recognized(data) || isAgeArmor(string(data)) || encutil.IsJWE(strings.TrimSpace(string(data))) {
+		return true
+	}
+	if !isEncodedText(data) {
+		return false
+	}
+	raw, err := decodeInput(string(data))
+	return err == nil && recognized(raw)
+}
+
+// matchAny matches name against the patterns of [scan].
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		switch {
+		case strings.HasSuffix(p, "/"):
+			if strings.HasPrefix(name, strings.TrimPrefix(p, "/")) {
+				return true
+			}
+		case strings.Contains(p, "/"):
+			if ok, _ := path.Match(strings.TrimPrefix(p, "/"), name); ok {
+				return true
+			}
+		default:
+			if ok, _ := path.Match(p, path.Base(name)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// entropy is the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var h float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(s))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Non-interactive key and passphrase sources for CI and services:
+// ENCUTITL_KEY holds the key.bin contents in base64 and replaces the file,
+// and passphrases for SSH keys and passphrase files come from --passphrase-fd, --passphrase-file or
+// ENCUTITL_PASSPHRASE, in that order, before falling back to a prompt.
+
+var (
+	passphraseFile = flag.String("passphrase-file", "", "Read the SSH key or file passphrase from this file")
+	passphraseFD   = flag.Int("passphrase-fd", -1, "Read the SSH key or file passphrase from this file descriptor")
+)
+
+// envKey returns the key from ENCUTITL_KEY, or nil if it is not set.
+func envKey() ([]byte, error) {
+	s := strings.TrimSpace(os.Getenv("ENCUTITL_KEY"))
+	if s == "" {
+		return nil, nil
+	}
+	var key []byte
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err = enc.DecodeString(s); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ENCUTITL_KEY: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("ENCUTITL_KEY is %d bytes, want %d", len(key), keySize)
+	}
+	return lockedCopy(key), nil
+}
+
+var (
+	passphraseOnce sync.Once
+	passphrase     []byte
+	passphraseErr  error
+)
+
+// configuredPassphrase returns the passphrase from the non-interactive
+// sources, or nil if none is set. A descriptor can only be read once, so
+// the result is kept for every key that asks.
+func configuredPassphrase() ([]byte, error) {
+	passphraseOnce.Do(func() {
+		var data []byte
+		switch {
+		case *passphraseFD >= 0:
+			f := os.NewFile(uintptr(*passphraseFD), "passphrase-fd")
+			if f == nil {
+				passphraseErr = fmt.Errorf("--passphrase-fd %d is not open", *passphraseFD)
+				return
+			}
+			data, passphraseErr = io.ReadAll(f)
+			f.Close()
+		case *passphraseFile != "":
+			data, passphraseErr = os.ReadFile(*passphraseFile)
+		case os.Getenv("ENCUTITL_PASSPHRASE") != "":
+			data = []byte(os.Getenv("ENCUTITL_PASSPHRASE"))
+		default:
+			return
+		}
+		if passphraseErr != nil {
+			return
+		}
+		// Only the first line, like the prompt.
+		data, _, _ = bytes.Cut(data, []byte("\n"))
+		passphrase = lockedCopy(bytes.TrimSuffix(data, []byte("\r")))
+		if len(passphrase) == 0 {
+			passphraseErr = errors.New("empty passphrase")
+		}
+	})
+	return passphrase, passphraseErr
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// serve puts the keys the daemon holds behind HTTP, for services that want
+// encutitl's format without linking Go code:
+//
+//	POST /encrypt  body: plaintext     reply: encutitl file
+//	POST /decrypt  body: any format -d reads  reply: plaintext
+//	GET  /healthz
+//	POST /links, GET /download/TOKEN  with --objects, see links.go
+//
+// Requests need "Authorization: Bearer TOKEN" with one of the tokens in
+// --token-file (one per line) or ENCUTITL_SERVE_TOKEN; --no-auth is for
+// listeners that already authenticate, with client-ca or a unix socket
+// mode. TLS is the cert= and key= options of --listen. Bodies are read up
+// to --max-input-size (default 256M) and replies written as they are
+// produced, but the format authenticates a file as a whole, so a request
+// is buffered before anything is sent back. Errors carry a code and
+// request ID, see apierror.go.
+
+const serveTokenEnv = "ENCUTITL_SERVE_TOKEN"
+
+// codeMessage is what a client is told for a failed decryption; the
+// error itself only goes to the log.
+var codeMessage = map[string]string{
+	codeAuthFailed:        "decryption failed, wrong key or modified data",
+	codeKeyNotFound:       "no key on this server opens the file",
+	codePayloadTooLarge:   "over the size limit",
+	codeFormatUnsupported: "not a file this server can decrypt",
+	codeReplayed:          "this file was already decrypted",
+	codeInternal:          "internal error",
+}
+
+type server struct {
+	*daemon
+	tokens [][sha256.Size]byte
+	replay *replayGuard // nil without --replay-window
+	links  *linkSigner  // nil without --objects
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var listen listFlag
+	fs.Var(&listen, "listen", "Listen spec, e.g. :8080 or :8443,cert=server.pem,key=server.key (repeatable, default :8080)")
+	tokenFile := fs.String("token-file", "", "File of accepted bearer tokens, one per line")
+	noAuth := fs.Bool("no-auth", false, "Accept requests without a token")
+	fs.Var(&recipientFlags, "recipient", "Recipient to encrypt to (repeatable, default key.bin)")
+	fs.Var(&identityFlags, "i", "Identity file to decrypt with (repeatable, default as for -d)")
+	addKeyPermsFlag(fs)
+	addKeyFileFlag(fs)
+	addBatchFlag(fs)
+	fs.Var(&maxInputSize, "max-input-size", "Largest request body accepted (default 256M)")
+	replayWindow := fs.Duration("replay-window", 0, "Refuse to decrypt a file again within this long, e.g. 24h")
+	objects := fs.String("objects", "", "Directory of encrypted files to mint one-time download links for")
+	linkMaxTTL := fs.Duration("link-max-ttl", time.Hour, "Longest a download link may be valid for")
+	var linkRate sizeFlag
+	fs.Var(&linkRate, "link-rate", "Bytes a second each link download is paced at, e.g. 1M (0 for no limit)")
+	fs.Var(&maxOutputSize, "max-output-size", "Largest plaintext one decryption or link download may produce, e.g. 512M (0 for no limit)")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fail(exitUsage, "Usage: serve [--listen SPEC...] [--token-file FILE | --no-auth] [--recipient KEY...] [-i KEY...] [--replay-window D] [--objects DIR]")
+		return
+	}
+	if len(listen) == 0 {
+		listen = listFlag{":8080"}
+	}
+	tokens, err := loadServeTokens(*tokenFile)
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	if len(tokens) == 0 && !*noAuth {
+		failf(exitUsage, tr("Error: serve needs --token-file or %s, or --no-auth"), serveTokenEnv)
+		return
+	}
+	d, err := loadDaemonKeys()
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	d.maxSize = int64(maxInputSize)
+	if d.maxSize == 0 {
+		d.maxSize = serveDefaultSize
+	}
+	lns, err := listenAll(listen)
+	if err != nil {
+		fail(exitIO, tr("Listen error:"), err)
+		return
+	}
+
+	s := &server{daemon: d, tokens: tokens, replay: newReplayGuard(*replayWindow)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/encrypt", s.auth(s.encrypt))
+	mux.HandleFunc("/decrypt", s.auth(s.decrypt))
+	if *objects != "" {
+		if s.links, err = newLinkSigner(*objects, *linkMaxTTL, int64(linkRate)); err != nil {
+			fail(exitUsage, tr("Error: --objects:"), err)
+			return
+		}
+		mux.HandleFunc("/links", s.auth(s.mintLink))
+		mux.HandleFunc(linkPath, s.download)
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok\n") })
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, r, codeNotFound, "no such endpoint", nil)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		fmt.Println(tr("Serving encrypt and decrypt on"), ln.Addr())
+		go func() { errs <- srv.Serve(ln) }()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		fail(exitIO, tr("Serve error:"), err)
+	case <-sigs:
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx) // let requests in flight finish
+	}
+}
+
+// loadServeTokens reads the token file and ENCUTITL_SERVE_TOKEN, keeping
+// hashes so comparing them takes the same time whatever their length.
+func loadServeTokens(path string) ([][sha256.Size]byte, error) {
+	var tokens [][sha256.Size]byte
+	if t := strings.TrimSpace(os.Getenv(serveTokenEnv)); t != "" {
+		tokens = append(tokens, sha256.Sum256([]byte(t)))
+	}
+	if path == "" {
+		return tokens, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, sha256.Sum256([]byte(line)))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return tokens, nil
+}
+
+// authorized checks a bearer token, taking the same time for any token.
+func (s *server) authorized(token string) bool {
+	if len(s.tokens) == 0 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(token))
+	ok := 0
+	for _, t := range s.tokens {
+		ok |= subtle.ConstantTimeCompare(sum[:], t[:])
+	}
+	return ok == 1
+}
+
+func (s *server) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// One ID for the error reply and the log line.
+		id := requestID(r)
+		r.Header.Set("X-Request-Id", id)
+		w.Header().Set("X-Request-Id", id)
+		if r.Method != http.MethodPost {
+			writeAPIError(w, r, codeMethodNotAllowed, r.Method+" not allowed on "+r.URL.Path, nil)
+			return
+		}
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !s.authorized(token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, r, codeAuthFailed, "missing or unknown token", nil)
+			return
+		}
+		start := time.Now()
+		next(w, r)
+		fmt.Fprintf(os.Stderr, "%s request_id=%s %s %s took=%s\n", time.Now().UTC().Format(time.RFC3339), id, r.Method, r.URL.Path, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func (s *server) encrypt(w http.ResponseWriter, r *http.Request) {
+	if len(s.recipients) == 0 {
+		writeAPIError(w, r, codeKeyNotFound, "this server has no recipients to encrypt to", nil)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxSize))
+	if err != nil {
+		s.readError(w, r, err)
+		return
+	}
+	out, err := s.handle("encrypt", data)
+	clear(data)
+	if err != nil {
+		writeAPIError(w, r, codeInternal, codeMessage[codeInternal], err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(out)
+}
+
+func (s *server) decrypt(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxSize))
+	if err != nil {
+		s.readError(w, r, err)
+		return
+	}
+	if isAgeArmor(string(data)) {
+		if data, err = dearmorAge(string(data)); err != nil {
+			writeAPIError(w, r, codeFormatUnsupported, codeMessage[codeFormatUnsupported], err)
+			return
+		}
+	}
+	id, err := s.replay.claim(data)
+	if err != nil {
+		writeAPIError(w, r, codeReplayed, codeMessage[codeReplayed], err)
+		return
+	}
+	lw := &lazyWriter{w: w}
+	_, stanza, err := decryptTo(lw, data, s.key, s.identities)
+	s.replay.finish(id, stanza, data, err)
+	clear(data)
+	if err == nil {
+		return
+	}
+	if lw.started {
+		// Over --max-output-size halfway through: all that is left is
+		// cutting the reply short so the client cannot take it as whole.
+		fmt.Fprintf(os.Stderr, "%s request_id=%s %s: %v\n", time.Now().UTC().Format(time.RFC3339), requestID(r), r.URL.Path, err)
+		panic(http.ErrAbortHandler)
+	}
+	code := errorCode(err)
+	writeAPIError(w, r, code, codeMessage[code], err)
+}
+
+func (s *server) readError(w http.ResponseWriter, r *http.Request, err error) {
+	code := errorCode(err)
+	if code == codeInternal {
+		code = codeBadRequest // the client went away mid-body
+	}
+	writeAPIError(w, r, code, "reading the request: "+codeMessage[code], err)
+}
+
+// lazyWriter sends the reply headers with the first byte of plaintext,
+// so an error found before that can still be a proper error reply.
+type lazyWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (l *lazyWriter) Write(p []byte) (int, error) {
+	if !l.started {
+		l.w.Header().Set("Content-Type", "application/octet-stream")
+		l.started = true
+	}
+	return l.w.Write(p)
+}
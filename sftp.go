@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// -f and -o also take sftp://[user@]host[:port]/path, for pushing backups
+// to a host that only speaks SSH. The path is absolute; /~/ starts it in
+// the remote home directory, as curl has it. Authentication is by the
+// keys in the SSH agent at SSH_AUTH_SOCK and the host key must already be
+// in ~/.ssh/known_hosts, so the first connection is made with ssh, which
+// asks. Uploads go to a temporary name next to the target and are renamed
+// over it once complete, so a cut connection leaves the old file.
+//
+// Reading and writing one file is five requests of SFTP version 3, which
+// every server speaks, so they are spoken here directly rather than
+// through a client library.
+
+const (
+	sftpInit          = 1
+	sftpVersion       = 2
+	sftpOpen          = 3
+	sftpClose         = 4
+	sftpRead          = 5
+	sftpWrite         = 6
+	sftpRemove        = 13
+	sftpRename        = 18
+	sftpStatus        = 101
+	sftpHandle        = 102
+	sftpData          = 103
+	sftpExtended      = 200
+	sftpFlagRead      = 0x01
+	sftpFlagWrite     = 0x02
+	sftpFlagCreate    = 0x08
+	sftpFlagTruncate  = 0x10
+	sftpAttrPerms     = 0x04
+	sftpStatusEOF     = 1
+	sftpStatusMissing = 2
+	sftpChunk         = 32 << 10 // the size every server accepts
+	sftpInFlight      = 16       // writes sent before waiting for replies
+	sftpMaxPacket     = 256 << 10
+	sftpPosixRename   = "posix-rename@openssh.com"
+)
+
+func isSFTPURL(s string) bool {
+	return strings.HasPrefix(s, "sftp://")
+}
+
+type sftpConn struct {
+	client      *ssh.Client
+	w           io.WriteCloser
+	r           *bufio.Reader
+	nextID      uint32
+	posixRename bool
+}
+
+// sftpStatusError is a failed request, with the server's message.
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatusError) Error() string { return fmt.Sprintf("sftp: %s (status %d)", e.msg, e.code) }
+
+func (e *sftpStatusError) Is(target error) bool {
+	return e.code == sftpStatusMissing && target == os.ErrNotExist
+}
+
+// sftpDial connects and logs in for the URL, returning the connection and
+// the remote path it names.
+func sftpDial(ctx context.Context, s string) (*sftpConn, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, "", err
+	}
+	remote := u.Path
+	if rest, ok := strings.CutPrefix(remote, "/~/"); ok {
+		remote = rest // relative paths start in the login directory
+	}
+	if u.Hostname() == "" || remote == "" || strings.HasSuffix(remote, "/") {
+		return nil, "", fmt.Errorf("%s: expected sftp://[user@]host[:port]/path", s)
+	}
+	name := u.User.Username()
+	if name == "" {
+		cur, err := user.Current()
+		if err != nil {
+			return nil, "", err
+		}
+		name = cur.Username
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, "", errors.New("sftp:// needs an SSH agent, SSH_AUTH_SOCK is not set")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, "", err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", fmt.Errorf("%s is not in known_hosts, connect with ssh once to check and add its key", u.Hostname())
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("known_hosts: %w", err)
+	}
+	agentConn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, "", fmt.Errorf("SSH agent: %w", err)
+	}
+	defer agentConn.Close() // only needed to log in
+	config := &ssh.ClientConfig{
+		User:            name,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)},
+		HostKeyCallback: hostKeys,
+	}
+	d, err := dialer()
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil, "", fmt.Errorf("%s is not in known_hosts, connect with ssh once to check and add its key", u.Hostname())
+		}
+		if errors.As(err, &keyErr) {
+			return nil, "", fmt.Errorf("the host key of %s does NOT match known_hosts, refusing to connect", u.Hostname())
+		}
+		return nil, "", err
+	}
+	c := &sftpConn{client: ssh.NewClient(sc, chans, reqs)}
+	if err := c.start(); err != nil {
+		c.Close()
+		return nil, "", err
+	}
+	return c, remote, nil
+}
+
+// start opens the sftp subsystem and agrees on version 3.
+func (c *sftpConn) start() error {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	if c.w, err = session.StdinPipe(); err != nil {
+		return err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	c.r = bufio.NewReaderSize(out, 64<<10)
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("sftp subsystem: %w", err)
+	}
+	if _, err := c.w.Write(sftpPacket(sftpInit, uint32(3))); err != nil {
+		return err
+	}
+	typ, payload, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if typ != sftpVersion || len(payload) < 4 {
+		return errors.New("sftp: unexpected reply to init")
+	}
+	// Extensions are name and data string pairs after the version.
+	for rest := payload[4:]; len(rest) > 0; {
+		var name, data []byte
+		if name, rest, err = sftpString(rest); err == nil {
+			data, rest, err = sftpString(rest)
+		}
+		if err != nil {
+			break
+		}
+		if string(name) == sftpPosixRename && string(data) == "1" {
+			c.posixRename = true
+		}
+	}
+	return nil
+}
+
+func (c *sftpConn) Close() error {
+	if c.w != nil {
+		c.w.Close()
+	}
+	return c.client.Close()
+}
+
+// sftpPacket encodes a packet; strings and byte slices go with a length.
+func sftpPacket(typ byte, fields ...any) []byte {
+	b := []byte{0, 0, 0, 0, typ}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		case []byte:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func sftpString(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 || uint64(len(b)-4) < uint64(binary.BigEndian.Uint32(b)) {
+		return nil, nil, errors.New("sftp: short packet")
+	}
+	n := binary.BigEndian.Uint32(b)
+	return b[4 : 4+n], b[4+n:], nil
+}
+
+func (c *sftpConn) readPacket() (byte, []byte, error) {
+	var n uint32
+	if err := binary.Read(c.r, binary.BigEndian, &n); err != nil {
+		return 0, nil, err
+	}
+	if n == 0 || n > sftpMaxPacket+1024 {
+		return 0, nil, fmt.Errorf("sftp: packet of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// send writes a request and returns its ID.
+func (c *sftpConn) send(typ byte, fields ...any) (uint32, error) {
+	c.nextID++
+	_, err := c.w.Write(sftpPacket(typ, append([]any{c.nextID}, fields...)...))
+	return c.nextID, err
+}
+
+// reply reads the next response, returning its ID and payload, or the
+// error of a failed status.
+func (c *sftpConn) reply() (byte, uint32, []byte, error) {
+	typ, b, err := c.readPacket()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(b) < 4 {
+		return 0, 0, nil, errors.New("sftp: short packet")
+	}
+	id, b := binary.BigEndian.Uint32(b), b[4:]
+	if typ == sftpStatus {
+		if len(b) < 4 {
+			return 0, 0, nil, errors.New("sftp: short packet")
+		}
+		code := binary.BigEndian.Uint32(b)
+		if code != 0 {
+			msg, _, _ := sftpString(b[4:])
+			return typ, id, nil, &sftpStatusError{code: code, msg: string(msg)}
+		}
+	}
+	return typ, id, b, nil
+}
+
+// call sends a request and waits for its response.
+func (c *sftpConn) call(typ byte, fields ...any) (byte, []byte, error) {
+	id, err := c.send(typ, fields...)
+	if err != nil {
+		return 0, nil, err
+	}
+	rtyp, rid, b, err := c.reply()
+	if err == nil && rid != id {
+		err = errors.New("sftp: reply out of order")
+	}
+	return rtyp, b, err
+}
+
+func (c *sftpConn) open(name string, flags uint32) ([]byte, error) {
+	typ, b, err := c.call(sftpOpen, name, flags, uint32(sftpAttrPerms), uint32(0600))
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpHandle {
+		return nil, errors.New("sftp: unexpected reply to open")
+	}
+	handle, _, err := sftpString(b)
+	return handle, err
+}
+
+func (c *sftpConn) closeHandle(handle []byte) error {
+	_, _, err := c.call(sftpClose, handle)
+	return err
+}
+
+func (c *sftpConn) readFile(name string) ([]byte, error) {
+	handle, err := c.open(name, sftpFlagRead)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for {
+		typ, b, err := c.call(sftpRead, handle, uint64(len(data)), uint32(sftpChunk))
+		var status *sftpStatusError
+		if errors.As(err, &status) && status.code == sftpStatusEOF {
+			return data, c.closeHandle(handle)
+		}
+		if err != nil {
+			c.closeHandle(handle)
+			return nil, err
+		}
+		chunk, _, err := sftpString(b)
+		if err != nil || typ != sftpData {
+			c.closeHandle(handle)
+			return nil, errors.New("sftp: unexpected reply to read")
+		}
+		data = append(data, chunk...)
+		if maxInputSize > 0 && int64(len(data)) > int64(maxInputSize) {
+			c.closeHandle(handle)
+			return nil, fmt.Errorf("input is over --max-input-size %s", formatBytes(int64(maxInputSize)))
+		}
+	}
+}
+
+// writeFile writes r to name, keeping a few writes in flight so a distant
+// server is not waited on for every chunk.
+func (c *sftpConn) writeFile(name string, r io.Reader) error {
+	handle, err := c.open(name, sftpFlagWrite|sftpFlagCreate|sftpFlagTruncate)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sftpChunk)
+	var off uint64
+	pending := 0
+	for err == nil {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err = c.send(sftpWrite, handle, off, buf[:n]); err != nil {
+				break
+			}
+			off += uint64(n)
+			pending++
+		}
+		for err == nil && pending > 0 && (pending >= sftpInFlight || rerr != nil) {
+			_, _, _, err = c.reply()
+			pending--
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		c.closeHandle(handle)
+		return err
+	}
+	return c.closeHandle(handle)
+}
+
+func (c *sftpConn) rename(from, to string) error {
+	if c.posixRename {
+		_, _, err := c.call(sftpExtended, sftpPosixRename, from, to)
+		return err
+	}
+	// Plain SFTP rename refuses to replace the target.
+	c.call(sftpRemove, to)
+	_, _, err := c.call(sftpRename, from, to)
+	return err
+}
+
+func downloadSFTP(ctx context.Context, src string) ([]byte, error) {
+	c, remote, err := sftpDial(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	data, err := c.readFile(remote)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	return data, nil
+}
+
+func uploadSFTP(ctx context.Context, dest string, r io.Reader) error {
+	c, remote, err := sftpDial(ctx, dest)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	tmp := path.Join(path.Dir(remote), "."+path.Base(remote)+".encutitl-tmp")
+	if err := c.writeFile(tmp, r); err != nil {
+		c.call(sftpRemove, tmp)
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	if err := c.rename(tmp, remote); err != nil {
+		c.call(sftpRemove, tmp)
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	return nil
+}
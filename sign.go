@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func runSign(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	file := fs.String("f", "", "File to sign (signature saved to <file>.sig)")
+	str := fs.String("s", "", "String to sign (signature printed to stdout)")
+	fs.BoolVar(outputAsHex, "output-as-hex", false, "Print signature in hex instead of base64")
+	addLangFlag(fs)
+	fs.Parse(args)
+
+	data, err := signInput(*file, *str)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	sig, err := signBytes(data)
+	if err != nil {
+		fail(exitKey, tr("Signing key error:"), err)
+		return
+	}
+	if *file == "" {
+		outputEncoded(sig)
+		return
+	}
+	if err := os.WriteFile(*file+".sig", sig, 0644); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Println(tr("Signature saved to:"), *file+".sig")
+}
+
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	file := fs.String("f", "", "Signed file")
+	str := fs.String("s", "", "Signed string")
+	sigFlag := fs.String("sig", "", "Signature file (default <file>.sig), or encoded signature with -s")
+	pubFlag := fs.String("pub", "", "Signer public key file (default sign.pub in the config directory)")
+	fs.BoolVar(outputAsHex, "output-as-hex", false, "Signature given with -s is hex instead of base64")
+	addLangFlag(fs)
+	fs.Parse(args)
+
+	data, err := signInput(*file, *str)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+
+	var sig []byte
+	if *file != "" {
+		sigFile := *sigFlag
+		if sigFile == "" {
+			sigFile = *file + ".sig"
+		}
+		sig, err = os.ReadFile(sigFile)
+	} else {
+		sig, err = decodeInput(*sigFlag)
+	}
+	if err != nil {
+		fail(exitIO, tr("Signature read error:"), err)
+		return
+	}
+
+	if *pubFlag == "" {
+		*pubFlag = signPubPath()
+	}
+	pub, err := readPublicKey(*pubFlag)
+	if err != nil {
+		fail(exitKey, tr("Public key error:"), err)
+		return
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		fail(exitAuth, tr("Signature INVALID"))
+		return
+	}
+	fmt.Println(tr("Signature OK, signed by"), base64.RawURLEncoding.EncodeToString(pub))
+}
+
+func signInput(file, str string) ([]byte, error) {
+	switch {
+	case file != "":
+		return os.ReadFile(file)
+	case str != "":
+		return []byte(str), nil
+	}
+	return nil, fmt.Errorf("provide input via -f <file> or -s <string>")
+}
+
+// signBytes signs with the agent's signing key when one is running, else
+// with sign.key.
+func signBytes(data []byte) ([]byte, error) {
+	if os.Getenv(agentSockEnv) != "" {
+		return agentSign(data)
+	}
+	priv, err := loadOrGenerateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(priv, data), nil
+}
+
+// The signing key is kept in the config directory like key.bin; sign.pub
+// is what gets shared with recipients.
+func loadOrGenerateSigningKey() (ed25519.PrivateKey, error) {
+	seed, err := readPrivateKey(signKeyPath())
+	if os.IsNotExist(err) {
+		return generateSigningKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: invalid key size %d", signKeyPath(), len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func generateSigningKey() (ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPath, pubPath := signKeyPath(), signPubPath()
+	if err := writePrivateKey(keyPath, priv.Seed()); err != nil {
+		return nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(pub) + "\n"
+	if err := os.WriteFile(pubPath, []byte(encoded), 0644); err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, tr("Generated signing key, public key saved to:"), pubPath)
+	return priv, nil
+}
+
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s: invalid public key size %d", path, len(pub))
+	}
+	return ed25519.PublicKey(pub), nil
+}
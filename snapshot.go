@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// --snapshot reads the input from a point-in-time filesystem snapshot
+// instead of the live file, so a database or a file still being written
+// is captured consistently. The snapshot is taken just before the read
+// and removed after the run; -R and --archive read the whole tree from
+// one snapshot. auto picks VSS on Windows and btrfs, ZFS or LVM on Linux
+// from the filesystem holding the input; all of them need root (or
+// Administrator).
+
+var (
+	snapshotFlag = flag.String("snapshot", "", "Read inputs from a filesystem snapshot: auto, vss, btrfs, zfs or lvm")
+	snapshotSize = flag.String("snapshot-size", "1G", "Copy-on-write space for LVM snapshots")
+)
+
+// A snapshot maps live paths to their frozen copies.
+type snapshot interface {
+	Path(live string) (string, error)
+	Remove() error
+}
+
+// runTool executes a snapshot tool and folds its stderr into the error.
+func runTool(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), msg)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// relativeTo returns live relative to root after resolving symlinks, the
+// part that stays the same inside a snapshot of root.
+func relativeTo(root, live string) (string, error) {
+	abs, err := filepath.Abs(live)
+	if err != nil {
+		return "", err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not under %s", live, root)
+	}
+	return rel, nil
+}
+
+func snapshotName() string {
+	return fmt.Sprintf("encutitl-%d", os.Getpid())
+}
+
+// withSnapshot takes one snapshot of the filesystem holding path and
+// calls read with path's frozen copy in it, removing the snapshot after.
+func withSnapshot(path string, read func(frozen string) error) error {
+	snap, err := takeSnapshot(*snapshotFlag, path)
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	defer func() {
+		if err := snap.Remove(); err != nil {
+			fmt.Fprintln(os.Stderr, tr("Warning: snapshot not removed:"), err)
+		}
+	}()
+	frozen, err := snap.Path(path)
+	if err != nil {
+		return err
+	}
+	return read(frozen)
+}
+
+// readFromSnapshot reads path from a snapshot taken for this read.
+func readFromSnapshot(path string) (data []byte, err error) {
+	err = withSnapshot(path, func(frozen string) error {
+		if err := checkInputFile(frozen); err != nil {
+			return err
+		}
+		data, err = os.ReadFile(frozen)
+		return err
+	})
+	return data, err
+}
+
+// tarFromSnapshot is tarDir of dir as it is in a snapshot.
+func tarFromSnapshot(dir string) (data []byte, err error) {
+	err = withSnapshot(dir, func(frozen string) error {
+		data, err = tarDir(frozen)
+		return err
+	})
+	return data, err
+}
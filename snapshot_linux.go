@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// takeSnapshot snapshots the filesystem holding path.
+func takeSnapshot(kind, path string) (snapshot, error) {
+	out, err := runTool("findmnt", "-n", "-o", "TARGET,FSTYPE,SOURCE", "--target", path)
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Fields(out)
+	if len(f) < 3 {
+		return nil, fmt.Errorf("findmnt: unexpected output %q", out)
+	}
+	mount, fstype, source := f[0], f[1], f[2]
+	if kind == "auto" {
+		switch {
+		case fstype == "btrfs" || fstype == "zfs":
+			kind = fstype
+		case strings.HasPrefix(source, "/dev/mapper/") || strings.HasPrefix(source, "/dev/dm-"):
+			kind = "lvm"
+		default:
+			return nil, fmt.Errorf("%s is on %s (%s), which has no snapshot support", mount, fstype, source)
+		}
+	}
+	switch kind {
+	case "btrfs":
+		return btrfsSnapshot(mount)
+	case "zfs":
+		return zfsSnapshot(mount, source)
+	case "lvm":
+		return lvmSnapshot(mount, fstype, source)
+	}
+	return nil, fmt.Errorf("--snapshot %s is not supported on Linux", kind)
+}
+
+// btrfs: a read-only snapshot of the mounted subvolume, inside it. Files
+// in nested subvolumes are not included.
+type btrfsSnap struct{ mount, dir string }
+
+func btrfsSnapshot(mount string) (snapshot, error) {
+	dir := filepath.Join(mount, "."+snapshotName())
+	if _, err := runTool("btrfs", "subvolume", "snapshot", "-r", mount, dir); err != nil {
+		return nil, err
+	}
+	return &btrfsSnap{mount, dir}, nil
+}
+
+func (s *btrfsSnap) Path(live string) (string, error) {
+	rel, err := relativeTo(s.mount, live)
+	return filepath.Join(s.dir, rel), err
+}
+
+func (s *btrfsSnap) Remove() error {
+	_, err := runTool("btrfs", "subvolume", "delete", s.dir)
+	return err
+}
+
+// zfs: dataset@name, read through the hidden .zfs directory.
+type zfsSnap struct{ mount, dataset, name string }
+
+func zfsSnapshot(mount, dataset string) (snapshot, error) {
+	s := &zfsSnap{mount, dataset, snapshotName()}
+	if _, err := runTool("zfs", "snapshot", dataset+"@"+s.name); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *zfsSnap) Path(live string) (string, error) {
+	rel, err := relativeTo(s.mount, live)
+	return filepath.Join(s.mount, ".zfs", "snapshot", s.name, rel), err
+}
+
+func (s *zfsSnap) Remove() error {
+	_, err := runTool("zfs", "destroy", s.dataset+"@"+s.name)
+	return err
+}
+
+// lvm: a copy-on-write snapshot volume mounted read-only in a temporary
+// directory. --snapshot-size bounds how much may change during the run.
+type lvmSnap struct{ mount, dir, lv string }
+
+func lvmSnapshot(mount, fstype, source string) (snapshot, error) {
+	out, err := runTool("lvs", "--noheadings", "-o", "vg_name,lv_name", source)
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Fields(out)
+	if len(f) != 2 {
+		return nil, fmt.Errorf("%s is not an LVM volume", source)
+	}
+	lv := f[0] + "/" + snapshotName()
+	if _, err := runTool("lvcreate", "-q", "-s", "-L", *snapshotSize, "-n", snapshotName(), f[0]+"/"+f[1]); err != nil {
+		return nil, err
+	}
+	s := &lvmSnap{mount: mount, lv: lv}
+	if s.dir, err = os.MkdirTemp("", "encutitl-snap-"); err != nil {
+		s.Remove()
+		return nil, err
+	}
+	opts := "ro"
+	if fstype == "xfs" {
+		opts += ",nouuid" // the snapshot shares the origin's UUID
+	}
+	if _, err := runTool("mount", "-o", opts, "/dev/"+lv, s.dir); err != nil {
+		s.dir = ""
+		s.Remove()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *lvmSnap) Path(live string) (string, error) {
+	rel, err := relativeTo(s.mount, live)
+	return filepath.Join(s.dir, rel), err
+}
+
+func (s *lvmSnap) Remove() error {
+	if s.dir != "" {
+		if _, err := runTool("umount", s.dir); err != nil {
+			return err
+		}
+		os.Remove(s.dir)
+	}
+	_, err := runTool("lvremove", "-q", "-f", s.lv)
+	return err
+}
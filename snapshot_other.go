@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package main
+
+import "fmt"
+
+func takeSnapshot(kind, path string) (snapshot, error) {
+	return nil, fmt.Errorf("--snapshot is not supported on this platform")
+}
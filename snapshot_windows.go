@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// takeSnapshot creates a VSS shadow copy of the volume holding path
+// through WMI, which unlike vssadmin create also works on client
+// editions.
+func takeSnapshot(kind, path string) (snapshot, error) {
+	if kind != "auto" && kind != "vss" {
+		return nil, fmt.Errorf("--snapshot %s is not supported on Windows", kind)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	volume := filepath.VolumeName(abs) + `\`
+	script := fmt.Sprintf(`$r = (Get-WmiObject -List Win32_ShadowCopy).Create('%s', 'ClientAccessible'); `+
+		`if ($r.ReturnValue -ne 0) { throw "Win32_ShadowCopy.Create returned $($r.ReturnValue)" }; `+
+		`$s = Get-WmiObject Win32_ShadowCopy -Filter "ID='$($r.ShadowID)'"; $s.ID; $s.DeviceObject`, volume)
+	out, err := runTool("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Fields(out)
+	if len(f) != 2 {
+		return nil, fmt.Errorf("vss: unexpected output %q", out)
+	}
+	return &vssSnap{volume: volume, id: f[0], device: f[1]}, nil
+}
+
+type vssSnap struct{ volume, id, device string }
+
+func (s *vssSnap) Path(live string) (string, error) {
+	rel, err := relativeTo(s.volume, live)
+	return s.device + `\` + rel, err
+}
+
+func (s *vssSnap) Remove() error {
+	_, err := runTool("vssadmin", "delete", "shadows", "/shadow="+s.id, "/quiet")
+	return err
+}
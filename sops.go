@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"gopkg.in/yaml.v3"
+)
+
+// --format sops encrypts only the values of a YAML, JSON or .env file, in
+// the layout of Mozilla SOPS, so the keys stay readable and a changed
+// value is a one-line diff. Each value is sealed with AES-256-GCM under a
+// data key, with its path as associated data so values cannot be moved
+// around, and a MAC over all of them catches values being dropped. Keys
+// ending in _unencrypted, and everything under them, stay in plaintext.
+//
+// The data key goes in the sops metadata: wrapped for each age1
+// recipient as sops itself does, so the sops tool opens the file with the
+// age identity, and for every other recipient (key.bin by default) in an
+// encutitl entry, which sops ignores. Encrypting over an earlier version
+// reuses its data key and leaves unchanged values as they were, so the
+// diff shows only what changed. -d recognizes the layout whatever
+// --format says and writes the plain file back without the metadata.
+
+const (
+	sopsVersion           = "3.9.0"
+	sopsUnencryptedSuffix = "_unencrypted"
+	sopsNonceSize         = 32
+)
+
+type sopsAgeKey struct {
+	Recipient string `yaml:"recipient"`
+	Enc       string `yaml:"enc"`
+}
+
+type sopsEncutitlKey struct {
+	Enc string `yaml:"enc"` // an encutitl file, base64
+}
+
+type sopsMetadata struct {
+	Age               []sopsAgeKey      `yaml:"age,omitempty"`
+	Encutitl          []sopsEncutitlKey `yaml:"encutitl,omitempty"`
+	LastModified      string            `yaml:"lastmodified"`
+	MAC               string            `yaml:"mac"`
+	UnencryptedSuffix string            `yaml:"unencrypted_suffix"`
+	Version           string            `yaml:"version"`
+}
+
+var (
+	sopsValue   = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:([a-z]+)\]$`)
+	sopsEnvMAC  = regexp.MustCompile(`(?m)^sops_mac=ENC\[`)
+	sopsEnvList = regexp.MustCompile(`^(age|encutitl)__list_(\d+)__map_(recipient|enc)$`)
+)
+
+// sopsFile is a YAML, JSON or .env file, with its sops metadata taken
+// out if it has any. .env values are held as scalar nodes too.
+type sopsFile struct {
+	format string // yaml, json or dotenv
+	doc    *yaml.Node
+	lines  []sopsEnvLine
+	meta   *sopsMetadata
+}
+
+type sopsEnvLine struct {
+	raw   string // comments and blank lines
+	key   string
+	value *yaml.Node
+}
+
+// isSOPS reports whether data is a file in the sops layout.
+func isSOPS(data []byte) bool {
+	if !bytes.Contains(data, []byte("ENC[AES256_GCM,")) {
+		return false
+	}
+	f, err := parseSOPS(data, sopsFormatOfData(data))
+	return err == nil && f.meta != nil
+}
+
+// sopsFormatOf picks the format for encrypting name.
+func sopsFormatOf(name string, data []byte) (string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".json":
+		return "json", nil
+	case ".env":
+		return "dotenv", nil
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return "json", nil
+	}
+	return "", fmt.Errorf("%s: --format sops takes .yaml, .yml, .json and .env files", name)
+}
+
+func sopsFormatOfData(data []byte) string {
+	switch {
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		return "json"
+	case sopsEnvMAC.Match(data):
+		return "dotenv"
+	}
+	return "yaml"
+}
+
+func parseSOPS(data []byte, format string) (*sopsFile, error) {
+	f := &sopsFile{format: format}
+	if format == "dotenv" {
+		return f, f.parseEnv(data)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	f.doc = new(yaml.Node)
+	if err := dec.Decode(f.doc); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("the file is empty")
+		}
+		return nil, err
+	}
+	if err := dec.Decode(new(yaml.Node)); err != io.EOF {
+		return nil, errors.New("files with several YAML documents are not supported")
+	}
+	top := f.doc.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return nil, errors.New("the top level has to be a map")
+	}
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		if top.Content[i].Value != "sops" {
+			continue
+		}
+		var md sopsMetadata
+		if err := top.Content[i+1].Decode(&md); err != nil || md.MAC == "" {
+			break // an ordinary key named sops
+		}
+		f.meta = &md
+		top.Content = append(top.Content[:i], top.Content[i+2:]...)
+		break
+	}
+	return f, nil
+}
+
+func (f *sopsFile) parseEnv(data []byte) error {
+	meta := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			f.lines = append(f.lines, sopsEnvLine{raw: line})
+			continue
+		}
+		if k, ok := strings.CutPrefix(key, "sops_"); ok {
+			meta[k] = strings.ReplaceAll(value, `\n`, "\n")
+			continue
+		}
+		f.lines = append(f.lines, sopsEnvLine{key: key, value: &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}})
+	}
+	if meta["mac"] == "" {
+		return nil
+	}
+	md := &sopsMetadata{LastModified: meta["lastmodified"], MAC: meta["mac"], UnencryptedSuffix: meta["unencrypted_suffix"], Version: meta["version"]}
+	for k, v := range meta {
+		m := sopsEnvList.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		i, _ := strconv.Atoi(m[2])
+		if i > 100 {
+			return fmt.Errorf("sops_%s: too many keys", k)
+		}
+		switch m[1] {
+		case "age":
+			for len(md.Age) <= i {
+				md.Age = append(md.Age, sopsAgeKey{})
+			}
+			if m[3] == "recipient" {
+				md.Age[i].Recipient = v
+			} else {
+				md.Age[i].Enc = v
+			}
+		case "encutitl":
+			for len(md.Encutitl) <= i {
+				md.Encutitl = append(md.Encutitl, sopsEncutitlKey{})
+			}
+			md.Encutitl[i].Enc = v
+		}
+	}
+	f.meta = md
+	return nil
+}
+
+// walk calls fn on every value with its associated data, the path of
+// keys down to it, and whether it is to be encrypted.
+func (f *sopsFile) walk(suffix string, fn func(n *yaml.Node, ad string, encrypt bool) error) error {
+	if f.format == "dotenv" {
+		for _, l := range f.lines {
+			if l.value == nil {
+				continue
+			}
+			if err := fn(l.value, l.key+":", suffix == "" || !strings.HasSuffix(l.key, suffix)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return sopsWalk(f.doc.Content[0], nil, true, suffix, fn)
+}
+
+func sopsWalk(n *yaml.Node, path []string, encrypt bool, suffix string, fn func(n *yaml.Node, ad string, encrypt bool) error) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			if err := sopsWalk(n.Content[i+1], append(path, key), encrypt && (suffix == "" || !strings.HasSuffix(key, suffix)), suffix, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			if err := sopsWalk(c, path, encrypt, suffix, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return nil
+		}
+		return fn(n, strings.Join(path, ":")+":", encrypt)
+	case yaml.AliasNode:
+		return errors.New("YAML aliases are not supported")
+	}
+	return nil
+}
+
+// sopsBytes is a value as sops encrypts and hashes it, and its type.
+func sopsBytes(n *yaml.Node) ([]byte, string) {
+	switch n.Tag {
+	case "!!int":
+		if i, err := strconv.ParseInt(n.Value, 0, 64); err == nil {
+			return []byte(strconv.FormatInt(i, 10)), "int"
+		}
+	case "!!float":
+		if v, err := strconv.ParseFloat(n.Value, 64); err == nil {
+			return []byte(strconv.FormatFloat(v, 'f', -1, 64)), "float"
+		}
+	case "!!bool":
+		var b bool
+		if n.Decode(&b) == nil {
+			if b {
+				return []byte("True"), "bool"
+			}
+			return []byte("False"), "bool"
+		}
+	}
+	return []byte(n.Value), "str"
+}
+
+func sopsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, sopsNonceSize)
+}
+
+func sopsSeal(key, plain []byte, ad, typ string) (string, error) {
+	aead, err := sopsAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, sopsNonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	out := aead.Seal(nil, iv, plain, []byte(ad))
+	tag := len(out) - aead.Overhead()
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", b64(out[:tag]), b64(iv), b64(out[tag:]), typ), nil
+}
+
+func sopsOpen(key []byte, value, ad string) ([]byte, string, error) {
+	m := sopsValue.FindStringSubmatch(value)
+	if m == nil {
+		return nil, "", fmt.Errorf("%w: bad sops value for %s", encutil.ErrMalformed, strings.TrimSuffix(ad, ":"))
+	}
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		if parts[i], err = base64.StdEncoding.DecodeString(m[i+1]); err != nil {
+			return nil, "", fmt.Errorf("%w: bad sops value for %s", encutil.ErrMalformed, strings.TrimSuffix(ad, ":"))
+		}
+	}
+	aead, err := sopsAEAD(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(parts[1]) != sopsNonceSize {
+		return nil, "", fmt.Errorf("%w: bad sops value for %s", encutil.ErrMalformed, strings.TrimSuffix(ad, ":"))
+	}
+	plain, err := aead.Open(nil, parts[1], append(parts[0], parts[2]...), []byte(ad))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", strings.TrimSuffix(ad, ":"), err)
+	}
+	return plain, m[4], nil
+}
+
+// sopsCacheKey identifies a value for reuse by a later encryption.
+func sopsCacheKey(ad, typ string, plain []byte) string {
+	return ad + "\x00" + typ + "\x00" + string(plain)
+}
+
+// sopsEncrypt encrypts the values of plain, a file named name. prev is
+// the earlier encrypted version, if any, whose data key and unchanged
+// values are kept.
+func sopsEncrypt(plain []byte, name string, prev []byte) ([]byte, error) {
+	format, err := sopsFormatOf(name, plain)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseSOPS(plain, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if f.meta != nil {
+		return nil, fmt.Errorf("%s is already encrypted", name)
+	}
+	key, cache, prevMeta := sopsReuse(prev)
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	defer clear(key)
+	md := &sopsMetadata{
+		LastModified:      time.Now().UTC().Format(time.RFC3339),
+		UnencryptedSuffix: sopsUnencryptedSuffix,
+		Version:           sopsVersion,
+	}
+	if err := sopsWrapKey(md, key, prevMeta); err != nil {
+		return nil, err
+	}
+
+	h := sha512.New()
+	err = f.walk(md.UnencryptedSuffix, func(n *yaml.Node, ad string, encrypt bool) error {
+		b, typ := sopsBytes(n)
+		h.Write(b)
+		if !encrypt || len(b) == 0 {
+			return nil
+		}
+		sealed, ok := cache[sopsCacheKey(ad, typ, b)]
+		if !ok {
+			var err error
+			if sealed, err = sopsSeal(key, b, ad, typ); err != nil {
+				return err
+			}
+		}
+		n.Value, n.Tag, n.Style = sealed, "!!str", 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if md.MAC, err = sopsSeal(key, []byte(strings.ToUpper(hex.EncodeToString(h.Sum(nil)))), md.LastModified, "str"); err != nil {
+		return nil, err
+	}
+	f.meta = md
+	return f.marshal()
+}
+
+// sopsReuse opens prev, if it is a sops file the key is at hand for, for
+// its data key, its values by path and plaintext and its metadata.
+func sopsReuse(prev []byte) ([]byte, map[string]string, *sopsMetadata) {
+	if !isSOPS(prev) {
+		return nil, nil, nil
+	}
+	f, err := parseSOPS(prev, sopsFormatOfData(prev))
+	if err != nil {
+		return nil, nil, nil
+	}
+	key, err := sopsDataKey(f.meta)
+	if err != nil {
+		return nil, nil, nil
+	}
+	cache, err := f.open(key)
+	if err != nil {
+		clear(key)
+		return nil, nil, nil
+	}
+	return key, cache, f.meta
+}
+
+// sopsWrapKey wraps the data key for the recipients: age1 keys in the
+// age list, everything else in one encutitl file. Entries of prev, which
+// wrap the same key, are kept for recipients it already had.
+func sopsWrapKey(md *sopsMetadata, key []byte, prev *sopsMetadata) error {
+	if prev == nil {
+		prev = &sopsMetadata{}
+	}
+	var recipients []encutil.Recipient
+	var err error
+	if len(recipientFlags) == 0 {
+		recipients, err = encryptRecipients()
+	} else {
+		err = parseRecipientSpecs(recipientFlags, func(line string) error {
+			if !strings.HasPrefix(line, "age1") {
+				r, err := parseRecipientLine(line)
+				if err == nil {
+					recipients = append(recipients, r)
+				}
+				return err
+			}
+			r, err := parseAgeRecipient(line)
+			if err != nil {
+				return err
+			}
+			name := strings.Fields(line)[0]
+			for _, k := range prev.Age {
+				if k.Recipient == name {
+					md.Age = append(md.Age, k)
+					return nil
+				}
+			}
+			var buf bytes.Buffer
+			aw := armor.NewWriter(&buf)
+			w, err := age.Encrypt(aw, r)
+			if err != nil {
+				return err
+			}
+			w.Write(key)
+			if err := w.Close(); err != nil {
+				return err
+			}
+			if err := aw.Close(); err != nil {
+				return err
+			}
+			md.Age = append(md.Age, sopsAgeKey{Recipient: name, Enc: buf.String()})
+			return nil
+		})
+	}
+	if err != nil || len(recipients) == 0 {
+		return err
+	}
+	for _, k := range prev.Encutitl {
+		sealed, err := base64.StdEncoding.DecodeString(k.Enc)
+		if err != nil {
+			continue
+		}
+		if hdr, _, err := encutil.ParseHeader(sealed); err == nil && hdr != nil && checkSameRecipients(hdr, recipients) == nil {
+			md.Encutitl = []sopsEncutitlKey{k}
+			return nil
+		}
+	}
+	sealed, err := encutil.Encrypt(key, recipients...)
+	if err != nil {
+		return err
+	}
+	md.Encutitl = []sopsEncutitlKey{{Enc: base64.StdEncoding.EncodeToString(sealed)}}
+	return nil
+}
+
+// sopsDataKey unwraps the data key with the encutitl entry or, failing
+// that, an age identity.
+func sopsDataKey(md *sopsMetadata) ([]byte, error) {
+	var errs []error
+	for _, k := range md.Encutitl {
+		sealed, err := base64.StdEncoding.DecodeString(k.Enc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: bad encutitl key entry", encutil.ErrMalformed))
+			continue
+		}
+		identities, legacy, err := decryptIdentities(sealed)
+		if err == nil {
+			var key []byte
+			if key, err = encutil.Decrypt(sealed, legacy, identities...); err == nil {
+				return key, nil
+			}
+		}
+		errs = append(errs, err)
+	}
+	if len(md.Age) > 0 {
+		identities, err := ageIdentities()
+		if err == nil && len(identities) == 0 {
+			err = errors.New("no age identities, pass one with -i")
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, k := range md.Age {
+			if len(identities) == 0 {
+				break
+			}
+			r, err := age.Decrypt(armor.NewReader(strings.NewReader(k.Enc)), identities...)
+			if err == nil {
+				var key []byte
+				if key, err = io.ReadAll(r); err == nil {
+					return key, nil
+				}
+			}
+			errs = append(errs, fmt.Errorf("age %s: %w", k.Recipient, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("the file has no keys encutitl can use")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// open decrypts the values in place and checks the MAC. It returns the
+// encrypted values for sopsReuse. Whatever looks encrypted is decrypted,
+// so files using the other sops selectors (encrypted_regex and the
+// like) open too.
+func (f *sopsFile) open(key []byte) (map[string]string, error) {
+	cache := map[string]string{}
+	h := sha512.New()
+	err := f.walk("", func(n *yaml.Node, ad string, _ bool) error {
+		if !strings.HasPrefix(n.Value, "ENC[AES256_GCM,") {
+			b, _ := sopsBytes(n)
+			h.Write(b)
+			return nil
+		}
+		b, typ, err := sopsOpen(key, n.Value, ad)
+		if err != nil {
+			return err
+		}
+		h.Write(b)
+		cache[sopsCacheKey(ad, typ, b)] = n.Value
+		n.Value, n.Tag, n.Style = string(b), "!!"+typ, 0
+		switch typ {
+		case "bool":
+			n.Value = strings.ToLower(n.Value)
+		case "bytes", "comment":
+			n.Tag = "!!str"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	mac, _, err := sopsOpen(key, f.meta.MAC, f.meta.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("MAC: %w", err)
+	}
+	if string(mac) != strings.ToUpper(hex.EncodeToString(h.Sum(nil))) {
+		return nil, errors.New("MAC mismatch, values were removed or changed")
+	}
+	return cache, nil
+}
+
+// marshal writes the file back, with the metadata if it has any, in
+// the layout sops writes: YAML indented by four, JSON by tabs.
+func (f *sopsFile) marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	if f.format == "dotenv" {
+		for _, l := range f.lines {
+			if l.value == nil {
+				buf.WriteString(l.raw + "\n")
+			} else {
+				buf.WriteString(l.key + "=" + l.value.Value + "\n")
+			}
+		}
+		if f.meta != nil {
+			for _, kv := range f.meta.flatten() {
+				buf.WriteString("sops_" + kv + "\n")
+			}
+		}
+		return buf.Bytes(), nil
+	}
+	top := f.doc.Content[0]
+	if f.meta != nil {
+		var k, v yaml.Node
+		k.SetString("sops")
+		if err := v.Encode(f.meta); err != nil {
+			return nil, err
+		}
+		top.Content = append(top.Content, &k, &v)
+		defer func() { top.Content = top.Content[:len(top.Content)-2] }()
+	}
+	if f.format == "json" {
+		if err := writeJSONNode(&buf, top, ""); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(4)
+	if err := enc.Encode(f.doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// flatten lays the metadata out as .env lines the way sops does.
+func (md *sopsMetadata) flatten() []string {
+	kv := map[string]string{
+		"lastmodified":       md.LastModified,
+		"mac":                md.MAC,
+		"unencrypted_suffix": md.UnencryptedSuffix,
+		"version":            md.Version,
+	}
+	for i, k := range md.Age {
+		kv[fmt.Sprintf("age__list_%d__map_recipient", i)] = k.Recipient
+		kv[fmt.Sprintf("age__list_%d__map_enc", i)] = k.Enc
+	}
+	for i, k := range md.Encutitl {
+		kv[fmt.Sprintf("encutitl__list_%d__map_enc", i)] = k.Enc
+	}
+	var lines []string
+	for k, v := range kv {
+		lines = append(lines, k+"="+strings.ReplaceAll(v, "\n", `\n`))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// writeJSONNode writes a node parsed from JSON (or YAML) as JSON, keeping
+// the order of keys.
+func writeJSONNode(buf *bytes.Buffer, n *yaml.Node, indent string) error {
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, end := "{", "}"
+		if n.Kind == yaml.SequenceNode {
+			open, end = "[", "]"
+		}
+		if len(n.Content) == 0 {
+			buf.WriteString(open + end)
+			return nil
+		}
+		buf.WriteString(open + "\n")
+		step := 1
+		if n.Kind == yaml.MappingNode {
+			step = 2
+		}
+		for i := 0; i < len(n.Content); i += step {
+			buf.WriteString(indent + "\t")
+			if step == 2 {
+				key, _ := json.Marshal(n.Content[i].Value)
+				buf.Write(key)
+				buf.WriteString(": ")
+			}
+			if err := writeJSONNode(buf, n.Content[i+step-1], indent+"\t"); err != nil {
+				return err
+			}
+			if i+step < len(n.Content) {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(indent + end)
+	case yaml.ScalarNode:
+		switch n.Tag {
+		case "!!int", "!!float", "!!bool", "!!null":
+			if json.Valid([]byte(n.Value)) {
+				buf.WriteString(n.Value)
+				return nil
+			}
+			if n.Tag == "!!null" {
+				buf.WriteString("null")
+				return nil
+			}
+		}
+		s, _ := json.Marshal(n.Value)
+		buf.Write(s)
+	default:
+		return errors.New("YAML aliases are not supported")
+	}
+	return nil
+}
+
+// decryptSOPSInput writes the plain file of a sops input.
+func decryptSOPSInput(data []byte, inputName string) {
+	f, err := parseSOPS(data, sopsFormatOfData(data))
+	if err != nil {
+		fail(exitAuth, tr("Decode input error:"), err)
+		return
+	}
+	key, err := sopsDataKey(f.meta)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	defer clear(key)
+	var plain []byte
+	if _, err = f.open(key); err == nil {
+		f.meta = nil
+		plain, err = f.marshal()
+	}
+	if err != nil {
+		fail(exitAuth, tr("Decryption error:"), err)
+		return
+	}
+	if *toStdout {
+		os.Stdout.Write(plain)
+		return
+	}
+	out := decryptedName(inputName)
+	if *inPlaceFlag {
+		out = inputName
+	}
+	decryptIntoFile(out, func(w io.Writer) (int64, restoreSource, error) {
+		n, err := w.Write(plain)
+		return int64(n), newRestoreSource(inputName, data, nil), err
+	})
+}
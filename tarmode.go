@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// --archive turns a directory into a single encrypted dir.tar.bin and
+// back. The tar is built in memory (no temporary file ever holds the
+// plaintext) and keeps relative paths, permissions, times and symlinks.
+// Extraction stays inside the target directory: absolute paths, ..
+// components and writes through symlinks are refused.
+
+var archiveFlag = flag.Bool("archive", false, "Encrypt a directory as one tar, or extract one when decrypting")
+
+// tarDir archives dir with entries named under its base name.
+func tarDir(dir string) ([]byte, error) {
+	dir = filepath.Clean(dir)
+	parent := filepath.Dir(dir)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		rel, err := filepath.Rel(parent, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", "" // ownership is not restored
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// untar extracts data into dest, creating it if needed, and returns the
+// number of entries written.
+func untar(data []byte, dest string, written func(name string, size int, sum []byte)) (int, error) {
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return 0, err
+	}
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		return 0, err
+	}
+	defer root.Close()
+
+	prefix := commonRoot(data)
+	type link struct{ name, target string }
+	var links []link
+	n := 0
+	rd := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		name := path.Clean(hdr.Name)
+		if !fs.ValidPath(name) || name == "." {
+			return n, fmt.Errorf("refusing archive entry %q", hdr.Name)
+		}
+		if name = strings.TrimPrefix(strings.TrimPrefix(name, prefix), "/"); name == "" {
+			continue
+		}
+		mode := fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := mkdirAllRoot(root, name, mode|0700); err != nil {
+				return n, err
+			}
+		case tar.TypeReg:
+			if err := mkdirAllRoot(root, path.Dir(name), 0700); err != nil {
+				return n, err
+			}
+			f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return n, err
+			}
+			h := sha256.New()
+			size, err := io.Copy(f, io.TeeReader(rd, h))
+			if err == nil {
+				err = f.Chmod(mode) // OpenFile mode is subject to umask
+			}
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return n, err
+			}
+			os.Chtimes(filepath.Join(dest, filepath.FromSlash(name)), hdr.AccessTime, hdr.ModTime)
+			if written != nil {
+				written(name, int(size), h.Sum(nil))
+			}
+		case tar.TypeSymlink:
+			// Created last, so no file is written through them.
+			links = append(links, link{name, hdr.Linkname})
+		default:
+			continue
+		}
+		n++
+	}
+	for _, l := range links {
+		parent := path.Dir(l.name)
+		if err := mkdirAllRoot(root, parent, 0700); err != nil {
+			return n, err
+		}
+		if err := noSymlinkParents(root, parent); err != nil {
+			return n, err
+		}
+		if err := os.Symlink(l.target, filepath.Join(dest, filepath.FromSlash(l.name))); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// commonRoot returns the top-level directory every entry of the tar is
+// under, as tarDir writes them, or "". Extraction strips it so dest
+// becomes that directory.
+func commonRoot(data []byte) string {
+	var root string
+	nested := false
+	rd := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := rd.Next()
+		if err != nil {
+			break
+		}
+		first, rest, _ := strings.Cut(path.Clean(hdr.Name), "/")
+		if root != "" && first != root || first == "." || first == ".." {
+			return ""
+		}
+		root = first
+		nested = nested || rest != ""
+	}
+	if !nested {
+		return ""
+	}
+	return root
+}
+
+// mkdirAllRoot is MkdirAll inside root.
+func mkdirAllRoot(root *os.Root, name string, mode fs.FileMode) error {
+	if name == "." {
+		return nil
+	}
+	if err := mkdirAllRoot(root, path.Dir(name), 0700); err != nil {
+		return err
+	}
+	err := root.Mkdir(name, mode)
+	if errors.Is(err, fs.ErrExist) {
+		if fi, serr := root.Lstat(name); serr == nil && !fi.IsDir() {
+			return fmt.Errorf("%s exists and is not a directory", name)
+		}
+		return nil
+	}
+	return err
+}
+
+func noSymlinkParents(root *os.Root, name string) error {
+	for p := name; p != "."; p = path.Dir(p) {
+		fi, err := root.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to create a symlink under symlink %s", p)
+		}
+	}
+	return nil
+}
+
+// extractName is the default directory for a decrypted archive.
+func extractName(inputName string) string {
+	for _, ext := range []string{".bin", ".age", ".jwe", ".tar"} {
+		inputName = strings.TrimSuffix(inputName, ext)
+	}
+	return inputName
+}
+
+// extractArchive unpacks a decrypted --archive into -o or the directory
+// named after the input. An existing directory is only extracted into
+// with --on-conflict overwrite; rename picks a free name.
+func extractArchive(plain []byte, inputName string, src restoreSource) {
+	dest := extractName(inputName)
+	if *outputFlag != "" {
+		dest = *outputFlag
+	}
+	if _, err := os.Stat(dest); err == nil {
+		switch *onConflict {
+		case "overwrite":
+		case "rename":
+			dest = freeName(dest)
+		default:
+			fail(exitIO, tr("Write error:"), fmt.Errorf("%s already exists, use -o or --on-conflict overwrite|rename", dest))
+			return
+		}
+	}
+	n, err := untar(plain, dest, func(name string, size int, sum []byte) {
+		src.recordSum(filepath.Join(dest, filepath.FromSlash(name)), size, sum)
+	})
+	if err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Printf(tr("Extracted %d entries to: %s")+"\n", n, dest)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// tpm seal replaces key.bin with a blob sealed to this machine's TPM
+// (/dev/tpmrm0 on Linux, TBS on Windows), optionally bound to PCR values
+// so it only unseals in the same boot state. A copied key.bin is useless
+// elsewhere. The sealing parent is the standard ECC storage root key,
+// which the TPM re-derives on every use, so nothing has to be persisted
+// in the TPM itself.
+
+var tpmSealedMagic = []byte("encutitl-tpm-sealed\n")
+
+type sealedKey struct {
+	PCRs    []uint `json:"pcrs,omitempty"`
+	Public  []byte `json:"public"`
+	Private []byte `json:"private"`
+}
+
+func runTPM(args []string) {
+	if len(args) == 0 || (args[0] != "seal" && args[0] != "unseal") {
+		fail(exitUsage, "Usage: tpm seal [--pcrs 0,7] | tpm unseal")
+		return
+	}
+	fs := flag.NewFlagSet("tpm "+args[0], flag.ExitOnError)
+	pcrList := fs.String("pcrs", "", "Bind the key to these SHA-256 PCRs, e.g. 7 for Secure Boot state")
+	addKeyFileFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args[1:])
+
+	keyFile := keyFilePath()
+	data, err := readPrivateKey(keyFile)
+	if err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	sealed := bytes.HasPrefix(data, tpmSealedMagic)
+	switch args[0] {
+	case "seal":
+		if sealed {
+			failf(exitUsage, tr("Error: %s is already sealed"), keyFile)
+			return
+		}
+		if len(data) != keySize {
+			failf(exitUsage, tr("Error: %s is not a %d byte key"), keyFile, keySize)
+			return
+		}
+		pcrs, err := parsePCRs(*pcrList)
+		if err != nil {
+			fail(exitUsage, tr("Error:"), err)
+			return
+		}
+		blob, err := sealKey(data, pcrs)
+		if err == nil {
+			err = writePrivateKey(keyFile, blob)
+		}
+		if err != nil {
+			fail(exitKey, tr("TPM error:"), err)
+			return
+		}
+		fmt.Printf(tr("Sealed %s to this TPM")+"\n", keyFile)
+	case "unseal":
+		if !sealed {
+			failf(exitUsage, tr("Error: %s is not sealed"), keyFile)
+			return
+		}
+		key, err := unsealKey(data)
+		if err == nil {
+			err = writePrivateKey(keyFile, key)
+		}
+		if err != nil {
+			fail(exitKey, tr("TPM error:"), err)
+			return
+		}
+		fmt.Println(tr("Unsealed"), keyFile)
+	}
+}
+
+func parsePCRs(s string) ([]uint, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var pcrs []uint
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(f), 10, 8)
+		if err != nil || n > 23 {
+			return nil, fmt.Errorf("bad PCR %q", f)
+		}
+		pcrs = append(pcrs, uint(n))
+	}
+	return pcrs, nil
+}
+
+// readKeyFile returns key.bin, unsealing it first if it is TPM sealed.
+func readKeyFile() ([]byte, error) {
+	data, err := readPrivateKey(keyFilePath())
+	if err != nil || !bytes.HasPrefix(data, tpmSealedMagic) {
+		return lockedCopy(data), err
+	}
+	key, err := unsealKey(data)
+	return lockedCopy(key), err
+}
+
+func pcrSelection(pcrs []uint) tpm2.TPMLPCRSelection {
+	return tpm2.TPMLPCRSelection{PCRSelections: []tpm2.TPMSPCRSelection{{
+		Hash:      tpm2.TPMAlgSHA256,
+		PCRSelect: tpm2.PCClientCompatible.PCRs(pcrs...),
+	}}}
+}
+
+// createSRK loads the storage root key. Callers flush it when done.
+func createSRK(tpm transport.TPM) (*tpm2.CreatePrimaryResponse, error) {
+	return tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(tpm)
+}
+
+func flush(tpm transport.TPM, h tpm2.TPMHandle) {
+	tpm2.FlushContext{FlushHandle: h}.Execute(tpm)
+}
+
+func sealKey(key []byte, pcrs []uint) ([]byte, error) {
+	tpm, err := transport.OpenTPM()
+	if err != nil {
+		return nil, fmt.Errorf("open TPM: %w", err)
+	}
+	defer tpm.Close()
+	srk, err := createSRK(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("create SRK: %w", err)
+	}
+	defer flush(tpm, srk.ObjectHandle)
+
+	attrs := tpm2.TPMAObject{FixedTPM: true, FixedParent: true, NoDA: true, UserWithAuth: true}
+	var policy []byte
+	if len(pcrs) > 0 {
+		// A trial session computes the policy digest over the current
+		// PCR values.
+		sess, closeSess, err := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16, tpm2.Trial())
+		if err != nil {
+			return nil, err
+		}
+		defer closeSess()
+		if _, err := (tpm2.PolicyPCR{PolicySession: sess.Handle(), Pcrs: pcrSelection(pcrs)}).Execute(tpm); err != nil {
+			return nil, fmt.Errorf("PCR policy: %w", err)
+		}
+		pgd, err := tpm2.PolicyGetDigest{PolicySession: sess.Handle()}.Execute(tpm)
+		if err != nil {
+			return nil, err
+		}
+		policy = pgd.PolicyDigest.Buffer
+		attrs.UserWithAuth = false
+	}
+
+	created, err := tpm2.Create{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InSensitive: tpm2.TPM2BSensitiveCreate{Sensitive: &tpm2.TPMSSensitiveCreate{
+			Data: tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{Buffer: key}),
+		}},
+		InPublic: tpm2.New2B(tpm2.TPMTPublic{
+			Type:             tpm2.TPMAlgKeyedHash,
+			NameAlg:          tpm2.TPMAlgSHA256,
+			ObjectAttributes: attrs,
+			AuthPolicy:       tpm2.TPM2BDigest{Buffer: policy},
+		}),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("seal: %w", err)
+	}
+	blob, err := json.Marshal(sealedKey{
+		PCRs:    pcrs,
+		Public:  tpm2.Marshal(created.OutPublic),
+		Private: tpm2.Marshal(created.OutPrivate),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, tpmSealedMagic...), blob...), nil
+}
+
+func unsealKey(data []byte) ([]byte, error) {
+	var sk sealedKey
+	if err := json.Unmarshal(bytes.TrimPrefix(data, tpmSealedMagic), &sk); err != nil {
+		return nil, fmt.Errorf("malformed sealed key: %w", err)
+	}
+	pub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](sk.Public)
+	if err != nil {
+		return nil, fmt.Errorf("malformed sealed key: %w", err)
+	}
+	priv, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](sk.Private)
+	if err != nil {
+		return nil, fmt.Errorf("malformed sealed key: %w", err)
+	}
+
+	tpm, err := transport.OpenTPM()
+	if err != nil {
+		return nil, fmt.Errorf("sealed key needs the TPM: %w", err)
+	}
+	defer tpm.Close()
+	srk, err := createSRK(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("create SRK: %w", err)
+	}
+	defer flush(tpm, srk.ObjectHandle)
+
+	loaded, err := tpm2.Load{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InPrivate:    *priv,
+		InPublic:     *pub,
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("load sealed key (sealed on another machine?): %w", err)
+	}
+	defer flush(tpm, loaded.ObjectHandle)
+
+	auth := tpm2.PasswordAuth(nil)
+	if len(sk.PCRs) > 0 {
+		auth = tpm2.Policy(tpm2.TPMAlgSHA256, 16, func(tpm transport.TPM, h tpm2.TPMISHPolicy, _ tpm2.TPM2BNonce) error {
+			_, err := tpm2.PolicyPCR{PolicySession: h, Pcrs: pcrSelection(sk.PCRs)}.Execute(tpm)
+			return err
+		})
+	}
+	srkPub, err := srk.OutPublic.Contents()
+	if err != nil {
+		return nil, err
+	}
+	// The salted session encrypts the key on its way back from the TPM.
+	out, err := tpm2.Unseal{
+		ItemHandle: tpm2.AuthHandle{Handle: loaded.ObjectHandle, Name: loaded.Name, Auth: auth},
+	}.Execute(tpm, tpm2.HMAC(tpm2.TPMAlgSHA256, 16,
+		tpm2.AESEncryption(128, tpm2.EncryptOut),
+		tpm2.Salted(srk.ObjectHandle, *srkPub)))
+	if errors.Is(err, tpm2.TPMRCPolicyFail) {
+		return nil, fmt.Errorf("PCRs %v changed since the key was sealed", sk.PCRs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unseal: %w", err)
+	}
+	return out.OutData.Buffer, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A transfer is one JSON metadata message, the file in data messages, an
+// empty message marking the end and an "ok" acknowledgement.
+
+type transferMeta struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func runSend(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	file := fs.String("f", "", "File to send")
+	to := fs.String("to", "", "Receiver address host:port or unix:/path")
+	fs.StringVar(proxyFlag, "proxy", "", "Connect through a socks5:// proxy")
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *file == "" || *to == "" {
+		fail(exitUsage, tr("Error: send needs -f <file> and --to <host:port>"))
+		return
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+
+	id, err := loadOrGenerateIdentity()
+	if err != nil {
+		fail(exitKey, tr("Identity error:"), err)
+		return
+	}
+	nc, err := noiseDial(*to, id)
+	if err != nil {
+		fail(exitIO, tr("Connect error:"), err)
+		return
+	}
+	defer nc.Close()
+
+	if err := sendFile(nc, f, transferMeta{Name: filepath.Base(*file), Size: st.Size()}); err != nil {
+		fail(exitIO, tr("Send error:"), err)
+		return
+	}
+	fmt.Printf(tr("Sent %s (%d bytes) to %s")+"\n", *file, st.Size(), *to)
+}
+
+func sendFile(nc *noiseConn, r io.Reader, meta transferMeta) error {
+	m, _ := json.Marshal(meta)
+	if err := nc.WriteMsg(m); err != nil {
+		return err
+	}
+	buf := make([]byte, noiseMaxPayload)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := nc.WriteMsg(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := nc.WriteMsg(nil); err != nil {
+		return err
+	}
+	ack, err := nc.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if string(ack) != "ok" {
+		return fmt.Errorf("receiver: %s", ack)
+	}
+	return nil
+}
+
+func runReceive(args []string) {
+	fs := flag.NewFlagSet("receive", flag.ExitOnError)
+	var listen listFlag
+	fs.Var(&listen, "listen", "Listen spec, e.g. :7788, tcp6:[::]:7788 or unix:/path (repeatable, default :7788)")
+	outDir := fs.String("o", ".", "Directory to save the received file in")
+	from := fs.String("from", "", "Only accept a sender with this key fingerprint")
+	fs.Var(&maxInputSize, "max-input-size", "Refuse files larger than this, e.g. 4G (0 for no limit)")
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+
+	id, err := loadOrGenerateIdentity()
+	if err != nil {
+		fail(exitKey, tr("Identity error:"), err)
+		return
+	}
+	if len(listen) == 0 {
+		listen = listFlag{":7788"}
+	}
+	for _, l := range listen {
+		if spec, err := parseListenSpec(l); err == nil && spec.certFile != "" {
+			fail(exitUsage, tr("Error: receive is already Noise encrypted, TLS listener options are for server modes"))
+			return
+		}
+	}
+	lns, err := listenAll(listen)
+	if err != nil {
+		fail(exitIO, tr("Listen error:"), err)
+		return
+	}
+	for _, ln := range lns {
+		defer ln.Close()
+		fmt.Printf(tr("Waiting on %s %s, identity %s")+"\n", ln.Addr().Network(), ln.Addr(), displayFingerprint(id.Public))
+	}
+
+	conn, err := acceptAny(lns)
+	if err != nil {
+		fail(exitIO, tr("Accept error:"), err)
+		return
+	}
+	nc, err := noiseAccept(conn, id)
+	if err != nil {
+		conn.Close()
+		fail(exitAuth, tr("Handshake error:"), err)
+		return
+	}
+	defer nc.Close()
+
+	sender := displayFingerprint(nc.peerStatic)
+	if *from != "" && !matchFingerprint(*from, nc.peerStatic) {
+		nc.WriteMsg([]byte("sender not accepted"))
+		fail(exitAuth, tr("Error: rejected sender"), sender)
+		return
+	}
+	if *a11yFlag {
+		fmt.Printf(tr("Connected to sender at %s, key %s.")+"\n", conn.RemoteAddr(), sender)
+	} else {
+		fmt.Println(tr("Sender"), conn.RemoteAddr(), sender)
+	}
+
+	path, n, err := receiveFile(nc, *outDir)
+	if err != nil {
+		fail(exitIO, tr("Receive error:"), err)
+		return
+	}
+	fmt.Printf(tr("Received %s (%d bytes)")+"\n", path, n)
+}
+
+func receiveFile(nc *noiseConn, dir string) (string, int64, error) {
+	m, err := nc.ReadMsg()
+	if err != nil {
+		return "", 0, err
+	}
+	var meta transferMeta
+	if err := json.Unmarshal(m, &meta); err != nil {
+		return "", 0, err
+	}
+	name := filepath.Base(meta.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", 0, fmt.Errorf("bad file name %q", meta.Name)
+	}
+	if meta.Size < 0 {
+		return "", 0, fmt.Errorf("bad file size %d", meta.Size)
+	}
+	if err := checkInputSize(meta.Size); err != nil {
+		nc.WriteMsg([]byte("file too large"))
+		return "", 0, err
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		nc.WriteMsg([]byte("cannot create file"))
+		return "", 0, err
+	}
+
+	var n int64
+	for {
+		chunk, err := nc.ReadMsg()
+		if err == nil && len(chunk) == 0 {
+			break
+		}
+		if err == nil && n+int64(len(chunk)) > meta.Size {
+			// The announced size is what --max-input-size accepted, so
+			// the sender cannot stream past it.
+			nc.WriteMsg([]byte("size mismatch"))
+			err = errors.New("sender went past the announced size")
+		}
+		if err == nil {
+			_, err = f.Write(chunk)
+			n += int64(len(chunk))
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(path)
+			return "", 0, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", 0, err
+	}
+	if n != meta.Size {
+		os.Remove(path)
+		nc.WriteMsg([]byte("size mismatch"))
+		return "", 0, errors.New("size mismatch, transfer incomplete")
+	}
+	return path, n, nc.WriteMsg([]byte("ok"))
+}
+
+func runIdentity(args []string) {
+	if len(args) > 0 && args[0] == "import" {
+		runIdentityImport(args[1:])
+		return
+	}
+	fs := flag.NewFlagSet("identity", flag.ExitOnError)
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	id, err := loadOrGenerateIdentity()
+	if err != nil {
+		fail(exitKey, tr("Identity error:"), err)
+		return
+	}
+	fmt.Println(displayFingerprint(id.Public))
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// transparency publishes signed manifests of encrypted artifacts (size,
+// per-chunk SHA-256, the encutitl header) and serves them read-only. The
+// server holds manifests only, no keys and no artifacts, so it can be
+// public: anyone with a copy of an artifact checks it chunk by chunk
+// against the manifest, and the manifest against the publisher's
+// signing key.
+//
+//	GET /v1/artifacts              names
+//	GET /v1/artifacts/NAME         manifest
+//	GET /v1/artifacts/NAME/header  raw encutitl header
+//	POST /v1/artifacts/NAME/verify body: artifact, reply: bad chunks
+//
+// Errors carry a code and request ID, see apierror.go.
+
+const defaultChunkSize = 1 << 20
+
+type manifest struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	ChunkSize int       `json:"chunk_size"`
+	Chunks    []string  `json:"chunks"`
+	Header    []byte    `json:"header,omitempty"`
+	Published time.Time `json:"published"`
+	Signer    []byte    `json:"signer"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+// signedBytes is what the signature covers: the manifest without it.
+func (m manifest) signedBytes() ([]byte, error) {
+	m.Signature = nil
+	return json.Marshal(m)
+}
+
+func (m *manifest) verifySignature(pub ed25519.PublicKey) error {
+	if pub != nil && !bytes.Equal(pub, m.Signer) {
+		return errors.New("manifest is signed by a different key")
+	}
+	msg, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	if len(m.Signer) != ed25519.PublicKeySize || !ed25519.Verify(m.Signer, msg, m.Signature) {
+		return errors.New("manifest signature INVALID")
+	}
+	return nil
+}
+
+func chunkHashes(data []byte, size int) []string {
+	var out []string
+	for off := 0; off < len(data); off += size {
+		sum := sha256.Sum256(data[off:min(off+size, len(data))])
+		out = append(out, hex.EncodeToString(sum[:]))
+	}
+	return out
+}
+
+// badChunks compares data against m and returns the mismatching chunk
+// indexes, with a size mismatch reported as an error.
+func (m *manifest) badChunks(data []byte) ([]int, error) {
+	if int64(len(data)) != m.Size {
+		return nil, fmt.Errorf("size is %d, manifest says %d", len(data), m.Size)
+	}
+	var bad []int
+	for i, h := range chunkHashes(data, m.ChunkSize) {
+		if i >= len(m.Chunks) || h != m.Chunks[i] {
+			bad = append(bad, i)
+		}
+	}
+	return bad, nil
+}
+
+func runTransparency(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "Usage: transparency publish|serve|check [flags]")
+		return
+	}
+	switch args[0] {
+	case "publish":
+		runPublish(args[1:])
+	case "serve":
+		runTransparencyServe(args[1:])
+	case "check":
+		runTransparencyCheck(args[1:])
+	default:
+		fail(exitUsage, tr("Error: unknown transparency command"), args[0])
+	}
+}
+
+func runPublish(args []string) {
+	fs := flag.NewFlagSet("transparency publish", flag.ExitOnError)
+	file := fs.String("f", "", "Encrypted artifact to publish")
+	dir := fs.String("manifests", "manifests", "Directory the server serves manifests from")
+	chunk := fs.Int("chunk-size", defaultChunkSize, "Chunk size in bytes")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *file == "" || *chunk <= 0 {
+		fail(exitUsage, tr("Error: publish needs -f <artifact> and a positive --chunk-size"))
+		return
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	priv, err := loadOrGenerateSigningKey()
+	if err != nil {
+		fail(exitKey, tr("Signing key error:"), err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	m := manifest{
+		Name:      filepath.Base(*file),
+		Size:      int64(len(data)),
+		SHA256:    hex.EncodeToString(sum[:]),
+		ChunkSize: *chunk,
+		Chunks:    chunkHashes(data, *chunk),
+		Published: time.Now().UTC(),
+		Signer:    priv.Public().(ed25519.PublicKey),
+	}
+	if hdr, prefix, err := encutil.ParseHeader(data); err == nil && hdr != nil {
+		m.Header = prefix
+	}
+	msg, err := m.signedBytes()
+	if err != nil {
+		fail(exitError, tr("Error:"), err)
+		return
+	}
+	m.Signature = ed25519.Sign(priv, msg)
+	out, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		fail(exitError, tr("Error:"), err)
+		return
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	path := filepath.Join(*dir, m.Name+".json")
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Println(tr("Manifest saved to:"), path)
+}
+
+// manifestStore serves the manifests in a directory, rereading them when
+// any changes so publishing needs no restart.
+type manifestStore struct {
+	dir string
+
+	mu      sync.Mutex
+	loaded  time.Time
+	entries map[string]*manifest
+}
+
+func (s *manifestStore) all() (map[string]*manifest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, err := os.Stat(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	newest := st.ModTime()
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	if s.entries != nil && !newest.After(s.loaded) {
+		return s.entries, nil
+	}
+	entries := map[string]*manifest{}
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		m := new(manifest)
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if err := m.verifySignature(nil); err != nil {
+			fmt.Fprintf(os.Stderr, tr("Skipping %s: %v")+"\n", p, err)
+			continue
+		}
+		entries[m.Name] = m
+	}
+	s.entries, s.loaded = entries, newest
+	return entries, nil
+}
+
+func (s *manifestStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.all()
+	if err != nil {
+		writeAPIError(w, r, codeUnavailable, "manifests unavailable", err)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v1/artifacts")
+	if !ok {
+		writeAPIError(w, r, codeNotFound, "no such endpoint", nil)
+		return
+	}
+	rest = strings.Trim(rest, "/")
+	if rest == "" {
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeJSON(w, names)
+		return
+	}
+	name, action, _ := strings.Cut(rest, "/")
+	m, ok := entries[name]
+	if !ok {
+		writeAPIError(w, r, codeNotFound, "no artifact "+name, nil)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, m)
+	case action == "header" && r.Method == http.MethodGet:
+		if m.Header == nil {
+			writeAPIError(w, r, codeNotFound, name+" is not an encutitl file", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(m.Header)
+	case action == "verify" && r.Method == http.MethodPost:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, m.Size+1))
+		if err != nil {
+			code := errorCode(err)
+			if code == codeInternal {
+				code = codeBadRequest // the client went away mid-body
+			}
+			writeAPIError(w, r, code, "artifact larger than published", err)
+			return
+		}
+		bad, err := m.badChunks(data)
+		resp := map[string]any{"ok": err == nil && len(bad) == 0, "bad_chunks": bad}
+		if err != nil {
+			resp["error"] = err.Error()
+		}
+		writeJSON(w, resp)
+	case action == "" || action == "header" || action == "verify":
+		writeAPIError(w, r, codeMethodNotAllowed, r.Method+" not allowed on "+r.URL.Path, nil)
+	default:
+		writeAPIError(w, r, codeNotFound, "no such endpoint", nil)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func runTransparencyServe(args []string) {
+	fs := flag.NewFlagSet("transparency serve", flag.ExitOnError)
+	var listen listFlag
+	fs.Var(&listen, "listen", "Listen spec, e.g. :8080 or :8443,cert=server.pem,key=server.key (repeatable, default :8080)")
+	dir := fs.String("manifests", "manifests", "Directory of published manifests")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if len(listen) == 0 {
+		listen = listFlag{":8080"}
+	}
+	lns, err := listenAll(listen)
+	if err != nil {
+		fail(exitIO, tr("Listen error:"), err)
+		return
+	}
+	store := &manifestStore{dir: *dir}
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		fmt.Printf(tr("Serving manifests from %s on %s")+"\n", *dir, ln.Addr())
+		srv := &http.Server{Handler: store, ReadHeaderTimeout: 10 * time.Second}
+		go func() { errs <- srv.Serve(ln) }()
+	}
+	fail(exitIO, tr("Serve error:"), <-errs)
+}
+
+func runTransparencyCheck(args []string) {
+	fs := flag.NewFlagSet("transparency check", flag.ExitOnError)
+	file := fs.String("f", "", "Artifact to check")
+	server := fs.String("server", "", "Transparency server URL, e.g. https://artifacts.example.com")
+	pubFile := fs.String("pub", "", "Publisher public key file; without it any validly signed manifest is accepted")
+	fs.StringVar(proxyFlag, "proxy", "", "Proxy for the request")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *file == "" || *server == "" {
+		fail(exitUsage, tr("Error: check needs -f <artifact> and --server <url>"))
+		return
+	}
+	var pub ed25519.PublicKey
+	if *pubFile != "" {
+		var err error
+		if pub, err = readPublicKey(*pubFile); err != nil {
+			fail(exitKey, tr("Public key error:"), err)
+			return
+		}
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	client, err := httpClient()
+	if err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	u := strings.TrimRight(*server, "/") + "/v1/artifacts/" + filepath.Base(*file)
+	resp, err := client.Get(u)
+	if err != nil {
+		fail(exitIO, tr("Connect error:"), err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(exitIO, tr("Connect error:"), u+":", readAPIError(resp))
+		return
+	}
+	m := new(manifest)
+	if err := json.NewDecoder(resp.Body).Decode(m); err != nil {
+		fail(exitIO, tr("Manifest error:"), err)
+		return
+	}
+	if err := m.verifySignature(pub); err != nil {
+		fail(exitAuth, tr("Manifest error:"), err)
+		return
+	}
+	bad, err := m.badChunks(data)
+	if err != nil {
+		fail(exitAuth, tr("Artifact MODIFIED:"), err)
+		return
+	}
+	if len(bad) > 0 {
+		failf(exitAuth, tr("Artifact MODIFIED: chunks %v of %d differ"), bad, len(m.Chunks))
+		return
+	}
+	fmt.Printf(tr("Artifact OK, %d chunks match the manifest published %s by %s")+"\n",
+		len(m.Chunks), m.Published.Format(time.RFC3339), base64.RawURLEncoding.EncodeToString(m.Signer))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flynn/noise"
+)
+
+// Peer-to-peer transfers run over a Noise handshake between the managed
+// transport identities of both sides, so no certificates are involved.
+// The dialer uses IK when it already pinned the listener's key and XX
+// (then pins it, see known_peers) otherwise. A single pattern byte sent
+// before the handshake tells the listener which one follows.
+
+const (
+	identityKeyFile = "identity.key"
+	noiseMaxMsg     = 65535
+	noiseMaxPayload = noiseMaxMsg - 16
+
+	patternXX byte = 1
+	patternIK byte = 2
+)
+
+var noiseSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+
+type noiseConn struct {
+	conn       net.Conn
+	send, recv *noise.CipherState
+	peerStatic []byte
+}
+
+func identityKeyPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, identityKeyFile), nil
+}
+
+// loadOrGenerateIdentity returns the X25519 transport identity, creating
+// it on first use.
+func loadOrGenerateIdentity() (noise.DHKey, error) {
+	path, err := identityKeyPath()
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	raw, err := readPrivateKey(path)
+	if os.IsNotExist(err) {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return noise.DHKey{}, err
+		}
+		if err := writePrivateKey(path, priv.Bytes()); err != nil {
+			return noise.DHKey{}, err
+		}
+		return noise.DHKey{Private: priv.Bytes(), Public: priv.PublicKey().Bytes()}, nil
+	}
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return noise.DHKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return noise.DHKey{Private: priv.Bytes(), Public: priv.PublicKey().Bytes()}, nil
+}
+
+func noiseDial(addr string, id noise.DHKey) (*noiseConn, error) {
+	peers, err := loadKnownPeers()
+	if err != nil {
+		return nil, err
+	}
+	pinned := peers[addr]
+
+	network, dialAddr := "tcp", addr
+	if strings.HasPrefix(addr, "unix:") {
+		network, dialAddr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	conn, err := dial(network, dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := noise.Config{
+		CipherSuite:   noiseSuite,
+		Pattern:       noise.HandshakeXX,
+		Initiator:     true,
+		StaticKeypair: id,
+		Prologue:      []byte("encutitl transfer"),
+	}
+	pattern := patternXX
+	if pinned != nil {
+		cfg.Pattern = noise.HandshakeIK
+		cfg.PeerStatic = pinned
+		pattern = patternIK
+	}
+	if _, err := conn.Write([]byte{pattern}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	nc, err := noiseHandshake(conn, cfg)
+	if err != nil {
+		conn.Close()
+		if pinned != nil {
+			return nil, fmt.Errorf("handshake with %s failed against pinned key %s (the peer may have changed keys): %w", addr, displayFingerprint(pinned), err)
+		}
+		return nil, err
+	}
+	if err := checkPeerKey(addr, nc.peerStatic); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+func noiseAccept(conn net.Conn, id noise.DHKey) (*noiseConn, error) {
+	var pattern [1]byte
+	if _, err := io.ReadFull(conn, pattern[:]); err != nil {
+		return nil, err
+	}
+	cfg := noise.Config{
+		CipherSuite:   noiseSuite,
+		StaticKeypair: id,
+		Prologue:      []byte("encutitl transfer"),
+	}
+	switch pattern[0] {
+	case patternXX:
+		cfg.Pattern = noise.HandshakeXX
+	case patternIK:
+		cfg.Pattern = noise.HandshakeIK
+	default:
+		return nil, fmt.Errorf("unknown handshake pattern %d", pattern[0])
+	}
+	return noiseHandshake(conn, cfg)
+}
+
+func noiseHandshake(conn net.Conn, cfg noise.Config) (*noiseConn, error) {
+	hs, err := noise.NewHandshakeState(cfg)
+	if err != nil {
+		return nil, err
+	}
+	writing := cfg.Initiator
+	for {
+		var cs0, cs1 *noise.CipherState
+		if writing {
+			var msg []byte
+			msg, cs0, cs1, err = hs.WriteMessage(nil, nil)
+			if err == nil {
+				err = writeFrame(conn, msg)
+			}
+		} else {
+			var msg []byte
+			msg, err = readFrame(conn)
+			if err == nil {
+				_, cs0, cs1, err = hs.ReadMessage(nil, msg)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cs0 != nil {
+			nc := &noiseConn{conn: conn, send: cs0, recv: cs1, peerStatic: hs.PeerStatic()}
+			if !cfg.Initiator {
+				nc.send, nc.recv = cs1, cs0
+			}
+			return nc, nil
+		}
+		writing = !writing
+	}
+}
+
+func (c *noiseConn) WriteMsg(p []byte) error {
+	if len(p) > noiseMaxPayload {
+		return errors.New("noise message too large")
+	}
+	msg, err := c.send.Encrypt(nil, nil, p)
+	if err != nil {
+		return err
+	}
+	return writeFrame(c.conn, msg)
+}
+
+func (c *noiseConn) ReadMsg() ([]byte, error) {
+	msg, err := readFrame(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	return c.recv.Decrypt(nil, nil, msg)
+}
+
+func (c *noiseConn) Close() error {
+	return c.conn.Close()
+}
+
+func writeFrame(w io.Writer, msg []byte) error {
+	if len(msg) > noiseMaxMsg {
+		return errors.New("frame too large")
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
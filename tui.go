@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// tui is a terminal front end for the common cases: browse to a file,
+// pick recipients and options, and watch the run. It does not encrypt
+// anything itself. It builds the same command line one would type,
+// shows it, and runs it as a child process, so the TUI can never
+// disagree with the CLI and doubles as a way to learn the flags.
+//
+// The child has no terminal to prompt on: SSH key passphrases come from
+// ENCUTITL_PASSPHRASE or the passphrase file in a profile, as in scripts.
+
+type tuiScreen int
+
+const (
+	screenBrowse tuiScreen = iota
+	screenOptions
+	screenRun
+)
+
+// tuiToggle is one checkbox on the options screen.
+type tuiToggle struct {
+	label string
+	args  []string
+	mode  string // "encrypt", "decrypt", or "" for both
+	on    bool
+}
+
+type tuiModel struct {
+	screen tuiScreen
+	err    error
+
+	// screenBrowse
+	dir     string
+	entries []os.DirEntry
+	cursor  int
+
+	// screenOptions
+	file    string
+	decrypt bool
+	toggles []*tuiToggle
+	row     int
+
+	// screenRun
+	args     []string
+	nextLine func() tea.Cmd
+	output   []string
+	started  time.Time
+	elapsed  time.Duration
+	done     bool
+	runErr   error
+	spin     int
+}
+
+type (
+	tuiLineMsg string
+	tuiDoneMsg struct{ err error }
+	tuiTickMsg struct{}
+)
+
+func runTUI(args []string) {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fail(exitUsage, "Usage: tui")
+		return
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+	m := &tuiModel{}
+	m.chdir(dir)
+	if _, err := tea.NewProgram(m, tea.WithAltScreen()).Run(); err != nil {
+		fail(exitError, tr("TUI error:"), err)
+	}
+}
+
+func (m *tuiModel) Init() tea.Cmd { return nil }
+
+func (m *tuiModel) chdir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		m.err = err
+		return
+	}
+	visible := entries[:0]
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			visible = append(visible, e)
+		}
+	}
+	sort.SliceStable(visible, func(i, j int) bool { return visible[i].IsDir() && !visible[j].IsDir() })
+	m.dir, m.entries, m.cursor, m.err = dir, visible, 0, nil
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		switch m.screen {
+		case screenBrowse:
+			return m, m.updateBrowse(msg.String())
+		case screenOptions:
+			return m, m.updateOptions(msg.String())
+		case screenRun:
+			if m.done {
+				m.screen = screenBrowse
+				m.chdir(m.dir) // show the new files
+			}
+		}
+	case tuiLineMsg:
+		m.output = append(m.output, string(msg))
+		return m, m.nextLine()
+	case tuiDoneMsg:
+		m.done, m.runErr, m.elapsed = true, msg.err, time.Since(m.started)
+	case tuiTickMsg:
+		if !m.done {
+			m.spin++
+			m.elapsed = time.Since(m.started)
+			return m, tuiTick()
+		}
+	}
+	return m, nil
+}
+
+func (m *tuiModel) updateBrowse(key string) tea.Cmd {
+	switch key {
+	case "q", "esc":
+		return tea.Quit
+	case "up", "k":
+		m.cursor = max(m.cursor-1, 0)
+	case "down", "j":
+		m.cursor = min(m.cursor+1, max(len(m.entries)-1, 0))
+	case "backspace", "left", "h":
+		m.chdir(filepath.Dir(m.dir))
+	case "enter", "right", "l":
+		if len(m.entries) == 0 {
+			break
+		}
+		e := m.entries[m.cursor]
+		path := filepath.Join(m.dir, e.Name())
+		if e.IsDir() {
+			m.chdir(path)
+		} else {
+			m.selectFile(path)
+		}
+	}
+	return nil
+}
+
+func (m *tuiModel) selectFile(path string) {
+	m.screen, m.file, m.row = screenOptions, path, 0
+	switch filepath.Ext(path) {
+	case ".bin", ".age", ".jwe":
+		m.decrypt = true
+	default:
+		m.decrypt = false
+	}
+	if m.toggles == nil {
+		m.toggles = tuiToggles()
+	}
+}
+
+// tuiToggles lists the public keys found as recipients, then options.
+func tuiToggles() []*tuiToggle {
+	var out []*tuiToggle
+	var pubs []string
+	if home, err := os.UserHomeDir(); err == nil {
+		pubs, _ = filepath.Glob(filepath.Join(home, ".ssh", "*.pub"))
+	}
+	pq := pqPubPath()
+	if _, err := os.Stat(pq); err == nil {
+		pubs = append(pubs, pq)
+	}
+	for _, pub := range pubs {
+		out = append(out, &tuiToggle{label: "Encrypt to " + pub, args: []string{"--recipient", pub}, mode: "encrypt"})
+	}
+	return append(out,
+		&tuiToggle{label: "Pad to hide the size", args: []string{"--pad", "padme"}, mode: "encrypt"},
+		&tuiToggle{label: "Sign the output", args: []string{"--sign"}, mode: "encrypt"},
+		&tuiToggle{label: "Write a .meta sidecar", args: []string{"--metadata"}, mode: "encrypt"},
+		&tuiToggle{label: "Decompress in an isolated worker", args: []string{"--isolate"}, mode: "decrypt"},
+		&tuiToggle{label: "Replace the file in place", args: []string{"--in-place"}},
+	)
+}
+
+// visible returns the toggles that apply to the current mode.
+func (m *tuiModel) visible() []*tuiToggle {
+	mode := "encrypt"
+	if m.decrypt {
+		mode = "decrypt"
+	}
+	var out []*tuiToggle
+	for _, t := range m.toggles {
+		if t.mode == "" || t.mode == mode {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Rows on the options screen: the mode, the toggles, then Run.
+func (m *tuiModel) updateOptions(key string) tea.Cmd {
+	toggles := m.visible()
+	last := len(toggles) + 1
+	switch key {
+	case "q", "esc", "backspace":
+		m.screen = screenBrowse
+	case "up", "k":
+		m.row = max(m.row-1, 0)
+	case "down", "j", "tab":
+		m.row = min(m.row+1, last)
+	case " ", "x":
+		switch {
+		case m.row == 0:
+			m.decrypt = !m.decrypt
+		case m.row < last:
+			toggles[m.row-1].on = !toggles[m.row-1].on
+		}
+	case "enter":
+		switch {
+		case m.row == 0:
+			m.decrypt = !m.decrypt
+		case m.row < last:
+			toggles[m.row-1].on = !toggles[m.row-1].on
+		default:
+			return m.start()
+		}
+	}
+	m.row = min(m.row, len(m.visible())+1)
+	return nil
+}
+
+// commandArgs is the command line for the current choices.
+func (m *tuiModel) commandArgs() []string {
+	args := []string{"-e"}
+	if m.decrypt {
+		args[0] = "-d"
+	}
+	args = append(args, "-f", m.file)
+	for _, t := range m.visible() {
+		if t.on {
+			args = append(args, t.args...)
+		}
+	}
+	return args
+}
+
+func (m *tuiModel) start() tea.Cmd {
+	m.screen, m.args, m.output = screenRun, m.commandArgs(), nil
+	m.done, m.runErr, m.spin = false, nil, 0
+	m.started = time.Now()
+	exe, err := os.Executable()
+	if err != nil {
+		m.done, m.runErr = true, err
+		return nil
+	}
+	cmd := exec.Command(exe, m.args...)
+	cmd.Dir = m.dir // stdin stays empty: no terminal to prompt on
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		m.done, m.runErr = true, err
+		return nil
+	}
+	cmd.Stdout, cmd.Stderr = pw, pw
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		m.done, m.runErr = true, err
+		return nil
+	}
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(pr)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+		io.Copy(io.Discard, pr) // past an overlong line
+		close(lines)
+	}()
+	m.nextLine = func() tea.Cmd {
+		return func() tea.Msg {
+			if line, ok := <-lines; ok {
+				return tuiLineMsg(line)
+			}
+			pr.Close()
+			return tuiDoneMsg{cmd.Wait()}
+		}
+	}
+	return tea.Batch(m.nextLine(), tuiTick())
+}
+
+func tuiTick() tea.Cmd {
+	return tea.Tick(100*time.Millisecond, func(time.Time) tea.Msg { return tuiTickMsg{} })
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+	switch m.screen {
+	case screenBrowse:
+		fmt.Fprintf(&b, "encutitl  %s\n\n", m.dir)
+		if len(m.entries) == 0 {
+			b.WriteString("  (empty)\n")
+		}
+		for i, e := range m.entries {
+			name := e.Name()
+			if e.IsDir() {
+				name += "/"
+			}
+			fmt.Fprintf(&b, "%s %s\n", cursorMark(i == m.cursor), name)
+		}
+		b.WriteString("\nenter open/select · backspace up · q quit\n")
+	case screenOptions:
+		fmt.Fprintf(&b, "encutitl  %s\n\n", m.file)
+		mode := "encrypt"
+		if m.decrypt {
+			mode = "decrypt"
+		}
+		fmt.Fprintf(&b, "%s Mode: %s\n", cursorMark(m.row == 0), mode)
+		toggles := m.visible()
+		for i, t := range toggles {
+			box := "[ ]"
+			if t.on {
+				box = "[x]"
+			}
+			fmt.Fprintf(&b, "%s %s %s\n", cursorMark(m.row == i+1), box, t.label)
+		}
+		fmt.Fprintf(&b, "%s Run\n\n", cursorMark(m.row == len(toggles)+1))
+		fmt.Fprintf(&b, "Same as: encutitl %s\n", shellQuote(m.commandArgs()))
+		b.WriteString("\nspace toggle · enter run · esc back\n")
+	case screenRun:
+		fmt.Fprintf(&b, "encutitl %s\n\n", shellQuote(m.args))
+		for _, line := range m.output {
+			b.WriteString("  " + line + "\n")
+		}
+		b.WriteString("\n")
+		switch {
+		case !m.done:
+			fmt.Fprintf(&b, "%c running %s\n", `|/-\`[m.spin%4], m.elapsed.Round(100*time.Millisecond))
+		case m.runErr != nil:
+			var exit *exec.ExitError
+			if errors.As(m.runErr, &exit) {
+				fmt.Fprintf(&b, "failed with exit code %d after %s\n", exit.ExitCode(), m.elapsed.Round(time.Millisecond))
+			} else {
+				fmt.Fprintf(&b, "failed: %v\n", m.runErr)
+			}
+		default:
+			fmt.Fprintf(&b, "done in %s\n", m.elapsed.Round(time.Millisecond))
+		}
+		if m.done {
+			b.WriteString("\nany key to go back\n")
+		}
+	}
+	if m.err != nil {
+		fmt.Fprintf(&b, "\nError: %v\n", m.err)
+	}
+	return b.String()
+}
+
+func cursorMark(on bool) string {
+	if on {
+		return ">"
+	}
+	return " "
+}
+
+// shellQuote joins args the way one would type them.
+func shellQuote(args []string) string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t'\"$\\*?") {
+			a = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+		out[i] = a
+	}
+	return strings.Join(out, " ")
+}
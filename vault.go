@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// With --key-backend vault the file key is wrapped by HashiCorp Vault's
+// transit engine instead of key.bin; the key never leaves Vault. The
+// stanza records the mount and key name, so decryption only needs
+// VAULT_ADDR and VAULT_TOKEN.
+
+const vaultStanza = "vault-transit"
+
+var (
+	keyBackend = flag.String("key-backend", "local", "Where the file key is wrapped: local (key.bin), vault (Vault transit, VAULT_ADDR/VAULT_TOKEN) pkcs11 (--pkcs11-module) or passphrase (Argon2id, --kdf-preset)")
+	keyName    = flag.String("key-name", "", "Key name for --key-backend vault, or key label for pkcs11")
+	vaultMount = flag.String("vault-mount", "transit", "Vault transit engine mount path")
+)
+
+// addKeyBackendFlags offers --key-backend and its options on a
+// subcommand.
+func addKeyBackendFlags(fs *flag.FlagSet) {
+	fs.StringVar(keyBackend, "key-backend", *keyBackend, "Where the file key is wrapped: local, vault, pkcs11 or passphrase")
+	fs.StringVar(keyName, "key-name", *keyName, "Key name for --key-backend vault, or key label for pkcs11")
+	fs.StringVar(vaultMount, "vault-mount", *vaultMount, "Vault transit engine mount path")
+	fs.StringVar(pkcs11Module, "pkcs11-module", *pkcs11Module, "PKCS#11 module for --key-backend pkcs11")
+	fs.StringVar(kdfPreset, "kdf-preset", *kdfPreset, "Argon2id cost for --key-backend passphrase")
+}
+
+type vaultTransit struct {
+	addr  string
+	token string
+	mount string
+	name  string
+}
+
+func newVaultTransit(mount, name string) (*vaultTransit, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return nil, errors.New("vault: VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	if name == "" {
+		return nil, errors.New("vault: --key-name is required")
+	}
+	mount = strings.Trim(mount, "/")
+	if err := checkVaultMount(mount); err != nil {
+		return nil, err
+	}
+	return &vaultTransit{
+		addr:  strings.TrimRight(addr, "/"),
+		token: token,
+		mount: mount,
+		name:  name,
+	}, nil
+}
+
+// checkVaultMount refuses mounts that would take the request, which
+// carries VAULT_TOKEN, outside the mount path.
+func checkVaultMount(mount string) error {
+	if strings.ContainsAny(mount, "?#") {
+		return fmt.Errorf("vault: invalid mount %q", mount)
+	}
+	for _, seg := range strings.Split(mount, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return fmt.Errorf("vault: invalid mount %q", mount)
+		}
+	}
+	return nil
+}
+
+// escapedMount is the mount path with each segment escaped.
+func (v *vaultTransit) escapedMount() string {
+	segs := strings.Split(v.mount, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+func (v *vaultTransit) Wrap(fileKey []byte) (*encutil.Stanza, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := v.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(fileKey)}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &encutil.Stanza{Type: vaultStanza, Args: []string{v.mount, v.name}, Body: []byte(out.Ciphertext)}, nil
+}
+
+func (v *vaultTransit) Unwrap(s *encutil.Stanza) ([]byte, error) {
+	if s.Type != vaultStanza || len(s.Args) != 2 || s.Args[0] != v.mount || s.Args[1] != v.name {
+		return nil, encutil.ErrIncorrectIdentity
+	}
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.call("decrypt", map[string]string{"ciphertext": string(s.Body)}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+func (v *vaultTransit) call(op string, req any, out any) error {
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/v1/%s/%s/%s", v.addr, v.escapedMount(), op, url.PathEscape(v.name))
+	hr, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("X-Vault-Token", v.token)
+	hr.Header.Set("Content-Type", "application/json")
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		hr.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := client.Do(hr)
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("vault %s: %w", op, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(r.Errors) > 0 {
+			return fmt.Errorf("vault %s %s/%s: %s", op, v.mount, v.name, strings.Join(r.Errors, "; "))
+		}
+		return fmt.Errorf("vault %s %s/%s: %s", op, v.mount, v.name, resp.Status)
+	}
+	return json.Unmarshal(r.Data, out)
+}
+
+// vaultIdentities returns one identity per distinct transit key named in
+// the header under --vault-mount. The header comes with the file, so a
+// mount it names is not trusted with VAULT_TOKEN: a file from elsewhere
+// could point the request at any other engine.
+func vaultIdentities(hdr *encutil.Header) ([]encutil.Identity, error) {
+	var out []encutil.Identity
+	var other string
+	seen := map[string]bool{}
+	for _, s := range hdr.Recipients {
+		if s.Type != vaultStanza || len(s.Args) != 2 || seen[s.Args[0]+"/"+s.Args[1]] {
+			continue
+		}
+		if s.Args[0] != strings.Trim(*vaultMount, "/") {
+			other = s.Args[0]
+			continue
+		}
+		seen[s.Args[0]+"/"+s.Args[1]] = true
+		v, err := newVaultTransit(s.Args[0], s.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	if len(out) == 0 && other != "" {
+		return nil, fmt.Errorf("vault: the file was encrypted under mount %q, give it with --vault-mount if it is a transit engine", other)
+	}
+	return out, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// vault du shows where a vault's bytes go: for each entry its plaintext
+// size (logical) and the size of its encrypted, compressed content in
+// the file (stored), and what older versions and removed entries still
+// take up until vault compact drops them. Only metadata is decrypted.
+
+// vaultUsage is what one name takes up in a vault.
+type vaultUsage struct {
+	logical, stored int64 // of the current version, if it is live
+	history         int64 // content of older versions and removals
+	versions        int
+	live            bool
+}
+
+func runVaultDu(args []string) {
+	fs := flag.NewFlagSet("vault du", flag.ExitOnError)
+	bySize := fs.Bool("sort-size", false, "List the entries taking up the most first")
+	addA11yFlag(fs)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(exitUsage, "Usage: vault du [--sort-size] VAULT")
+		return
+	}
+	v, err := openVault(fs.Arg(0))
+	if err != nil {
+		failVault(err)
+		return
+	}
+	info, err := os.Stat(v.path)
+	if err != nil {
+		fail(exitIO, tr("Vault error:"), err)
+		return
+	}
+
+	usage := map[string]*vaultUsage{}
+	overhead := int64(len(vaultMagic)) // framing and encrypted metadata
+	for _, rec := range v.records {
+		u := usage[rec.meta.Name]
+		if u == nil {
+			u = &vaultUsage{}
+			usage[rec.meta.Name] = u
+		}
+		overhead += 4 + int64(len(rec.sealedMeta)) + 8
+		u.history += u.stored // the version before this record is history now
+		u.logical, u.stored, u.live = 0, 0, false
+		if rec.meta.Op == vaultPut {
+			u.logical, u.stored, u.live = rec.meta.Size, int64(len(rec.data)), true
+			u.versions++
+		}
+	}
+	names := make([]string, 0, len(usage))
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if *bySize {
+		sort.SliceStable(names, func(i, j int) bool {
+			a, b := usage[names[i]], usage[names[j]]
+			return a.stored+a.history > b.stored+b.history
+		})
+	}
+
+	var logical, stored, history int64
+	var live, old int
+	if !*a11yFlag {
+		fmt.Printf("%12s %12s %12s  %s\n", "logical", "stored", "history", "name")
+	}
+	for _, name := range names {
+		u := usage[name]
+		logical += u.logical
+		stored += u.stored
+		history += u.history
+		old += u.versions
+		if u.live {
+			live++
+			old--
+		}
+		switch {
+		case *a11yFlag && u.live:
+			fmt.Printf(tr("%s is %s, stored in %s, with %s of older versions.")+"\n", name, formatBytes(u.logical), formatBytes(u.stored), formatBytes(u.history))
+		case *a11yFlag:
+			fmt.Printf(tr("%s was removed, its versions take %s.")+"\n", name, formatBytes(u.history))
+		case u.live:
+			fmt.Printf("%12s %12s %12s  %s\n", formatBytes(u.logical), formatBytes(u.stored), formatBytes(u.history), name)
+		default:
+			fmt.Printf(tr("%12s %12s %12s  %s (removed)")+"\n", "-", "-", formatBytes(u.history), name)
+		}
+	}
+
+	fmt.Println()
+	ratio := ""
+	if logical > 0 {
+		ratio = fmt.Sprintf(" (%d%%)", stored*100/logical)
+	}
+	fmt.Printf(tr("%d entries: %s of plaintext stored in %s%s")+"\n", live, formatBytes(logical), formatBytes(stored), ratio)
+	fmt.Printf(tr("History: %s in %d older or removed versions, dropped by vault compact")+"\n", formatBytes(history), old)
+	fmt.Printf(tr("Metadata: %s")+"\n", formatBytes(overhead))
+	fmt.Printf(tr("Vault file: %s")+"\n", formatBytes(info.Size()))
+}
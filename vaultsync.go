@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// vault sync merges two copies of a vault, say one on a laptop and one
+// in a synced folder, on a USB stick or in S3. The remote is only ever
+// read and replaced whole, so any storage that holds a file will do.
+//
+// Each side gets the records it is missing, in the order the other side
+// wrote them. For every name the parent links decide the rest: if one
+// side's latest record descends from the other's, the newer one wins as
+// it is. If both changed the name since their common ancestor, a merge
+// record naming both as parents is appended to both sides:
+//
+//   - text edited on both sides becomes both versions between conflict
+//     markers, listed as (conflict) until it is added again;
+//   - binary content keeps the local version, the remote one stays in
+//     vault history;
+//   - an edit beats a removal.
+//
+// Both sides then list the same entries. Records dropped by vault compact
+// on one side come back from the other, so compact both after a sync.
+
+func runVaultSync(args []string) {
+	fs := flag.NewFlagSet("vault sync", flag.ExitOnError)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fail(exitUsage, "Usage: vault sync VAULT REMOTE")
+		return
+	}
+	localPath, remote := fs.Arg(0), fs.Arg(1)
+	remoteData, err := readReplica(remote)
+	if err != nil {
+		fail(exitIO, tr("Vault error:"), err)
+		return
+	}
+	localData, err := os.ReadFile(localPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && remoteData != nil:
+		// A new machine: take the remote as it is.
+		if err := writeOutput(localPath, remoteData, 0600); err != nil {
+			fail(exitIO, tr("Write error:"), err)
+			return
+		}
+		fmt.Printf(tr("Copied %s to %s")+"\n", remote, localPath)
+		return
+	case err != nil:
+		fail(exitIO, tr("Vault error:"), err)
+		return
+	case remoteData == nil:
+		if err := writeReplica(remote, nil, localData); err != nil {
+			fail(exitIO, tr("Vault error:"), err)
+			return
+		}
+		fmt.Printf(tr("Copied %s to %s")+"\n", localPath, remote)
+		return
+	}
+
+	local := &vaultFile{path: localPath}
+	err = local.parse(localData)
+	if err == nil {
+		other := &vaultFile{path: remote, identities: local.identities, legacyKey: local.legacyKey}
+		if err = other.parse(remoteData); err == nil {
+			err = syncVaults(local, other, localData, remoteData)
+		}
+	}
+	if err != nil {
+		failVault(err)
+	}
+}
+
+// syncPlan is what both sides need appended.
+type syncPlan struct {
+	toLocal, toRemote []vaultRecord
+	merges            []vaultRecord
+}
+
+func syncVaults(local, remote *vaultFile, localData, remoteData []byte) error {
+	plan := syncPlan{toLocal: missing(remote, local), toRemote: missing(local, remote)}
+	byID := map[string]vaultRecord{}
+	names := map[string]bool{}
+	for _, v := range []*vaultFile{local, remote} {
+		for _, rec := range v.records {
+			byID[rec.meta.ID] = rec
+			names[rec.meta.Name] = true
+		}
+	}
+	var diverged []string
+	for name := range names {
+		l, r := local.head(name), remote.head(name)
+		if l != "" && r != "" && l != r && !ancestor(byID, l, r) && !ancestor(byID, r, l) {
+			diverged = append(diverged, name)
+		}
+	}
+	sort.Strings(diverged)
+
+	var recipients []encutil.Recipient
+	if len(diverged) > 0 {
+		var err error
+		if recipients, err = encryptRecipients(); err != nil {
+			return err
+		}
+	}
+	for _, name := range diverged {
+		merged := &vaultFile{records: append(append([]vaultRecord{}, local.records...), plan.toLocal...)}
+		rec, note, err := mergeEntry(local, byID[local.head(name)], byID[remote.head(name)], merged.nextVersion(name), recipients)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		plan.merges = append(plan.merges, rec)
+		fmt.Printf(tr("Merged %s: %s")+"\n", name, note)
+	}
+	if len(plan.toLocal)+len(plan.toRemote)+len(plan.merges) == 0 {
+		fmt.Println(tr("Already in sync"))
+		return nil
+	}
+
+	// The remote first: it is the one another machine may be writing,
+	// and a sync that stops after it is finished by the next one.
+	var buf bytes.Buffer
+	buf.Write(remoteData)
+	for _, rec := range append(plan.toRemote, plan.merges...) {
+		if err := writeSealed(&buf, rec.sealedMeta, rec.data); err != nil {
+			return err
+		}
+	}
+	if err := writeReplica(remote.path, remoteData, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := appendToVault(local.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, rec := range append(plan.toLocal, plan.merges...) {
+		if err := writeSealed(f, rec.sealedMeta, rec.data); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	fmt.Printf(tr("Synced %s with %s: %d records pulled, %d pushed, %d merged")+"\n",
+		local.path, remote.path, len(plan.toLocal), len(plan.toRemote), len(plan.merges))
+	return nil
+}
+
+// missing returns the records of from that to does not have.
+func missing(from, to *vaultFile) []vaultRecord {
+	have := map[string]bool{}
+	for _, rec := range to.records {
+		have[rec.meta.ID] = true
+	}
+	var out []vaultRecord
+	for _, rec := range from.records {
+		if !have[rec.meta.ID] {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// ancestor reports whether record a is an ancestor of record b.
+func ancestor(byID map[string]vaultRecord, a, b string) bool {
+	seen := map[string]bool{}
+	queue := byID[b].meta.Parents
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == a {
+			return true
+		}
+		if !seen[id] {
+			seen[id] = true
+			queue = append(queue, byID[id].meta.Parents...)
+		}
+	}
+	return false
+}
+
+// mergeEntry builds the record resolving l and r, the local and remote
+// heads of one name, and says what it did.
+func mergeEntry(v *vaultFile, l, r vaultRecord, version int, recipients []encutil.Recipient) (vaultRecord, string, error) {
+	meta := l.meta
+	if l.meta.Op == vaultRemove {
+		meta = r.meta
+	}
+	meta.Added = time.Now().UTC()
+	meta.ID = newRecordID()
+	meta.Parents = []string{l.meta.ID, r.meta.ID}
+	meta.RestoredFrom = 0
+	meta.Conflict = false
+	data := l.data
+	if l.meta.Op == vaultRemove {
+		data = r.data
+	}
+
+	var note string
+	var content []byte
+	switch {
+	case l.meta.Op == vaultRemove && r.meta.Op == vaultRemove:
+		note = "removed on both sides"
+	case l.meta.Op == vaultRemove || r.meta.Op == vaultRemove:
+		note = "removed on one side and changed on the other, kept the change"
+	default:
+		lc, err := v.open(l.data)
+		if err != nil {
+			return vaultRecord{}, "", err
+		}
+		rc, err := v.open(r.data)
+		if err != nil {
+			return vaultRecord{}, "", err
+		}
+		switch {
+		case bytes.Equal(lc, rc):
+			note = "same content on both sides"
+		case isText(lc) && isText(rc):
+			content = conflictMarkers(lc, rc, l.meta.Version, r.meta.Version)
+			meta.Conflict = true
+			meta.Size = int64(len(content))
+			note = "both versions kept between conflict markers"
+		default:
+			note = fmt.Sprintf("binary, kept the local version; the remote one is version %d in vault history", r.meta.Version)
+		}
+	}
+	if meta.Op == vaultPut {
+		meta.Version = version
+	}
+	if content != nil {
+		compression, err := payloadCompression(content)
+		if err != nil {
+			return vaultRecord{}, "", err
+		}
+		if data, err = encutil.EncryptCompressed(content, compression, recipients...); err != nil {
+			return vaultRecord{}, "", err
+		}
+	}
+	sealed, err := sealMeta(meta, recipients)
+	if err != nil {
+		return vaultRecord{}, "", err
+	}
+	rec := vaultRecord{meta: meta, sealedMeta: sealed, data: data}
+	return rec, note, nil
+}
+
+func isText(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) < 0
+}
+
+func conflictMarkers(local, remote []byte, lv, rv int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<<<<<<< local (version %d)\n", lv)
+	b.Write(local)
+	if !bytes.HasSuffix(local, []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	b.WriteString("=======\n")
+	b.Write(remote)
+	if !bytes.HasSuffix(remote, []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, ">>>>>>> remote (version %d)\n", rv)
+	return b.Bytes()
+}
+
+// readReplica reads the remote copy, nil if there is none yet.
+func readReplica(remote string) ([]byte, error) {
+	if isS3URL(remote) {
+		data, err := downloadS3(context.Background(), remote)
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		return data, err
+	}
+	data, err := os.ReadFile(remote)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// writeReplica replaces the remote copy with data, refusing if it no
+// longer holds old: another machine synced in between, and running sync
+// again merges its changes too.
+func writeReplica(remote string, old, data []byte) error {
+	current, err := readReplica(remote)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, old) {
+		return fmt.Errorf("%s changed during the sync, run it again", remote)
+	}
+	if isS3URL(remote) {
+		return uploadS3(context.Background(), remote, bytes.NewReader(data))
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(remote), ".sync-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), remote)
+}
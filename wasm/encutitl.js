@@ -0,0 +1,56 @@
+// encutitl.js loads encutitl.wasm and wraps its functions so they throw
+// an Error instead of returning one. wasm_exec.js, from
+// Go's lib/wasm directory, has to be loaded first.
+//
+//	const encutitl = await loadEncutitl("encutitl.wasm");
+//	const plain = encutitl.decrypt(bytes, {identities: [sshKey]});
+
+let loading;
+
+export function loadEncutitl(url = "encutitl.wasm") {
+	if (!loading) {
+		loading = start(url);
+	}
+	return loading;
+}
+
+async function start(url) {
+	const go = new Go();
+	const res = await fetch(url);
+	const { instance } = WebAssembly.instantiateStreaming
+		? await WebAssembly.instantiateStreaming(res, go.importObject)
+		: await WebAssembly.instantiate(await res.arrayBuffer(), go.importObject);
+	go.run(instance); // never returns, the functions stay registered
+	const raw = globalThis.encutitl;
+	const call = (fn) => (...args) => {
+		const v = fn(...args.map(bytes));
+		if (v instanceof Error) {
+			throw v;
+		}
+		return v;
+	};
+	return {
+		decrypt: call(raw.decrypt),
+		encrypt: call(raw.encrypt),
+		inspect: call(raw.inspect),
+	};
+}
+
+// bytes lets callers pass strings and ArrayBuffers where the Go side reads
+// a Uint8Array.
+function bytes(v) {
+	if (typeof v === "string") {
+		return new TextEncoder().encode(v);
+	}
+	if (v instanceof ArrayBuffer) {
+		return new Uint8Array(v);
+	}
+	if (v && typeof v === "object" && !(v instanceof Uint8Array) && !Array.isArray(v)) {
+		const out = {};
+		for (const [k, x] of Object.entries(v)) {
+			out[k] = k === "key" || k === "aad" ? bytes(x) : x;
+		}
+		return out;
+	}
+	return v;
+}
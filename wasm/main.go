@@ -0,0 +1,195 @@
+//go:build js && wasm
+
+// Command wasm is encutil compiled to WebAssembly, for decrypting and
+// encrypting encutitl files in a browser, so keys for a shared file stay
+// with the person it was shared with rather than on a server. Build it
+// and copy Go's loader next to it:
+//
+//	GOOS=js GOARCH=wasm go build -o encutitl.wasm ./wasm
+//	cp "$(go env GOROOT)/lib/wasm/wasm_exec.js" .
+//
+// encutitl.js wraps what it registers on globalThis.encutitl:
+//
+//	decrypt(data, {key, identities, passphrase, aad, maxSize})  Uint8Array
+//	encrypt(data, {key, recipients, compression})              Uint8Array
+//	inspect(data)                                               header object
+//
+// data and key are Uint8Arrays, identities are SSH private keys or
+// mlkem768x25519 identity files as text, and recipients are SSH public
+// key or mlkem768x25519 recipient lines. Failures come back as an Error,
+// which encutitl.js throws.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"syscall/js"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+func main() {
+	js.Global().Set("encutitl", js.ValueOf(map[string]any{
+		"decrypt": js.FuncOf(wrap(decrypt)),
+		"encrypt": js.FuncOf(wrap(encrypt)),
+		"inspect": js.FuncOf(wrap(inspect)),
+	}))
+	select {} // the functions live as long as the page
+}
+
+// wrap turns a Go error, or a panic from a wrong argument type, into a
+// returned Error.
+func wrap(fn func(args []js.Value) (any, error)) func(this js.Value, args []js.Value) any {
+	return func(this js.Value, args []js.Value) (ret any) {
+		defer func() {
+			if r := recover(); r != nil {
+				ret = js.Global().Get("Error").New("encutitl: bad arguments")
+			}
+		}()
+		v, err := fn(args)
+		if err != nil {
+			return js.Global().Get("Error").New("encutitl: " + err.Error())
+		}
+		return v
+	}
+}
+
+func bytesOf(v js.Value) []byte {
+	if v.IsUndefined() || v.IsNull() {
+		return nil
+	}
+	b := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(b, v)
+	return b
+}
+
+func bytesTo(b []byte) js.Value {
+	v := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(v, b)
+	return v
+}
+
+// option reads a field of the options object, which may be left out.
+func option(args []js.Value, name string) js.Value {
+	if len(args) < 2 || args[1].Type() != js.TypeObject {
+		return js.Undefined()
+	}
+	return args[1].Get(name)
+}
+
+// stringList reads a string or an array of them.
+func stringList(v js.Value) []string {
+	var out []string
+	if v.Type() == js.TypeString {
+		return []string{v.String()}
+	}
+	for i := 0; v.Type() == js.TypeObject && i < v.Length(); i++ {
+		out = append(out, v.Index(i).String())
+	}
+	return out
+}
+
+func decrypt(args []js.Value) (any, error) {
+	data := bytesOf(args[0])
+	key := bytesOf(option(args, "key"))
+	if encutil.IsJWE(string(data)) {
+		plain, err := encutil.DecryptJWE(key, string(data))
+		return bytesTo(plain), err
+	}
+	var identities []encutil.Identity
+	if key != nil {
+		r, err := encutil.NewKeyRecipient(key)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, r)
+	}
+	passphrase := option(args, "passphrase")
+	for _, text := range stringList(option(args, "identities")) {
+		if strings.Contains(text, "PRIVATE KEY") {
+			id, err := encutil.ParseSSHIdentity([]byte(text), func() ([]byte, error) {
+				if passphrase.Type() != js.TypeString {
+					return nil, errors.New("ssh key is encrypted, give a passphrase")
+				}
+				return []byte(passphrase.String()), nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, id)
+			continue
+		}
+		ids, err := encutil.ParseHybridIdentities([]byte(text))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			identities = append(identities, id)
+		}
+	}
+	opts := encutil.DecryptOptions{LegacyKey: key, AAD: bytesOf(option(args, "aad"))}
+	if v := option(args, "maxSize"); v.Type() == js.TypeNumber {
+		opts.MaxSize = int64(v.Float())
+	}
+	var buf bytes.Buffer
+	if _, _, err := encutil.DecryptWith(&buf, data, opts, identities...); err != nil {
+		return nil, err
+	}
+	return bytesTo(buf.Bytes()), nil
+}
+
+func encrypt(args []js.Value) (any, error) {
+	var recipients []encutil.Recipient
+	if key := bytesOf(option(args, "key")); key != nil {
+		r, err := encutil.NewKeyRecipient(key)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	for _, line := range stringList(option(args, "recipients")) {
+		line = strings.TrimSpace(line)
+		var r encutil.Recipient
+		var err error
+		if encutil.IsHybridRecipient(line) {
+			r, err = encutil.ParseHybridRecipient(line)
+		} else {
+			r, err = encutil.ParseSSHRecipient(line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("no key or recipients to encrypt to")
+	}
+	compression := encutil.CompressionDeflate
+	if v := option(args, "compression"); v.Type() == js.TypeString {
+		compression = v.String()
+	}
+	sealed, err := encutil.EncryptCompressed(bytesOf(args[0]), compression, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	return bytesTo(sealed), nil
+}
+
+// inspect returns the header as JSON.parse would, so a page can tell which
+// keys a file needs before asking for them.
+func inspect(args []js.Value) (any, error) {
+	hdr, _, err := encutil.ParseHeader(bytesOf(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	if hdr == nil {
+		return nil, errors.New("legacy file without a header, needs its key")
+	}
+	out, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return js.Global().Get("JSON").Call("parse", string(out)), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+)
+
+// watch turns a directory into a drop folder: every file that appears
+// under --dir, including in new subdirectories, is encrypted into the
+// mirrored path under --out once nothing has written to it for --settle,
+// so files still being copied in are not picked up half done. Files
+// already there when it starts are encrypted first. With --shred the
+// original is overwritten and removed after its encrypted copy is saved;
+// on SSDs and copy-on-write filesystems that cannot promise the old
+// blocks are gone, so a drop folder on tmpfs is better still.
+//
+// Dotfiles and the partial files browsers and editors write (.part,
+// .crdownload, .tmp, .swp, ~) are left alone.
+
+var partialSuffixes = []string{".part", ".crdownload", ".tmp", ".swp", "~"}
+
+type watcher struct {
+	dir, out   string
+	shred      bool
+	settle     time.Duration
+	recipients []encutil.Recipient
+
+	fsw     *fsnotify.Watcher
+	pending map[string]*time.Timer
+	ready   chan string
+}
+
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory to watch")
+	out := fs.String("out", "", "Directory (or s3:// prefix) the encrypted files go to")
+	shred := fs.Bool("shred", false, "Overwrite and remove each original once it is encrypted")
+	settle := fs.Duration("settle", 2*time.Second, "How long a file must go unchanged before it is encrypted")
+	fs.Var(&recipientFlags, "recipient", "Recipient to encrypt to (repeatable, default key.bin)")
+	fs.StringVar(durabilityFlag, "durability", *durabilityFlag, "How outputs reach the disk: none, flush, fsync or fsync-dir (default flush)")
+	fs.IntVar(niceFlag, "nice", *niceFlag, "CPU niceness, -20 to 19 (0 leaves it)")
+	fs.StringVar(ioniceFlag, "ionice", *ioniceFlag, "I/O priority: idle, best-effort[:0-7] or realtime[:0-7]")
+	fs.StringVar(cpusFlag, "cpus", *cpusFlag, "Run on these CPUs, as a list like 0-3,8")
+	fs.IntVar(numaNodeFlag, "numa-node", *numaNodeFlag, "Run on the CPUs of this NUMA node")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if *dir == "" || *out == "" || fs.NArg() != 0 {
+		fail(exitUsage, "Usage: watch --dir DIR --out DIR [--shred] [--settle 2s] [--recipient KEY...] [--durability LEVEL] [--nice N] [--ionice CLASS] [--cpus LIST]")
+		return
+	}
+	if err := checkDurability(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	if err := applyPriority(); err != nil {
+		fail(exitUsage, tr("Error:"), err)
+		return
+	}
+	bulkRun = true
+	if *settle <= 0 {
+		fail(exitUsage, tr("Error: --settle must be positive"))
+		return
+	}
+	w := &watcher{shred: *shred, settle: *settle, pending: map[string]*time.Timer{}, ready: make(chan string)}
+	var err error
+	if w.dir, err = filepath.Abs(*dir); err == nil && !isRemoteURL(*out) {
+		w.out, err = filepath.Abs(*out)
+	} else if err == nil {
+		w.out = strings.TrimSuffix(*out, "/")
+	}
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+	if w.recipients, err = encryptRecipients(); err != nil {
+		fail(exitKey, tr("Key error:"), err)
+		return
+	}
+	if w.fsw, err = fsnotify.NewWatcher(); err != nil {
+		fail(exitIO, tr("Watch error:"), err)
+		return
+	}
+	defer w.fsw.Close()
+	if err := w.addTree(w.dir); err != nil {
+		fail(exitIO, tr("Watch error:"), err)
+		return
+	}
+
+	startJob(jobFiles, 0)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	fmt.Printf(tr("Watching %s, encrypting into %s")+"\n", w.dir, w.out)
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.event(ev)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			fail(exitIO, tr("Watch error:"), err)
+		case path := <-w.ready:
+			delete(w.pending, path)
+			w.encrypt(path)
+		case <-sigs:
+			return
+		}
+	}
+}
+
+// addTree watches dir and its subdirectories and schedules the files
+// already in them.
+func (w *watcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == w.out || (path != w.dir && strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return w.fsw.Add(path)
+		}
+		w.schedule(path)
+		return nil
+	})
+}
+
+func (w *watcher) event(ev fsnotify.Event) {
+	switch {
+	case ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename):
+		if t := w.pending[ev.Name]; t != nil {
+			t.Stop()
+			delete(w.pending, ev.Name)
+		}
+	case ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write):
+		if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+			if err := w.addTree(ev.Name); err != nil {
+				fail(exitIO, tr("Watch error:"), err)
+			}
+			return
+		}
+		w.schedule(ev.Name)
+	}
+}
+
+// schedule (re)starts the settle timer of path.
+func (w *watcher) schedule(path string) {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return
+	}
+	for _, suffix := range partialSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return
+		}
+	}
+	if t := w.pending[path]; t != nil {
+		t.Reset(w.settle)
+		return
+	}
+	w.pending[path] = time.AfterFunc(w.settle, func() { w.ready <- path })
+}
+
+func (w *watcher) encrypt(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return // gone, or not a plain file
+	}
+	rel, err := filepath.Rel(w.dir, path)
+	if err != nil {
+		fail(exitIO, tr("Watch error:"), err)
+		return
+	}
+	out := filepath.Join(w.out, encryptedName(rel))
+	if isRemoteURL(w.out) {
+		out = w.out + "/" + filepath.ToSlash(encryptedName(rel))
+	} else if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	data, err := readFileRetry(path)
+	if err != nil {
+		fail(exitIO, tr("Input read error:"), err)
+		return
+	}
+	if !encryptInput(data, path, out, w.recipients) {
+		return
+	}
+	clear(data)
+	jobProgress(1)
+	if w.shred {
+		wipeFile(path)
+		if err := os.Remove(path); err != nil {
+			fail(exitIO, tr("Shred error:"), err)
+			return
+		}
+		fmt.Println(tr("Shredded"), path)
+	}
+}
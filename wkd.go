@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/EvnMiller/encryptutiltui/encutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// A recipient given as an email address, -r alice@example.com, is looked
+// up in the key directory of its domain, much like OpenPGP's WKD:
+//
+//	GET https://example.com/.well-known/encutitl/keys/alice
+//
+// returns a JSON document naming the address and its public key lines,
+// signed with the domain's encutitl signing key. TLS only proves the
+// server is example.com; the signature is what stops a compromised web
+// server from handing out other keys. The domain's key is trusted on first
+// use and pinned in directory-signers.json in the config dir, and an entry
+// signed by any other key fails the run until the pin is dropped with
+// `directory forget example.com`, after checking the new key with the
+// domain's owner.
+//
+// `directory publish` writes an entry, signed with sign.key, into the
+// tree to copy to the domain's web root.
+
+const (
+	directoryPath        = ".well-known/encutitl/keys"
+	directorySignersFile = "directory-signers.json"
+)
+
+type directoryEntry struct {
+	Address   string    `json:"address"`
+	Keys      []string  `json:"keys"`
+	Issued    time.Time `json:"issued"`
+	Signer    []byte    `json:"signer"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+// signedBytes is what the signature covers: the entry without it.
+func (e directoryEntry) signedBytes() ([]byte, error) {
+	e.Signature = nil
+	return json.Marshal(e)
+}
+
+func (e *directoryEntry) verify() error {
+	msg, err := e.signedBytes()
+	if err != nil {
+		return err
+	}
+	if len(e.Signer) != ed25519.PublicKeySize || !ed25519.Verify(e.Signer, msg, e.Signature) {
+		return errors.New("directory entry signature INVALID")
+	}
+	return nil
+}
+
+// isDirectoryAddress reports whether a --recipient value is an address
+// to look up rather than a file.
+func isDirectoryAddress(spec string) bool {
+	local, domain, ok := strings.Cut(spec, "@")
+	if !ok || local == "" || domain == "" || strings.ContainsAny(spec, "/\\ \t") || strings.Contains(domain, "@") {
+		return false
+	}
+	_, err := os.Stat(spec)
+	return err != nil
+}
+
+// lookupDirectory returns the key lines published for addr, once the
+// entry verifies against the domain's pinned signing key.
+func lookupDirectory(addr string) ([]string, error) {
+	local, domain, _ := strings.Cut(addr, "@")
+	domain = strings.ToLower(domain)
+	u := "https://" + domain + "/" + directoryPath + "/" + url.PathEscape(strings.ToLower(local))
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%s publishes no keys for %s", domain, addr)
+	default:
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	e := new(directoryEntry)
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	if err := e.verify(); err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	if !strings.EqualFold(e.Address, addr) {
+		return nil, fmt.Errorf("%s: entry is for %s, not %s", u, e.Address, addr)
+	}
+	if err := pinDirectorySigner(domain, e.Signer); err != nil {
+		return nil, err
+	}
+	return e.Keys, nil
+}
+
+// pinDirectorySigner checks signer against the key pinned for domain,
+// pinning it if there is none yet.
+func pinDirectorySigner(domain string, signer ed25519.PublicKey) error {
+	path, pins, err := loadDirectorySigners()
+	if err != nil {
+		return err
+	}
+	if pinned, ok := pins[domain]; ok {
+		if !bytes.Equal(pinned, signer) {
+			return fmt.Errorf("%s signs its directory with a different key than before (was %s, now %s); if the domain's owner confirms the change, run `directory forget %s`",
+				domain, keyFingerprint(pinned), keyFingerprint(signer), domain)
+		}
+		return nil
+	}
+	pins[domain] = signer
+	if err := saveDirectorySigners(path, pins); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, tr("Trusting the directory signing key %s of %s from now on")+"\n", keyFingerprint(signer), domain)
+	return nil
+}
+
+func loadDirectorySigners() (string, map[string][]byte, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(dir, directorySignersFile)
+	pins := map[string][]byte{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return path, pins, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &pins)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return path, pins, nil
+}
+
+func saveDirectorySigners(path string, pins map[string][]byte) error {
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+func runDirectory(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "Usage: directory publish|forget [flags]")
+		return
+	}
+	switch args[0] {
+	case "publish":
+		runDirectoryPublish(args[1:])
+	case "forget":
+		runDirectoryForget(args[1:])
+	default:
+		fail(exitUsage, tr("Error: unknown directory command"), args[0])
+	}
+}
+
+func runDirectoryPublish(args []string) {
+	fs := flag.NewFlagSet("directory publish", flag.ExitOnError)
+	root := fs.String("o", ".", "Web root to write .well-known/encutitl/keys/NAME into")
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() < 2 || !strings.Contains(fs.Arg(0), "@") {
+		fail(exitUsage, "Usage: directory publish [-o WEBROOT] ADDRESS KEY...")
+		return
+	}
+	addr := fs.Arg(0)
+	e := &directoryEntry{Address: addr, Issued: time.Now().UTC()}
+	for _, spec := range fs.Args()[1:] {
+		lines, err := expandRecipientSpec(spec)
+		if err != nil {
+			fail(exitKey, tr("Key error:"), err)
+			return
+		}
+		for _, line := range lines {
+			// Checked here so a typo is not published.
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil && !strings.HasPrefix(line, "age1") && !encutil.IsHybridRecipient(line) {
+				fail(exitKey, tr("Key error:"), fmt.Errorf("%s: not a public key: %.40s", spec, line))
+				return
+			}
+			e.Keys = append(e.Keys, line)
+		}
+	}
+	priv, err := loadOrGenerateSigningKey()
+	if err != nil {
+		fail(exitKey, tr("Signing key error:"), err)
+		return
+	}
+	e.Signer = priv.Public().(ed25519.PublicKey)
+	msg, err := e.signedBytes()
+	if err != nil {
+		fail(exitError, tr("Error:"), err)
+		return
+	}
+	e.Signature = ed25519.Sign(priv, msg)
+	out, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		fail(exitError, tr("Error:"), err)
+		return
+	}
+	local, _, _ := strings.Cut(addr, "@")
+	path := filepath.Join(*root, filepath.FromSlash(directoryPath), strings.ToLower(local))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	if err := os.WriteFile(path, append(out, '\n'), 0644); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Printf(tr("Published %d keys for %s to: %s")+"\n", len(e.Keys), addr, path)
+}
+
+func runDirectoryForget(args []string) {
+	fs := flag.NewFlagSet("directory forget", flag.ExitOnError)
+	addLangFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(exitUsage, "Usage: directory forget DOMAIN")
+		return
+	}
+	domain := strings.ToLower(fs.Arg(0))
+	path, pins, err := loadDirectorySigners()
+	if err != nil {
+		fail(exitIO, tr("Error:"), err)
+		return
+	}
+	if _, ok := pins[domain]; !ok {
+		fmt.Println(tr("No key pinned for"), domain)
+		return
+	}
+	delete(pins, domain)
+	if err := saveDirectorySigners(path, pins); err != nil {
+		fail(exitIO, tr("Write error:"), err)
+		return
+	}
+	fmt.Println(tr("Forgot the directory signing key of"), domain)
+}